@@ -0,0 +1,389 @@
+// Copyright 2018 The Loopix-Messaging Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"anonymous-messaging/config"
+
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"mime"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The local API of the client daemon serves JSON over HTTP:
+//
+//	POST /send            {"recipient": id, "message": text, "reliable": bool} -> {"messageId": id}
+//	GET  /inbox           ?since=RFC3339 time&limit=n -> the received messages, without their content
+//	GET  /messages/{id}   -> the sent or received message with the given id
+//	GET  /deliveries/{id} -> the delivery status of the reliable message with the given id
+//	GET  /contacts        -> the other clients in the network
+//	GET  /stats           -> the accounting of the cover traffic and the traffic parameters
+//
+// The process managing several identities serves the API of each identity under
+// /identities/{id}/, and the list of the identities at /identities.
+//
+// The requests must carry the bearer token of the API, which is kept in a file readable only by
+// the owner of the client, see LoadOrCreateAPIToken. The requests with a body must be sent as
+// application/json, and the requests addressed to another host than the loopback are rejected,
+// hence the web pages open in a browser can neither forge the requests nor read the responses
+// through DNS rebinding. The API should still be exposed only on a Unix socket or a loopback address.
+
+type sendRequest struct {
+	Recipient string `json:"recipient"`
+	Message   string `json:"message"`
+	Reliable  bool   `json:"reliable"`
+}
+
+type sendResponse struct {
+	MessageId string `json:"messageId"`
+}
+
+type inboxItem struct {
+	MessageId string    `json:"messageId"`
+	Time      time.Time `json:"time"`
+	Size      int       `json:"size"`
+}
+
+type messageResponse struct {
+	MessageId string    `json:"messageId"`
+	Direction string    `json:"direction"`
+	Peer      string    `json:"peer,omitempty"`
+	Message   string    `json:"message"`
+	Time      time.Time `json:"time"`
+}
+
+type deliveryResponse struct {
+	MessageId string `json:"messageId"`
+	Status    string `json:"status"`
+}
+
+type contactResponse struct {
+	Id       string `json:"id"`
+	Provider string `json:"provider,omitempty"`
+}
+
+type statsResponse struct {
+	LoopsSent     uint64                  `json:"loopsSent"`
+	LoopsReturned uint64                  `json:"loopsReturned"`
+	LoopsLost     uint64                  `json:"loopsLost"`
+	LoopsPending  int                     `json:"loopsPending"`
+	LossRate      float64                 `json:"lossRate"`
+	AverageRTT    string                  `json:"averageRTT"`
+	Parameters    config.ClientParameters `json:"parameters"`
+}
+
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+// APIServer exposes the client to the local applications, e.g., chat front-ends and scripts.
+type APIServer struct {
+	client Client
+	server *http.Server
+}
+
+// NewAPIServer creates the server of the local API of the given client, which accepts
+// the requests carrying the given token.
+func NewAPIServer(c Client, token string) *APIServer {
+	a := &APIServer{client: c}
+	a.server = &http.Server{Handler: authenticated(token, a.handler())}
+	return a
+}
+
+// NewIdentitiesAPIServer creates the server of the local API of all the given identities,
+// which accepts the requests carrying the given token.
+func NewIdentitiesAPIServer(identities *Identities, token string) *APIServer {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/identities", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, identities.Ids())
+	})
+	mux.HandleFunc("/identities/", func(w http.ResponseWriter, r *http.Request) {
+		path := strings.TrimPrefix(r.URL.Path, "/identities/")
+		id := strings.SplitN(path, "/", 2)[0]
+		c, err := identities.Get(id)
+		if err != nil {
+			writeError(w, http.StatusNotFound, err)
+			return
+		}
+		api := &APIServer{client: c}
+		http.StripPrefix("/identities/"+id, api.handler()).ServeHTTP(w, r)
+	})
+	return &APIServer{server: &http.Server{Handler: authenticated(token, mux)}}
+}
+
+// apiTokenSize is the number of random bytes of the token of the API.
+const apiTokenSize = 32
+
+// LoadOrCreateAPIToken returns the token of the API kept in the file at the given path. If the file
+// does not exist, a random token is generated and written to the file, which only its owner can read.
+func LoadOrCreateAPIToken(path string) (string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err == nil {
+		token := strings.TrimSpace(string(data))
+		if token == "" {
+			return "", errors.New("the file of the API token is empty")
+		}
+		return token, nil
+	}
+	if !os.IsNotExist(err) {
+		return "", err
+	}
+
+	random := make([]byte, apiTokenSize)
+	if _, err := rand.Read(random); err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(random)
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return "", err
+	}
+	if _, err := file.WriteString(token + "\n"); err != nil {
+		file.Close()
+		return "", err
+	}
+	return token, file.Close()
+}
+
+// authenticated rejects the requests which do not carry the token, which are addressed to another host
+// than the loopback, or which have a body of another type than JSON, before passing them to the handler.
+func authenticated(token string, handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !loopbackHost(r.Host) {
+			writeError(w, http.StatusForbidden, errors.New("the request is not addressed to the loopback"))
+			return
+		}
+		provided := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if token == "" || subtle.ConstantTimeCompare([]byte(provided), []byte(token)) != 1 {
+			writeError(w, http.StatusUnauthorized, errors.New("the API token is missing or invalid"))
+			return
+		}
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+			if err != nil || mediaType != "application/json" {
+				writeError(w, http.StatusUnsupportedMediaType, errors.New("the request should be sent as application/json"))
+				return
+			}
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// loopbackHost checks whether the Host header of the request names the loopback.
+func loopbackHost(host string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.Trim(host, "[]")
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+func (a *APIServer) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/send", a.handleSend)
+	mux.HandleFunc("/inbox", a.handleInbox)
+	mux.HandleFunc("/messages/", a.handleMessage)
+	mux.HandleFunc("/deliveries/", a.handleDelivery)
+	mux.HandleFunc("/contacts", a.handleContacts)
+	mux.HandleFunc("/stats", a.handleStats)
+	return mux
+}
+
+// ListenAPI opens the listener of the local API. The address is either the path of a Unix socket,
+// or a host and port, which should be a loopback address.
+func ListenAPI(address string) (net.Listener, error) {
+	if strings.Contains(address, "/") {
+		return net.Listen("unix", address)
+	}
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return nil, errors.New("the client API should listen on a loopback address")
+	}
+	return net.Listen("tcp", address)
+}
+
+// Serve serves the API requests on the given listener, until the server is closed.
+func (a *APIServer) Serve(listener net.Listener) error {
+	err := a.server.Serve(listener)
+	if err == http.ErrServerClosed {
+		return nil
+	}
+	return err
+}
+
+// Close stops the server of the API.
+func (a *APIServer) Close() error {
+	return a.server.Close()
+}
+
+func (a *APIServer) handleSend(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, errors.New("the method is not allowed"))
+		return
+	}
+	var request sendRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if request.Recipient == "" {
+		writeError(w, http.StatusBadRequest, errors.New("the recipient is required"))
+		return
+	}
+
+	send := a.client.Send
+	if request.Reliable {
+		send = a.client.SendReliable
+	}
+	messageId, err := send(context.Background(), request.Recipient, []byte(request.Message))
+	if err != nil {
+		writeError(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, sendResponse{MessageId: messageId})
+}
+
+func (a *APIServer) handleInbox(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, errors.New("the method is not allowed"))
+		return
+	}
+	query := HistoryQuery{Direction: Received}
+	if since := r.URL.Query().Get("since"); since != "" {
+		var err error
+		if query.Since, err = time.Parse(time.RFC3339, since); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+	}
+	if limit := r.URL.Query().Get("limit"); limit != "" {
+		var err error
+		if query.Limit, err = strconv.Atoi(limit); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+	}
+
+	entries, err := a.client.History(query)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	inbox := []inboxItem{}
+	for _, entry := range entries {
+		inbox = append(inbox, inboxItem{MessageId: entry.MessageId, Time: entry.Time, Size: len(entry.Payload)})
+	}
+	writeJSON(w, http.StatusOK, inbox)
+}
+
+func (a *APIServer) handleMessage(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, errors.New("the method is not allowed"))
+		return
+	}
+	messageId := strings.TrimPrefix(r.URL.Path, "/messages/")
+	entries, err := a.client.History(HistoryQuery{MessageId: messageId, Limit: 1})
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	if messageId == "" || len(entries) == 0 {
+		writeError(w, http.StatusNotFound, errors.New("no message with the given id"))
+		return
+	}
+	entry := entries[0]
+	direction := "received"
+	if entry.Direction == Sent {
+		direction = "sent"
+	}
+	writeJSON(w, http.StatusOK, messageResponse{MessageId: entry.MessageId, Direction: direction, Peer: entry.Peer, Message: string(entry.Payload), Time: entry.Time})
+}
+
+func (a *APIServer) handleDelivery(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, errors.New("the method is not allowed"))
+		return
+	}
+	messageId := strings.TrimPrefix(r.URL.Path, "/deliveries/")
+	status, err := a.client.DeliveryStatus(messageId)
+	if err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, deliveryResponse{MessageId: messageId, Status: status.String()})
+}
+
+func (a *APIServer) handleContacts(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, errors.New("the method is not allowed"))
+		return
+	}
+	contacts := []contactResponse{}
+	for _, contact := range a.client.Contacts() {
+		response := contactResponse{Id: contact.Id}
+		if contact.Provider != nil {
+			response.Provider = contact.Provider.Id
+		}
+		contacts = append(contacts, response)
+	}
+	writeJSON(w, http.StatusOK, contacts)
+}
+
+func (a *APIServer) handleStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, errors.New("the method is not allowed"))
+		return
+	}
+	stats := a.client.LoopStats()
+	writeJSON(w, http.StatusOK, statsResponse{
+		LoopsSent:     stats.Sent,
+		LoopsReturned: stats.Returned,
+		LoopsLost:     stats.Lost,
+		LoopsPending:  stats.Pending,
+		LossRate:      stats.LossRate,
+		AverageRTT:    stats.AverageRTT.String(),
+		Parameters:    a.client.Parameters(),
+	})
+}
+
+func writeJSON(w http.ResponseWriter, status int, response interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		logLocal.WithError(err).Error("Error in writing the API response")
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, errorResponse{Error: err.Error()})
+}
@@ -22,15 +22,22 @@ import (
 	"anonymous-messaging/config"
 	"anonymous-messaging/helpers"
 	"anonymous-messaging/logging"
-	"anonymous-messaging/networker"
+	"anonymous-messaging/pki"
+	"anonymous-messaging/sphinx"
 
 	"github.com/protobuf/proto"
 
+	"bytes"
+	"context"
 	"crypto/elliptic"
 	"crypto/rand"
+	"errors"
+	"fmt"
 	"math"
 	"math/big"
 	"net"
+	"strconv"
+	"sync"
 	"time"
 )
 
@@ -40,28 +47,48 @@ var (
 	dropCoverTrafficEnabled = true
 )
 
+// The rates of sending and fetching are the parameters of the exponential distributions,
+// and are set by the client parameters, see config.ClientParameters.
 const (
-	// the parameter of the exponential distribution which defines the rate of sending by client
-	// the desiredRateParameter is the reciprocal of the expected value of the exponential distribution
-	desiredRateParameter = 0.2
-	loopRate             = 0.1
-	dropRate             = 0.1
-	// the rate at which clients are querying the provider for received packets. fetchRate value is the
-	// parameter of an exponential distribution, and is the reciprocal of the expected value of the exp. distribution
-	fetchRate  = 0.01
-	assignFlag = "\xA2"
-	commFlag   = "\xc6"
-	tokenFlag  = "xa9"
-	pullFlag   = "\xff"
+	assignFlag     = "\xA2"
+	commFlag       = "\xc6"
+	tokenFlag      = "xa9"
+	pullFlag       = "\xff"
+	deregisterFlag = "\xa4"
+	migrateFlag    = "\xa5"
+	noticeFlag     = "\xa7"
+	// the number of received messages which are buffered until the application reads them
+	receiveQueueSize = 100
+	// the number of acknowledgements of the reliable messages which are buffered until they are sent
+	ackQueueSize = 100
 )
 
+// Client is the public API of the mix network client, which allows an application
+// to send and receive messages through the mix network.
 type Client interface {
-	networker.NetworkClient
-	networker.NetworkServer
-
 	Start() error
+	Close() error
+	Send(ctx context.Context, recipientId string, message []byte) (string, error)
+	Receive() <-chan []byte
+	History(query HistoryQuery) ([]HistoryEntry, error)
+	SendReliable(ctx context.Context, recipientId string, message []byte) (string, error)
+	DeliveryStatus(messageId string) (DeliveryStatus, error)
+	CreateGroup(name string, members []string) (string, error)
+	AddGroupMember(groupId, memberId string) error
+	RemoveGroupMember(groupId, memberId string) error
+	SendToGroup(ctx context.Context, groupId string, message []byte) (string, error)
+	Groups() []Group
+	LoopStats() LoopStats
+	Status() Status
+	Contacts() []config.ClientConfig
+	Alerts() <-chan LoopAlert
 	SendMessage(message string, recipient config.ClientConfig) error
-	ReadInNetworkFromPKI(pkiName string) error
+	ReadInNetworkFromPKI() error
+	Deregister() error
+	MigrateToProvider(provider config.MixConfig) error
+	SendServiceRequest(serviceId string, provider config.MixConfig, payload []byte) error
+	Parameters() config.ClientParameters
+	SetParameters(params config.ClientParameters) error
 }
 
 type client struct {
@@ -71,52 +98,102 @@ type client struct {
 
 	listener *net.TCPListener
 	pkiDir   string
+	pki      pki.PKI
 
 	config config.ClientConfig
-	token  []byte
 
-	outQueue         chan []byte
-	registrationDone chan bool
+	tokenMutex     sync.Mutex
+	token          []byte
+	providerSignal chan struct{}
+	health         providerHealth
+
+	outQueue       chan []byte
+	ackQueue       chan []byte
+	outboxSignal   chan struct{}
+	store          MessageStore
+	trafficStarted sync.Once
+
+	repliesMutex   sync.Mutex
+	pendingReplies map[string]sphinx.ReplyKeys
+
+	deliveriesMutex sync.Mutex
+	deliveries      map[string]*delivery
+	receivedIds     map[string]time.Time
+	receivedPruned  time.Time
+
+	groupsMutex sync.Mutex
+	groups      map[string]*group
+
+	received  chan []byte
+	onReceive func([]byte)
+	loops     *loopMonitor
+
+	stop      chan struct{}
+	closeOnce sync.Once
+	routines  sync.WaitGroup
 
 	*clientCore.CryptoClient
 }
 
 // Start function creates the loggers for capturing the info and error logs;
 // it reads the network and users information from the PKI database
-// and starts the listening server. Function returns an error
+// and starts the listening server. Start does not block, the client
+// runs in the background until Close is called. Function returns an error
 // signaling whenever any operation was unsuccessful.
 func (c *client) Start() error {
 
-	c.resolveAddressAndStartListening()
+	err := c.resolveAddressAndStartListening()
+	if err != nil {
+		logLocal.WithError(err).Error("Error during starting the listener")
+		return err
+	}
 
 	c.outQueue = make(chan []byte)
-	c.registrationDone = make(chan bool)
 
-	err := c.ReadInNetworkFromPKI(c.pkiDir)
+	err = c.ReadInNetworkFromPKI()
 	if err != nil {
 		logLocal.WithError(err).Error("Error during reading in network PKI")
+		c.listener.Close()
 		return err
 	}
 
+	c.routines.Add(1)
 	go func() {
-		for {
-			select {
-			case <-c.registrationDone:
-				return
-			default:
-				err = c.sendRegisterMessageToProvider()
-				if err != nil {
-					logLocal.WithError(err).Error("Error during registration to provider", err)
-				}
-				time.Sleep(60 * time.Second)
-			}
-		}
+		defer c.routines.Done()
+		c.controlProvider()
+	}()
+
+	c.routines.Add(1)
+	go func() {
+		defer c.routines.Done()
+		c.controlPKIRefresh()
 	}()
 
 	c.startListenerInNewRoutine()
 	return nil
 }
 
+// Close stops the cover traffic, the fetching of messages and the listener of the client.
+// Close waits until the packets being processed are handled and closes the channel returned by Receive.
+// Close can be called multiple times, but the closed client cannot be started again.
+func (c *client) Close() error {
+	var err error
+	c.closeOnce.Do(func() {
+		close(c.stop)
+		if c.listener != nil {
+			err = c.listener.Close()
+		}
+		c.routines.Wait()
+		close(c.received)
+		close(c.loops.alerts)
+		if storeErr := c.store.Close(); err == nil {
+			err = storeErr
+		}
+		logLocal.Info("Client closed")
+	})
+	return err
+}
+
 func (c *client) resolveAddressAndStartListening() error {
 	addr, err := helpers.ResolveTCPAddress(c.host, c.port)
 	if err != nil {
@@ -127,36 +204,265 @@ func (c *client) resolveAddressAndStartListening() error {
 	if err != nil {
 		return err
 	}
+	// the port 0 lets the system choose the port, which is then announced to the provider
+	c.port = strconv.Itoa(c.listener.Addr().(*net.TCPAddr).Port)
+	c.config.Port = c.port
 	return nil
 }
 
 // SendMessage responsible for sending a real message. Takes as input the message string
-// and the public information about the destination.
+// and the public information about the destination. The message is stored in the outbox
+// and sent in the background.
 func (c *client) SendMessage(message string, recipient config.ClientConfig) error {
-	packet, err := c.encodeMessage(message, recipient)
+	_, err := c.addToOutbox(recipient, []byte(message), sphinx.RealMessageType, false, "")
+	return err
+}
+
+// Send sends the message to the client with the given id, which is looked up in the network
+// information read from the PKI. The message is stored in the outbox and Send returns immediately
+// with the id of the message. The messages from the outbox are sent in place of the drop cover
+// messages, and the messages which were not sent before the client stopped are sent after a restart.
+func (c *client) Send(ctx context.Context, recipientId string, message []byte) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	recipient, err := c.findRecipient(recipientId)
 	if err != nil {
-		logLocal.WithError(err).Error("Error in sending message - encode message returned error")
-		return err
+		return "", err
 	}
-	c.outQueue <- packet
-	return nil
+	return c.addToOutbox(recipient, message, sphinx.RealMessageType, false, "")
+}
+
+// History returns the messages sent and received by the client, which match the given query.
+func (c *client) History(query HistoryQuery) ([]HistoryEntry, error) {
+	return c.store.SearchHistory(query)
 }
 
-// encodeMessage encapsulates the given message into a sphinx packet destinated for recipient
-// and wraps with the flag pointing that it is the communication packet
-func (c *client) encodeMessage(message string, recipient config.ClientConfig) ([]byte, error) {
-	sphinxPacket, err := c.EncodeMessage(message, recipient)
+// addToOutbox stores the message of the given sphinx message type in the outbox and wakes up the controller
+// of the outbox. The group is empty, unless the message is a part of the fan-out to a group.
+func (c *client) addToOutbox(recipient config.ClientConfig, message []byte, messageType string, reliable bool, group string) (string, error) {
+	select {
+	case <-c.stop:
+		return "", errors.New("the client is closed")
+	default:
+	}
+	messageId, err := newMessageId()
 	if err != nil {
-		logLocal.WithError(err).Error("Error in sending message - create sphinx packet returned an error")
-		return nil, err
+		return "", err
+	}
+	entry := OutboxEntry{MessageId: messageId, Recipient: recipient, Payload: message, Type: messageType, Reliable: reliable, Group: group, Created: time.Now()}
+	if err := c.store.AddToOutbox(entry); err != nil {
+		logLocal.WithError(err).Error("Error in send - storing message in the outbox returned an error")
+		return "", err
+	}
+	select {
+	case c.outboxSignal <- struct{}{}:
+	default:
+	}
+	return messageId, nil
+}
+
+// controlOutbox passes the messages from the outbox to the outgoing queue, from the oldest.
+// The messages are removed from the outbox once they are sent, and the reliable messages
+// once they are acknowledged or failed.
+func (c *client) controlOutbox() {
+	for {
+		entries, err := c.store.Outbox()
+		if err != nil {
+			logLocal.WithError(err).Error("Error in the controller of the outbox - reading the outbox returned an error")
+		}
+		for _, entry := range entries {
+			if c.isDispatched(entry.MessageId) {
+				continue
+			}
+			err := c.dispatch(entry)
+			if err != nil {
+				logLocal.WithError(err).Error("Error in the controller of the outbox - sending message returned an error")
+			}
+			select {
+			case <-c.stop:
+				return
+			default:
+			}
+		}
+		select {
+		case <-c.stop:
+			return
+		case <-c.outboxSignal:
+		}
 	}
+}
 
-	packetBytes, err := config.WrapWithFlag(commFlag, sphinxPacket)
+// dispatch sends the message from the outbox and records it in the history,
+// unless it is a part of the fan-out to a group.
+func (c *client) dispatch(entry OutboxEntry) error {
+	if entry.Reliable {
+		err := c.transmit(context.Background(), entry.MessageId, c.deliveryOf(entry))
+		if err != nil {
+			return err
+		}
+	} else {
+		sphinxPacket, err := c.EncodeMessage(string(entry.Payload), entry.Recipient, entryType(entry))
+		if err != nil {
+			return err
+		}
+		if err := c.enqueue(context.Background(), sphinxPacket); err != nil {
+			return err
+		}
+		if err := c.store.RemoveFromOutbox(entry.MessageId); err != nil {
+			return err
+		}
+	}
+	if entry.Group != "" {
+		return nil
+	}
+	return c.store.AddToHistory(HistoryEntry{MessageId: entry.MessageId, Direction: Sent, Peer: entry.Recipient.Id, Payload: entry.Payload, Time: time.Now()})
+}
+
+// Receive returns the channel of the decrypted messages received by the client.
+// The channel is closed when the client is closed. If the client was created with
+// a receive callback, the messages are passed to the callback instead.
+func (c *client) Receive() <-chan []byte {
+	return c.received
+}
+
+// publishedConfig returns the record of the client published in the PKI. The record carries
+// the id of the provider instead of the address of the client, hence the client can be reached only
+// through its provider.
+func (c *client) publishedConfig() config.ClientConfig {
+	return config.ClientConfig{Id: c.id, PubKey: c.GetPublicKey(), ProviderId: c.Provider().Id}
+}
+
+// ownConfig returns the configuration of the client with its current provider, which is used
+// in the registration and as the sender of the packets.
+func (c *client) ownConfig() config.ClientConfig {
+	own := c.config
+	provider := c.Provider()
+	own.Provider = &provider
+	return own
+}
+
+// Status describes the registration of the client with its provider.
+type Status struct {
+	Id         string
+	Provider   string
+	Registered bool
+	Token      []byte
+}
+
+// Status returns the current registration status of the client.
+func (c *client) Status() Status {
+	token := c.currentToken()
+	return Status{Id: c.id, Provider: c.Provider().Id, Registered: token != nil, Token: token}
+}
+
+// LoopStats returns the accounting of the loop cover messages, i.e., the number of loops
+// sent, returned and lost, and the loss rate and average round-trip time of the recent loops.
+func (c *client) LoopStats() LoopStats {
+	return c.loops.loopStats()
+}
+
+// Alerts returns the channel of the alerts raised when the loss rate of the loop messages
+// crosses the alert threshold. The channel is closed when the client is closed.
+func (c *client) Alerts() <-chan LoopAlert {
+	return c.loops.alerts
+}
+
+// Contacts returns the public configurations of the other clients in the network,
+// as read from the PKI.
+func (c *client) Contacts() []config.ClientConfig {
+	var contacts []config.ClientConfig
+	for _, contact := range c.Network().Clients {
+		if contact.Id != c.id {
+			contacts = append(contacts, contact)
+		}
+	}
+	return contacts
+}
+
+// findRecipient returns the public configuration of the client with the given id.
+func (c *client) findRecipient(recipientId string) (config.ClientConfig, error) {
+	for _, recipient := range c.Network().Clients {
+		if recipient.Id == recipientId {
+			return recipient, nil
+		}
+	}
+	return config.ClientConfig{}, errors.New("no client with the given id in the network")
+}
+
+// enqueue passes the packet to the outgoing queue. enqueue returns an error
+// if the context is done or the client is closed before the packet is queued.
+func (c *client) enqueue(ctx context.Context, sphinxPacket []byte) error {
+	select {
+	case c.outQueue <- sphinxPacket:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-c.stop:
+		return errors.New("the client is closed")
+	}
+}
+
+// recordReceived adds the received message to the history. The messages without
+// an id, i.e., the unreliable messages, get a fresh id.
+func (c *client) recordReceived(messageId string, message []byte) {
+	if messageId == "" {
+		var err error
+		if messageId, err = newMessageId(); err != nil {
+			logLocal.WithError(err).Error("Error in recording received message")
+			return
+		}
+	}
+	err := c.store.AddToHistory(HistoryEntry{MessageId: messageId, Direction: Received, Payload: message, Time: time.Now()})
 	if err != nil {
-		logLocal.WithError(err).Error("Error in sending message - wrap with flag returned an error")
-		return nil, err
+		logLocal.WithError(err).Error("Error in recording received message")
 	}
-	return packetBytes, nil
+}
+
+// deliver passes the received message to the application, either through the receive
+// callback or the channel returned by Receive.
+func (c *client) deliver(message []byte) {
+	if c.onReceive != nil {
+		c.onReceive(message)
+		return
+	}
+	select {
+	case c.received <- message:
+	case <-c.stop:
+	}
+}
+
+// SendServiceRequest sends the request to the service with the given id, hosted by the given provider.
+// The request carries a reply block, and the reply of the service is received as any other message.
+func (c *client) SendServiceRequest(serviceId string, provider config.MixConfig, payload []byte) error {
+	service := config.ClientConfig{Id: serviceId, PubKey: provider.PubKey, Provider: &provider}
+	sphinxPacket, keys, err := c.EncodeServiceRequest(payload, service, c.ownConfig())
+	if err != nil {
+		logLocal.WithError(err).Error("Error in sending service request - create sphinx packet returned an error")
+		return err
+	}
+
+	c.repliesMutex.Lock()
+	c.pendingReplies[string(keys.Id)] = keys
+	c.repliesMutex.Unlock()
+
+	return c.enqueue(context.Background(), sphinxPacket)
+}
+
+// sendToProvider wraps the given data with the flag and the client's credentials,
+// i.e., its id and the authentication token received during the registration,
+// and sends the resulting packet to the provider. The credentials allow the provider
+// to attribute the packet to the client and enforce the published sending rates.
+func (c *client) sendToProvider(flag string, data []byte) error {
+	packetBytes, err := config.WrapWithCredentials(flag, data, c.id, c.currentToken())
+	if err != nil {
+		logLocal.WithError(err).Error("Error in sending to provider - wrap with credentials returned an error")
+		return err
+	}
+	provider := c.Provider()
+	err = c.send(packetBytes, provider.Host, provider.Port)
+	c.health.sent(err)
+	return err
 }
 
 // Send opens a connection with selected network address
@@ -178,15 +484,12 @@ func (c *client) send(packet []byte, host string, port string) error {
 
 // run opens the listener to start listening on clients host and port
 func (c *client) startListenerInNewRoutine() {
-	defer c.listener.Close()
-	finish := make(chan bool)
-
+	c.routines.Add(1)
 	go func() {
+		defer c.routines.Done()
 		logLocal.Infof("Listening on address %s", c.host+":"+c.port)
 		c.listenForIncomingConnections()
 	}()
-
-	<-finish
 }
 
 // ListenForIncomingConnections responsible for running the listening process of the server;
@@ -194,14 +497,24 @@ func (c *client) startListenerInNewRoutine() {
 // passes the incoming packets to the packet handler.
 // If the connection could not be accepted an error
 // is logged into the log files, but the function is not stopped
+// until the client is closed.
 func (c *client) listenForIncomingConnections() {
 	for {
 		conn, err := c.listener.Accept()
 
 		if err != nil {
-			logLocal.WithError(err).Error(err)
+			select {
+			case <-c.stop:
+				return
+			default:
+				logLocal.WithError(err).Error(err)
+			}
 		} else {
-			go c.handleConnection(conn)
+			c.routines.Add(1)
+			go func() {
+				defer c.routines.Done()
+				c.handleConnection(conn)
+			}()
 		}
 	}
 }
@@ -211,16 +524,16 @@ func (c *client) listenForIncomingConnections() {
 // The potential errors are logged into the log files.
 func (c *client) handleConnection(conn net.Conn) {
 
-	buff := make([]byte, 1024)
 	defer conn.Close()
 
-	reqLen, err := conn.Read(buff)
+	// the sender closes the connection after writing a single packet
+	buff, err := helpers.ReadPacket(conn)
 	if err != nil {
 		logLocal.WithError(err).Error("Error while reading incoming connection")
-		panic(err)
+		return
 	}
 	var packet config.GeneralPacket
-	err = proto.Unmarshal(buff[:reqLen], &packet)
+	err = proto.Unmarshal(buff, &packet)
 	if err != nil {
 		logLocal.WithError(err).Error("Error in unmarshal incoming packet")
 	}
@@ -228,49 +541,228 @@ func (c *client) handleConnection(conn net.Conn) {
 	switch packet.Flag {
 	case tokenFlag:
 		c.registerToken(packet.Data)
-		go func() {
-			err := c.controlOutQueue()
-			if err != nil {
-				logLocal.WithError(err).Panic("Error in the controller of the outgoing packets queue. Possible security threat.")
-			}
-		}()
+		c.trafficStarted.Do(c.startTraffic)
 
-		if loopCoverTrafficEnabled {
-			c.turnOnLoopCoverTraffic()
+	case commFlag:
+		messageType, message, isReply, err := c.processPacket(packet.Data)
+		if err != nil {
+			logLocal.WithError(err).Error("Error in processing received packet")
+			return
 		}
+		c.health.received(time.Now())
+		c.receiveMessage(messageType, message, isReply)
+	default:
+		logLocal.Info("Packet flag not recognised. Packet dropped.")
+	}
+}
 
-		if dropCoverTrafficEnabled {
-			c.turnOnDropCoverTraffic()
+// receiveMessage handles the received message according to its type, which the sender set in the routing
+// commands of the last hop and the provider passed on with the message. The payload is never inspected
+// to learn its type, hence any message sent by the user is delivered as it is.
+func (c *client) receiveMessage(messageType string, message []byte, isReply bool) {
+	switch messageType {
+	case sphinx.LoopMessageType:
+		if c.loops.returned(string(message)) {
+			logLocal.Info("Received loop cover message")
+		} else {
+			logLocal.Warning("Received loop cover message with an unknown tag. Message dropped")
+		}
+	case sphinx.AcknowledgementType:
+		// the acknowledgements arrive through the reply blocks created by the client
+		if isReply {
+			c.acknowledge(string(message))
+		}
+	case sphinx.ReliableMessageType:
+		reliable, ok := clientCore.DecodeReliableMessage(message)
+		if !ok {
+			logLocal.Warning("Received malformed reliable message. Message dropped")
+			return
 		}
+		if !c.receiveReliable(reliable) {
+			logLocal.Info("Received duplicate of reliable message")
+			return
+		}
+		c.receivePayload(reliable.Type, reliable.MessageId, reliable.Payload)
+	default:
+		c.receivePayload(messageType, "", message)
+	}
+}
 
-		go func() {
-			c.controlMessagingFetching()
-		}()
+// receivePayload passes the group packets to the groups, and delivers the other messages to the user.
+func (c *client) receivePayload(messageType string, messageId string, message []byte) {
+	switch messageType {
+	case sphinx.GroupInviteType, sphinx.GroupMessageType:
+		c.receiveGroupPacket(messageType, message)
+	default:
+		logLocal.Info("Received new message")
+		c.recordReceived(messageId, message)
+		c.deliver(message)
+	}
+}
 
-	case commFlag:
-		_, err := c.processPacket(packet.Data)
+// entryType returns the sphinx message type of the outbox entry. The entries stored by the
+// older versions of the client carry no type, and are plain messages.
+func entryType(entry OutboxEntry) string {
+	if entry.Type == "" {
+		return sphinx.RealMessageType
+	}
+	return entry.Type
+}
+
+// startTraffic starts the controller of the outgoing queue, the streams of cover traffic,
+// the fetching of messages from the provider, the controller of the outbox and the
+// retransmissions of the reliable messages.
+// The traffic is started once, after the first
+// registration, and it keeps running when the client migrates to another provider.
+func (c *client) startTraffic() {
+	c.routines.Add(1)
+	go func() {
+		defer c.routines.Done()
+		err := c.controlOutQueue()
 		if err != nil {
-			logLocal.WithError(err).Error("Error in processing received packet")
+			logLocal.WithError(err).Panic("Error in the controller of the outgoing packets queue. Possible security threat.")
 		}
-		logLocal.Info("Received new message")
-	default:
-		logLocal.Info("Packet flag not recognised. Packet dropped.")
+	}()
+
+	if loopCoverTrafficEnabled {
+		c.turnOnLoopCoverTraffic()
+	}
+
+	if dropCoverTrafficEnabled {
+		c.turnOnDropCoverTraffic()
 	}
+
+	c.routines.Add(1)
+	go func() {
+		defer c.routines.Done()
+		c.controlMessagingFetching()
+	}()
+
+	c.routines.Add(1)
+	go func() {
+		defer c.routines.Done()
+		c.controlRetransmissions()
+	}()
+
+	c.routines.Add(1)
+	go func() {
+		defer c.routines.Done()
+		c.controlOutbox()
+	}()
 }
 
 // RegisterToken stores the authentication token received from the provider
 func (c *client) registerToken(token []byte) {
-	c.token = token
-	logLocal.Infof(" Registered token %s", c.token)
-	c.registrationDone <- true
+	c.setToken(token)
+	c.health.reset(time.Now())
+	logLocal.Infof(" Registered token %s", token)
+}
+
+// Deregister sends the deregistration request to the provider, which removes
+// the client's inbox and invalidates its token, and removes the client from the PKI.
+func (c *client) Deregister() error {
+	err := c.sendToProvider(deregisterFlag, nil)
+	if err != nil {
+		logLocal.WithError(err).Error("Error in deregister - sending deregistration request returned an error")
+		return err
+	}
+	c.setToken(nil)
+
+	err = c.pki.RemoveClient(c.publishedConfig(), c.Sign)
+	if err != nil {
+		logLocal.WithError(err).Error("Error in deregister - removing client from the PKI returned an error")
+		return err
+	}
+	logLocal.Info("Deregistered from provider")
+	return nil
+}
+
+// MigrateToProvider moves the client to the given provider. The client announces the migration
+// to the new provider, asks its current provider to hand over the stored messages to the new provider,
+// updates its public configuration in the PKI and registers with the new provider. Until the new token
+// arrives the packets sent by the client are dropped by the new provider.
+func (c *client) MigrateToProvider(provider config.MixConfig) error {
+	providerBytes, err := proto.Marshal(&provider)
+	if err != nil {
+		logLocal.WithError(err).Error("Error in migrate - marshal of provider config returned an error")
+		return err
+	}
+
+	err = c.announceMigration(provider)
+	if err != nil {
+		logLocal.WithError(err).Error("Error in migrate - announcing the migration returned an error")
+		return err
+	}
+
+	err = c.sendToProvider(migrateFlag, providerBytes)
+	if err != nil {
+		logLocal.WithError(err).Error("Error in migrate - sending migration request returned an error")
+		return err
+	}
+
+	err = c.switchProvider(provider)
+	if err != nil {
+		logLocal.WithError(err).Error("Error in migrate - updating client config in the PKI returned an error")
+		return err
+	}
+	logLocal.Infof("Migrating to provider %s", provider.Id)
+	return nil
+}
+
+// announceMigration sends the migration notice signed by the client to the new provider, which
+// then accepts the messages handed over by the current provider.
+func (c *client) announceMigration(provider config.MixConfig) error {
+	notice := config.MigrationNotice{ClientId: c.id, FromProviderId: c.Provider().Id, ToProviderId: provider.Id, Timestamp: time.Now().Unix()}
+	data, err := config.MigrationNoticeSignedData(notice)
+	if err != nil {
+		return err
+	}
+	notice.Signature, err = c.Sign(data)
+	if err != nil {
+		return err
+	}
+	noticeBytes, err := proto.Marshal(&notice)
+	if err != nil {
+		return err
+	}
+	packetBytes, err := config.WrapWithFlag(noticeFlag, noticeBytes)
+	if err != nil {
+		return err
+	}
+	return c.send(packetBytes, provider.Host, provider.Port)
 }
 
 // ProcessPacket processes the received sphinx packet and returns the
 // encapsulated message or error in case the processing
-// was unsuccessful.
-func (c *client) processPacket(packet []byte) ([]byte, error) {
+// was unsuccessful. The packets fetched from the inbox are sealed
+// by the provider to the client's public key. The replies, e.g., to the
+// service requests or the acknowledgements of the reliable messages,
+// are decrypted using the keys of their reply blocks, and are marked as replies.
+func (c *client) processPacket(packet []byte) (string, []byte, bool, error) {
 	logLocal.Info(" Processing packet")
-	return packet, nil
+	messageType, opened, err := c.OpenStoredMessage(packet)
+	if err != nil {
+		return "", nil, false, err
+	}
+
+	var sphinxPacket sphinx.SphinxPacket
+	err = proto.Unmarshal(opened, &sphinxPacket)
+	if err != nil {
+		return "", nil, false, err
+	}
+
+	replyId := string(sphinxPacket.GetHdr().GetAlpha())
+	c.repliesMutex.Lock()
+	keys, ok := c.pendingReplies[replyId]
+	delete(c.pendingReplies, replyId)
+	c.repliesMutex.Unlock()
+
+	if ok {
+		logLocal.Info("Received reply")
+		message, err := sphinx.OpenReply(sphinxPacket, keys)
+		return messageType, message, true, err
+	}
+	return messageType, sphinxPacket.Pld, false, nil
 }
 
 // SendRegisterMessageToProvider allows the client to register with the selected provider.
@@ -280,7 +772,8 @@ func (c *client) sendRegisterMessageToProvider() error {
 
 	logLocal.Info("Sending request to provider to register")
 
-	confBytes, err := proto.Marshal(&c.config)
+	own := c.ownConfig()
+	confBytes, err := proto.Marshal(&own)
 	if err != nil {
 		logLocal.WithError(err).Error("Error in register provider - marshal of provider config returned an error")
 		return err
@@ -292,7 +785,7 @@ func (c *client) sendRegisterMessageToProvider() error {
 		return err
 	}
 
-	err = c.send(pktBytes, c.Provider.Host, c.Provider.Port)
+	err = c.send(pktBytes, own.Provider.Host, own.Provider.Port)
 	if err != nil {
 		logLocal.WithError(err).Error("Error in register provider - send registration packet returned an error")
 		return err
@@ -304,20 +797,14 @@ func (c *client) sendRegisterMessageToProvider() error {
 // provider. The client sends a pull packet to the provider, along with
 // the authentication token. An error is returned if occurred.
 func (c *client) getMessagesFromProvider() error {
-	pullRqs := config.PullRequest{ClientId: c.id, Token: c.token}
+	pullRqs := config.PullRequest{ClientId: c.id, Token: c.currentToken()}
 	pullRqsBytes, err := proto.Marshal(&pullRqs)
 	if err != nil {
 		logLocal.WithError(err).Error("Error in register provider - marshal of pull request returned an error")
 		return err
 	}
 
-	pktBytes, err := config.WrapWithFlag(pullFlag, pullRqsBytes)
-	if err != nil {
-		logLocal.WithError(err).Error("Error in register provider - marshal of provider config returned an error")
-		return err
-	}
-
-	err = c.send(pktBytes, c.Provider.Host, c.Provider.Port)
+	err = c.sendToProvider(pullFlag, pullRqsBytes)
 	if err != nil {
 		return err
 	}
@@ -332,23 +819,30 @@ func (c *client) controlOutQueue() error {
 	logLocal.Info("Queue controller started")
 	for {
 		select {
+		case <-c.stop:
+			return nil
 		case realPacket := <-c.outQueue:
-			c.send(realPacket, c.Provider.Host, c.Provider.Port)
+			c.sendToProvider(commFlag, realPacket)
 			logLocal.Info("Real packet was sent")
+		case ack := <-c.ackQueue:
+			c.sendToProvider(commFlag, ack)
+			logLocal.Info("Acknowledgement was sent")
 		default:
+			// the drop cover message cannot be created until the view of the network contains
+			// some clients, which might be fixed by the next refresh of the PKI
 			dummyPacket, err := c.createDropCoverMessage()
 			if err != nil {
-				return err
+				logLocal.WithError(err).Warning("OutQueue empty. Dummy packet could not be created.")
+			} else {
+				c.sendToProvider(commFlag, dummyPacket)
+				logLocal.Info("OutQueue empty. Dummy packet sent.")
 			}
-			c.send(dummyPacket, c.Provider.Host, c.Provider.Port)
-			logLocal.Info("OutQueue empty. Dummy packet sent.")
 		}
-		err := delayBeforeContinute(desiredRateParameter)
-		if err != nil {
+		running, err := c.delayBeforeContinute(c.Parameters().RealTrafficRate)
+		if err != nil || !running {
 			return err
 		}
 	}
-	return nil
 }
 
 // controlMessagingFetching periodically at random sends a query to the provider
@@ -357,10 +851,13 @@ func (c *client) controlMessagingFetching() {
 	for {
 		c.getMessagesFromProvider()
 		logLocal.Info("Sent request to provider to fetch messages")
-		err := delayBeforeContinute(fetchRate)
+		running, err := c.delayBeforeContinute(c.Parameters().FetchRate)
 		if err != nil {
 			logLocal.Error("Error in ControlMessagingFetching - generating random exp. value failed")
 		}
+		if !running {
+			return
+		}
 	}
 }
 
@@ -368,25 +865,23 @@ func (c *client) controlMessagingFetching() {
 // The dummy message is a loop message.
 func (c *client) createDropCoverMessage() ([]byte, error) {
 	dummyLoad := "DummyPayloadMessage"
-	randomRecipient, err := c.getRandomRecipient(c.Network.Clients)
+	randomRecipient, err := c.getRandomRecipient(c.Network().Clients)
 	if err != nil {
 		return nil, err
 	}
-	sphinxPacket, err := c.EncodeMessage(dummyLoad, randomRecipient)
+	sphinxPacket, err := c.EncodeMessage(dummyLoad, randomRecipient, sphinx.DropMessageType)
 	if err != nil {
 		return nil, err
 	}
-
-	packetBytes, err := config.WrapWithFlag(commFlag, sphinxPacket)
-	if err != nil {
-		return nil, err
-	}
-	return packetBytes, nil
+	return sphinxPacket, nil
 }
 
 // getRandomRecipient picks a random client from the list of all available clients (stored by the client).
 // getRandomRecipient returns the selected client public configuration and an error
 func (c *client) getRandomRecipient(slice []config.ClientConfig) (config.ClientConfig, error) {
+	if len(slice) == 0 {
+		return config.ClientConfig{}, errors.New("no clients in the network")
+	}
 	randIdx, err := rand.Int(rand.Reader, big.NewInt(int64(len(slice))))
 	if err != nil {
 		return config.ClientConfig{}, err
@@ -394,41 +889,43 @@ func (c *client) getRandomRecipient(slice []config.ClientConfig) (config.ClientC
 	return slice[randIdx.Int64()], nil
 }
 
-// createLoopCoverMessage packs a dummy loop message into
-// a sphinx packet. The loop message is destinated back to the sender
-// createLoopCoverMessage returns a byte representation of the encapsulated packet and an error
-func (c *client) createLoopCoverMessage() ([]byte, error) {
-	loopLoad := "LoopCoverMessage"
-	sphinxPacket, err := c.EncodeMessage(loopLoad, c.config)
+// createLoopCoverMessage packs a dummy loop message, consisting of a fresh random tag, into
+// a sphinx packet. The loop message is destinated back to the sender, which recognises it by the tag.
+// The loop messages are accounted for by the client and are not delivered to the application.
+// createLoopCoverMessage returns a byte representation of the encapsulated packet, the tag and an error
+func (c *client) createLoopCoverMessage() ([]byte, string, error) {
+	tag, err := newLoopTag()
 	if err != nil {
-		return nil, err
+		return nil, "", err
 	}
-	packetBytes, err := config.WrapWithFlag(commFlag, sphinxPacket)
+	sphinxPacket, err := c.EncodeMessage(tag, c.ownConfig(), sphinx.LoopMessageType)
 	if err != nil {
-		return nil, err
+		return nil, "", err
 	}
-	return packetBytes, nil
+	return sphinxPacket, tag, nil
 }
 
 // runLoopCoverTrafficStream manages the stream of loop cover traffic.
-// In each stream iteration it sends a freshly created loop packet and
-// waits a random time before scheduling the next loop packet.
+// In each stream iteration it sends a freshly created loop packet, records
+// its tag to match the returning loop, and waits a random time before
+// scheduling the next loop packet.
 func (c *client) runLoopCoverTrafficStream() error {
 	logLocal.Info("Stream of loop cover traffic started")
 	for {
-		loopPacket, err := c.createLoopCoverMessage()
+		loopPacket, tag, err := c.createLoopCoverMessage()
 		if err != nil {
 			return err
 		}
-		c.send(loopPacket, c.Provider.Host, c.Provider.Port)
-		logLocal.Info("Loop message sent")
-		err = delayBeforeContinute(loopRate)
-		if err != nil {
+		err = c.sendToProvider(commFlag, loopPacket)
+		if err == nil {
+			c.loops.sent(tag)
+			logLocal.Info("Loop message sent")
+		}
+		running, err := c.delayBeforeContinute(c.Parameters().LoopTrafficRate)
+		if err != nil || !running {
 			return err
 		}
-
 	}
-	return nil
 }
 
 // runDropCoverTrafficStream manages the stream of drop cover traffic.
@@ -440,30 +937,38 @@ func (c *client) runDropCoverTrafficStream() error {
 	for {
 		dropPacket, err := c.createDropCoverMessage()
 		if err != nil {
-			return err
+			logLocal.WithError(err).Warning("Drop packet could not be created")
+		} else {
+			c.sendToProvider(commFlag, dropPacket)
+			logLocal.Info("Drop packet sent")
 		}
-		c.send(dropPacket, c.Provider.Host, c.Provider.Port)
-		logLocal.Info("Drop packet sent")
-		err = delayBeforeContinute(dropRate)
-		if err != nil {
+		running, err := c.delayBeforeContinute(c.Parameters().DropTrafficRate)
+		if err != nil || !running {
 			return err
 		}
 	}
-	return nil
 }
 
-func delayBeforeContinute(rateParam float64) error {
+// delayBeforeContinute waits a random time drawn from the exponential distribution with the given rate.
+// The wait is interrupted when the client is closed, in which case delayBeforeContinute returns false.
+func (c *client) delayBeforeContinute(rateParam float64) (bool, error) {
 	delaySec, err := helpers.RandomExponential(rateParam)
 	if err != nil {
-		return err
+		return true, err
+	}
+	select {
+	case <-c.stop:
+		return false, nil
+	case <-time.After(time.Duration(int64(delaySec*math.Pow10(9))) * time.Nanosecond):
+		return true, nil
 	}
-	time.Sleep(time.Duration(int64(delaySec*math.Pow10(9))) * time.Nanosecond)
-	return nil
 }
 
 // turnOnLoopCoverTraffic starts the stream of loop cover traffic
 func (c *client) turnOnLoopCoverTraffic() {
+	c.routines.Add(1)
 	go func() {
+		defer c.routines.Done()
 		err := c.runLoopCoverTrafficStream()
 		if err != nil {
 			logLocal.WithError(err).Panic("Error in the controller of the loop cover traffic. Possible security threat.")
@@ -473,7 +978,9 @@ func (c *client) turnOnLoopCoverTraffic() {
 
 // turnOnDropCoverTraffic starts the stream of drop cover traffic
 func (c *client) turnOnDropCoverTraffic() {
+	c.routines.Add(1)
 	go func() {
+		defer c.routines.Done()
 		err := c.runDropCoverTrafficStream()
 		if err != nil {
 			logLocal.WithError(err).Panic("Error in the controller of the drop cover traffic. Possible security threat.")
@@ -482,56 +989,83 @@ func (c *client) turnOnDropCoverTraffic() {
 }
 
 // ReadInNetworkFromPKI reads in the public information about active mixes
-// from the PKI database and stores them locally. In case
+// from the PKI of the client and stores them locally. In case
 // the connection or fetching data from the PKI went wrong,
-// an error is returned.
-func (c *client) ReadInNetworkFromPKI(pkiName string) error {
-	logLocal.Infof("Reading network information from the PKI: %s", pkiName)
-
-	mixes, err := helpers.GetMixesPKI(pkiName)
+// an error is returned. The mixes and the clients are read from
+// the network document of a single epoch. The document of an epoch
+// never changes, hence a document of the current epoch with another
+// digest, or a document of an earlier epoch, is rejected and the
+// current view is kept.
+func (c *client) ReadInNetworkFromPKI() error {
+	logLocal.Infof("Reading network information from the PKI: %s", c.pkiDir)
+
+	snapshot, err := c.pki.Snapshot()
 	if err != nil {
-		logLocal.WithError(err).Error("Error while reading mixes from PKI")
+		logLocal.WithError(err).Error("Error while reading the network from PKI")
 		return err
 	}
-	c.Network.Mixes = mixes
 
-	clients, err := helpers.GetClientPKI(pkiName)
-	if err != nil {
-		logLocal.WithError(err).Error("Error while reading clients from PKI")
-		return err
+	current := c.Network()
+	if snapshot.Epoch != 0 && snapshot.Epoch == current.Epoch && !bytes.Equal(snapshot.Digest, current.Digest) {
+		return fmt.Errorf("the PKI served another network document of epoch %d", snapshot.Epoch)
 	}
-	c.Network.Clients = clients
+	if snapshot.Epoch < current.Epoch {
+		return fmt.Errorf("the PKI served the network document of epoch %d, older than the current epoch %d", snapshot.Epoch, current.Epoch)
+	}
+	c.SetNetwork(clientCore.NetworkPKI{Mixes: snapshot.Mixes, Clients: snapshot.Clients, Epoch: snapshot.Epoch, Digest: snapshot.Digest})
 
 	logLocal.Info("Network information uploaded")
 	return nil
 }
 
-// The constructor function to create an new client object.
+// The constructor function to create an new client object, which sends
+// its traffic following the given parameters. The parameters can be changed
+// later with SetParameters, without restarting the traffic streams.
 // Function returns a new client object or an error, if occurred.
-func NewClient(id, host, port string, pubKey []byte, prvKey []byte, pkiDir string, provider config.MixConfig) (*client, error) {
-	core := clientCore.NewCryptoClient(pubKey, prvKey, elliptic.P224(), provider, clientCore.NetworkPKI{})
-	c := client{id: id, host: host, port: port, CryptoClient: core, pkiDir: pkiDir}
-	c.config = config.ClientConfig{Id: c.id, Host: c.host, Port: c.port, PubKey: c.GetPublicKey(), Provider: &c.Provider}
-
-	configBytes, err := proto.Marshal(&c.config)
-
+func NewClient(id, host, port string, pubKey []byte, prvKey []byte, pkiDir string, provider config.MixConfig, params config.ClientParameters) (*client, error) {
+	c, err := newClient(id, host, port, pubKey, prvKey, pkiDir, provider, params)
 	if err != nil {
 		return nil, err
 	}
-	err = helpers.AddToDatabase(pkiDir, "Pki", c.id, "Client", configBytes)
+
+	err = c.pki.PublishClient(c.publishedConfig(), c.Sign)
 	if err != nil {
 		return nil, err
 	}
 
-	return &c, nil
+	return c, nil
 }
 
 // NewTestClient constructs a client object, which can be used for testing. The object contains the crypto core
 // and the top-level of client, but does not involve networking and starting a listener.
-func NewTestClient(id, host, port string, pubKey []byte, prvKey []byte, pkiDir string, provider config.MixConfig) (*client, error) {
+func NewTestClient(id, host, port string, pubKey []byte, prvKey []byte, pkiDir string, provider config.MixConfig, params config.ClientParameters) (*client, error) {
+	return newClient(id, host, port, pubKey, prvKey, pkiDir, provider, params)
+}
+
+// newClient creates the client object shared by NewClient and NewTestClient, without publishing
+// the client in the PKI.
+func newClient(id, host, port string, pubKey []byte, prvKey []byte, pkiDir string, provider config.MixConfig, params config.ClientParameters) (*client, error) {
 	core := clientCore.NewCryptoClient(pubKey, prvKey, elliptic.P224(), provider, clientCore.NetworkPKI{})
-	c := client{id: id, host: host, port: port, CryptoClient: core, pkiDir: pkiDir}
-	c.config = config.ClientConfig{Id: c.id, Host: c.host, Port: c.port, PubKey: c.GetPublicKey(), Provider: &c.Provider}
+	if err := core.SetParameters(params); err != nil {
+		return nil, err
+	}
+	p, err := pki.Open(pkiDir)
+	if err != nil {
+		return nil, err
+	}
+	c := client{id: id, host: host, port: port, CryptoClient: core, pkiDir: pkiDir, pki: p}
+	c.pendingReplies = make(map[string]sphinx.ReplyKeys)
+	c.received = make(chan []byte, receiveQueueSize)
+	c.stop = make(chan struct{})
+	c.loops = newLoopMonitor(func() time.Duration { return loopTimeout(c.Parameters()) })
+	c.deliveries = make(map[string]*delivery)
+	c.store = NewMemoryStore()
+	c.outboxSignal = make(chan struct{}, 1)
+	c.providerSignal = make(chan struct{}, 1)
+	c.receivedIds = make(map[string]time.Time)
+	c.ackQueue = make(chan []byte, ackQueueSize)
+	c.groups = make(map[string]*group)
+	c.config = config.ClientConfig{Id: c.id, Host: c.host, Port: c.port, PubKey: c.GetPublicKey()}
 
 	return &c, nil
 }
@@ -15,17 +15,34 @@
 package client
 
 import (
+	"anonymous-messaging/clientCore"
 	"anonymous-messaging/config"
+	"anonymous-messaging/directory"
+	"anonymous-messaging/pki"
 	sphinx "anonymous-messaging/sphinx"
 
-	"github.com/jmoiron/sqlx"
 	"github.com/protobuf/proto"
 	"github.com/stretchr/testify/assert"
 
+	"bytes"
+	"context"
+	"crypto/elliptic"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
 	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 var providerPubs config.MixConfig
@@ -37,39 +54,22 @@ const (
 	pkiDir = "testDatabase.db"
 )
 
-func setupTestDatabase() (*sqlx.DB, error) {
-
-	db, err := sqlx.Connect("sqlite3", pkiDir)
+// uploadTestDescriptor signs the configuration with the given key and uploads it to the test PKI database.
+func uploadTestDescriptor(t *testing.T, typ, id string, configBytes, prvKey []byte) {
+	descriptor, err := directory.NewDescriptor(typ, id, configBytes, directory.KeySigner(prvKey))
 	if err != nil {
-		return nil, err
+		t.Fatal(err)
 	}
-
-	query := `CREATE TABLE Pki (
-		idx INTEGER PRIMARY KEY,
-    	Id TEXT,
-    	Typ TEXT,
-    	Config BLOB);`
-
-	_, err = db.Exec(query)
-	if err != nil {
-		return nil, err
+	if err := directory.NewLocalAuthority(pkiDir).Upload(descriptor); err != nil {
+		t.Fatal(err)
 	}
-
-	return db, err
 }
 
 func SetupTestMixesInDatabase(t *testing.T) error {
 	clean()
 
-	db, err := setupTestDatabase()
-	if err != nil {
-		t.Fatal(err)
-	}
-
-	insertQuery := `INSERT INTO Pki (Id, Typ, Config) VALUES (?, ?, ?)`
-
 	for i := 0; i < 10; i++ {
-		pub, _, err := sphinx.GenerateKeyPair()
+		pub, priv, err := sphinx.GenerateKeyPair()
 		if err != nil {
 			return err
 		}
@@ -81,10 +81,7 @@ func SetupTestMixesInDatabase(t *testing.T) error {
 		if err != nil {
 			return err
 		}
-		_, err = db.Exec(insertQuery, m.Id, "Mix", mBytes)
-		if err != nil {
-			return err
-		}
+		uploadTestDescriptor(t, directory.MixDescriptor, m.Id, mBytes, priv)
 		testMixSet = append(testMixSet, m)
 	}
 	return nil
@@ -93,30 +90,19 @@ func SetupTestMixesInDatabase(t *testing.T) error {
 func SetupTestClientsInDatabase(t *testing.T) {
 	clean()
 
-	db, err := setupTestDatabase()
-	if err != nil {
-		t.Fatal(err)
-	}
-
-	insertQuery := `INSERT INTO Pki (Id, Typ, Config) VALUES (?, ?, ?)`
-
 	for i := 0; i < 10; i++ {
-		pub, _, err := sphinx.GenerateKeyPair()
+		pub, priv, err := sphinx.GenerateKeyPair()
 		if err != nil {
 			t.Fatal(err)
 		}
 		c := config.ClientConfig{Id: fmt.Sprintf("Client%d", i),
-			Host:   "localhost",
-			Port:   strconv.Itoa(9980 + i),
-			PubKey: pub}
+			PubKey:     pub,
+			ProviderId: "Provider"}
 		cBytes, err := proto.Marshal(&c)
 		if err != nil {
 			t.Fatal(err)
 		}
-		_, err = db.Exec(insertQuery, c.Id, "Client", cBytes)
-		if err != nil {
-			t.Fatal(err)
-		}
+		uploadTestDescriptor(t, directory.ClientDescriptor, c.Id, cBytes, priv)
 		testClientSet = append(testClientSet, c)
 	}
 }
@@ -132,7 +118,7 @@ func SetupTestClient(t *testing.T) *client {
 	if err != nil {
 		t.Fatal(err)
 	}
-	client, err := NewTestClient("Client", "localhost", "3332", pubC, privC, pkiDir, providerPubs)
+	client, err := NewTestClient("Client", "localhost", "3332", pubC, privC, pkiDir, providerPubs, config.DefaultClientParameters())
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -232,9 +218,73 @@ func TestClient_RegisterToProvider(t *testing.T) {
 //	}
 //}
 
-// TODO: Fix this test
 func TestClient_ProcessPacket(t *testing.T) {
+	client := SetupTestClient(t)
+	packet := sphinx.SphinxPacket{Hdr: &sphinx.Header{Alpha: []byte("Alpha")}, Pld: []byte("Stored message")}
+	packetBytes, err := proto.Marshal(&packet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed, err := sphinx.SealToPublicKey(client.GetPublicKey(), sphinx.TypedMessage(sphinx.RealMessageType, packetBytes))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	messageType, message, isReply, err := client.processPacket(sealed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, sphinx.RealMessageType, messageType)
+	assert.Equal(t, []byte("Stored message"), message)
+	assert.False(t, isReply)
+}
+
+func TestClient_ProcessPacket_Reply(t *testing.T) {
+	client := SetupTestClient(t)
+
+	pub1, priv1, err := sphinx.GenerateKeyPair()
+	pub2, priv2, err := sphinx.GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	firstHop := config.MixConfig{Id: "ServiceProvider", Host: "localhost", Port: "9996", PubKey: pub1}
+	provider := config.MixConfig{Id: "Provider", Host: "localhost", Port: "9995", PubKey: pub2}
+	path := config.E2EPath{IngressProvider: firstHop, Mixes: []config.MixConfig{}, EgressProvider: provider, Recipient: client.ownConfig()}
+
+	block, keys, err := sphinx.CreateReplyBlock(elliptic.P224(), path, []float64{0.0, 0.0}, sphinx.AcknowledgementType)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.pendingReplies[string(keys.Id)] = keys
+
+	reply, err := sphinx.PackReplyMessage(block, []byte("Reply message"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	replyBytes, err := proto.Marshal(&reply)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var commands sphinx.Commands
+	for _, priv := range [][]byte{priv1, priv2} {
+		_, commands, replyBytes, err = sphinx.ProcessSphinxPacket(replyBytes, priv)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	sealed, err := sphinx.SealToPublicKey(client.GetPublicKey(), sphinx.TypedMessage(commands.Type, replyBytes))
+	if err != nil {
+		t.Fatal(err)
+	}
 
+	messageType, message, isReply, err := client.processPacket(sealed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, sphinx.AcknowledgementType, messageType, "The type of the reply block should be passed on")
+	assert.Equal(t, []byte("Reply message"), message)
+	assert.True(t, isReply)
+	assert.Equal(t, 0, len(client.pendingReplies), "The keys of a reply block should be used once")
 }
 
 func TestClient_ReadInMixnetPKI(t *testing.T) {
@@ -242,12 +292,1340 @@ func TestClient_ReadInMixnetPKI(t *testing.T) {
 	SetupTestMixesInDatabase(t)
 
 	client := SetupTestClient(t)
-	err := client.ReadInNetworkFromPKI("testDatabase.db")
+	err := client.ReadInNetworkFromPKI()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, len(testMixSet), len(client.Network().Mixes))
+	assert.Equal(t, testMixSet, client.Network().Mixes)
+
+}
+
+func setupTestNetwork(client *client, t *testing.T) config.ClientConfig {
+	pub1, _, err := sphinx.GenerateKeyPair()
+	pub2, _, err := sphinx.GenerateKeyPair()
+	pubR, _, err := sphinx.GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mixes := []config.MixConfig{
+		{Id: "Mix1", Host: "localhost", Port: "3330", PubKey: pub1},
+		{Id: "Mix2", Host: "localhost", Port: "3331", PubKey: pub2},
+	}
+	recipient := config.ClientConfig{Id: "Recipient", Host: "localhost", Port: "9999", PubKey: pubR, Provider: &providerPubs}
+	client.SetNetwork(clientCore.NetworkPKI{Mixes: mixes, Clients: []config.ClientConfig{recipient}})
+	return recipient
+}
+
+func sendSealedPacket(client *client, messageType string, payload []byte, t *testing.T) {
+	packetBytes, err := proto.Marshal(&sphinx.SphinxPacket{Hdr: &sphinx.Header{}, Pld: payload})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed, err := sphinx.SealToPublicKey(client.GetPublicKey(), sphinx.TypedMessage(messageType, packetBytes))
+	if err != nil {
+		t.Fatal(err)
+	}
+	wrapped, err := config.WrapWithFlag(commFlag, sealed)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serverConn, clientConn := net.Pipe()
+	go func() {
+		clientConn.Write(wrapped)
+		clientConn.Close()
+	}()
+	client.handleConnection(serverConn)
+}
+
+func TestClient_Send_Pass(t *testing.T) {
+	client := SetupTestClient(t)
+	setupTestNetwork(client, t)
+	client.outQueue = make(chan []byte, 1)
+
+	messageId, err := client.Send(context.Background(), "Recipient", []byte("Hello world"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	outbox, err := client.store.Outbox()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 1, len(outbox), "The message should be stored in the outbox")
+	assert.Equal(t, messageId, outbox[0].MessageId)
+
+	dispatchOutbox(client, t)
+	assert.Equal(t, 1, len(client.outQueue), "The message should be queued")
+	outbox, err = client.store.Outbox()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 0, len(outbox), "The sent message should be removed from the outbox")
+}
+
+func TestClient_Send_UnknownRecipient(t *testing.T) {
+	client := SetupTestClient(t)
+	setupTestNetwork(client, t)
+
+	_, err := client.Send(context.Background(), "Stranger", []byte("Hello world"))
+	assert.EqualError(t, err, "no client with the given id in the network")
+}
+
+func TestClient_Send_ContextDone(t *testing.T) {
+	client := SetupTestClient(t)
+	setupTestNetwork(client, t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := client.Send(ctx, "Recipient", []byte("Hello world"))
+	assert.Equal(t, context.Canceled, err)
+}
+
+func TestClient_Receive(t *testing.T) {
+	client := SetupTestClient(t)
+
+	client.loops.sent("LoopTag")
+	sendSealedPacket(client, sphinx.LoopMessageType, []byte("LoopTag"), t)
+	sendSealedPacket(client, sphinx.RealMessageType, []byte("Hello world"), t)
+
+	select {
+	case message := <-client.Receive():
+		assert.Equal(t, []byte("Hello world"), message, "Loop cover messages should not be delivered")
+	default:
+		t.Fatal("The received message was not delivered")
+	}
+
+	client.loops.sent("LoopTag")
+	sendSealedPacket(client, sphinx.RealMessageType, []byte("LoopTag"), t)
+	select {
+	case message := <-client.Receive():
+		assert.Equal(t, []byte("LoopTag"), message, "Real messages should be delivered whatever their payload")
+	default:
+		t.Fatal("The received message was not delivered")
+	}
+}
+
+func TestClient_ReceiveCallback(t *testing.T) {
+	client := SetupTestClient(t)
+	var received [][]byte
+	client.onReceive = func(message []byte) { received = append(received, message) }
+
+	sendSealedPacket(client, sphinx.RealMessageType, []byte("Hello world"), t)
+	assert.Equal(t, [][]byte{[]byte("Hello world")}, received)
+	assert.Equal(t, 0, len(client.Receive()), "The messages passed to the callback should not be queued")
+}
+
+func TestClient_Close(t *testing.T) {
+	client := SetupTestClient(t)
+	setupTestNetwork(client, t)
+	client.outQueue = make(chan []byte)
+
+	err := client.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Nil(t, client.Close(), "Closing the client again should not fail")
+
+	_, open := <-client.Receive()
+	assert.False(t, open, "The receive channel should be closed")
+
+	_, err = client.Send(context.Background(), "Recipient", []byte("Hello world"))
+	assert.EqualError(t, err, "the client is closed")
+
+	running, err := client.delayBeforeContinute(0.001)
+	assert.False(t, running, "The closed client should stop the traffic streams")
+}
+
+func TestNew_MissingOptions(t *testing.T) {
+	_, err := New(WithId("Client"), WithAddress("localhost", "3332"))
+	assert.EqualError(t, err, "the PKI and the provider of the client are required")
+
+	_, err = New(WithPKI(pkiDir), WithProvider(providerPubs))
+	assert.EqualError(t, err, "the id and the address of the client are required")
+}
+
+// testLoopTimeout is the timeout of the loops in the tests of the loop monitor.
+const testLoopTimeout = 10 * time.Minute
+
+func TestLoopTimeout(t *testing.T) {
+	params := config.DefaultClientParameters()
+	slow := params
+	slow.FetchRate = params.FetchRate / 10
+	assert.True(t, loopTimeout(slow) > 9*loopTimeout(params), "The timeout should follow the fetch rate")
+	deep := params
+	deep.PathLength = params.PathLength * 5
+	assert.True(t, loopTimeout(deep) > loopTimeout(params), "The timeout should follow the length of the paths")
+}
+
+func TestLoopMonitor_Returned(t *testing.T) {
+	monitor := newLoopMonitor(func() time.Duration { return testLoopTimeout })
+	now := time.Unix(1000, 0)
+	monitor.now = func() time.Time { return now }
+
+	monitor.sent("Loop1")
+	monitor.sent("Loop2")
+	now = now.Add(4 * time.Second)
+	assert.True(t, monitor.returned("Loop1"))
+	assert.False(t, monitor.returned("Unknown"), "Messages without the tag of a sent loop should not be loops")
+
+	stats := monitor.loopStats()
+	assert.Equal(t, uint64(2), stats.Sent)
+	assert.Equal(t, uint64(1), stats.Returned)
+	assert.Equal(t, 1, stats.Pending)
+	assert.Equal(t, 4*time.Second, stats.AverageRTT)
+	assert.Equal(t, 0.0, stats.LossRate)
+}
+
+func TestLoopMonitor_LossAlert(t *testing.T) {
+	monitor := newLoopMonitor(func() time.Duration { return testLoopTimeout })
+	now := time.Unix(1000, 0)
+	monitor.now = func() time.Time { return now }
+
+	for i := 0; i < loopMinSamples; i++ {
+		monitor.sent(fmt.Sprintf("Loop%d", i))
+	}
+	now = now.Add(testLoopTimeout + time.Second)
+
+	stats := monitor.loopStats()
+	assert.Equal(t, uint64(loopMinSamples), stats.Lost)
+	assert.Equal(t, 1.0, stats.LossRate)
+	assert.Equal(t, 1, len(monitor.alerts), "Crossing the loss threshold should raise a single alert")
+
+	alert := <-monitor.alerts
+	assert.Equal(t, 1.0, alert.LossRate)
+	assert.Equal(t, loopMinSamples, alert.Window)
+
+	monitor.sent("LateLoop")
+	now = now.Add(testLoopTimeout + time.Second)
+	monitor.loopStats()
+	assert.Equal(t, 0, len(monitor.alerts), "No new alert should be raised while the loss rate stays above the threshold")
+	assert.True(t, monitor.returned("LateLoop"), "The loops which return late should still be recognised")
+	assert.Equal(t, uint64(0), monitor.loopStats().Returned, "The late loops should not be counted as returned")
+}
+
+func TestLoopMonitor_Window(t *testing.T) {
+	monitor := newLoopMonitor(func() time.Duration { return testLoopTimeout })
+	now := time.Unix(1000, 0)
+	monitor.now = func() time.Time { return now }
+
+	for i := 0; i < loopWindowSize; i++ {
+		monitor.sent(fmt.Sprintf("Lost%d", i))
+	}
+	now = now.Add(testLoopTimeout + time.Second)
+	monitor.loopStats()
+
+	for i := 0; i < loopWindowSize; i++ {
+		tag := fmt.Sprintf("Returned%d", i)
+		monitor.sent(tag)
+		monitor.returned(tag)
+	}
+	stats := monitor.loopStats()
+	assert.Equal(t, 0.0, stats.LossRate, "The loss rate should be computed over the most recent loops")
+	assert.Equal(t, uint64(loopWindowSize), stats.Lost)
+}
+
+func TestClient_LoopReturned(t *testing.T) {
+	client := SetupTestClient(t)
+	client.loops.sent("Tag")
+
+	sendSealedPacket(client, sphinx.LoopMessageType, []byte("Tag"), t)
+
+	assert.Equal(t, uint64(1), client.LoopStats().Returned)
+	assert.Equal(t, 0, len(client.Receive()), "Loop messages should not be delivered to the application")
+}
+
+func TestLoadClientParameters(t *testing.T) {
+	path := "testParams.json"
+	err := ioutil.WriteFile(path, []byte(`{"loopTrafficRate": 50, "pathLength": 3}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(path)
+
+	params, err := config.LoadClientParameters(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := config.DefaultClientParameters()
+	expected.LoopTrafficRate = 50
+	expected.PathLength = 3
+	assert.Equal(t, expected, params, "The parameters missing in the file should keep their defaults")
+}
+
+func TestLoadClientParameters_OutOfRange(t *testing.T) {
+	path := "testParams.json"
+	err := ioutil.WriteFile(path, []byte(`{"fetchRate": 0}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(path)
+
+	_, err = config.LoadClientParameters(path)
+	assert.EqualError(t, err, "fetchRate should be in the range (0, 1000]")
+}
+
+func TestClient_SetParameters(t *testing.T) {
+	client := SetupTestClient(t)
+
+	params := config.DefaultClientParameters()
+	params.PathLength = 0
+	err := client.SetParameters(params)
+	assert.EqualError(t, err, "pathLength should be in the range [1, 10]")
+	assert.Equal(t, config.DefaultClientParameters(), client.Parameters(), "Invalid parameters should not replace the current ones")
+
+	params.PathLength = 1
+	params.LoopTrafficRate = 1000
+	err = client.SetParameters(params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, params, client.Parameters())
+
+	start := time.Now()
+	for i := 0; i < 10; i++ {
+		client.delayBeforeContinute(client.Parameters().LoopTrafficRate)
+	}
+	assert.True(t, time.Since(start) < 5*time.Second, "The fast rates should shorten the delays of the traffic streams")
+}
+
+// routePacket processes the packet by each node on its path, starting from the given first hop,
+// and seals the packet processed by the last hop to the given recipient, as the recipient's provider does.
+func routePacket(packet []byte, firstHop string, privs map[string][]byte, recipient *client, t *testing.T) []byte {
+	hop := firstHop
+	var commands sphinx.Commands
+	for {
+		nextHop, hopCommands, processed, err := sphinx.ProcessSphinxPacket(packet, privs[hop])
+		if err != nil {
+			t.Fatal(err)
+		}
+		packet, commands = processed, hopCommands
+		if commands.Flag == "\xF0" {
+			break
+		}
+		hop = nextHop.Id
+	}
+	sealed, err := sphinx.SealToPublicKey(recipient.GetPublicKey(), sphinx.TypedMessage(commands.Type, packet))
+	if err != nil {
+		t.Fatal(err)
+	}
+	wrapped, err := config.WrapWithFlag(commFlag, sealed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return wrapped
+}
+
+func handlePacket(client *client, packet []byte) {
+	serverConn, clientConn := net.Pipe()
+	go func() {
+		clientConn.Write(packet)
+		clientConn.Close()
+	}()
+	client.handleConnection(serverConn)
+}
+
+// dispatchOutbox sends the messages from the outbox, as the controller of the outbox does.
+func dispatchOutbox(c *client, t *testing.T) {
+	outbox, err := c.store.Outbox()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range outbox {
+		if c.isDispatched(entry.MessageId) {
+			continue
+		}
+		if err := c.dispatch(entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func setupReliableClients(t *testing.T) (*client, *client, map[string][]byte) {
+	privs := make(map[string][]byte)
+	var mixes []config.MixConfig
+	for i := 0; i < 2; i++ {
+		pub, priv, err := sphinx.GenerateKeyPair()
+		if err != nil {
+			t.Fatal(err)
+		}
+		id := fmt.Sprintf("Mix%d", i)
+		privs[id] = priv
+		mixes = append(mixes, config.MixConfig{Id: id, Host: "localhost", Port: strconv.Itoa(3330 + i), PubKey: pub})
+	}
+	var clients []*client
+	for i := 0; i < 2; i++ {
+		pubP, privP, err := sphinx.GenerateKeyPair()
+		pubC, privC, err := sphinx.GenerateKeyPair()
+		if err != nil {
+			t.Fatal(err)
+		}
+		providerId := fmt.Sprintf("Provider%d", i)
+		privs[providerId] = privP
+		provider := config.MixConfig{Id: providerId, Host: "localhost", Port: strconv.Itoa(9990 + i), PubKey: pubP}
+		c, err := NewTestClient(fmt.Sprintf("Client%d", i), "localhost", strconv.Itoa(3340+i), pubC, privC, pkiDir, provider, config.DefaultClientParameters())
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.SetNetwork(clientCore.NetworkPKI{Mixes: mixes})
+		c.outQueue = make(chan []byte, 1)
+		clients = append(clients, c)
+	}
+	for _, c := range clients {
+		c.SetNetwork(clientCore.NetworkPKI{Mixes: c.Network().Mixes, Clients: []config.ClientConfig{clients[0].ownConfig(), clients[1].ownConfig()}})
+	}
+	return clients[0], clients[1], privs
+}
+
+func TestClient_SendReliable_Acknowledged(t *testing.T) {
+	sender, recipient, privs := setupReliableClients(t)
+
+	messageId, err := sender.SendReliable(context.Background(), "Client1", []byte("Hello world"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	status, err := sender.DeliveryStatus(messageId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, DeliveryPending, status)
+
+	dispatchOutbox(sender, t)
+	handlePacket(recipient, routePacket(<-sender.outQueue, "Provider0", privs, recipient, t))
+	assert.Equal(t, []byte("Hello world"), <-recipient.Receive(), "The payload of the reliable message should be delivered")
+
+	handlePacket(sender, routePacket(<-recipient.ackQueue, "Provider1", privs, sender, t))
+	status, err = sender.DeliveryStatus(messageId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, DeliveryAcknowledged, status)
+	assert.Equal(t, 0, len(sender.pendingReplies), "The keys of the reply blocks should be removed after the acknowledgement")
+	assert.Equal(t, 0, len(sender.Receive()), "The acknowledgements should not be delivered to the application")
+	outbox, err := sender.store.Outbox()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 0, len(outbox), "The acknowledged message should be removed from the outbox")
+}
+
+func TestClient_ReceiveReliable_Duplicate(t *testing.T) {
+	sender, recipient, privs := setupReliableClients(t)
+
+	_, err := sender.SendReliable(context.Background(), "Client1", []byte("Hello world"))
 	if err != nil {
 		t.Fatal(err)
 	}
+	dispatchOutbox(sender, t)
+	packet := routePacket(<-sender.outQueue, "Provider0", privs, recipient, t)
+
+	handlePacket(recipient, packet)
+	<-recipient.ackQueue
+	handlePacket(recipient, packet)
+
+	assert.Equal(t, 1, len(recipient.Receive()), "A retransmitted message should be delivered once")
+	assert.Equal(t, 1, len(recipient.ackQueue), "Each copy of the message should be acknowledged")
+
+	for i := 0; i < ackQueueSize; i++ {
+		handlePacket(recipient, packet)
+	}
+	assert.Equal(t, ackQueueSize, len(recipient.ackQueue), "The acknowledgements should be dropped when the queue is full")
+
+	recipient.receivedIds[reliableIdOf(t, recipient)] = time.Now().Add(-receivedIdRetention - time.Minute)
+	recipient.receivedPruned = time.Time{}
+	<-recipient.ackQueue
+	handlePacket(recipient, packet)
+	assert.Equal(t, 2, len(recipient.Receive()), "The ids of the old messages should be forgotten")
+}
+
+// reliableIdOf returns the id of the single reliable message received by the client.
+func reliableIdOf(t *testing.T, c *client) string {
+	if len(c.receivedIds) != 1 {
+		t.Fatalf("expected a single received message, got %d", len(c.receivedIds))
+	}
+	for messageId := range c.receivedIds {
+		return messageId
+	}
+	return ""
+}
+
+func TestClient_ExpiredDeliveries(t *testing.T) {
+	sender, _, _ := setupReliableClients(t)
+	now := time.Now()
+
+	sender.deliveries["Retransmit"] = &delivery{status: DeliveryPending, transmissions: 1, deadline: now.Add(-time.Second)}
+	sender.deliveries["Fail"] = &delivery{status: DeliveryPending, transmissions: maxTransmissions, deadline: now.Add(-time.Second)}
+	sender.deliveries["Wait"] = &delivery{status: DeliveryPending, transmissions: 1, deadline: now.Add(time.Second)}
+
+	expired := sender.expiredDeliveries(now)
+	assert.Equal(t, 1, len(expired))
+	assert.NotNil(t, expired["Retransmit"])
+
+	status, err := sender.DeliveryStatus("Fail")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, DeliveryFailed, status)
+}
+
+func TestClient_AckTimeout(t *testing.T) {
+	client := SetupTestClient(t)
+	expected := time.Duration((10 + 2/config.FetchRate) * ackTimeoutFactor * float64(time.Second))
+	assert.Equal(t, expected, client.ackTimeout(10))
+}
+
+func TestClient_Outbox_Restart(t *testing.T) {
+	sender, recipient, privs := setupReliableClients(t)
+
+	messageId, err := sender.SendReliable(context.Background(), "Client1", []byte("Hello world"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dispatchOutbox(sender, t)
+	<-sender.outQueue
+
+	// the client restarts with the same store before the message is acknowledged
+	restarted, err := NewTestClient("Client0", "localhost", "3340", sender.config.PubKey, nil, pkiDir, sender.Provider(), config.DefaultClientParameters())
+	if err != nil {
+		t.Fatal(err)
+	}
+	restarted.CryptoClient = sender.CryptoClient
+	restarted.store = sender.store
+	restarted.outQueue = make(chan []byte, 1)
+
+	dispatchOutbox(restarted, t)
+	handlePacket(recipient, routePacket(<-restarted.outQueue, "Provider0", privs, recipient, t))
+	assert.Equal(t, []byte("Hello world"), <-recipient.Receive(), "The pending message should be sent after the restart")
+
+	handlePacket(restarted, routePacket(<-recipient.ackQueue, "Provider1", privs, restarted, t))
+	status, err := restarted.DeliveryStatus(messageId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, DeliveryAcknowledged, status)
+}
+
+func TestClient_History(t *testing.T) {
+	client := SetupTestClient(t)
+	setupTestNetwork(client, t)
+	client.outQueue = make(chan []byte, 1)
+
+	_, err := client.Send(context.Background(), "Recipient", []byte("Hello world"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dispatchOutbox(client, t)
+	sendSealedPacket(client, sphinx.RealMessageType, []byte("Hello back"), t)
+
+	sent, err := client.History(HistoryQuery{Direction: Sent})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 1, len(sent))
+	assert.Equal(t, "Recipient", sent[0].Peer)
+	assert.Equal(t, []byte("Hello world"), sent[0].Payload)
+
+	found, err := client.History(HistoryQuery{Contains: []byte("back")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 1, len(found))
+	assert.Equal(t, Received, found[0].Direction)
+}
+
+func TestMemoryStore_Outbox(t *testing.T) {
+	store := NewMemoryStore()
+	for _, id := range []string{"A", "B", "C"} {
+		if err := store.AddToOutbox(OutboxEntry{MessageId: id}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := store.RemoveFromOutbox("B"); err != nil {
+		t.Fatal(err)
+	}
+	outbox, err := store.Outbox()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []OutboxEntry{{MessageId: "A"}, {MessageId: "C"}}, outbox)
+}
+
+func TestMemoryStore_SearchHistory(t *testing.T) {
+	store := NewMemoryStore()
+	now := time.Now()
+	entries := []HistoryEntry{
+		{MessageId: "A", Direction: Sent, Peer: "Alice", Payload: []byte("Hello Alice"), Time: now.Add(-time.Hour)},
+		{MessageId: "B", Direction: Sent, Peer: "Bob", Payload: []byte("Hello Bob"), Time: now},
+		{MessageId: "C", Direction: Received, Payload: []byte("Hello"), Time: now},
+	}
+	for _, entry := range entries {
+		if err := store.AddToHistory(entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	result, err := store.SearchHistory(HistoryQuery{Since: now.Add(-time.Minute)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, entries[1:], result)
+
+	result, err = store.SearchHistory(HistoryQuery{Direction: Sent, Contains: []byte("Alice")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, entries[:1], result)
+
+	result, err = store.SearchHistory(HistoryQuery{Limit: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, entries[:2], result)
+}
+
+func TestMemoryStore_HistorySize(t *testing.T) {
+	store := NewMemoryStore()
+	for i := 0; i < memoryHistorySize+1; i++ {
+		if err := store.AddToHistory(HistoryEntry{MessageId: strconv.Itoa(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	history, err := store.SearchHistory(HistoryQuery{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, memoryHistorySize, len(history))
+	assert.Equal(t, "1", history[0].MessageId, "The oldest message should be dropped")
+}
+
+func TestSQLiteStore(t *testing.T) {
+	path := "testStore.db"
+	defer os.Remove(path)
+
+	_, priv, err := sphinx.GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := StoreKeyFromPrivateKey(priv)
+	store, err := NewSQLiteStore(path, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recipient := config.ClientConfig{Id: "Recipient", Host: "localhost", Port: "9999"}
+	if err := store.AddToOutbox(OutboxEntry{MessageId: "A", Recipient: recipient, Payload: []byte("Hello"), Reliable: true, Created: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.AddToHistory(HistoryEntry{MessageId: "A", Direction: Sent, Peer: "Recipient", Payload: []byte("Hello"), Time: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	store, err = NewSQLiteStore(path, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	var stored []byte
+	if err := store.(*sqliteStore).db.QueryRow("SELECT Payload FROM History").Scan(&stored); err != nil {
+		t.Fatal(err)
+	}
+	assert.False(t, bytes.Contains(stored, []byte("Hello")), "The payloads should be encrypted in the database")
+	outbox, err := store.Outbox()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 1, len(outbox), "The outbox should be kept after reopening the store")
+	assert.Equal(t, "Recipient", outbox[0].Recipient.Id)
+	assert.True(t, outbox[0].Reliable)
+	assert.Equal(t, []byte("Hello"), outbox[0].Payload)
+
+	history, err := store.SearchHistory(HistoryQuery{Peer: "Recipient", Contains: []byte("ell")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 1, len(history))
+	assert.Equal(t, []byte("Hello"), history[0].Payload)
+
+	_, other, err := sphinx.GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	reopened, err := NewSQLiteStore(path, StoreKeyFromPrivateKey(other))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+	_, err = reopened.SearchHistory(HistoryQuery{})
+	assert.Error(t, err, "The payloads should not be readable with the key of another identity")
+}
+
+const testAPIToken = "TestAPIToken"
+
+// apiGet sends a GET request carrying the test token to the API.
+func apiGet(url string) (*http.Response, error) {
+	request, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Authorization", "Bearer "+testAPIToken)
+	return http.DefaultClient.Do(request)
+}
+
+// apiPost sends a JSON POST request carrying the test token to the API.
+func apiPost(url string, body io.Reader) (*http.Response, error) {
+	request, err := http.NewRequest(http.MethodPost, url, body)
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Authorization", "Bearer "+testAPIToken)
+	request.Header.Set("Content-Type", "application/json")
+	return http.DefaultClient.Do(request)
+}
+
+func TestAPIServer_SendAndRead(t *testing.T) {
+	client := SetupTestClient(t)
+	setupTestNetwork(client, t)
+	server := httptest.NewServer(NewAPIServer(client, testAPIToken).server.Handler)
+	defer server.Close()
+
+	response, err := apiPost(server.URL+"/send", strings.NewReader(`{"recipient": "Recipient", "message": "Hello world"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sent sendResponse
+	if err := json.NewDecoder(response.Body).Decode(&sent); err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	assert.Equal(t, http.StatusOK, response.StatusCode)
+	outbox, err := client.store.Outbox()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, sent.MessageId, outbox[0].MessageId, "The message should be stored in the outbox")
+
+	sendSealedPacket(client, sphinx.RealMessageType, []byte("Hello back"), t)
+	response, err = apiGet(server.URL + "/inbox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var inbox []inboxItem
+	if err := json.NewDecoder(response.Body).Decode(&inbox); err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	assert.Equal(t, 1, len(inbox))
+	assert.Equal(t, len("Hello back"), inbox[0].Size)
+
+	response, err = apiGet(server.URL + "/messages/" + inbox[0].MessageId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var message messageResponse
+	if err := json.NewDecoder(response.Body).Decode(&message); err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	assert.Equal(t, "Hello back", message.Message)
+	assert.Equal(t, "received", message.Direction)
+}
+
+func TestAPIServer_Errors(t *testing.T) {
+	client := SetupTestClient(t)
+	setupTestNetwork(client, t)
+	server := httptest.NewServer(NewAPIServer(client, testAPIToken).server.Handler)
+	defer server.Close()
+
+	response, err := apiPost(server.URL+"/send", strings.NewReader(`{"recipient": "Stranger", "message": "Hello world"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var failure errorResponse
+	if err := json.NewDecoder(response.Body).Decode(&failure); err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	assert.Equal(t, http.StatusUnprocessableEntity, response.StatusCode)
+	assert.Equal(t, "no client with the given id in the network", failure.Error)
+
+	response, err = apiGet(server.URL + "/messages/Unknown")
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	assert.Equal(t, http.StatusNotFound, response.StatusCode)
+
+	response, err = apiGet(server.URL + "/send")
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	assert.Equal(t, http.StatusMethodNotAllowed, response.StatusCode)
+}
+
+func TestAPIServer_ContactsAndStats(t *testing.T) {
+	client := SetupTestClient(t)
+	setupTestNetwork(client, t)
+	server := httptest.NewServer(NewAPIServer(client, testAPIToken).server.Handler)
+	defer server.Close()
+
+	response, err := apiGet(server.URL + "/contacts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var contacts []contactResponse
+	if err := json.NewDecoder(response.Body).Decode(&contacts); err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	assert.Equal(t, []contactResponse{{Id: "Recipient", Provider: "Provider"}}, contacts)
+
+	client.loops.sent("tag")
+	response, err = apiGet(server.URL + "/stats")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stats statsResponse
+	if err := json.NewDecoder(response.Body).Decode(&stats); err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	assert.Equal(t, uint64(1), stats.LoopsSent)
+	assert.Equal(t, 1, stats.LoopsPending)
+	assert.Equal(t, config.DefaultClientParameters(), stats.Parameters)
+}
+
+func TestAPIServer_Authentication(t *testing.T) {
+	client := SetupTestClient(t)
+	setupTestNetwork(client, t)
+	server := httptest.NewServer(NewAPIServer(client, testAPIToken).server.Handler)
+	defer server.Close()
+
+	response, err := http.Get(server.URL + "/contacts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	assert.Equal(t, http.StatusUnauthorized, response.StatusCode, "The requests without the token should be rejected")
+
+	request, err := http.NewRequest(http.MethodGet, server.URL+"/contacts", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	request.Header.Set("Authorization", "Bearer WrongToken")
+	response, err = http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	assert.Equal(t, http.StatusUnauthorized, response.StatusCode, "The requests with a wrong token should be rejected")
+
+	request, err = http.NewRequest(http.MethodPost, server.URL+"/send", strings.NewReader(`{"recipient": "Recipient", "message": "Hello world"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	request.Header.Set("Authorization", "Bearer "+testAPIToken)
+	request.Header.Set("Content-Type", "text/plain")
+	response, err = http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	assert.Equal(t, http.StatusUnsupportedMediaType, response.StatusCode, "The requests with a body of another type than JSON should be rejected")
+
+	request, err = http.NewRequest(http.MethodGet, server.URL+"/inbox", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	request.Host = "attacker.example:8080"
+	request.Header.Set("Authorization", "Bearer "+testAPIToken)
+	response, err = http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	assert.Equal(t, http.StatusForbidden, response.StatusCode, "The requests addressed to another host than the loopback should be rejected")
+
+	outbox, err := client.store.Outbox()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Empty(t, outbox, "No message should be sent by the rejected requests")
+}
+
+func TestLoadOrCreateAPIToken(t *testing.T) {
+	dir, err := ioutil.TempDir("", "apitoken")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "api.token")
+
+	token, err := LoadOrCreateAPIToken(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 2*apiTokenSize, len(token))
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm(), "Only the owner should be able to read the token")
+
+	loaded, err := LoadOrCreateAPIToken(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, token, loaded, "The existing token should be reused")
+}
+
+func TestListenAPI_NotLoopback(t *testing.T) {
+	_, err := ListenAPI("0.0.0.0:9900")
+	assert.EqualError(t, err, "the client API should listen on a loopback address")
+}
+
+func TestRunREPL(t *testing.T) {
+	client := SetupTestClient(t)
+	setupTestNetwork(client, t)
+	client.token = []byte("token")
+
+	input := "users\nsend Recipient Hello  world\nsend Stranger Hello\nstatus\nunknown\nquit\nusers\n"
+	var output bytes.Buffer
+	err := RunREPL(client, strings.NewReader(input), &output)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Contains(t, output.String(), "Recipient (provider Provider)")
+	assert.Contains(t, output.String(), "Error: no client with the given id in the network")
+	assert.Contains(t, output.String(), "Registered, token "+hex.EncodeToString([]byte("token")))
+	assert.Contains(t, output.String(), "Unknown command \"unknown\"")
+	assert.Equal(t, 1, strings.Count(output.String(), "(provider Provider)"), "The commands after quit should not run")
+
+	outbox, err := client.store.Outbox()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 1, len(outbox))
+	assert.Equal(t, []byte("Hello  world"), outbox[0].Payload)
+}
+
+func TestRunREPL_Incoming(t *testing.T) {
+	client := SetupTestClient(t)
+	reader, writer := io.Pipe()
+	var output syncBuffer
+	finished := make(chan error)
+	go func() { finished <- RunREPL(client, reader, &output) }()
+
+	sendSealedPacket(client, sphinx.RealMessageType, []byte("Hello \x1b[2Jworld"), t)
+	for i := 0; i < 100 && !strings.Contains(output.String(), "<< "); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Contains(t, output.String(), `<< "Hello \x1b[2Jworld"`, "The incoming messages should be printed quoted")
+	assert.NotContains(t, output.String(), "\x1b", "The escape sequences of the terminal should not be printed")
+
+	writer.Close()
+	assert.Nil(t, <-finished)
+}
+
+// syncBuffer is a buffer, which can be written and read concurrently.
+type syncBuffer struct {
+	mutex  sync.Mutex
+	buffer bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.buffer.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.buffer.String()
+}
+
+func TestProviderHealth(t *testing.T) {
+	var health providerHealth
+	now := time.Now()
+	timeout := providerSilenceTimeout(config.DefaultClientParameters())
+	health.reset(now)
+	assert.Nil(t, health.healthy(now, timeout))
+
+	for i := 0; i < providerFailureThreshold; i++ {
+		health.sent(errors.New("connection refused"))
+	}
+	assert.EqualError(t, health.healthy(now, timeout), "the provider is unreachable")
+	health.sent(nil)
+	assert.Nil(t, health.healthy(now, timeout), "A successful send should reset the failures")
+
+	assert.EqualError(t, health.healthy(now.Add(timeout+time.Second), timeout), "no packets were fetched from the provider within the timeout")
+	health.received(now.Add(timeout))
+	assert.Nil(t, health.healthy(now.Add(timeout+time.Second), timeout))
+}
+
+func TestProviderSilenceTimeout(t *testing.T) {
+	params := config.DefaultClientParameters()
+	timeout := providerSilenceTimeout(params)
+	assert.True(t, timeout > loopTimeout(params), "The provider should be given time for the loop messages to return")
+
+	params.LoopTrafficRate /= 10
+	assert.True(t, providerSilenceTimeout(params) > timeout, "A lower loop rate should extend the timeout")
+}
+
+func TestSelectProvider(t *testing.T) {
+	providers := []config.MixConfig{{Id: "Provider1"}, {Id: "Provider2"}}
+	provider, err := selectProvider(providers, "Provider1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "Provider2", provider.Id)
+
+	_, err = selectProvider(providers[:1], "Provider1")
+	assert.EqualError(t, err, "no other provider in the PKI")
+}
+
+func TestClient_ControlProvider_Reregister(t *testing.T) {
+	client := SetupTestClient(t)
+	listener, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	host, port, err := net.SplitHostPort(listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	provider := client.Provider()
+	provider.Host, provider.Port = host, port
+	client.SetProvider(provider)
+
+	client.setToken([]byte("token"))
+	client.health.reset(time.Now())
+	for i := 0; i < providerFailureThreshold; i++ {
+		client.health.sent(errors.New("connection refused"))
+	}
+
+	client.routines.Add(1)
+	go func() {
+		defer client.routines.Done()
+		client.controlProvider()
+	}()
+	defer client.Close()
+
+	conn, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	packetBytes, err := ioutil.ReadAll(conn)
+	conn.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var packet config.GeneralPacket
+	if err := proto.Unmarshal(packetBytes, &packet); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, assignFlag, packet.Flag, "The client should register again with the unhealthy provider")
+	assert.False(t, client.Status().Registered, "The token of the unhealthy provider should be removed")
+}
+
+func TestClient_CreateDropCoverMessage_EmptyNetwork(t *testing.T) {
+	client := SetupTestClient(t)
+	client.SetNetwork(clientCore.NetworkPKI{})
+
+	_, err := client.createDropCoverMessage()
+	assert.EqualError(t, err, "no clients in the network")
+}
+
+func TestClient_Network_ConcurrentRefresh(t *testing.T) {
+	client := SetupTestClient(t)
+	recipient := setupTestNetwork(client, t)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			client.SetNetwork(clientCore.NetworkPKI{Mixes: client.Network().Mixes, Clients: []config.ClientConfig{recipient}})
+		}
+	}()
+	for i := 0; i < 10; i++ {
+		_, err := client.createDropCoverMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	<-done
+}
+
+func setupTestIdentities(t *testing.T) (*Identities, *client, *client) {
+	alice, bob, _ := setupReliableClients(t)
+	identities := NewIdentities()
+	if err := identities.Add(alice); err != nil {
+		t.Fatal(err)
+	}
+	if err := identities.Add(bob); err != nil {
+		t.Fatal(err)
+	}
+	return identities, alice, bob
+}
+
+func TestIdentities(t *testing.T) {
+	identities, alice, bob := setupTestIdentities(t)
+
+	assert.EqualError(t, identities.Add(alice), "an identity with the given id already exists")
+	assert.Equal(t, []string{"Client0", "Client1"}, identities.Ids())
+
+	c, err := identities.Get("Client1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, bob.GetPublicKey(), c.(*client).GetPublicKey())
+	assert.NotEqual(t, alice.GetPublicKey(), bob.GetPublicKey(), "Each identity should have its own keys")
+
+	if err := identities.Remove("Client0"); err != nil {
+		t.Fatal(err)
+	}
+	_, err = identities.Get("Client0")
+	assert.EqualError(t, err, "no identity with the given id")
+	_, open := <-alice.Receive()
+	assert.False(t, open, "The removed identity should be closed")
+	assert.Nil(t, identities.Close())
+}
+
+func TestIdentitiesAPIServer(t *testing.T) {
+	identities, alice, _ := setupTestIdentities(t)
+	server := httptest.NewServer(NewIdentitiesAPIServer(identities, testAPIToken).server.Handler)
+	defer server.Close()
+
+	response, err := apiGet(server.URL + "/identities")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []string
+	if err := json.NewDecoder(response.Body).Decode(&ids); err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	assert.Equal(t, []string{"Client0", "Client1"}, ids)
+
+	response, err = apiPost(server.URL+"/identities/Client0/send", strings.NewReader(`{"recipient": "Client1", "message": "Hello"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	assert.Equal(t, http.StatusOK, response.StatusCode)
+	outbox, err := alice.store.Outbox()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 1, len(outbox), "The message should be sent by the identity from the path")
+
+	response, err = apiGet(server.URL + "/identities/Unknown/contacts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	assert.Equal(t, http.StatusNotFound, response.StatusCode)
+}
+
+// deliverGroupPacket passes the next packet of the sender to the recipient, and, for the reliable
+// packets, the acknowledgement of the recipient back to the sender.
+func deliverGroupPacket(sender, recipient *client, privs map[string][]byte, reliable bool, t *testing.T) {
+	dispatchOutbox(sender, t)
+	handlePacket(recipient, routePacket(<-sender.outQueue, sender.Provider().Id, privs, recipient, t))
+	if reliable {
+		handlePacket(sender, routePacket(<-recipient.ackQueue, recipient.Provider().Id, privs, sender, t))
+	}
+}
+
+func TestClient_Group(t *testing.T) {
+	sender, recipient, privs := setupReliableClients(t)
+
+	groupId, err := sender.CreateGroup("Friends", []string{"Client1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "Client0/Friends", groupId, "The id of the group should start with the id of its creator")
+	_, err = sender.CreateGroup("Friends", nil)
+	assert.EqualError(t, err, "a group with the given id already exists")
+	deliverGroupPacket(sender, recipient, privs, true, t)
+	expected := []Group{{Id: groupId, Members: []string{"Client0", "Client1"}, Epoch: 1}}
+	assert.Equal(t, expected, sender.Groups())
+	assert.Equal(t, expected, recipient.Groups(), "The invited member should join the group")
+
+	messageId, err := sender.SendToGroup(context.Background(), groupId, []byte("Hello group"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	deliverGroupPacket(sender, recipient, privs, false, t)
+	assert.Equal(t, []byte("Hello group"), <-recipient.Receive())
+
+	received, err := recipient.History(HistoryQuery{Peer: groupId})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 1, len(received))
+	assert.Equal(t, messageId, received[0].MessageId, "The members should record the message with the id of the sender")
+	sent, err := sender.History(HistoryQuery{Direction: Sent})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 1, len(sent), "The fan-out to the members should be recorded once")
+	assert.Equal(t, groupId, sent[0].Peer)
+
+	_, err = sender.SendToGroup(context.Background(), "Strangers", []byte("Hello"))
+	assert.EqualError(t, err, "no group with the given id")
+	assert.EqualError(t, recipient.AddGroupMember(groupId, "Client2"), "only the creator of the group can change its members")
+}
+
+func TestClient_Group_Rekey(t *testing.T) {
+	sender, recipient, privs := setupReliableClients(t)
+
+	groupId, err := sender.CreateGroup("Friends", []string{"Client1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	deliverGroupPacket(sender, recipient, privs, true, t)
+	key := sender.groups[groupId].key
+
+	if err := sender.RemoveGroupMember(groupId, "Client1"); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []Group{{Id: groupId, Members: []string{"Client0"}, Epoch: 2}}, sender.Groups())
+	assert.NotEqual(t, key, sender.groups[groupId].key, "The key should be replaced when a member is removed")
+	deliverGroupPacket(sender, recipient, privs, true, t)
+	assert.Equal(t, 0, len(recipient.Groups()), "The removed member should forget the group")
+
+	if err := sender.AddGroupMember(groupId, "Client1"); err != nil {
+		t.Fatal(err)
+	}
+	deliverGroupPacket(sender, recipient, privs, true, t)
+	assert.Equal(t, []Group{{Id: groupId, Members: []string{"Client0", "Client1"}, Epoch: 3}}, recipient.Groups())
+	assert.Equal(t, sender.groups[groupId].key, recipient.groups[groupId].key)
+
+	stale, err := clientCore.SealGroupMessage(key, groupId, 1, config.GroupContent{Payload: []byte("Stale")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	recipient.receiveGroupPacket(sphinx.GroupMessageType, stale)
+	assert.Equal(t, 0, len(recipient.Receive()), "The messages of the epochs unknown to the member should be dropped")
+
+	forged, err := clientCore.EncodeGroupInvite(config.GroupInvite{GroupId: groupId, Epoch: 4, Members: []string{"Client0", "Client1"}, Key: key}, recipient.GetPublicKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	recipient.receiveGroupPacket(sphinx.GroupInviteType, forged)
+	assert.Equal(t, uint64(3), recipient.Groups()[0].Epoch, "The invitation not signed by the creator should be dropped")
+
+	signed, err := clientCore.SignGroupInvite(config.GroupInvite{GroupId: groupId, Epoch: 4, Members: []string{"Client0", "Client1"}, Key: key}, recipient.Sign)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rekey, err := clientCore.SealGroupMessage(recipient.groups[groupId].key, groupId, 3, config.GroupContent{Sender: "Client1", Rekey: &signed})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sender.receiveGroupPacket(sphinx.GroupMessageType, rekey)
+	assert.Equal(t, uint64(3), sender.Groups()[0].Epoch, "Only the creator should replace the key of the group")
+}
+
+func TestClient_Group_Epochs(t *testing.T) {
+	sender, recipient, privs := setupReliableClients(t)
+
+	groupId, err := sender.CreateGroup("Friends", []string{"Client1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	deliverGroupPacket(sender, recipient, privs, true, t)
+	key := sender.groups[groupId].key
+
+	if err := sender.rekeyGroup(sender.groups[groupId], []string{"Client0", "Client1"}); err != nil {
+		t.Fatal(err)
+	}
+	dispatchOutbox(sender, t)
+	rekeyPacket := <-sender.outQueue
+
+	early, err := sender.SendToGroup(context.Background(), groupId, []byte("Sent in epoch 2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	deliverGroupPacket(sender, recipient, privs, false, t)
+	assert.Equal(t, 0, len(recipient.Receive()), "The message of a later epoch should wait for its key")
+
+	handlePacket(recipient, routePacket(rekeyPacket, sender.Provider().Id, privs, recipient, t))
+	assert.Equal(t, []byte("Sent in epoch 2"), <-recipient.Receive(), "The kept message should be read with the new key")
+	received, err := recipient.History(HistoryQuery{Peer: groupId})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, early, received[0].MessageId)
+
+	late, err := clientCore.SealGroupMessage(key, groupId, 1, config.GroupContent{MessageId: "Late", Sender: "Client0", Payload: []byte("Sent in epoch 1")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	recipient.receiveGroupPacket(sphinx.GroupMessageType, late)
+	assert.Equal(t, []byte("Sent in epoch 1"), <-recipient.Receive(), "The message of the previous epoch should be read within the grace time")
+
+	recipient.groups[groupId].previousKeys[0].until = time.Now()
+	recipient.receiveGroupPacket(sphinx.GroupMessageType, late)
+	assert.Equal(t, 0, len(recipient.Receive()), "The message of an expired epoch should be dropped")
+}
+
+func TestClient_PublishedConfig(t *testing.T) {
+	client := SetupTestClient(t)
+
+	published := client.publishedConfig()
+	assert.Equal(t, config.ClientConfig{Id: "Client", PubKey: client.GetPublicKey(), ProviderId: client.Provider().Id}, published,
+		"The published record should not reveal the address of the client")
+}
+
+// staticDirectory serves the given network document as the document of the latest epoch.
+type staticDirectory struct {
+	document config.NetworkDocument
+}
+
+func (d *staticDirectory) Upload(config.Descriptor) error { return nil }
+func (d *staticDirectory) Remove(config.Descriptor) error { return nil }
+func (d *staticDirectory) Document() (config.NetworkDocument, error) {
+	return d.document, nil
+}
+func (d *staticDirectory) DocumentAt(epoch uint64) (config.NetworkDocument, error) {
+	return d.document, nil
+}
+
+func TestClient_ReadInNetworkFromPKI_Epoch(t *testing.T) {
+	client := SetupTestClient(t)
+	d := &staticDirectory{document: config.NetworkDocument{Epoch: 5}}
+	server := httptest.NewServer(directory.NewServer(d).Handler())
+	defer server.Close()
+	p, err := pki.Open(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.pki = p
+
+	if err := client.ReadInNetworkFromPKI(); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, uint64(5), client.Network().Epoch)
+	assert.Equal(t, directory.Digest(d.document), client.Network().Digest)
+
+	d.document = config.NetworkDocument{Epoch: 5, Descriptors: []*config.Descriptor{{Typ: directory.MixDescriptor, Id: "Mix1"}}}
+	err = client.ReadInNetworkFromPKI()
+	assert.EqualError(t, err, "the PKI served another network document of epoch 5",
+		"The document of an epoch should not change")
 
-	assert.Equal(t, len(testMixSet), len(client.Network.Mixes))
-	assert.Equal(t, testMixSet, client.Network.Mixes)
+	d.document = config.NetworkDocument{Epoch: 4}
+	err = client.ReadInNetworkFromPKI()
+	assert.EqualError(t, err, "the PKI served the network document of epoch 4, older than the current epoch 5")
 
+	d.document = config.NetworkDocument{Epoch: 6}
+	assert.Nil(t, client.ReadInNetworkFromPKI())
+	assert.Equal(t, uint64(6), client.Network().Epoch)
 }
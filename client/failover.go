@@ -0,0 +1,205 @@
+// Copyright 2018 The Loopix-Messaging Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"anonymous-messaging/config"
+
+	"errors"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+const (
+	// the initial and the maximal delay between the registration requests, which doubles after each request
+	minRegistrationBackoff = time.Second
+	maxRegistrationBackoff = time.Minute
+	// maxRegistrationAttempts is the number of registration requests sent to the provider
+	// before the client fails over to another provider from the PKI.
+	maxRegistrationAttempts = 5
+	// providerFailureThreshold is the number of consecutive failed sends after which the provider is considered down.
+	providerFailureThreshold = 5
+	// providerCheckInterval is the interval of checking the health of the provider of the registered client.
+	providerCheckInterval = 10 * time.Second
+	// providerSilenceLoops is the number of loop messages, which the client expects to send and receive back
+	// before it considers the token lost, see providerSilenceTimeout.
+	providerSilenceLoops = 3
+)
+
+// providerSilenceTimeout returns the time without any packet fetched from the provider, after which
+// the token of the client is considered lost, e.g., because the provider restarted. The timeout
+// covers the sending of a few loop messages at the loop rate and the timeout of their return,
+// hence it follows the current parameters of the client.
+func providerSilenceTimeout(params config.ClientParameters) time.Duration {
+	var loopInterval float64
+	if params.LoopTrafficRate > 0 {
+		loopInterval = 1 / params.LoopTrafficRate
+	}
+	return time.Duration(loopInterval*providerSilenceLoops*float64(time.Second)) + loopTimeout(params)
+}
+
+// providerHealth keeps track of the failed sends to the provider and of the last packet fetched from it.
+type providerHealth struct {
+	mutex        sync.Mutex
+	failures     int
+	lastReceived time.Time
+}
+
+func (h *providerHealth) sent(err error) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	if err != nil {
+		h.failures++
+	} else {
+		h.failures = 0
+	}
+}
+
+func (h *providerHealth) received(now time.Time) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	h.lastReceived = now
+}
+
+func (h *providerHealth) reset(now time.Time) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	h.failures = 0
+	h.lastReceived = now
+}
+
+// healthy checks whether the provider is reachable, and whether it still delivers the packets of the client
+// within the given silence timeout. The silence of the provider is considered only if the client sends loop messages.
+func (h *providerHealth) healthy(now time.Time, silenceTimeout time.Duration) error {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	if h.failures >= providerFailureThreshold {
+		return errors.New("the provider is unreachable")
+	}
+	if loopCoverTrafficEnabled && now.Sub(h.lastReceived) > silenceTimeout {
+		return errors.New("no packets were fetched from the provider within the timeout")
+	}
+	return nil
+}
+
+func (c *client) currentToken() []byte {
+	c.tokenMutex.Lock()
+	defer c.tokenMutex.Unlock()
+
+	return c.token
+}
+
+// setToken replaces the authentication token of the client and wakes up the controller of the provider,
+// which registers the client again if the token is removed.
+func (c *client) setToken(token []byte) {
+	c.tokenMutex.Lock()
+	c.token = token
+	c.tokenMutex.Unlock()
+
+	select {
+	case c.providerSignal <- struct{}{}:
+	default:
+	}
+}
+
+// controlProvider registers the client with its provider, retrying with an exponential backoff
+// until the token is received. If the provider does not respond to the registration requests,
+// the client fails over to another provider from the PKI. Once registered, the client checks
+// the health of the provider and registers again if the provider went down or lost the token.
+func (c *client) controlProvider() {
+	backoff := minRegistrationBackoff
+	attempts := 0
+	for {
+		wait := providerCheckInterval
+		if c.currentToken() == nil {
+			if attempts >= maxRegistrationAttempts {
+				if err := c.failover(); err != nil {
+					logLocal.WithError(err).Error("Error during failover to another provider")
+				}
+				attempts, backoff = 0, minRegistrationBackoff
+			}
+			err := c.sendRegisterMessageToProvider()
+			if err != nil {
+				logLocal.WithError(err).Error("Error during registration to provider")
+			}
+			attempts++
+			wait = backoff
+			backoff *= 2
+			if backoff > maxRegistrationBackoff {
+				backoff = maxRegistrationBackoff
+			}
+		} else {
+			attempts, backoff = 0, minRegistrationBackoff
+			if err := c.health.healthy(time.Now(), providerSilenceTimeout(c.Parameters())); err != nil {
+				logLocal.WithError(err).Warningf("Provider %s is not healthy, registering again", c.Provider().Id)
+				c.setToken(nil)
+				continue
+			}
+		}
+
+		select {
+		case <-c.stop:
+			return
+		case <-c.providerSignal:
+		case <-time.After(wait):
+		}
+	}
+}
+
+// failover moves the client to another provider from the PKI, without the cooperation of the current provider.
+// The messages waiting in the inbox of the current provider are lost.
+func (c *client) failover() error {
+	providers, err := c.pki.Providers()
+	if err != nil {
+		return err
+	}
+	current := c.Provider()
+	provider, err := selectProvider(providers, current.Id)
+	if err != nil {
+		return err
+	}
+	logLocal.Warningf("Provider %s does not respond, failing over to provider %s", current.Id, provider.Id)
+	return c.switchProvider(provider)
+}
+
+// selectProvider picks at random a provider other than the current one.
+func selectProvider(providers []config.MixConfig, currentId string) (config.MixConfig, error) {
+	var candidates []config.MixConfig
+	for _, provider := range providers {
+		if provider.Id != currentId {
+			candidates = append(candidates, provider)
+		}
+	}
+	if len(candidates) == 0 {
+		return config.MixConfig{}, errors.New("no other provider in the PKI")
+	}
+	return candidates[rand.Intn(len(candidates))], nil
+}
+
+// switchProvider publishes the updated configuration of the client in the PKI and removes the token
+// of the previous provider, hence the client registers with the new provider.
+func (c *client) switchProvider(provider config.MixConfig) error {
+	c.SetProvider(provider)
+	c.health.reset(time.Now())
+
+	err := c.pki.PublishClient(c.publishedConfig(), c.Sign)
+	c.setToken(nil)
+	return err
+}
@@ -0,0 +1,444 @@
+// Copyright 2018 The Loopix-Messaging Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"anonymous-messaging/clientCore"
+	"anonymous-messaging/config"
+	"anonymous-messaging/sphinx"
+
+	"context"
+	"errors"
+	"sort"
+	"time"
+)
+
+// Group is a conversation of several clients, which share the key of the group. The key is replaced,
+// and the epoch incremented, whenever the membership changes, hence the removed members cannot read
+// the later messages, and the new members cannot read the earlier ones. The id of the group starts with
+// the id of its creator, who is the only client allowed to change the members and signs all the keys.
+//
+// A message to the group is encrypted once with the group key and sent in a separate Sphinx packet
+// to each member. The packets are passed through the outbox, so each of them takes a slot of the
+// Poisson stream of the real messages, and the fan-out looks like any other sequence of messages.
+type Group struct {
+	Id      string
+	Members []string
+	Epoch   uint64
+}
+
+const (
+	// groupKeyGrace is the time for which the key of the previous epoch is kept after a rekey,
+	// so that the messages sent before the members received the new key can still be read.
+	groupKeyGrace = 10 * time.Minute
+	// groupKeptEpochs is the maximal number of the previous epochs whose keys are kept.
+	groupKeptEpochs = 3
+	// groupPendingSize is the maximal number of the messages of the later epochs of a group, which
+	// are kept until the key of their epoch is received.
+	groupPendingSize = 32
+)
+
+// epochKey is the key of a previous epoch of the group, which is accepted until the given time.
+type epochKey struct {
+	epoch uint64
+	key   []byte
+	until time.Time
+}
+
+// group is the state of a group kept by a member.
+type group struct {
+	Group
+	key []byte
+	// creatorKey is the public key of the creator, which all the later keys of the group must be signed with
+	creatorKey   []byte
+	previousKeys []epochKey
+	pending      []config.GroupMessage
+}
+
+func (g *group) hasMember(id string) bool {
+	for _, member := range g.Members {
+		if member == id {
+			return true
+		}
+	}
+	return false
+}
+
+// keyOf returns the key of the given epoch of the group, or nil if the key is not known or expired.
+func (g *group) keyOf(epoch uint64, now time.Time) []byte {
+	if epoch == g.Epoch {
+		return g.key
+	}
+	for _, previous := range g.previousKeys {
+		if previous.epoch == epoch && now.Before(previous.until) {
+			return previous.key
+		}
+	}
+	return nil
+}
+
+// retiredKeys returns the keys of the recent epochs, including the current one, which should be kept
+// after the group moves to the next epoch.
+func (g *group) retiredKeys(now time.Time) []epochKey {
+	keys := []epochKey{{epoch: g.Epoch, key: g.key, until: now.Add(groupKeyGrace)}}
+	for _, previous := range g.previousKeys {
+		if len(keys) < groupKeptEpochs && now.Before(previous.until) {
+			keys = append(keys, previous)
+		}
+	}
+	return keys
+}
+
+// receivedGroupMessage is the decrypted message of a group, which is passed to the application.
+type receivedGroupMessage struct {
+	groupId string
+	content config.GroupContent
+}
+
+// CreateGroup creates a group with the given name of the client and the clients with the given ids,
+// sends the invitations with the key of the group to the members, and returns the id of the group.
+func (c *client) CreateGroup(name string, members []string) (string, error) {
+	c.groupsMutex.Lock()
+	defer c.groupsMutex.Unlock()
+
+	if name == "" {
+		return "", errors.New("the name of the group is empty")
+	}
+	groupId := clientCore.GroupId(c.id, name)
+	if _, ok := c.groups[groupId]; ok {
+		return "", errors.New("a group with the given id already exists")
+	}
+	previous := &group{Group: Group{Id: groupId}, creatorKey: c.GetPublicKey()}
+	if err := c.rekeyGroup(previous, append(append([]string{}, members...), c.id)); err != nil {
+		return "", err
+	}
+	return groupId, nil
+}
+
+// AddGroupMember adds the client with the given id to the group and replaces the key of the group.
+func (c *client) AddGroupMember(groupId, memberId string) error {
+	c.groupsMutex.Lock()
+	defer c.groupsMutex.Unlock()
+
+	g, err := c.ownedGroup(groupId)
+	if err != nil {
+		return err
+	}
+	if g.hasMember(memberId) {
+		return errors.New("the client is already a member of the group")
+	}
+	return c.rekeyGroup(g, append(append([]string{}, g.Members...), memberId))
+}
+
+// RemoveGroupMember removes the client with the given id from the group and replaces the key
+// of the group, which is sent only to the remaining members.
+func (c *client) RemoveGroupMember(groupId, memberId string) error {
+	c.groupsMutex.Lock()
+	defer c.groupsMutex.Unlock()
+
+	g, err := c.ownedGroup(groupId)
+	if err != nil {
+		return err
+	}
+	if !g.hasMember(memberId) {
+		return errors.New("the client is not a member of the group")
+	}
+	if memberId == c.id {
+		return errors.New("the client cannot remove itself from the group")
+	}
+	var members []string
+	for _, member := range g.Members {
+		if member != memberId {
+			members = append(members, member)
+		}
+	}
+	return c.rekeyGroup(g, members)
+}
+
+// ownedGroup returns the group with the given id, if the client is its creator. ownedGroup must be
+// called with the groups mutex held.
+func (c *client) ownedGroup(groupId string) (*group, error) {
+	g, ok := c.groups[groupId]
+	if !ok {
+		return nil, errors.New("no group with the given id")
+	}
+	if clientCore.GroupCreator(groupId) != c.id {
+		return nil, errors.New("only the creator of the group can change its members")
+	}
+	return g, nil
+}
+
+// rekeyGroup generates a fresh key of the group with the given members, and sends it to the members.
+// Every key is signed by the creator of the group. The members who already had the previous key receive
+// the new key sealed under the previous one, hence the keys of the group form a chain. The new members
+// receive an invitation sealed to their public keys, and the removed members a notice without the key,
+// sealed under the previous key. The keys are sent as reliable messages, since a member who misses a key
+// cannot read the group messages. rekeyGroup must be called with the groups mutex held.
+func (c *client) rekeyGroup(previous *group, members []string) error {
+	key, err := clientCore.NewGroupKey()
+	if err != nil {
+		return err
+	}
+	next := &group{Group: Group{Id: previous.Id, Members: uniqueSorted(members), Epoch: previous.Epoch + 1},
+		key: key, creatorKey: previous.creatorKey}
+	if previous.key != nil {
+		next.previousKeys = previous.retiredKeys(time.Now())
+	}
+
+	recipients := make(map[string]config.ClientConfig)
+	for _, member := range uniqueSorted(append(append([]string{}, previous.Members...), next.Members...)) {
+		if member == c.id {
+			continue
+		}
+		recipient, err := c.findRecipient(member)
+		if err != nil && next.hasMember(member) {
+			return err
+		}
+		if err != nil {
+			// the removed member who left the network does not need the notice
+			continue
+		}
+		recipients[member] = recipient
+	}
+
+	invite, err := clientCore.SignGroupInvite(config.GroupInvite{GroupId: next.Id, Epoch: next.Epoch, Members: next.Members, Key: next.key}, c.Sign)
+	if err != nil {
+		return err
+	}
+	removal, err := clientCore.SignGroupInvite(config.GroupInvite{GroupId: next.Id, Epoch: next.Epoch, Members: next.Members}, c.Sign)
+	if err != nil {
+		return err
+	}
+	payloads := make(map[string][]byte)
+	types := make(map[string]string)
+	for member, recipient := range recipients {
+		types[member] = sphinx.GroupMessageType
+		switch {
+		case !previous.hasMember(member):
+			types[member] = sphinx.GroupInviteType
+			payloads[member], err = clientCore.EncodeGroupInvite(invite, recipient.PubKey)
+		case next.hasMember(member):
+			payloads[member], err = c.sealRekey(previous, invite)
+		default:
+			payloads[member], err = c.sealRekey(previous, removal)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	c.groups[next.Id] = next
+	for member, recipient := range recipients {
+		if _, err := c.addToOutbox(recipient, payloads[member], types[member], true, next.Id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *client) sealRekey(previous *group, invite config.GroupInvite) ([]byte, error) {
+	return clientCore.SealGroupMessage(previous.key, previous.Id, previous.Epoch, config.GroupContent{Sender: c.id, Rekey: &invite})
+}
+
+// SendToGroup sends the message to all the other members of the group, and returns the id of the message.
+// The message is stored in the outbox, in a separate entry for each member, and recorded once in the history.
+func (c *client) SendToGroup(ctx context.Context, groupId string, message []byte) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	c.groupsMutex.Lock()
+	defer c.groupsMutex.Unlock()
+
+	g, ok := c.groups[groupId]
+	if !ok {
+		return "", errors.New("no group with the given id")
+	}
+	messageId, err := newMessageId()
+	if err != nil {
+		return "", err
+	}
+	payload, err := clientCore.SealGroupMessage(g.key, g.Id, g.Epoch, config.GroupContent{MessageId: messageId, Sender: c.id, Payload: message})
+	if err != nil {
+		return "", err
+	}
+	for _, member := range g.Members {
+		if member == c.id {
+			continue
+		}
+		recipient, err := c.findRecipient(member)
+		if err != nil {
+			logLocal.WithError(err).Errorf("Error in send to group - member %s is not in the network", member)
+			continue
+		}
+		if _, err := c.addToOutbox(recipient, payload, sphinx.GroupMessageType, false, g.Id); err != nil {
+			return "", err
+		}
+	}
+	err = c.store.AddToHistory(HistoryEntry{MessageId: messageId, Direction: Sent, Peer: g.Id, Payload: message, Time: time.Now()})
+	if err != nil {
+		return "", err
+	}
+	return messageId, nil
+}
+
+// Groups returns the groups the client is a member of.
+func (c *client) Groups() []Group {
+	c.groupsMutex.Lock()
+	defer c.groupsMutex.Unlock()
+
+	var groups []Group
+	for _, g := range c.groups {
+		groups = append(groups, Group{Id: g.Id, Members: append([]string{}, g.Members...), Epoch: g.Epoch})
+	}
+	sort.Slice(groups, func(i, j int) bool { return groups[i].Id < groups[j].Id })
+	return groups
+}
+
+// receiveGroupPacket handles the received group invitations and group messages of the given sphinx message type.
+func (c *client) receiveGroupPacket(messageType string, message []byte) {
+	var received []receivedGroupMessage
+	switch messageType {
+	case sphinx.GroupInviteType:
+		invite, ok := c.DecodeGroupInvite(message)
+		if !ok {
+			logLocal.Warning("Received malformed group invitation. Message dropped.")
+			return
+		}
+		received = c.acceptInvite(invite)
+	case sphinx.GroupMessageType:
+		groupMessage, ok := clientCore.DecodeGroupMessage(message)
+		if !ok {
+			logLocal.Warning("Received malformed group message. Message dropped.")
+			return
+		}
+		c.groupsMutex.Lock()
+		received = c.openGroupMessage(groupMessage, time.Now())
+		c.groupsMutex.Unlock()
+	}
+
+	for _, m := range received {
+		logLocal.Info("Received new group message")
+		err := c.store.AddToHistory(HistoryEntry{MessageId: m.content.MessageId, Direction: Received, Peer: m.groupId, Payload: m.content.Payload, Time: time.Now()})
+		if err != nil {
+			logLocal.WithError(err).Error("Error in recording received message")
+		}
+		c.deliver(m.content.Payload)
+	}
+}
+
+// openGroupMessage decrypts the group message with the key of its epoch, and returns the messages
+// for the application. The messages of the later epochs are kept until their key is received, and
+// the messages of the expired epochs are dropped. openGroupMessage must be called with the groups mutex held.
+func (c *client) openGroupMessage(message config.GroupMessage, now time.Time) []receivedGroupMessage {
+	g, ok := c.groups[message.GroupId]
+	if !ok {
+		logLocal.Info("Received message of an unknown group. Message dropped.")
+		return nil
+	}
+	if message.Epoch > g.Epoch {
+		if len(g.pending) >= groupPendingSize {
+			logLocal.Info("Too many messages of the later epochs of the group. Message dropped.")
+			return nil
+		}
+		g.pending = append(g.pending, message)
+		return nil
+	}
+	key := g.keyOf(message.Epoch, now)
+	if key == nil {
+		logLocal.Info("Received message of an expired epoch of the group. Message dropped.")
+		return nil
+	}
+	content, err := clientCore.OpenGroupMessage(key, message)
+	if err != nil {
+		logLocal.WithError(err).Error("Error in processing received group message")
+		return nil
+	}
+	if content.Rekey != nil {
+		rekey := *content.Rekey
+		if message.Epoch != g.Epoch || rekey.GroupId != g.Id || rekey.Epoch <= g.Epoch || !clientCore.VerifyGroupInvite(rekey, g.creatorKey) {
+			logLocal.Info("Received key of the group not signed by its creator. Key dropped.")
+			return nil
+		}
+		return c.joinGroup(rekey, g.creatorKey, now)
+	}
+	return []receivedGroupMessage{{groupId: g.Id, content: content}}
+}
+
+// acceptInvite joins the group the client was invited to, after the signature of the invitation
+// is checked against the key of the creator of the group. The key of the creator is taken from the PKI
+// when the client joins the group, and kept for the later invitations.
+func (c *client) acceptInvite(invite config.GroupInvite) []receivedGroupMessage {
+	c.groupsMutex.Lock()
+	defer c.groupsMutex.Unlock()
+
+	var creatorKey []byte
+	if g, ok := c.groups[invite.GroupId]; ok {
+		if invite.Epoch <= g.Epoch {
+			logLocal.Info("Received invitation to a past epoch of a known group. Invitation dropped.")
+			return nil
+		}
+		creatorKey = g.creatorKey
+	} else {
+		creator, err := c.findRecipient(clientCore.GroupCreator(invite.GroupId))
+		if err != nil {
+			logLocal.WithError(err).Info("Received invitation of an unknown creator. Invitation dropped.")
+			return nil
+		}
+		creatorKey = creator.PubKey
+	}
+	if !clientCore.VerifyGroupInvite(invite, creatorKey) {
+		logLocal.Info("Received invitation not signed by the creator of the group. Invitation dropped.")
+		return nil
+	}
+	return c.joinGroup(invite, creatorKey, time.Now())
+}
+
+// joinGroup sets the state of the group following the invitation, and returns the kept messages of
+// the group which can be read with the new key. If the client is not a member of the group any more,
+// the group is forgotten. joinGroup must be called with the groups mutex held.
+func (c *client) joinGroup(invite config.GroupInvite, creatorKey []byte, now time.Time) []receivedGroupMessage {
+	g := &group{Group: Group{Id: invite.GroupId, Members: uniqueSorted(invite.Members), Epoch: invite.Epoch}, key: invite.Key, creatorKey: creatorKey}
+	if !g.hasMember(c.id) || len(g.key) == 0 {
+		logLocal.Infof("Not a member of group %s in epoch %d", g.Id, g.Epoch)
+		delete(c.groups, g.Id)
+		return nil
+	}
+	var pending []config.GroupMessage
+	if previous, ok := c.groups[g.Id]; ok {
+		g.previousKeys = previous.retiredKeys(now)
+		pending = previous.pending
+	}
+	logLocal.Infof("Joined group %s in epoch %d", g.Id, g.Epoch)
+	c.groups[g.Id] = g
+
+	var received []receivedGroupMessage
+	for _, message := range pending {
+		received = append(received, c.openGroupMessage(message, now)...)
+	}
+	return received
+}
+
+func uniqueSorted(ids []string) []string {
+	seen := make(map[string]bool)
+	var unique []string
+	for _, id := range ids {
+		if !seen[id] {
+			seen[id] = true
+			unique = append(unique, id)
+		}
+	}
+	sort.Strings(unique)
+	return unique
+}
@@ -0,0 +1,122 @@
+// Copyright 2018 The Loopix-Messaging Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"errors"
+	"sort"
+	"sync"
+)
+
+// Identities manages several identities in one process. Each identity is a separate client,
+// with its own keys, provider registration, inbox and cover traffic streams. The identities
+// share no state which would affect their traffic, hence they cannot be linked by the timing
+// of their packets. The identities still share the host address, so the identities which should
+// not be linked by their providers should register with different providers.
+type Identities struct {
+	mutex   sync.Mutex
+	clients map[string]Client
+}
+
+// NewIdentities creates an empty set of identities.
+func NewIdentities() *Identities {
+	return &Identities{clients: make(map[string]Client)}
+}
+
+// Add adds the client as a new identity. The client is not started.
+func (m *Identities) Add(c Client) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	id := c.Status().Id
+	if _, ok := m.clients[id]; ok {
+		return errors.New("an identity with the given id already exists")
+	}
+	m.clients[id] = c
+	return nil
+}
+
+// Get returns the client of the identity with the given id.
+func (m *Identities) Get(id string) (Client, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	c, ok := m.clients[id]
+	if !ok {
+		return nil, errors.New("no identity with the given id")
+	}
+	return c, nil
+}
+
+// Ids returns the sorted ids of the identities.
+func (m *Identities) Ids() []string {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	var ids []string
+	for id := range m.clients {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// Start starts the clients of all the identities. If any client fails to start,
+// the clients already started are closed.
+func (m *Identities) Start() error {
+	var started []Client
+	for _, id := range m.Ids() {
+		c, err := m.Get(id)
+		if err != nil {
+			return err
+		}
+		if err := c.Start(); err != nil {
+			logLocal.WithError(err).Errorf("Error during starting identity %s", id)
+			for _, s := range started {
+				s.Close()
+			}
+			return err
+		}
+		started = append(started, c)
+	}
+	return nil
+}
+
+// Remove closes the client of the identity with the given id and removes the identity.
+func (m *Identities) Remove(id string) error {
+	m.mutex.Lock()
+	c, ok := m.clients[id]
+	delete(m.clients, id)
+	m.mutex.Unlock()
+
+	if !ok {
+		return errors.New("no identity with the given id")
+	}
+	return c.Close()
+}
+
+// Close closes the clients of all the identities, and returns the first error.
+func (m *Identities) Close() error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	var err error
+	for _, c := range m.clients {
+		if closeErr := c.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
@@ -0,0 +1,222 @@
+// Copyright 2018 The Loopix-Messaging Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"anonymous-messaging/config"
+
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
+	"time"
+)
+
+const (
+	// loopTimeoutFactor is the multiple of the expected round trip of a loop message after which
+	// the loop is counted as lost.
+	loopTimeoutFactor = 6
+	// loopWindowSize is the number of the most recent loops over which the loss rate is computed.
+	loopWindowSize = 100
+	// loopMinSamples is the number of loops which must complete before an alert can be raised.
+	loopMinSamples = 20
+	// lossAlertThreshold is the loss rate above which the client suspects an active attack.
+	lossAlertThreshold = 0.3
+	// the number of alerts which are buffered until the application reads them
+	alertQueueSize = 10
+)
+
+// LoopStats contains the accounting of the loop cover messages sent by the client.
+// The loss rate and the round-trip time are computed over the most recent loops.
+type LoopStats struct {
+	Sent       uint64
+	Returned   uint64
+	Lost       uint64
+	Pending    int
+	LossRate   float64
+	AverageRTT time.Duration
+}
+
+// LoopAlert is raised when the loss rate of the loop messages crosses the alert threshold,
+// which might indicate that the network drops or delays the client's traffic.
+type LoopAlert struct {
+	Time     time.Time
+	LossRate float64
+	Window   int
+}
+
+type loopOutcome struct {
+	returned bool
+	rtt      time.Duration
+}
+
+// loopMonitor keeps the sending times of the loop messages which did not return yet,
+// and the outcomes of the most recent loops. The loop messages carry only their random tags,
+// hence a received message is a loop message only if its tag was sent by the client. The tags
+// of the loops counted as lost are kept for another timeout, to recognise the late loops.
+type loopMonitor struct {
+	mutex   sync.Mutex
+	now     func() time.Time
+	timeout func() time.Duration
+
+	pending  map[string]time.Time
+	lost     map[string]time.Time
+	window   []loopOutcome
+	next     int
+	stats    LoopStats
+	alerting bool
+	alerts   chan LoopAlert
+}
+
+// loopTimeout returns the time after which a loop message which did not return is counted as lost.
+// The loops return through the inbox, hence the expected round trip includes the delays of the mixes
+// and the delay of fetching, which both depend on the current parameters of the client.
+func loopTimeout(params config.ClientParameters) time.Duration {
+	expected := 1 / params.FetchRate
+	if params.MixDelayRate > 0 {
+		expected += float64(params.PathLength) / params.MixDelayRate
+	}
+	return time.Duration(expected * loopTimeoutFactor * float64(time.Second))
+}
+
+// newLoopTag generates a fresh random tag, which identifies a single loop message.
+func newLoopTag() (string, error) {
+	tag := make([]byte, 16)
+	if _, err := rand.Read(tag); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(tag), nil
+}
+
+// sent records the sending time of the loop message with the given tag.
+func (m *loopMonitor) sent(tag string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	now := m.now()
+	m.expire(now)
+	m.pending[tag] = now
+	m.stats.Sent++
+}
+
+// returned matches the received message with the sending time of the loop with the same tag.
+// returned reports whether the message is a loop message of the client. The loops which return
+// after they were counted as lost are recognised, but not counted.
+func (m *loopMonitor) returned(tag string) bool {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	now := m.now()
+	m.expire(now)
+	if _, ok := m.lost[tag]; ok {
+		logLocal.Info("Received late loop message")
+		delete(m.lost, tag)
+		return true
+	}
+	sentAt, ok := m.pending[tag]
+	if !ok {
+		return false
+	}
+	delete(m.pending, tag)
+	m.stats.Returned++
+	m.record(loopOutcome{returned: true, rtt: now.Sub(sentAt)}, now)
+	return true
+}
+
+// expire counts the loops which did not return within the timeout as lost, and forgets
+// the tags of the lost loops after another timeout.
+func (m *loopMonitor) expire(now time.Time) {
+	timeout := m.timeout()
+	for tag, sentAt := range m.pending {
+		if now.Sub(sentAt) > timeout {
+			delete(m.pending, tag)
+			m.lost[tag] = sentAt
+			m.stats.Lost++
+			m.record(loopOutcome{returned: false}, now)
+		}
+	}
+	for tag, sentAt := range m.lost {
+		if now.Sub(sentAt) > 2*timeout {
+			delete(m.lost, tag)
+		}
+	}
+}
+
+// record adds the outcome to the sliding window, and raises an alert if the loss rate
+// crossed the threshold. The next alert is raised only after the loss rate drops below the threshold.
+func (m *loopMonitor) record(outcome loopOutcome, now time.Time) {
+	if len(m.window) < loopWindowSize {
+		m.window = append(m.window, outcome)
+	} else {
+		m.window[m.next] = outcome
+		m.next = (m.next + 1) % loopWindowSize
+	}
+
+	lossRate, _ := m.windowStats()
+	if len(m.window) < loopMinSamples {
+		return
+	}
+	if lossRate <= lossAlertThreshold {
+		m.alerting = false
+		return
+	}
+	if m.alerting {
+		return
+	}
+	m.alerting = true
+	logLocal.Warningf("Loss rate of loop messages %.2f crossed the alert threshold. Possible active attack.", lossRate)
+	select {
+	case m.alerts <- LoopAlert{Time: now, LossRate: lossRate, Window: len(m.window)}:
+	default:
+		logLocal.Warning("Alert queue full. Alert dropped.")
+	}
+}
+
+func (m *loopMonitor) windowStats() (float64, time.Duration) {
+	if len(m.window) == 0 {
+		return 0, 0
+	}
+	var lost int
+	var returned int64
+	var rtt time.Duration
+	for _, outcome := range m.window {
+		if outcome.returned {
+			returned++
+			rtt += outcome.rtt
+		} else {
+			lost++
+		}
+	}
+	lossRate := float64(lost) / float64(len(m.window))
+	if returned == 0 {
+		return lossRate, 0
+	}
+	return lossRate, rtt / time.Duration(returned)
+}
+
+func (m *loopMonitor) loopStats() LoopStats {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.expire(m.now())
+	stats := m.stats
+	stats.Pending = len(m.pending)
+	stats.LossRate, stats.AverageRTT = m.windowStats()
+	return stats
+}
+
+// newLoopMonitor creates the monitor, which counts the loops as lost after the given timeout.
+func newLoopMonitor(timeout func() time.Duration) *loopMonitor {
+	return &loopMonitor{now: time.Now, timeout: timeout, pending: make(map[string]time.Time), lost: make(map[string]time.Time), alerts: make(chan LoopAlert, alertQueueSize)}
+}
@@ -0,0 +1,133 @@
+// Copyright 2018 The Loopix-Messaging Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"anonymous-messaging/clientCore"
+	"anonymous-messaging/config"
+	"anonymous-messaging/sphinx"
+
+	"errors"
+)
+
+// Option configures the client created by New.
+type Option func(*options)
+
+type options struct {
+	id        string
+	host      string
+	port      string
+	pubKey    []byte
+	prvKey    []byte
+	pkiDir    string
+	provider  *config.MixConfig
+	params    *config.ClientParameters
+	store     MessageStore
+	policy    clientCore.PathPolicy
+	onReceive func([]byte)
+}
+
+// WithId sets the id under which the client is published in the PKI.
+func WithId(id string) Option {
+	return func(o *options) { o.id = id }
+}
+
+// WithAddress sets the host and port on which the client listens for the packets from its provider.
+func WithAddress(host, port string) Option {
+	return func(o *options) { o.host, o.port = host, port }
+}
+
+// WithKeys sets the key pair of the client. If no keys are given, a fresh key pair is generated.
+func WithKeys(pubKey, prvKey []byte) Option {
+	return func(o *options) { o.pubKey, o.prvKey = pubKey, prvKey }
+}
+
+// WithPKI sets the path of the PKI database.
+func WithPKI(pkiDir string) Option {
+	return func(o *options) { o.pkiDir = pkiDir }
+}
+
+// WithProvider sets the provider with which the client registers.
+func WithProvider(provider config.MixConfig) Option {
+	return func(o *options) { o.provider = &provider }
+}
+
+// WithParameters sets the traffic parameters of the client.
+// If no parameters are given, the defaults following the published rates are used.
+func WithParameters(params config.ClientParameters) Option {
+	return func(o *options) { o.params = &params }
+}
+
+// WithStore sets the store of the outbox and the history of the client. If no store is given,
+// the outbox and the history are kept in memory and are lost when the client stops.
+func WithStore(store MessageStore) Option {
+	return func(o *options) { o.store = store }
+}
+
+// WithPathPolicy sets the policy selecting the mixes on the paths of the packets.
+// If no policy is given, the mixes are sampled uniformly at random.
+func WithPathPolicy(policy clientCore.PathPolicy) Option {
+	return func(o *options) { o.policy = policy }
+}
+
+// WithReceiveCallback sets the function which is called with each decrypted message
+// received by the client, instead of passing the messages to the channel returned by Receive.
+// The callback is called from the goroutine handling the connection, and should not block.
+func WithReceiveCallback(onReceive func([]byte)) Option {
+	return func(o *options) { o.onReceive = onReceive }
+}
+
+// New creates a client configured with the given options, and publishes it in the PKI.
+// The id, address, PKI and provider of the client are required. The client should be
+// started with Start and released with Close. New returns an error if the options are
+// incomplete or the client could not be created.
+func New(opts ...Option) (Client, error) {
+	var o options
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	if o.id == "" || o.host == "" || o.port == "" {
+		return nil, errors.New("the id and the address of the client are required")
+	}
+	if o.pkiDir == "" || o.provider == nil {
+		return nil, errors.New("the PKI and the provider of the client are required")
+	}
+	if o.pubKey == nil || o.prvKey == nil {
+		var err error
+		o.pubKey, o.prvKey, err = sphinx.GenerateKeyPair()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	params := config.DefaultClientParameters()
+	if o.params != nil {
+		params = *o.params
+	}
+
+	c, err := NewClient(o.id, o.host, o.port, o.pubKey, o.prvKey, o.pkiDir, *o.provider, params)
+	if err != nil {
+		return nil, err
+	}
+	c.onReceive = o.onReceive
+	if o.store != nil {
+		c.store = o.store
+	}
+	if o.policy != nil {
+		c.SetPathPolicy(o.policy, nil)
+	}
+	return c, nil
+}
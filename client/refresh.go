@@ -0,0 +1,65 @@
+// Copyright 2018 The Loopix-Messaging Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"os"
+	"time"
+)
+
+const (
+	// pkiRefreshInterval is the interval after which the view of the network is reloaded from the PKI,
+	// even if no change of the PKI was noticed.
+	pkiRefreshInterval = 5 * time.Minute
+	// pkiChangeCheckInterval is the interval of checking whether the PKI database was modified.
+	pkiChangeCheckInterval = 5 * time.Second
+)
+
+// controlPKIRefresh reloads the view of the network when the PKI database is modified, and periodically
+// after the refresh interval. The new view replaces the old one atomically, hence the packets being
+// encoded use either the old or the new view. If the reload fails, the old view is kept.
+func (c *client) controlPKIRefresh() {
+	lastModified := c.pkiModTime()
+	lastRefresh := time.Now()
+	for {
+		select {
+		case <-c.stop:
+			return
+		case <-time.After(pkiChangeCheckInterval):
+		}
+
+		modified := c.pkiModTime()
+		if modified.Equal(lastModified) && time.Since(lastRefresh) < pkiRefreshInterval {
+			continue
+		}
+		err := c.ReadInNetworkFromPKI()
+		if err != nil {
+			logLocal.WithError(err).Error("Error during refreshing the network from the PKI")
+			continue
+		}
+		lastModified, lastRefresh = modified, time.Now()
+	}
+}
+
+// pkiModTime returns the time of the last modification of the PKI database, or the zero time
+// if it cannot be read. The remote directory has no modification time, hence the view of the network
+// served by the directory authority is reloaded only after the refresh interval.
+func (c *client) pkiModTime() time.Time {
+	info, err := os.Stat(c.pkiDir)
+	if err != nil {
+		return time.Time{}
+	}
+	return info.ModTime()
+}
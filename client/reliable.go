@@ -0,0 +1,281 @@
+// Copyright 2018 The Loopix-Messaging Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"anonymous-messaging/clientCore"
+	"anonymous-messaging/config"
+	"anonymous-messaging/sphinx"
+
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"time"
+)
+
+const (
+	// maxTransmissions is the number of times a reliable message is sent before it is considered failed.
+	maxTransmissions = 5
+	// ackTimeoutFactor is the multiple of the expected time of the acknowledgement after which
+	// the message is retransmitted.
+	ackTimeoutFactor = 3
+	// retransmissionCheckInterval is the interval of checking for the expired acknowledgement timeouts.
+	retransmissionCheckInterval = time.Second
+	// receivedIdRetention is the time for which the ids of the received reliable messages are kept
+	// to recognise the retransmitted duplicates, and receivedIdPruneInterval is the interval of
+	// forgetting the older ids.
+	receivedIdRetention     = 24 * time.Hour
+	receivedIdPruneInterval = time.Minute
+)
+
+// DeliveryStatus is the status of the delivery of a reliable message.
+type DeliveryStatus int
+
+const (
+	DeliveryPending DeliveryStatus = iota
+	DeliveryAcknowledged
+	DeliveryFailed
+)
+
+func (s DeliveryStatus) String() string {
+	switch s {
+	case DeliveryPending:
+		return "pending"
+	case DeliveryAcknowledged:
+		return "acknowledged"
+	case DeliveryFailed:
+		return "failed"
+	default:
+		return "unknown"
+	}
+}
+
+// delivery keeps the state of a reliable message, until it is acknowledged or fails.
+type delivery struct {
+	recipient     config.ClientConfig
+	message       []byte
+	messageType   string
+	status        DeliveryStatus
+	transmissions int
+	deadline      time.Time
+	replyIds      []string
+}
+
+// SendReliable sends the message to the client with the given id and requests an acknowledgement of the delivery.
+// If the acknowledgement does not arrive in time, the message is retransmitted along a fresh path.
+// The message is stored in the outbox until it is acknowledged, and SendReliable returns immediately
+// with the id of the message, which allows to check its delivery status.
+func (c *client) SendReliable(ctx context.Context, recipientId string, message []byte) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	recipient, err := c.findRecipient(recipientId)
+	if err != nil {
+		return "", err
+	}
+	messageId, err := c.addToOutbox(recipient, message, sphinx.RealMessageType, true, "")
+	if err != nil {
+		return "", err
+	}
+	c.deliveryOf(OutboxEntry{MessageId: messageId, Recipient: recipient, Payload: message, Type: sphinx.RealMessageType, Reliable: true})
+	return messageId, nil
+}
+
+// deliveryOf returns the delivery state of the reliable message from the outbox. The state is created
+// when the message is sent for the first time, also after a restart of the client.
+func (c *client) deliveryOf(entry OutboxEntry) *delivery {
+	c.deliveriesMutex.Lock()
+	defer c.deliveriesMutex.Unlock()
+
+	d, ok := c.deliveries[entry.MessageId]
+	if !ok {
+		d = &delivery{recipient: entry.Recipient, message: entry.Payload, messageType: entryType(entry), status: DeliveryPending}
+		c.deliveries[entry.MessageId] = d
+	}
+	return d
+}
+
+// isDispatched checks whether the message from the outbox was already sent
+// and awaits the acknowledgement.
+func (c *client) isDispatched(messageId string) bool {
+	c.deliveriesMutex.Lock()
+	defer c.deliveriesMutex.Unlock()
+
+	d, ok := c.deliveries[messageId]
+	return ok && d.transmissions > 0
+}
+
+// DeliveryStatus returns the delivery status of the reliable message with the given id.
+func (c *client) DeliveryStatus(messageId string) (DeliveryStatus, error) {
+	c.deliveriesMutex.Lock()
+	defer c.deliveriesMutex.Unlock()
+
+	d, ok := c.deliveries[messageId]
+	if !ok {
+		return DeliveryFailed, errors.New("no reliable message with the given id")
+	}
+	return d.status, nil
+}
+
+// transmit encodes the reliable message with a fresh path and reply block, and passes it to the outgoing queue.
+// The acknowledgement is expected within the timeout derived from the delays on the forward and reply paths,
+// extended by the expected time in which the recipient and the sender fetch their inboxes.
+func (c *client) transmit(ctx context.Context, messageId string, d *delivery) error {
+	packet, keys, delaySum, err := c.EncodeReliableMessage(messageId, d.messageType, d.message, d.recipient, c.ownConfig())
+	if err != nil {
+		logLocal.WithError(err).Error("Error in transmit - create sphinx packet returned an error")
+		return err
+	}
+
+	c.repliesMutex.Lock()
+	c.pendingReplies[string(keys.Id)] = keys
+	c.repliesMutex.Unlock()
+
+	err = c.enqueue(ctx, packet)
+	if err != nil {
+		c.forgetReplies([]string{string(keys.Id)})
+		return err
+	}
+
+	c.deliveriesMutex.Lock()
+	defer c.deliveriesMutex.Unlock()
+	d.transmissions++
+	d.deadline = time.Now().Add(c.ackTimeout(delaySum))
+	d.replyIds = append(d.replyIds, string(keys.Id))
+	return nil
+}
+
+func (c *client) ackTimeout(delaySum float64) time.Duration {
+	expected := delaySum + 2/c.Parameters().FetchRate
+	return time.Duration(expected * ackTimeoutFactor * float64(time.Second))
+}
+
+// controlRetransmissions periodically retransmits the reliable messages whose acknowledgement
+// did not arrive in time, and marks as failed the messages sent the maximum number of times.
+func (c *client) controlRetransmissions() {
+	for {
+		select {
+		case <-c.stop:
+			return
+		case <-time.After(retransmissionCheckInterval):
+		}
+
+		for messageId, d := range c.expiredDeliveries(time.Now()) {
+			err := c.transmit(context.Background(), messageId, d)
+			if err != nil {
+				logLocal.WithError(err).Error("Error during retransmission of reliable message")
+				continue
+			}
+			logLocal.Infof("Retransmitted reliable message %s", messageId)
+		}
+	}
+}
+
+// expiredDeliveries returns the pending deliveries which should be retransmitted. The deliveries which
+// reached the maximum number of transmissions are marked as failed.
+func (c *client) expiredDeliveries(now time.Time) map[string]*delivery {
+	c.deliveriesMutex.Lock()
+	defer c.deliveriesMutex.Unlock()
+
+	expired := make(map[string]*delivery)
+	for messageId, d := range c.deliveries {
+		if d.status != DeliveryPending || d.transmissions == 0 || now.Before(d.deadline) {
+			continue
+		}
+		if d.transmissions >= maxTransmissions {
+			d.status = DeliveryFailed
+			c.forgetReplies(d.replyIds)
+			c.removeFromOutbox(messageId)
+			logLocal.Warningf("Reliable message %s was not acknowledged", messageId)
+			continue
+		}
+		expired[messageId] = d
+	}
+	return expired
+}
+
+// acknowledge marks the reliable message as acknowledged and removes the keys of the remaining reply blocks.
+func (c *client) acknowledge(messageId string) {
+	c.deliveriesMutex.Lock()
+	defer c.deliveriesMutex.Unlock()
+
+	d, ok := c.deliveries[messageId]
+	if !ok || d.status != DeliveryPending {
+		return
+	}
+	d.status = DeliveryAcknowledged
+	c.forgetReplies(d.replyIds)
+	c.removeFromOutbox(messageId)
+	logLocal.Infof("Reliable message %s acknowledged", messageId)
+}
+
+func (c *client) removeFromOutbox(messageId string) {
+	if err := c.store.RemoveFromOutbox(messageId); err != nil {
+		logLocal.WithError(err).Error("Error in removing reliable message from the outbox")
+	}
+}
+
+func (c *client) forgetReplies(replyIds []string) {
+	c.repliesMutex.Lock()
+	defer c.repliesMutex.Unlock()
+
+	for _, replyId := range replyIds {
+		delete(c.pendingReplies, replyId)
+	}
+}
+
+// receiveReliable acknowledges the received reliable message, and returns false if the message is a duplicate
+// of a message already received, e.g., retransmitted because the previous acknowledgement was lost.
+// The acknowledgement is dropped if the queue of the acknowledgements is full, since the sender retransmits
+// the message and the duplicate is acknowledged again, hence the receiving of the packets is never blocked.
+func (c *client) receiveReliable(message config.ReliableMessage) bool {
+	ack, err := clientCore.EncodeAcknowledgement(message)
+	if err != nil {
+		logLocal.WithError(err).Error("Error in receive reliable - create acknowledgement returned an error")
+	} else {
+		select {
+		case c.ackQueue <- ack:
+		default:
+			logLocal.Warning("Acknowledgement queue full. Acknowledgement dropped")
+		}
+	}
+
+	c.deliveriesMutex.Lock()
+	defer c.deliveriesMutex.Unlock()
+
+	now := time.Now()
+	if now.Sub(c.receivedPruned) > receivedIdPruneInterval {
+		for messageId, receivedAt := range c.receivedIds {
+			if now.Sub(receivedAt) > receivedIdRetention {
+				delete(c.receivedIds, messageId)
+			}
+		}
+		c.receivedPruned = now
+	}
+	if _, ok := c.receivedIds[message.MessageId]; ok {
+		return false
+	}
+	c.receivedIds[message.MessageId] = now
+	return true
+}
+
+func newMessageId() (string, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(id), nil
+}
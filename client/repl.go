@@ -0,0 +1,173 @@
+// Copyright 2018 The Loopix-Messaging Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"bufio"
+	"context"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+)
+
+const replHelp = `Commands:
+  users                    list the users known from the PKI
+  send <id> <message>      send the message to the user with the given id
+  reliable <id> <message>  send the message and request an acknowledgement
+  delivery <messageId>     show the delivery status of a reliable message
+  status                   show the registration and the health of the loop traffic
+  help                     show this help
+  quit                     close the client`
+
+// repl is the interactive shell of the client. The output is shared by the commands
+// and the incoming messages and alerts, which are printed as they arrive.
+type repl struct {
+	client Client
+	mutex  sync.Mutex
+	out    io.Writer
+}
+
+// RunREPL runs the interactive shell of the client, which reads the commands from in
+// and writes to out, until the quit command or the end of the input. The messages
+// received by the client and the loop alerts are printed as they arrive, hence the client
+// should not be created with a receive callback. RunREPL does not close the client.
+func RunREPL(c Client, in io.Reader, out io.Writer) error {
+	r := &repl{client: c, out: out}
+	done := make(chan struct{})
+	defer close(done)
+	go r.printIncoming(done)
+
+	r.printf("%s\n", replHelp)
+	scanner := bufio.NewScanner(in)
+	for {
+		r.printf("> ")
+		if !scanner.Scan() {
+			return scanner.Err()
+		}
+		if !r.execute(scanner.Text()) {
+			return nil
+		}
+	}
+}
+
+// execute runs a single command, and returns false if the shell should quit.
+func (r *repl) execute(line string) bool {
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return true
+	}
+	command, args := fields[0], fields[1:]
+
+	switch command {
+	case "users":
+		contacts := r.client.Contacts()
+		if len(contacts) == 0 {
+			r.printf("No users known\n")
+		}
+		for _, contact := range contacts {
+			provider := "-"
+			if contact.Provider != nil {
+				provider = contact.Provider.Id
+			}
+			r.printf("%s (provider %s)\n", contact.Id, provider)
+		}
+
+	case "send", "reliable":
+		if len(args) < 2 {
+			r.printf("Usage: %s <id> <message>\n", command)
+			return true
+		}
+		// the message keeps its inner whitespace
+		rest := strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(line), command))
+		message := strings.TrimSpace(strings.TrimPrefix(rest, args[0]))
+		send := r.client.Send
+		if command == "reliable" {
+			send = r.client.SendReliable
+		}
+		messageId, err := send(context.Background(), args[0], []byte(message))
+		if err != nil {
+			r.printf("Error: %v\n", err)
+			return true
+		}
+		r.printf("Queued message %s\n", messageId)
+
+	case "delivery":
+		if len(args) != 1 {
+			r.printf("Usage: delivery <messageId>\n")
+			return true
+		}
+		status, err := r.client.DeliveryStatus(args[0])
+		if err != nil {
+			r.printf("Error: %v\n", err)
+			return true
+		}
+		r.printf("Message %s is %s\n", args[0], status)
+
+	case "status":
+		status := r.client.Status()
+		r.printf("Client %s, provider %s\n", status.Id, status.Provider)
+		if status.Registered {
+			r.printf("Registered, token %s\n", hex.EncodeToString(status.Token))
+		} else {
+			r.printf("Not registered\n")
+		}
+		loops := r.client.LoopStats()
+		r.printf("Loops sent %d, returned %d, lost %d, pending %d\n", loops.Sent, loops.Returned, loops.Lost, loops.Pending)
+		r.printf("Loss rate %.2f, average round trip %v\n", loops.LossRate, loops.AverageRTT)
+
+	case "help":
+		r.printf("%s\n", replHelp)
+
+	case "quit", "exit":
+		return false
+
+	default:
+		r.printf("Unknown command %q, type help for the list of commands\n", command)
+	}
+	return true
+}
+
+// printIncoming prints the received messages and the loop alerts, until the shell quits
+// or the client is closed.
+func (r *repl) printIncoming(done chan struct{}) {
+	received, alerts := r.client.Receive(), r.client.Alerts()
+	for received != nil || alerts != nil {
+		select {
+		case <-done:
+			return
+		case message, ok := <-received:
+			if !ok {
+				received = nil
+				continue
+			}
+			// The message is quoted, so that a sender cannot inject the escape sequences of the terminal.
+			r.printf("\n<< %q\n", message)
+		case alert, ok := <-alerts:
+			if !ok {
+				alerts = nil
+				continue
+			}
+			r.printf("\n!! Loss rate of loop messages %.2f over the last %d loops. Possible active attack.\n", alert.LossRate, alert.Window)
+		}
+	}
+}
+
+func (r *repl) printf(format string, args ...interface{}) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	fmt.Fprintf(r.out, format, args...)
+}
@@ -0,0 +1,420 @@
+// Copyright 2018 The Loopix-Messaging Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"anonymous-messaging/config"
+	"anonymous-messaging/helpers"
+	"anonymous-messaging/pki"
+	"anonymous-messaging/sphinx"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/protobuf/proto"
+
+	"bytes"
+	"database/sql"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Direction tells whether the message in the history was sent or received by the client.
+type Direction int
+
+const (
+	AnyDirection Direction = iota
+	Sent
+	Received
+)
+
+// memoryHistorySize is the number of the latest messages kept in the history of the memory store
+const memoryHistorySize = 10000
+
+// OutboxEntry is a message accepted by the client, which was not sent yet,
+// or, in case of a reliable message, was not acknowledged yet. The entries which are
+// a part of the fan-out to a group carry the id of the group; they are not recorded
+// in the history one by one, since the message to the group is recorded once.
+// The type is the sphinx message type of the payload, which tells the recipient
+// how to handle it.
+type OutboxEntry struct {
+	MessageId string
+	Recipient config.ClientConfig
+	Payload   []byte
+	Type      string
+	Reliable  bool
+	Group     string
+	Created   time.Time
+}
+
+// HistoryEntry is a message sent or received by the client. The sender of the received
+// messages is not known, hence their Peer is empty, except for the group messages, whose
+// Peer is the id of the group.
+type HistoryEntry struct {
+	MessageId string
+	Direction Direction
+	Peer      string
+	Payload   []byte
+	Time      time.Time
+}
+
+// HistoryQuery selects the messages from the history. The empty fields are not used
+// for the selection. The matching messages are returned from the oldest.
+type HistoryQuery struct {
+	MessageId string
+	Direction Direction
+	Peer      string
+	Contains  []byte
+	Since     time.Time
+	Limit     int
+}
+
+func (q HistoryQuery) matches(entry HistoryEntry) bool {
+	if q.MessageId != "" && q.MessageId != entry.MessageId {
+		return false
+	}
+	if q.Direction != AnyDirection && q.Direction != entry.Direction {
+		return false
+	}
+	if q.Peer != "" && q.Peer != entry.Peer {
+		return false
+	}
+	if q.Contains != nil && !bytes.Contains(entry.Payload, q.Contains) {
+		return false
+	}
+	return q.Since.IsZero() || !entry.Time.Before(q.Since)
+}
+
+// MessageStore keeps the outbox and the history of the messages of the client.
+type MessageStore interface {
+	AddToOutbox(entry OutboxEntry) error
+	RemoveFromOutbox(messageId string) error
+	Outbox() ([]OutboxEntry, error)
+	AddToHistory(entry HistoryEntry) error
+	SearchHistory(query HistoryQuery) ([]HistoryEntry, error)
+	Close() error
+}
+
+// memoryStore keeps the outbox and the history in memory, hence they are lost on restart.
+// The payloads are kept in plaintext, since they never leave the memory of the process, and
+// only the latest messages are kept in the history, so a long running client does not grow
+// without bounds. The older messages are dropped from the history.
+type memoryStore struct {
+	mutex   sync.Mutex
+	outbox  []OutboxEntry
+	history []HistoryEntry
+}
+
+// NewMemoryStore creates a message store, which is not persisted.
+func NewMemoryStore() MessageStore {
+	return &memoryStore{}
+}
+
+func (s *memoryStore) AddToOutbox(entry OutboxEntry) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.outbox = append(s.outbox, entry)
+	return nil
+}
+
+func (s *memoryStore) RemoveFromOutbox(messageId string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for i, entry := range s.outbox {
+		if entry.MessageId == messageId {
+			s.outbox = append(s.outbox[:i], s.outbox[i+1:]...)
+			return nil
+		}
+	}
+	return nil
+}
+
+func (s *memoryStore) Outbox() ([]OutboxEntry, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return append([]OutboxEntry{}, s.outbox...), nil
+}
+
+func (s *memoryStore) AddToHistory(entry HistoryEntry) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.history = append(s.history, entry)
+	if len(s.history) > memoryHistorySize {
+		s.history = append([]HistoryEntry{}, s.history[len(s.history)-memoryHistorySize:]...)
+	}
+	return nil
+}
+
+func (s *memoryStore) SearchHistory(query HistoryQuery) ([]HistoryEntry, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	var result []HistoryEntry
+	for _, entry := range s.history {
+		if query.matches(entry) {
+			result = append(result, entry)
+		}
+		if query.Limit > 0 && len(result) == query.Limit {
+			break
+		}
+	}
+	return result, nil
+}
+
+func (s *memoryStore) Close() error {
+	return nil
+}
+
+// sqliteStore keeps the outbox and the history in the SQLite database, which allows
+// the client to send the pending messages after a restart. The payloads are encrypted
+// with the key derived from the identity key of the client, so the database file does not
+// reveal the content of the messages. The ids, the peers, the directions and the times of
+// the messages are kept in plaintext, which allows to select the messages in the database,
+// hence the file still reveals with whom and when the client communicated. The search for
+// the content of the messages decrypts the payloads of the selected messages.
+type sqliteStore struct {
+	db  *sqlx.DB
+	key []byte
+}
+
+// StoreKeyFromPrivateKey derives the key, which the SQLite store uses to encrypt the payloads
+// of the messages, from the private key of the client.
+func StoreKeyFromPrivateKey(prvKey []byte) []byte {
+	return helpers.SHA256(append([]byte("message-store-key"), prvKey...))
+}
+
+// NewSQLiteStore opens the message store kept in the SQLite database at the given path,
+// and creates its tables if they do not exist yet. The payloads are encrypted with the given key,
+// see StoreKeyFromPrivateKey. The payloads stored in plaintext by the older versions of the client
+// are encrypted when the store is opened.
+func NewSQLiteStore(path string, key []byte) (MessageStore, error) {
+	db, err := pki.OpenDatabase(path, "sqlite3")
+	if err != nil {
+		return nil, err
+	}
+
+	outbox := map[string]string{"MessageId": "TEXT", "Recipient": "BLOB", "Payload": "BLOB", "Sealed": "INTEGER", "Type": "TEXT", "Reliable": "INTEGER", "GroupId": "TEXT", "Created": "INTEGER"}
+	if err := pki.CreateTable(db, "Outbox", outbox); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if err := addMissingColumn(db, "Outbox", "Type", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		db.Close()
+		return nil, err
+	}
+	history := map[string]string{"MessageId": "TEXT", "Direction": "INTEGER", "Peer": "TEXT", "Payload": "BLOB", "Sealed": "INTEGER", "Time": "INTEGER"}
+	if err := pki.CreateTable(db, "History", history); err != nil {
+		db.Close()
+		return nil, err
+	}
+	for _, table := range []string{"Outbox", "History"} {
+		if err := addMissingColumn(db, table, "Sealed", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+			db.Close()
+			return nil, err
+		}
+		if err := sealPlaintextPayloads(db, table, key); err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+	return &sqliteStore{db: db, key: key}, nil
+}
+
+// sealPlaintextPayloads encrypts the payloads, which were stored in plaintext by an older version of the client.
+func sealPlaintextPayloads(db *sqlx.DB, table string, key []byte) error {
+	rows, err := db.Query("SELECT idx, Payload FROM " + table + " WHERE Sealed = 0")
+	if err != nil {
+		return err
+	}
+	payloads := make(map[int64][]byte)
+	for rows.Next() {
+		var idx int64
+		var payload []byte
+		if err := rows.Scan(&idx, &payload); err != nil {
+			rows.Close()
+			return err
+		}
+		payloads[idx] = payload
+	}
+	err = rows.Err()
+	rows.Close()
+	if err != nil {
+		return err
+	}
+
+	for idx, payload := range payloads {
+		sealed, err := sphinx.SealWithKey(key, payload)
+		if err != nil {
+			return err
+		}
+		if _, err := db.Exec("UPDATE "+table+" SET Payload = ?, Sealed = 1 WHERE idx = ?", sealed, idx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addMissingColumn adds the column to the table created by an older version of the client.
+// The rows which existed before get the default value of the column.
+func addMissingColumn(db *sqlx.DB, table, column, definition string) error {
+	rows, err := db.Query("PRAGMA table_info(" + table + ")")
+	if err != nil {
+		return err
+	}
+	exists := false
+	for rows.Next() {
+		var cid, notNull, primaryKey int
+		var name, typ string
+		var defaultValue sql.NullString
+		if err := rows.Scan(&cid, &name, &typ, &notNull, &defaultValue, &primaryKey); err != nil {
+			rows.Close()
+			return err
+		}
+		exists = exists || name == column
+	}
+	err = rows.Err()
+	rows.Close()
+	if err != nil || exists {
+		return err
+	}
+
+	_, err = db.Exec("ALTER TABLE " + table + " ADD COLUMN " + column + " " + definition)
+	return err
+}
+
+func (s *sqliteStore) AddToOutbox(entry OutboxEntry) error {
+	recipient, err := proto.Marshal(&entry.Recipient)
+	if err != nil {
+		return err
+	}
+	payload, err := sphinx.SealWithKey(s.key, entry.Payload)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.Exec("INSERT INTO Outbox (MessageId, Recipient, Payload, Sealed, Type, Reliable, GroupId, Created) VALUES (?, ?, ?, 1, ?, ?, ?, ?)",
+		entry.MessageId, recipient, payload, entry.Type, entry.Reliable, entry.Group, entry.Created.UnixNano())
+	return err
+}
+
+func (s *sqliteStore) RemoveFromOutbox(messageId string) error {
+	_, err := s.db.Exec("DELETE FROM Outbox WHERE MessageId = ?", messageId)
+	return err
+}
+
+func (s *sqliteStore) Outbox() ([]OutboxEntry, error) {
+	rows, err := s.db.Query("SELECT MessageId, Recipient, Payload, Type, Reliable, GroupId, Created FROM Outbox ORDER BY idx")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var entries []OutboxEntry
+	for rows.Next() {
+		var entry OutboxEntry
+		var recipient, payload []byte
+		var created int64
+		if err := rows.Scan(&entry.MessageId, &recipient, &payload, &entry.Type, &entry.Reliable, &entry.Group, &created); err != nil {
+			return nil, err
+		}
+		if err := proto.Unmarshal(recipient, &entry.Recipient); err != nil {
+			return nil, err
+		}
+		entry.Payload, err = sphinx.OpenWithKey(s.key, payload)
+		if err != nil {
+			return nil, err
+		}
+		entry.Created = time.Unix(0, created)
+		entries = append(entries, entry)
+	}
+	return entries, rows.Err()
+}
+
+func (s *sqliteStore) AddToHistory(entry HistoryEntry) error {
+	payload, err := sphinx.SealWithKey(s.key, entry.Payload)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.Exec("INSERT INTO History (MessageId, Direction, Peer, Payload, Sealed, Time) VALUES (?, ?, ?, ?, 1, ?)",
+		entry.MessageId, entry.Direction, entry.Peer, payload, entry.Time.UnixNano())
+	return err
+}
+
+func (s *sqliteStore) SearchHistory(query HistoryQuery) ([]HistoryEntry, error) {
+	var conditions []string
+	var args []interface{}
+	if query.MessageId != "" {
+		conditions = append(conditions, "MessageId = ?")
+		args = append(args, query.MessageId)
+	}
+	if query.Direction != AnyDirection {
+		conditions = append(conditions, "Direction = ?")
+		args = append(args, query.Direction)
+	}
+	if query.Peer != "" {
+		conditions = append(conditions, "Peer = ?")
+		args = append(args, query.Peer)
+	}
+	if !query.Since.IsZero() {
+		conditions = append(conditions, "Time >= ?")
+		args = append(args, query.Since.UnixNano())
+	}
+
+	statement := "SELECT MessageId, Direction, Peer, Payload, Time FROM History"
+	if len(conditions) > 0 {
+		statement += " WHERE " + strings.Join(conditions, " AND ")
+	}
+	statement += " ORDER BY idx"
+	// the payloads are encrypted, hence the content is searched after the decryption
+	if query.Limit > 0 && query.Contains == nil {
+		statement += " LIMIT ?"
+		args = append(args, query.Limit)
+	}
+
+	rows, err := s.db.Query(statement, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var entries []HistoryEntry
+	for rows.Next() {
+		var entry HistoryEntry
+		var payload []byte
+		var timestamp int64
+		if err := rows.Scan(&entry.MessageId, &entry.Direction, &entry.Peer, &payload, &timestamp); err != nil {
+			return nil, err
+		}
+		entry.Payload, err = sphinx.OpenWithKey(s.key, payload)
+		if err != nil {
+			return nil, err
+		}
+		if query.Contains != nil && !bytes.Contains(entry.Payload, query.Contains) {
+			continue
+		}
+		entry.Time = time.Unix(0, timestamp)
+		entries = append(entries, entry)
+		if query.Limit > 0 && len(entries) == query.Limit {
+			break
+		}
+	}
+	return entries, rows.Err()
+}
+
+func (s *sqliteStore) Close() error {
+	return s.db.Close()
+}
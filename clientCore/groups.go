@@ -0,0 +1,192 @@
+// Copyright 2018 The Loopix-Messaging Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package clientCore
+
+import (
+	"anonymous-messaging/config"
+	"anonymous-messaging/sphinx"
+
+	"github.com/protobuf/proto"
+
+	"crypto/aes"
+	"crypto/cipher"
+	crand "crypto/rand"
+	"encoding/binary"
+	"errors"
+	"strings"
+)
+
+const (
+	// groupKeySize is the size of the shared AES-256 key of a group
+	groupKeySize = 32
+	// groupIdSeparator separates the id of the creator of the group from the name of the group
+	groupIdSeparator = "/"
+)
+
+// NewGroupKey generates a fresh shared key of a group.
+func NewGroupKey() ([]byte, error) {
+	key := make([]byte, groupKeySize)
+	if _, err := crand.Read(key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// GroupId returns the id of the group with the given name created by the given client. The id of the group
+// starts with the id of its creator, hence only the creator can sign the valid invitations to the group.
+func GroupId(creatorId, name string) string {
+	return creatorId + groupIdSeparator + name
+}
+
+// GroupCreator returns the id of the creator of the group with the given id, or an empty string
+// if the id of the group is malformed.
+func GroupCreator(groupId string) string {
+	i := strings.Index(groupId, groupIdSeparator)
+	if i <= 0 || i == len(groupId)-1 {
+		return ""
+	}
+	return groupId[:i]
+}
+
+// SignGroupInvite signs the invitation with the given signing function of the creator of the group.
+func SignGroupInvite(invite config.GroupInvite, sign func([]byte) ([]byte, error)) (config.GroupInvite, error) {
+	data, err := groupInviteSignedData(invite)
+	if err != nil {
+		return config.GroupInvite{}, err
+	}
+	invite.Signature, err = sign(data)
+	if err != nil {
+		return config.GroupInvite{}, err
+	}
+	return invite, nil
+}
+
+// VerifyGroupInvite checks the signature of the invitation against the given public key of the creator of the group.
+func VerifyGroupInvite(invite config.GroupInvite, creatorKey []byte) bool {
+	data, err := groupInviteSignedData(invite)
+	if err != nil {
+		return false
+	}
+	return sphinx.Verify(creatorKey, data, invite.Signature)
+}
+
+func groupInviteSignedData(invite config.GroupInvite) ([]byte, error) {
+	invite.Signature = nil
+	data, err := proto.Marshal(&invite)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte("group-invite"), data...), nil
+}
+
+// EncodeGroupInvite encodes the invitation of a new member to the group. The invitation carries
+// the key of the group, hence it is sealed to the public key of the new member. The invitation
+// is sent with the group invite message type.
+func EncodeGroupInvite(invite config.GroupInvite, recipientKey []byte) ([]byte, error) {
+	data, err := proto.Marshal(&invite)
+	if err != nil {
+		return nil, err
+	}
+	sealed, err := sphinx.SealToPublicKey(recipientKey, data)
+	if err != nil {
+		return nil, err
+	}
+	return sealed, nil
+}
+
+// DecodeGroupInvite decodes the received payload of a group invitation sealed to the client.
+// DecodeGroupInvite returns false if the payload cannot be opened or decoded.
+// The signature of the invitation is not checked.
+func (c *CryptoClient) DecodeGroupInvite(payload []byte) (config.GroupInvite, bool) {
+	data, err := sphinx.OpenSealed(c.prvKey, payload)
+	if err != nil {
+		return config.GroupInvite{}, false
+	}
+	var invite config.GroupInvite
+	if err := proto.Unmarshal(data, &invite); err != nil {
+		return config.GroupInvite{}, false
+	}
+	return invite, true
+}
+
+// SealGroupMessage encrypts the content with the key of the given epoch of the group, and encodes
+// the resulting group message. The id and the epoch of the group are authenticated with the content,
+// so the message cannot be replayed into another group or epoch. The group message is sent with the
+// group message type.
+func SealGroupMessage(key []byte, groupId string, epoch uint64, content config.GroupContent) ([]byte, error) {
+	plaintext, err := proto.Marshal(&content)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newGroupAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := crand.Read(nonce); err != nil {
+		return nil, err
+	}
+	message := config.GroupMessage{
+		GroupId:    groupId,
+		Epoch:      epoch,
+		Nonce:      nonce,
+		Ciphertext: aead.Seal(nil, nonce, plaintext, groupAdditionalData(groupId, epoch)),
+	}
+	return proto.Marshal(&message)
+}
+
+// DecodeGroupMessage decodes the received payload of a group message. DecodeGroupMessage returns
+// false if the payload cannot be decoded.
+func DecodeGroupMessage(payload []byte) (config.GroupMessage, bool) {
+	var message config.GroupMessage
+	if err := proto.Unmarshal(payload, &message); err != nil {
+		return config.GroupMessage{}, false
+	}
+	return message, true
+}
+
+// OpenGroupMessage decrypts the content of the group message with the key of the group.
+func OpenGroupMessage(key []byte, message config.GroupMessage) (config.GroupContent, error) {
+	aead, err := newGroupAEAD(key)
+	if err != nil {
+		return config.GroupContent{}, err
+	}
+	if len(message.Nonce) != aead.NonceSize() {
+		return config.GroupContent{}, errors.New("the group message is malformed")
+	}
+	plaintext, err := aead.Open(nil, message.Nonce, message.Ciphertext, groupAdditionalData(message.GroupId, message.Epoch))
+	if err != nil {
+		return config.GroupContent{}, errors.New("the group message cannot be decrypted with the group key")
+	}
+	var content config.GroupContent
+	if err := proto.Unmarshal(plaintext, &content); err != nil {
+		return config.GroupContent{}, err
+	}
+	return content, nil
+}
+
+func newGroupAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func groupAdditionalData(groupId string, epoch uint64) []byte {
+	data := make([]byte, 8, 8+len(groupId))
+	binary.BigEndian.PutUint64(data, epoch)
+	return append(data, groupId...)
+}
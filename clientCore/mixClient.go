@@ -28,14 +28,23 @@ import (
 	"github.com/protobuf/proto"
 
 	"crypto/elliptic"
-	"errors"
+	crand "crypto/rand"
+	"encoding/binary"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 var logLocal = logging.PackageLogger()
 
+// NetworkPKI is the view of the network from the network document of the epoch. The digest identifies
+// the document, hence the clients with the same epoch and digest build the paths from the same view.
 type NetworkPKI struct {
 	Mixes   []config.MixConfig
 	Clients []config.ClientConfig
+	Epoch   uint64
+	Digest  []byte
 }
 
 type MixClient interface {
@@ -45,17 +54,21 @@ type MixClient interface {
 }
 
 type CryptoClient struct {
-	pubKey   []byte
-	prvKey   []byte
-	curve    elliptic.Curve
-	Provider config.MixConfig
-	Network  NetworkPKI
-}
+	pubKey []byte
+	prvKey []byte
+	curve  elliptic.Curve
+	// provider holds the config.MixConfig of the current provider, which is replaced on failover and migration
+	provider atomic.Value
+	// network holds the current NetworkPKI, which is replaced as a whole on each refresh
+	network atomic.Value
 
-const (
-	desiredRateParameter = 5
-	pathLength           = 2
-)
+	paramsMutex sync.RWMutex
+	params      config.ClientParameters
+
+	pathMutex  sync.Mutex
+	pathPolicy PathPolicy
+	pathRand   *rand.Rand
+}
 
 // CreateSphinxPacket responsible for sending a real message. Takes as input the message string
 // and the public information about the destination.
@@ -63,59 +76,72 @@ const (
 // Given those values it triggers the encode function, which packs the message into the
 // sphinx cryptographic packet format. Next, the encoded packet is combined with a
 // flag signaling that this is a usual network packet, and passed to be send.
-// The function returns an error if any issues occurred.
-func (c *CryptoClient) createSphinxPacket(message string, recipient config.ClientConfig) ([]byte, error) {
+// The function returns the packet and the sum of the delays on its path,
+// or an error if any issues occurred.
+func (c *CryptoClient) createSphinxPacket(message string, recipient config.ClientConfig, messageType string) ([]byte, float64, error) {
 
 	path, err := c.buildPath(recipient)
 	if err != nil {
 		logLocal.WithError(err).Error("Error in CreateSphinxPacket - generating random path failed")
-		return nil, err
+		return nil, 0, err
 	}
 
-	delays, err := c.generateDelaySequence(desiredRateParameter, path.Len())
+	delays, err := c.generateDelaySequence(c.Parameters().MixDelayRate, path.Len())
 	if err != nil {
 		logLocal.WithError(err).Error("Error in CreateSphinxPacket - generating sequence of delays failed")
-		return nil, err
+		return nil, 0, err
 	}
 
-	sphinxPacket, err := sphinx.PackForwardMessage(c.curve, path, delays, message)
+	sphinxPacket, err := sphinx.PackForwardMessage(c.curve, path, delays, message, messageType)
 	if err != nil {
 		logLocal.WithError(err).Error("Error in CreateSphinxPacket - the pack procedure failed")
-		return nil, err
+		return nil, 0, err
 	}
 
-	return proto.Marshal(&sphinxPacket)
+	packetBytes, err := proto.Marshal(&sphinxPacket)
+	if err != nil {
+		return nil, 0, err
+	}
+	return packetBytes, sum(delays), nil
 }
 
 // buildPath builds a path containing the sender's provider,
 // a sequence (of length pre-defined in a config file) of randomly
 // selected mixes and the recipient's provider
 func (c *CryptoClient) buildPath(recipient config.ClientConfig) (config.E2EPath, error) {
-	mixSeq, err := c.getRandomMixSequence(c.Network.Mixes, pathLength)
+	mixSeq, err := c.getRandomMixSequence(c.Network().Mixes, c.Parameters().PathLength)
 	if err != nil {
 		logLocal.WithError(err).Error("Error in buildPath - generating random mix path failed")
 		return config.E2EPath{}, err
 	}
-	path := config.E2EPath{IngressProvider: c.Provider, Mixes: mixSeq, EgressProvider: *recipient.Provider, Recipient: recipient}
+	path := config.E2EPath{IngressProvider: c.Provider(), Mixes: mixSeq, EgressProvider: *recipient.Provider, Recipient: recipient}
 	return path, nil
 }
 
-// getRandomMixSequence generates a random sequence of given length from all possible mixes.
-// If the list of all active mixes is empty or the given length is larger than the set of active mixes,
-// an error is returned.
+// getRandomMixSequence generates a random sequence of given length from all possible mixes,
+// following the path policy of the client. If the list of all active mixes is empty or
+// the policy cannot be satisfied, an error is returned.
 func (c *CryptoClient) getRandomMixSequence(mixes []config.MixConfig, length int) ([]config.MixConfig, error) {
-	if len(mixes) == 0 || mixes == nil {
-		return nil, errors.New("cannot take a mix sequence from an empty list")
+	c.pathMutex.Lock()
+	defer c.pathMutex.Unlock()
+
+	randomSeq, err := c.pathPolicy.SelectMixes(mixes, length, c.pathRand)
+	if err != nil {
+		logLocal.WithError(err).Error("Error in getRandomMixSequence - sampling procedure failed")
+		return nil, err
 	}
-	if length > len(mixes) {
-		return mixes, nil
-	} else {
-		randomSeq, err := helpers.RandomSample(mixes, length)
-		if err != nil {
-			logLocal.WithError(err).Error("Error in getRandomMixSequence - sampling procedure failed")
-			return nil, err
-		}
-		return randomSeq, nil
+	return randomSeq, nil
+}
+
+// SetPathPolicy sets the policy selecting the mixes on the paths of the packets, and the source
+// of randomness used by the policy. If the source is nil, the current source is kept.
+func (c *CryptoClient) SetPathPolicy(policy PathPolicy, source rand.Source) {
+	c.pathMutex.Lock()
+	defer c.pathMutex.Unlock()
+
+	c.pathPolicy = policy
+	if source != nil {
+		c.pathRand = rand.New(source)
 	}
 }
 
@@ -136,11 +162,12 @@ func (c *CryptoClient) generateDelaySequence(desiredRateParameter float64, lengt
 }
 
 // EncodeMessage encodes given message into the Sphinx packet format. EncodeMessage takes as inputs
-// the message and the recipient's public configuration.
+// the message, the recipient's public configuration and the type of the message, which is
+// revealed only to the recipient's provider.
 // EncodeMessage returns the byte representation of the packet or an error if the packet could not be created.
-func (c *CryptoClient) EncodeMessage(message string, recipient config.ClientConfig) ([]byte, error) {
+func (c *CryptoClient) EncodeMessage(message string, recipient config.ClientConfig, messageType string) ([]byte, error) {
 
-	packet, err := c.createSphinxPacket(message, recipient)
+	packet, _, err := c.createSphinxPacket(message, recipient, messageType)
 	if err != nil {
 		logLocal.WithError(err).Error("Error in EncodeMessage - the pack procedure failed")
 		return nil, err
@@ -148,16 +175,211 @@ func (c *CryptoClient) EncodeMessage(message string, recipient config.ClientConf
 	return packet, err
 }
 
+// CreateReplyBlock creates a reply block, which allows to send a reply to the given recipient
+// without learning its identity. The reply travels from the given first hop, through a random sequence
+// of mixes, to the recipient's provider. CreateReplyBlock returns the reply block, which is attached to
+// the request, and the keys which the recipient needs to decrypt the reply.
+func (c *CryptoClient) CreateReplyBlock(firstHop config.MixConfig, recipient config.ClientConfig) (sphinx.ReplyBlock, sphinx.ReplyKeys, error) {
+	block, keys, _, err := c.createReplyBlock(firstHop, recipient, sphinx.RealMessageType)
+	return block, keys, err
+}
+
+// createReplyBlock creates a reply block of the given message type and returns it together with the sum
+// of the delays on the reply path.
+func (c *CryptoClient) createReplyBlock(firstHop config.MixConfig, recipient config.ClientConfig, messageType string) (sphinx.ReplyBlock, sphinx.ReplyKeys, float64, error) {
+	mixSeq, err := c.getRandomMixSequence(c.Network().Mixes, c.Parameters().PathLength)
+	if err != nil {
+		logLocal.WithError(err).Error("Error in CreateReplyBlock - generating random mix path failed")
+		return sphinx.ReplyBlock{}, sphinx.ReplyKeys{}, 0, err
+	}
+	path := config.E2EPath{IngressProvider: firstHop, Mixes: mixSeq, EgressProvider: *recipient.Provider, Recipient: recipient}
+
+	delays, err := c.generateDelaySequence(c.Parameters().MixDelayRate, path.Len())
+	if err != nil {
+		logLocal.WithError(err).Error("Error in CreateReplyBlock - generating sequence of delays failed")
+		return sphinx.ReplyBlock{}, sphinx.ReplyKeys{}, 0, err
+	}
+
+	block, keys, err := sphinx.CreateReplyBlock(c.curve, path, delays, messageType)
+	if err != nil {
+		return sphinx.ReplyBlock{}, sphinx.ReplyKeys{}, 0, err
+	}
+	return block, keys, sum(delays), nil
+}
+
+// EncodeServiceRequest encodes the request to the given service hosted by a provider into the Sphinx packet format.
+// The request carries a reply block, which allows the service to reply to the sender.
+// EncodeServiceRequest returns the byte representation of the packet and the keys needed to decrypt the reply,
+// or an error if the packet could not be created.
+func (c *CryptoClient) EncodeServiceRequest(payload []byte, service config.ClientConfig, sender config.ClientConfig) ([]byte, sphinx.ReplyKeys, error) {
+	block, keys, err := c.CreateReplyBlock(*service.Provider, sender)
+	if err != nil {
+		logLocal.WithError(err).Error("Error in EncodeServiceRequest - creating reply block failed")
+		return nil, sphinx.ReplyKeys{}, err
+	}
+	blockBytes, err := proto.Marshal(&block)
+	if err != nil {
+		return nil, sphinx.ReplyKeys{}, err
+	}
+	request, err := proto.Marshal(&config.ServiceRequest{Payload: payload, ReplyBlock: blockBytes})
+	if err != nil {
+		return nil, sphinx.ReplyKeys{}, err
+	}
+
+	packet, _, err := c.createSphinxPacket(string(request), service, sphinx.RealMessageType)
+	if err != nil {
+		logLocal.WithError(err).Error("Error in EncodeServiceRequest - the pack procedure failed")
+		return nil, sphinx.ReplyKeys{}, err
+	}
+	return packet, keys, nil
+}
+
+// EncodeReliableMessage encodes the message with the given id and type into the Sphinx packet format. The message
+// carries a reply block, which the recipient's client uses to acknowledge the delivery. The reply path starts at the
+// recipient's provider. EncodeReliableMessage returns the byte representation of the packet, the keys needed
+// to decrypt the acknowledgement and the sum of the delays on the forward and the reply paths, or an error
+// if the packet could not be created.
+func (c *CryptoClient) EncodeReliableMessage(messageId string, messageType string, message []byte, recipient config.ClientConfig, sender config.ClientConfig) ([]byte, sphinx.ReplyKeys, float64, error) {
+	block, keys, replyDelay, err := c.createReplyBlock(*recipient.Provider, sender, sphinx.AcknowledgementType)
+	if err != nil {
+		logLocal.WithError(err).Error("Error in EncodeReliableMessage - creating reply block failed")
+		return nil, sphinx.ReplyKeys{}, 0, err
+	}
+	blockBytes, err := proto.Marshal(&block)
+	if err != nil {
+		return nil, sphinx.ReplyKeys{}, 0, err
+	}
+	envelope, err := proto.Marshal(&config.ReliableMessage{MessageId: messageId, Payload: message, ReplyBlock: blockBytes, Type: messageType})
+	if err != nil {
+		return nil, sphinx.ReplyKeys{}, 0, err
+	}
+
+	packet, forwardDelay, err := c.createSphinxPacket(string(envelope), recipient, sphinx.ReliableMessageType)
+	if err != nil {
+		logLocal.WithError(err).Error("Error in EncodeReliableMessage - the pack procedure failed")
+		return nil, sphinx.ReplyKeys{}, 0, err
+	}
+	return packet, keys, forwardDelay + replyDelay, nil
+}
+
+// DecodeReliableMessage decodes the received payload of a message of the reliable message type.
+// DecodeReliableMessage returns false if the payload cannot be decoded.
+func DecodeReliableMessage(payload []byte) (config.ReliableMessage, bool) {
+	var message config.ReliableMessage
+	if err := proto.Unmarshal(payload, &message); err != nil {
+		return config.ReliableMessage{}, false
+	}
+	return message, true
+}
+
+// EncodeAcknowledgement encodes the acknowledgement of the given reliable message into the Sphinx packet format,
+// using the reply block attached to the message. The payload is the id of the message, and the reply block
+// marks the reply as an acknowledgement. The packet should be sent to the first hop of the reply block,
+// which is the provider of the recipient.
+func EncodeAcknowledgement(message config.ReliableMessage) ([]byte, error) {
+	var block sphinx.ReplyBlock
+	if err := proto.Unmarshal(message.ReplyBlock, &block); err != nil {
+		return nil, err
+	}
+	packet, err := sphinx.PackReplyMessage(block, []byte(message.MessageId))
+	if err != nil {
+		logLocal.WithError(err).Error("Error in EncodeAcknowledgement - the pack procedure failed")
+		return nil, err
+	}
+	return proto.Marshal(&packet)
+}
+
+func sum(values []float64) float64 {
+	var total float64
+	for _, v := range values {
+		total += v
+	}
+	return total
+}
+
 // DecodeMessage decodes the received sphinx packet.
 // TODO: this function is finished yet.
 func (c *CryptoClient) DecodeMessage(packet sphinx.SphinxPacket) (sphinx.SphinxPacket, error) {
 	return packet, nil
 }
 
+// OpenStoredMessage decrypts the message, which the provider stored in the client's inbox
+// sealed to the client's public key. OpenStoredMessage returns the type of the message,
+// passed on by the provider, and the packet.
+func (c *CryptoClient) OpenStoredMessage(sealed []byte) (string, []byte, error) {
+	opened, err := sphinx.OpenSealed(c.prvKey, sealed)
+	if err != nil {
+		return "", nil, err
+	}
+	return sphinx.SplitTypedMessage(opened)
+}
+
+// Parameters returns the current traffic parameters of the client.
+func (c *CryptoClient) Parameters() config.ClientParameters {
+	c.paramsMutex.RLock()
+	defer c.paramsMutex.RUnlock()
+
+	return c.params
+}
+
+// SetParameters replaces the traffic parameters of the client. The new parameters are used
+// for the packets created after the call. SetParameters returns an error, and keeps
+// the current parameters, if the new parameters are out of the sane ranges.
+func (c *CryptoClient) SetParameters(params config.ClientParameters) error {
+	if err := params.Validate(); err != nil {
+		return err
+	}
+	c.paramsMutex.Lock()
+	defer c.paramsMutex.Unlock()
+
+	c.params = params
+	return nil
+}
+
+// Provider returns the current provider of the client.
+func (c *CryptoClient) Provider() config.MixConfig {
+	return c.provider.Load().(config.MixConfig)
+}
+
+// SetProvider atomically replaces the provider of the client.
+func (c *CryptoClient) SetProvider(provider config.MixConfig) {
+	c.provider.Store(provider)
+}
+
+// Network returns the current view of the network. The view is replaced as a whole by SetNetwork,
+// hence it can be read concurrently with the refreshes, but it should not be modified.
+func (c *CryptoClient) Network() NetworkPKI {
+	return c.network.Load().(NetworkPKI)
+}
+
+// SetNetwork atomically replaces the view of the network.
+func (c *CryptoClient) SetNetwork(network NetworkPKI) {
+	c.network.Store(network)
+}
+
 func (c *CryptoClient) GetPublicKey() []byte {
 	return c.pubKey
 }
 
+// Sign signs the message with the identity key of the client.
+func (c *CryptoClient) Sign(message []byte) ([]byte, error) {
+	return sphinx.Sign(c.prvKey, message)
+}
+
+// newSeededSource returns a source of randomness seeded from the cryptographic source,
+// hence the clients created at the same time select different paths.
+func newSeededSource() rand.Source {
+	var seed [8]byte
+	if _, err := crand.Read(seed[:]); err != nil {
+		return rand.NewSource(time.Now().UnixNano())
+	}
+	return rand.NewSource(int64(binary.BigEndian.Uint64(seed[:])))
+}
+
 func NewCryptoClient(pubKey, privKey []byte, curve elliptic.Curve, provider config.MixConfig, network NetworkPKI) *CryptoClient {
-	return &CryptoClient{pubKey: pubKey, prvKey: privKey, curve: curve, Provider: provider, Network: network}
+	c := &CryptoClient{pubKey: pubKey, prvKey: privKey, curve: curve, params: config.DefaultClientParameters(),
+		pathPolicy: UniformPolicy{}, pathRand: rand.New(newSeededSource())}
+	c.SetProvider(provider)
+	c.SetNetwork(network)
+	return c
 }
@@ -20,11 +20,14 @@ import (
 
 	"github.com/stretchr/testify/assert"
 
+	"bytes"
 	"crypto/elliptic"
 	"errors"
 	"fmt"
+	"math/rand"
 	"os"
 	"reflect"
+	"sort"
 	"strconv"
 	"testing"
 )
@@ -63,8 +66,7 @@ func Setup() error {
 	m1 := config.MixConfig{Id: "Mix1", Host: "localhost", Port: "3330", PubKey: pub1}
 	m2 := config.MixConfig{Id: "Mix2", Host: "localhost", Port: "3331", PubKey: pub2}
 
-	client.Network = NetworkPKI{}
-	client.Network.Mixes = []config.MixConfig{m1, m2}
+	client.SetNetwork(NetworkPKI{Mixes: []config.MixConfig{m1, m2}})
 
 	return nil
 }
@@ -92,9 +94,9 @@ func TestCryptoClient_EncodeMessage(t *testing.T) {
 		t.Fatal(err)
 	}
 	recipient := config.ClientConfig{Id: "Recipient", Host: "localhost", Port: "9999", PubKey: pubD, Provider: &provider}
-	client.Provider = provider
+	client.SetProvider(provider)
 
-	encoded, err := client.EncodeMessage("Hello world", recipient)
+	encoded, err := client.EncodeMessage("Hello world", recipient, sphinx.RealMessageType)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -158,3 +160,236 @@ func Test_GetRandomMixSequence_FailNonList(t *testing.T) {
 	_, err := client.getRandomMixSequence(nil, 6)
 	assert.EqualError(t, errors.New("cannot take a mix sequence from an empty list"), err.Error(), "")
 }
+
+func TestCryptoClient_OpenStoredMessage(t *testing.T) {
+	sealed, err := sphinx.SealToPublicKey(client.GetPublicKey(), sphinx.TypedMessage(sphinx.ReliableMessageType, []byte("Stored message")))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	messageType, opened, err := client.OpenStoredMessage(sealed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, sphinx.ReliableMessageType, messageType, "The type stored by the provider should be returned")
+	assert.Equal(t, []byte("Stored message"), opened)
+
+	untyped, err := sphinx.SealToPublicKey(client.GetPublicKey(), []byte("Stored message"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = client.OpenStoredMessage(untyped)
+	assert.EqualError(t, err, "the message does not carry a known type")
+}
+
+func TestCryptoClient_EncodeServiceRequest(t *testing.T) {
+	pubP, _, err := sphinx.GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	provider := config.MixConfig{Id: "Provider", Host: "localhost", Port: "3331", PubKey: pubP}
+	client.SetProvider(provider)
+
+	service := config.ClientConfig{Id: "echo", Host: "localhost", Port: "3331", PubKey: pubP, Provider: &provider}
+	sender := config.ClientConfig{Id: "Sender", Host: "localhost", Port: "9999", PubKey: client.GetPublicKey(), Provider: &provider}
+
+	encoded, keys, err := client.EncodeServiceRequest([]byte("Ping"), service, sender)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, reflect.TypeOf([]byte{}), reflect.TypeOf(encoded))
+	assert.NotEmpty(t, keys.Id)
+	assert.Equal(t, 5, len(keys.Keys), "The reply keys should contain the payload key and a key of each hop")
+}
+
+func TestCryptoClient_SetParameters_PathLength(t *testing.T) {
+	provider := config.MixConfig{Id: "Provider", Host: "localhost", Port: "3331"}
+	recipient := config.ClientConfig{Id: "Recipient", Host: "localhost", Port: "9999", Provider: &provider}
+
+	params := config.DefaultClientParameters()
+	params.PathLength = 1
+	err := client.SetParameters(params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.SetParameters(config.DefaultClientParameters())
+
+	path, err := client.buildPath(recipient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 1, len(path.Mixes))
+}
+
+func testPolicyMixes() []config.MixConfig {
+	return []config.MixConfig{
+		{Id: "Mix1", Host: "host1", Operator: "Alice", Capacity: 1},
+		{Id: "Mix2", Host: "host1", Operator: "Bob", Capacity: 1},
+		{Id: "Mix3", Host: "host2", Operator: "Alice", Capacity: 1},
+		{Id: "Mix4", Host: "host3", Operator: "Carol", Capacity: 1000},
+	}
+}
+
+func TestUniformPolicy_Deterministic(t *testing.T) {
+	first, err := UniformPolicy{}.SelectMixes(mixes, 3, rand.New(rand.NewSource(42)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := UniformPolicy{}.SelectMixes(mixes, 3, rand.New(rand.NewSource(42)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, first, second, "The same seed should give the same path")
+	assert.Equal(t, 3, len(first))
+}
+
+func TestDiversePolicy(t *testing.T) {
+	for seed := int64(0); seed < 50; seed++ {
+		sequence, err := DiversePolicy{}.SelectMixes(testPolicyMixes(), 2, rand.New(rand.NewSource(seed)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.NotEqual(t, sequence[0].Host, sequence[1].Host, "The mixes on the path should run on distinct hosts")
+		assert.NotEqual(t, sequence[0].Operator, sequence[1].Operator, "The mixes on the path should have distinct operators")
+	}
+
+	_, err := DiversePolicy{}.SelectMixes(testPolicyMixes(), 4, rand.New(rand.NewSource(1)))
+	assert.EqualError(t, err, "not enough mixes satisfying the path policy")
+}
+
+func TestCapacityPolicy(t *testing.T) {
+	rng := rand.New(rand.NewSource(7))
+	var chosen int
+	for i := 0; i < 1000; i++ {
+		sequence, err := CapacityPolicy{}.SelectMixes(testPolicyMixes(), 1, rng)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sequence[0].Id == "Mix4" {
+			chosen++
+		}
+	}
+	assert.True(t, chosen > 450, "The mix with the largest capacity should be chosen most often")
+	assert.True(t, chosen < 700, "The advertised capacity should be capped")
+}
+
+func TestCappedCapacityWeight(t *testing.T) {
+	mixes := testPolicyMixes()
+	weight := cappedCapacityWeight(mixes)
+	assert.Equal(t, 1.0, weight(mixes[0]))
+	assert.Equal(t, float64(capacityCapFactor), weight(mixes[3]), "The capacity should be capped relative to the median")
+	assert.Equal(t, 1.0, weight(config.MixConfig{Id: "Mix5"}), "The mixes without the capacity should have the unit weight")
+}
+
+func TestExcludePolicy(t *testing.T) {
+	policy := ExcludePolicy{Excluded: []string{"Mix1", "Mix4"}, Policy: UniformPolicy{}}
+	sequence, err := policy.SelectMixes(testPolicyMixes(), 2, rand.New(rand.NewSource(1)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := []string{sequence[0].Id, sequence[1].Id}
+	sort.Strings(ids)
+	assert.Equal(t, []string{"Mix2", "Mix3"}, ids)
+
+	policy.Excluded = []string{"Mix1", "Mix2", "Mix3", "Mix4"}
+	_, err = policy.SelectMixes(testPolicyMixes(), 2, rand.New(rand.NewSource(1)))
+	assert.EqualError(t, err, "cannot take a mix sequence from an empty list")
+}
+
+func TestCryptoClient_SetPathPolicy(t *testing.T) {
+	pubC, privC, err := sphinx.GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := NewCryptoClient(pubC, privC, elliptic.P224(), config.MixConfig{}, NetworkPKI{Mixes: testPolicyMixes()})
+	c.SetPathPolicy(ExcludePolicy{Excluded: []string{"Mix4"}, Policy: DiversePolicy{}}, rand.NewSource(3))
+
+	sequence, err := c.getRandomMixSequence(c.Network().Mixes, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, mix := range sequence {
+		assert.NotEqual(t, "Mix4", mix.Id, "The excluded mix should not be on the path")
+	}
+}
+
+func TestSealGroupMessage(t *testing.T) {
+	key, err := NewGroupKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload, err := SealGroupMessage(key, "Group", 2, config.GroupContent{MessageId: "1", Sender: "Client", Payload: []byte("Hello")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, priv, err := sphinx.GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, ok := NewCryptoClient(pub, priv, elliptic.P224(), config.MixConfig{}, NetworkPKI{}).DecodeGroupInvite(payload)
+	assert.False(t, ok, "The group message should not be decoded as an invitation")
+
+	message, ok := DecodeGroupMessage(payload)
+	assert.True(t, ok)
+	assert.Equal(t, "Group", message.GroupId)
+	assert.Equal(t, uint64(2), message.Epoch)
+
+	content, err := OpenGroupMessage(key, message)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []byte("Hello"), content.Payload)
+	assert.Equal(t, "Client", content.Sender)
+
+	otherKey, err := NewGroupKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = OpenGroupMessage(otherKey, message)
+	assert.EqualError(t, err, "the group message cannot be decrypted with the group key")
+
+	message.Epoch = 3
+	_, err = OpenGroupMessage(key, message)
+	assert.EqualError(t, err, "the group message cannot be decrypted with the group key", "The epoch should be authenticated")
+}
+
+func TestEncodeGroupInvite(t *testing.T) {
+	creatorPub, creatorPriv, err := sphinx.GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, priv, err := sphinx.GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	recipient := NewCryptoClient(pub, priv, elliptic.P224(), config.MixConfig{}, NetworkPKI{})
+	creator := NewCryptoClient(creatorPub, creatorPriv, elliptic.P224(), config.MixConfig{}, NetworkPKI{})
+
+	invite, err := SignGroupInvite(config.GroupInvite{GroupId: GroupId("A", "Group"), Epoch: 1, Members: []string{"A", "B"}, Key: []byte("key")}, creator.Sign)
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload, err := EncodeGroupInvite(invite, pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.False(t, bytes.Contains(payload, []byte("key")), "The key of the group should be sealed")
+	_, ok := creator.DecodeGroupInvite(payload)
+	assert.False(t, ok, "Only the recipient should open the invitation")
+
+	decoded, ok := recipient.DecodeGroupInvite(payload)
+	assert.True(t, ok)
+	assert.Equal(t, invite.Members, decoded.Members)
+	assert.Equal(t, invite.Key, decoded.Key)
+	assert.True(t, VerifyGroupInvite(decoded, creatorPub))
+	assert.False(t, VerifyGroupInvite(decoded, pub), "The invitation should be signed by the creator")
+	decoded.Epoch = 2
+	assert.False(t, VerifyGroupInvite(decoded, creatorPub), "The signature should cover the epoch")
+}
+
+func TestGroupCreator(t *testing.T) {
+	assert.Equal(t, "Alice", GroupCreator(GroupId("Alice", "Friends")))
+	assert.Equal(t, "", GroupCreator("Friends"))
+	assert.Equal(t, "", GroupCreator("/Friends"))
+	assert.Equal(t, "", GroupCreator("Alice/"))
+}
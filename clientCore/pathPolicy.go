@@ -0,0 +1,180 @@
+// Copyright 2018 The Loopix-Messaging Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package clientCore
+
+import (
+	"anonymous-messaging/config"
+
+	"errors"
+	"math"
+	"math/rand"
+	"sort"
+)
+
+// capacityCapFactor bounds the weight of a mix in CapacityPolicy to the given multiple of the median
+// advertised capacity, since the capacity is advertised by the mix itself.
+const capacityCapFactor = 4
+
+// PathPolicy selects the sequence of mixes on the path of a packet. The policies draw all
+// the randomness from the given source, hence a seeded source gives a deterministic selection.
+type PathPolicy interface {
+	SelectMixes(mixes []config.MixConfig, length int, rng *rand.Rand) ([]config.MixConfig, error)
+}
+
+// UniformPolicy samples the mixes uniformly at random, without any restrictions.
+// If there are fewer mixes than the length of the path, all the mixes are used.
+type UniformPolicy struct{}
+
+func (UniformPolicy) SelectMixes(mixes []config.MixConfig, length int, rng *rand.Rand) ([]config.MixConfig, error) {
+	if len(mixes) == 0 {
+		return nil, errors.New("cannot take a mix sequence from an empty list")
+	}
+	if length > len(mixes) {
+		return mixes, nil
+	}
+	return sampleMixes(mixes, length, rng, uniformWeight, nil)
+}
+
+// DiversePolicy samples the mixes uniformly at random, such that no two mixes on the path
+// run on the same host or are run by the same operator.
+type DiversePolicy struct{}
+
+func (DiversePolicy) SelectMixes(mixes []config.MixConfig, length int, rng *rand.Rand) ([]config.MixConfig, error) {
+	return sampleMixes(mixes, length, rng, uniformWeight, shareHostOrOperator)
+}
+
+// CapacityPolicy samples the mixes with probability proportional to their advertised capacity.
+// The mixes which do not advertise their capacity are picked with the weight of a single packet per second.
+// The capacity is self-advertised, hence it is capped at capacityCapFactor times the median capacity,
+// so that a mix cannot attract most of the paths by advertising a huge capacity.
+type CapacityPolicy struct{}
+
+func (CapacityPolicy) SelectMixes(mixes []config.MixConfig, length int, rng *rand.Rand) ([]config.MixConfig, error) {
+	return sampleMixes(mixes, length, rng, cappedCapacityWeight(mixes), nil)
+}
+
+// ExcludePolicy removes the mixes with the given ids, and selects the path from the remaining
+// mixes following the wrapped policy.
+type ExcludePolicy struct {
+	Excluded []string
+	Policy   PathPolicy
+}
+
+func (p ExcludePolicy) SelectMixes(mixes []config.MixConfig, length int, rng *rand.Rand) ([]config.MixConfig, error) {
+	excluded := make(map[string]bool)
+	for _, id := range p.Excluded {
+		excluded[id] = true
+	}
+	var allowed []config.MixConfig
+	for _, mix := range mixes {
+		if !excluded[mix.Id] {
+			allowed = append(allowed, mix)
+		}
+	}
+	return p.Policy.SelectMixes(allowed, length, rng)
+}
+
+func uniformWeight(config.MixConfig) float64 {
+	return 1
+}
+
+func capacityWeight(mix config.MixConfig) float64 {
+	if mix.Capacity == 0 {
+		return 1
+	}
+	return float64(mix.Capacity)
+}
+
+// cappedCapacityWeight returns the weight of the advertised capacity, capped relative to the median
+// capacity of the given mixes.
+func cappedCapacityWeight(mixes []config.MixConfig) func(config.MixConfig) float64 {
+	if len(mixes) == 0 {
+		return capacityWeight
+	}
+	capacities := make([]float64, len(mixes))
+	for i, mix := range mixes {
+		capacities[i] = capacityWeight(mix)
+	}
+	sort.Float64s(capacities)
+	limit := capacityCapFactor * capacities[len(capacities)/2]
+	return func(mix config.MixConfig) float64 {
+		return math.Min(capacityWeight(mix), limit)
+	}
+}
+
+func shareHostOrOperator(a, b config.MixConfig) bool {
+	return a.Host == b.Host || (a.Operator != "" && a.Operator == b.Operator)
+}
+
+// sampleMixes draws the mixes one by one without replacement, each with probability proportional
+// to its weight. The mixes conflicting with any mix already on the path are not drawn.
+// An error is returned if the path of the given length cannot be completed.
+func sampleMixes(mixes []config.MixConfig, length int, rng *rand.Rand,
+	weight func(config.MixConfig) float64, conflict func(a, b config.MixConfig) bool) ([]config.MixConfig, error) {
+	if len(mixes) == 0 {
+		return nil, errors.New("cannot take a mix sequence from an empty list")
+	}
+
+	candidates := append([]config.MixConfig{}, mixes...)
+	var sequence []config.MixConfig
+	for len(sequence) < length {
+		var allowed []config.MixConfig
+		var total float64
+		for _, candidate := range candidates {
+			if !conflicts(candidate, sequence, conflict) {
+				allowed = append(allowed, candidate)
+				total += weight(candidate)
+			}
+		}
+		if len(allowed) == 0 {
+			return nil, errors.New("not enough mixes satisfying the path policy")
+		}
+
+		chosen := len(allowed) - 1
+		point := rng.Float64() * total
+		for i, candidate := range allowed {
+			point -= weight(candidate)
+			if point < 0 {
+				chosen = i
+				break
+			}
+		}
+		sequence = append(sequence, allowed[chosen])
+		candidates = remove(candidates, allowed[chosen].Id)
+	}
+	return sequence, nil
+}
+
+func conflicts(candidate config.MixConfig, sequence []config.MixConfig, conflict func(a, b config.MixConfig) bool) bool {
+	if conflict == nil {
+		return false
+	}
+	for _, mix := range sequence {
+		if conflict(candidate, mix) {
+			return true
+		}
+	}
+	return false
+}
+
+func remove(mixes []config.MixConfig, id string) []config.MixConfig {
+	var remaining []config.MixConfig
+	for _, mix := range mixes {
+		if mix.Id != id {
+			remaining = append(remaining, mix)
+		}
+	}
+	return remaining
+}
@@ -23,6 +23,16 @@ import (
 	"github.com/protobuf/proto"
 )
 
+// The published sending rates of the clients. Each rate is the parameter of an exponential
+// distribution, i.e., the expected number of packets per second which a client sends in the
+// given stream. Providers use those rates to police the traffic of their clients.
+const (
+	RealTrafficRate = 0.2
+	LoopTrafficRate = 0.1
+	DropTrafficRate = 0.1
+	FetchRate       = 0.01
+)
+
 func NewMixConfig(mixId, host, port string, pubKey []byte) MixConfig {
 	MixConfig := MixConfig{Id: mixId, Host: host, Port: port, PubKey: pubKey}
 	return MixConfig
@@ -46,6 +56,33 @@ func WrapWithFlag(flag string, data []byte) ([]byte, error) {
 	return mBytes, nil
 }
 
+/*
+	WrapWithCredentials packs the given byte information together with a specified flag into the
+	packet and attaches the id and the authentication token of the sending client, which allow the
+	provider to attribute the packet to a registered client.
+*/
+func WrapWithCredentials(flag string, data []byte, clientId string, token []byte) ([]byte, error) {
+	m := GeneralPacket{Flag: flag, Data: data, ClientId: clientId, Token: token}
+	mBytes, err := proto.Marshal(&m)
+	if err != nil {
+		return nil, err
+	}
+	return mBytes, nil
+}
+
+/*
+	MigrationNoticeSignedData returns the data of the migration notice covered by the signature
+	of the client, i.e., the encoded notice without the signature, prefixed with its purpose.
+*/
+func MigrationNoticeSignedData(notice MigrationNotice) ([]byte, error) {
+	notice.Signature = nil
+	data, err := proto.Marshal(&notice)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte("migration-notice"), data...), nil
+}
+
 type E2EPath struct {
 	IngressProvider MixConfig
 	Mixes           []MixConfig
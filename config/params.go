@@ -0,0 +1,104 @@
+// Copyright 2018 The Loopix-Messaging Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+)
+
+// The sane ranges of the client parameters.
+const (
+	MaxTrafficRate = 1000.0
+	MinPathLength  = 1
+	MaxPathLength  = 10
+)
+
+/*
+	ClientParameters contains the parameters of the client traffic. The rates are the parameters
+	of the exponential distributions, i.e., the expected number of packets per second in each stream.
+	The providers police the clients sending faster than the maximum rates allowed in each stream,
+	and the rates higher than the defaults make the clients stand out in the network.
+*/
+type ClientParameters struct {
+	RealTrafficRate float64 `json:"realTrafficRate"`
+	LoopTrafficRate float64 `json:"loopTrafficRate"`
+	DropTrafficRate float64 `json:"dropTrafficRate"`
+	FetchRate       float64 `json:"fetchRate"`
+	// the parameter of the exponential distribution of the delays added by each mix
+	MixDelayRate float64 `json:"mixDelayRate"`
+	// the number of mixes on the path of each packet
+	PathLength int `json:"pathLength"`
+}
+
+/*
+	DefaultClientParameters returns the parameters following the published sending rates.
+*/
+func DefaultClientParameters() ClientParameters {
+	return ClientParameters{
+		RealTrafficRate: RealTrafficRate,
+		LoopTrafficRate: LoopTrafficRate,
+		DropTrafficRate: DropTrafficRate,
+		FetchRate:       FetchRate,
+		MixDelayRate:    5,
+		PathLength:      2,
+	}
+}
+
+/*
+	LoadClientParameters reads the client parameters from the given JSON file. The parameters
+	missing in the file keep their default values. LoadClientParameters returns an error if the
+	file could not be read or the parameters are out of the sane ranges.
+*/
+func LoadClientParameters(path string) (ClientParameters, error) {
+	params := DefaultClientParameters()
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return ClientParameters{}, err
+	}
+	if err := json.Unmarshal(data, &params); err != nil {
+		return ClientParameters{}, err
+	}
+	if err := params.Validate(); err != nil {
+		return ClientParameters{}, err
+	}
+	return params, nil
+}
+
+/*
+	Validate checks whether the parameters are within the sane ranges.
+*/
+func (p ClientParameters) Validate() error {
+	rates := []struct {
+		name string
+		rate float64
+	}{
+		{"realTrafficRate", p.RealTrafficRate},
+		{"loopTrafficRate", p.LoopTrafficRate},
+		{"dropTrafficRate", p.DropTrafficRate},
+		{"fetchRate", p.FetchRate},
+		{"mixDelayRate", p.MixDelayRate},
+	}
+	for _, r := range rates {
+		if r.rate <= 0 || r.rate > MaxTrafficRate {
+			return fmt.Errorf("%s should be in the range (0, %v]", r.name, MaxTrafficRate)
+		}
+	}
+	if p.PathLength < MinPathLength || p.PathLength > MaxPathLength {
+		return fmt.Errorf("pathLength should be in the range [%d, %d]", MinPathLength, MaxPathLength)
+	}
+	return nil
+}
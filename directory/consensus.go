@@ -0,0 +1,565 @@
+// Copyright 2018 The Loopix-Messaging Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package directory
+
+import (
+	"anonymous-messaging/config"
+	"anonymous-messaging/sphinx"
+
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"sync"
+	"time"
+)
+
+// The network document is agreed by several directory authorities, hence no single authority can
+// add its own nodes to the network, or leave out the honest ones. In each epoch:
+//
+//	1. each authority signs its vote, the document of the descriptors uploaded to it,
+//	2. the authorities fetch the votes of each other, and each combines the votes into the consensus,
+//	   which lists the descriptors listed in the votes of the majority of the authorities,
+//	3. each authority signs the consensus, and collects the signatures of the other authorities.
+//
+// The authorities with the same votes compute the same consensus, hence the signatures of the honest
+// authorities are over the same document. The nodes and the clients accept the document only if it is
+// signed by the threshold of the authorities of the authority set.
+
+// The purposes of the signatures of the authorities.
+const (
+	votePurpose      = "vote"
+	consensusPurpose = "consensus"
+)
+
+// descriptorOrder is the order of the types of the descriptors in the consensus.
+var descriptorOrder = map[string]int{MixDescriptor: 0, ProviderDescriptor: 1, ClientDescriptor: 2}
+
+// Authority is the public identity of a directory authority.
+type Authority struct {
+	Id     string `json:"id"`
+	PubKey []byte `json:"publicKey"`
+	URL    string `json:"url"`
+}
+
+// AuthoritySet is the set of the directory authorities trusted by the nodes and the clients,
+// with the number of the authorities which must sign the network document.
+type AuthoritySet struct {
+	Authorities []Authority `json:"authorities"`
+	Threshold   int         `json:"threshold"`
+}
+
+// LoadAuthoritySet reads the authority set from the JSON file at the given path.
+func LoadAuthoritySet(path string) (AuthoritySet, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return AuthoritySet{}, err
+	}
+	var set AuthoritySet
+	if err := json.Unmarshal(data, &set); err != nil {
+		return AuthoritySet{}, err
+	}
+	if err := set.Validate(); err != nil {
+		return AuthoritySet{}, err
+	}
+	return set, nil
+}
+
+// Validate checks that the ids of the authorities are unique, and that the threshold is a majority
+// of the authorities which can be reached. A threshold of a half or less would let two disjoint groups
+// of the authorities sign two different documents for the same epoch.
+func (s AuthoritySet) Validate() error {
+	ids := make(map[string]bool)
+	for _, authority := range s.Authorities {
+		if ids[authority.Id] {
+			return fmt.Errorf("the authority %s is listed twice", authority.Id)
+		}
+		ids[authority.Id] = true
+	}
+	if s.Threshold < 1 || s.Threshold > len(s.Authorities) {
+		return fmt.Errorf("the threshold must be between 1 and the number of the authorities, got %d", s.Threshold)
+	}
+	if s.Threshold <= len(s.Authorities)/2 {
+		return fmt.Errorf("the threshold must be a majority of the %d authorities, got %d", len(s.Authorities), s.Threshold)
+	}
+	return nil
+}
+
+func (s AuthoritySet) authority(id string) (Authority, bool) {
+	for _, authority := range s.Authorities {
+		if authority.Id == id {
+			return authority, true
+		}
+	}
+	return Authority{}, false
+}
+
+// verifySignature checks that the signature is made by an authority of the set over the digest.
+func (s AuthoritySet) verifySignature(purpose string, digest []byte, signature config.AuthoritySignature) error {
+	authority, ok := s.authority(signature.AuthorityId)
+	if !ok {
+		return fmt.Errorf("unknown authority %s", signature.AuthorityId)
+	}
+	if !sphinx.Verify(authority.PubKey, lengthPrefixed([]byte(purpose), digest), signature.Signature) {
+		return fmt.Errorf("the signature of the authority %s is invalid", signature.AuthorityId)
+	}
+	return nil
+}
+
+// Verify checks that the consensus document is signed by at least the threshold of the authorities.
+// The signatures of the unknown authorities and the invalid signatures are not counted.
+func (s AuthoritySet) Verify(document config.NetworkDocument) error {
+	digest := Digest(document)
+	signed := make(map[string]bool)
+	for _, signature := range document.Signatures {
+		if s.verifySignature(consensusPurpose, digest, *signature) == nil {
+			signed[signature.AuthorityId] = true
+		}
+	}
+	if len(signed) < s.Threshold {
+		return fmt.Errorf("the network document is signed by %d of the required %d authorities", len(signed), s.Threshold)
+	}
+	return nil
+}
+
+// Digest returns the hash of the epoch and the descriptors of the network document, which is
+// signed by the authorities and compared by the nodes and the clients. The signatures of the authorities
+// are not covered.
+func Digest(document config.NetworkDocument) []byte {
+	h := sha256.New()
+	var header [12]byte
+	binary.BigEndian.PutUint64(header[:8], document.Epoch)
+	binary.BigEndian.PutUint32(header[8:], uint32(len(document.Descriptors)))
+	h.Write(header[:])
+	for _, descriptor := range document.Descriptors {
+		h.Write(lengthPrefixed([]byte(descriptor.Typ), []byte(descriptor.Id), descriptor.Config, descriptor.Signature))
+	}
+	return h.Sum(nil)
+}
+
+func signDocument(document *config.NetworkDocument, purpose, authorityId string, sign Signer) error {
+	signature, err := sign(lengthPrefixed([]byte(purpose), Digest(*document)))
+	if err != nil {
+		return err
+	}
+	document.Signatures = append(document.Signatures, &config.AuthoritySignature{AuthorityId: authorityId, Signature: signature})
+	return nil
+}
+
+// Combine computes the consensus of the votes for the given epoch. A descriptor is included if the same
+// configuration of the node or the client is listed in the votes of the majority of the authorities of
+// the set. The votes which are not signed by an authority of the set, are for another epoch, or repeat
+// the vote of an authority are ignored, as are the descriptors which are not signed by their owners.
+// The consensus does not depend on the order of the votes, so every authority computes the same document.
+func Combine(epoch uint64, votes []config.NetworkDocument, set AuthoritySet) config.NetworkDocument {
+	type entry struct {
+		descriptor config.Descriptor
+		votes      int
+	}
+	entries := make(map[string]*entry)
+	voted := make(map[string]bool)
+	for _, vote := range votes {
+		if vote.Epoch != epoch || len(vote.Signatures) != 1 {
+			continue
+		}
+		signature := *vote.Signatures[0]
+		if voted[signature.AuthorityId] {
+			continue
+		}
+		if err := set.verifySignature(votePurpose, Digest(vote), signature); err != nil {
+			logLocal.WithError(err).Warning("Vote rejected")
+			continue
+		}
+		voted[signature.AuthorityId] = true
+
+		counted := make(map[string]bool)
+		for _, descriptor := range vote.Descriptors {
+			if err := Verify(*descriptor); err != nil {
+				continue
+			}
+			key := string(lengthPrefixed([]byte(descriptor.Typ), []byte(descriptor.Id), descriptor.Config))
+			if counted[key] {
+				continue
+			}
+			counted[key] = true
+			e, ok := entries[key]
+			if !ok {
+				e = &entry{descriptor: *descriptor}
+				entries[key] = e
+			}
+			e.votes++
+			// the owner may have signed the configuration for each authority separately,
+			// hence the smallest signature is taken to choose the same one everywhere
+			if bytes.Compare(descriptor.Signature, e.descriptor.Signature) < 0 {
+				e.descriptor.Signature = descriptor.Signature
+			}
+		}
+	}
+
+	var agreed []*entry
+	for _, e := range entries {
+		if e.votes > len(set.Authorities)/2 {
+			agreed = append(agreed, e)
+		}
+	}
+	sort.Slice(agreed, func(i, j int) bool {
+		a, b := agreed[i].descriptor, agreed[j].descriptor
+		if a.Typ != b.Typ {
+			return descriptorOrder[a.Typ] < descriptorOrder[b.Typ]
+		}
+		if a.Id != b.Id {
+			return a.Id < b.Id
+		}
+		return bytes.Compare(a.Config, b.Config) < 0
+	})
+
+	document := config.NetworkDocument{Epoch: epoch}
+	for i, e := range agreed {
+		// a faulty authority may vote for several configurations of a node, only the first one is kept
+		if i > 0 && e.descriptor.Typ == agreed[i-1].descriptor.Typ && e.descriptor.Id == agreed[i-1].descriptor.Id {
+			continue
+		}
+		descriptor := e.descriptor
+		document.Descriptors = append(document.Descriptors, &descriptor)
+	}
+	return document
+}
+
+// Peer is another directory authority taking part in the consensus.
+type Peer interface {
+	// Vote returns the signed vote of the authority for the given epoch.
+	Vote(epoch uint64) (config.NetworkDocument, error)
+	// ConsensusSignature returns the signature of the authority over the consensus it computed for the given epoch.
+	ConsensusSignature(epoch uint64) (config.AuthoritySignature, error)
+}
+
+// VotingAuthority is a directory authority which agrees the network document with the other authorities
+// of the set. The descriptors are uploaded to the store of the authority, and the served document is
+// the latest consensus signed by the threshold of the authorities.
+type VotingAuthority struct {
+	id    string
+	sign  Signer
+	store Directory
+	set   AuthoritySet
+
+	mutex     sync.Mutex
+	period    time.Duration
+	now       func() time.Time
+	peers     []Peer
+	votes     map[uint64]config.NetworkDocument
+	consensus map[uint64]config.NetworkDocument
+	published map[uint64]config.NetworkDocument
+	latest    uint64
+}
+
+// NewVotingAuthority creates the authority with the given id, which must be in the authority set,
+// keeping the uploaded descriptors in the given store.
+func NewVotingAuthority(id string, sign Signer, store Directory, set AuthoritySet) (*VotingAuthority, error) {
+	if _, ok := set.authority(id); !ok {
+		return nil, errors.New("the authority is not in the authority set")
+	}
+	return &VotingAuthority{
+		id:        id,
+		sign:      sign,
+		store:     store,
+		set:       set,
+		now:       time.Now,
+		votes:     make(map[uint64]config.NetworkDocument),
+		consensus: make(map[uint64]config.NetworkDocument),
+		published: make(map[uint64]config.NetworkDocument),
+	}, nil
+}
+
+// SetPeers sets the other authorities of the set, whose votes and signatures are collected.
+func (a *VotingAuthority) SetPeers(peers []Peer) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.peers = peers
+}
+
+// Upload publishes the descriptor in the store of the authority. The descriptor is listed in the
+// network document after the next consensus.
+func (a *VotingAuthority) Upload(descriptor config.Descriptor) error {
+	return a.store.Upload(descriptor)
+}
+
+// Remove removes the descriptor from the store of the authority.
+func (a *VotingAuthority) Remove(revocation config.Descriptor) error {
+	return a.store.Remove(revocation)
+}
+
+// Document returns the latest consensus document signed by the threshold of the authorities.
+func (a *VotingAuthority) Document() (config.NetworkDocument, error) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if len(a.published) == 0 {
+		return config.NetworkDocument{}, errors.New("no consensus on the network document has been reached yet")
+	}
+	return a.published[a.latest], nil
+}
+
+// DocumentAt returns the consensus document of the given epoch, if it was published in one of the recent epochs.
+func (a *VotingAuthority) DocumentAt(epoch uint64) (config.NetworkDocument, error) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	document, ok := a.published[epoch]
+	if !ok {
+		return config.NetworkDocument{}, ErrUnknownEpoch
+	}
+	return document, nil
+}
+
+// Vote returns the vote of the authority for the given epoch. The vote is made from the store at
+// the first request, and the same vote is returned to all the authorities. Only the votes of the
+// current and the next epoch are served, as every vote is kept until its epoch is over.
+func (a *VotingAuthority) Vote(epoch uint64) (config.NetworkDocument, error) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	if a.period == 0 {
+		return config.NetworkDocument{}, errors.New("the authority does not take part in the epochs")
+	}
+	if current := EpochAt(a.now(), a.period); epoch < current || epoch > current+1 {
+		return config.NetworkDocument{}, fmt.Errorf("the vote of epoch %d is not served in epoch %d", epoch, current)
+	}
+
+	if vote, ok := a.votes[epoch]; ok {
+		return vote, nil
+	}
+	vote, err := a.store.Document()
+	if err != nil {
+		return config.NetworkDocument{}, err
+	}
+	vote.Epoch = epoch
+	vote.Signatures = nil
+	if err := signDocument(&vote, votePurpose, a.id, a.sign); err != nil {
+		return config.NetworkDocument{}, err
+	}
+	a.votes[epoch] = vote
+	return vote, nil
+}
+
+// ConsensusSignature returns the signature of the authority over its consensus for the given epoch.
+func (a *VotingAuthority) ConsensusSignature(epoch uint64) (config.AuthoritySignature, error) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	consensus, ok := a.consensus[epoch]
+	if !ok {
+		return config.AuthoritySignature{}, errors.New("no consensus computed for the epoch")
+	}
+	return *consensus.Signatures[0], nil
+}
+
+// ComputeConsensus collects the votes of the authorities for the given epoch, combines them
+// and signs the consensus. The authorities which cannot be reached are left out of the vote.
+func (a *VotingAuthority) ComputeConsensus(epoch uint64) error {
+	vote, err := a.Vote(epoch)
+	if err != nil {
+		return err
+	}
+	votes := []config.NetworkDocument{vote}
+	for _, peer := range a.getPeers() {
+		vote, err := peer.Vote(epoch)
+		if err != nil {
+			logLocal.WithError(err).Warning("Error in fetching the vote of an authority")
+			continue
+		}
+		votes = append(votes, vote)
+	}
+
+	consensus := Combine(epoch, votes, a.set)
+	if err := signDocument(&consensus, consensusPurpose, a.id, a.sign); err != nil {
+		return err
+	}
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.consensus[epoch] = consensus
+	// the votes and the consensus of the earlier epochs are not requested any more
+	for e := range a.votes {
+		if e+1 < epoch {
+			delete(a.votes, e)
+		}
+	}
+	for e := range a.consensus {
+		if e+1 < epoch {
+			delete(a.consensus, e)
+		}
+	}
+	return nil
+}
+
+// CollectSignatures collects the signatures of the other authorities over the consensus for the given
+// epoch, and publishes the consensus if it is signed by the threshold of the authorities. The signatures
+// over a different document, made by the authorities which saw different votes, are dropped.
+func (a *VotingAuthority) CollectSignatures(epoch uint64) error {
+	a.mutex.Lock()
+	consensus, ok := a.consensus[epoch]
+	a.mutex.Unlock()
+	if !ok {
+		return errors.New("no consensus computed for the epoch")
+	}
+
+	digest := Digest(consensus)
+	signatures := append([]*config.AuthoritySignature{}, consensus.Signatures...)
+	for _, peer := range a.getPeers() {
+		signature, err := peer.ConsensusSignature(epoch)
+		if err != nil {
+			logLocal.WithError(err).Warning("Error in fetching the consensus signature of an authority")
+			continue
+		}
+		if err := a.set.verifySignature(consensusPurpose, digest, signature); err != nil {
+			logLocal.WithError(err).Warning("Consensus signature rejected")
+			continue
+		}
+		if hasSignature(signatures, signature.AuthorityId) {
+			continue
+		}
+		signatures = append(signatures, &signature)
+	}
+	consensus.Signatures = signatures
+	if err := a.set.Verify(consensus); err != nil {
+		return err
+	}
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.published[epoch] = consensus
+	if epoch > a.latest {
+		a.latest = epoch
+	}
+	for e := range a.published {
+		if e+keptEpochs <= a.latest {
+			delete(a.published, e)
+		}
+	}
+	return nil
+}
+
+func hasSignature(signatures []*config.AuthoritySignature, authorityId string) bool {
+	for _, signature := range signatures {
+		if signature.AuthorityId == authorityId {
+			return true
+		}
+	}
+	return false
+}
+
+func (a *VotingAuthority) getPeers() []Peer {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	return a.peers
+}
+
+// Run takes part in the consensus of each epoch of the given duration, until the stop channel is closed.
+// The votes are combined a third into the epoch, and the signatures collected two thirds into it, which
+// leaves the other authorities the time to finish each step.
+func (a *VotingAuthority) Run(period time.Duration, stop <-chan struct{}) {
+	a.mutex.Lock()
+	a.period = period
+	a.mutex.Unlock()
+	runEpochs(period, stop, []epochStep{
+		{period / 3, a.ComputeConsensus},
+		{2 * period / 3, a.CollectSignatures},
+	})
+}
+
+// ConsensusDirectory is the directory of the nodes and the clients when the network is served by several
+// authorities. The descriptors are uploaded to every authority, and the network document is accepted
+// only if it is signed by the threshold of the authorities.
+type ConsensusDirectory struct {
+	set         AuthoritySet
+	authorities []Directory
+}
+
+// NewConsensusDirectory creates the directory of the authority set, reaching the authorities at their URLs.
+func NewConsensusDirectory(set AuthoritySet) *ConsensusDirectory {
+	d := &ConsensusDirectory{set: set}
+	for _, authority := range set.Authorities {
+		d.authorities = append(d.authorities, NewRemoteDirectory(authority.URL))
+	}
+	return d
+}
+
+// Upload uploads the descriptor to all the authorities. The upload fails unless the majority of the
+// authorities accepts the descriptor, since otherwise it is not included in the consensus.
+func (d *ConsensusDirectory) Upload(descriptor config.Descriptor) error {
+	return d.all(func(authority Directory) error { return authority.Upload(descriptor) })
+}
+
+// Remove removes the descriptor from all the authorities.
+func (d *ConsensusDirectory) Remove(revocation config.Descriptor) error {
+	return d.all(func(authority Directory) error { return authority.Remove(revocation) })
+}
+
+func (d *ConsensusDirectory) all(apply func(Directory) error) error {
+	accepted := 0
+	var lastErr error
+	for _, authority := range d.authorities {
+		if err := apply(authority); err != nil {
+			lastErr = err
+			continue
+		}
+		accepted++
+	}
+	if accepted <= len(d.authorities)/2 {
+		return fmt.Errorf("accepted by %d of %d authorities: %v", accepted, len(d.authorities), lastErr)
+	}
+	return nil
+}
+
+// Document returns the latest network document served by the authorities, which is signed by
+// the threshold of the authorities.
+func (d *ConsensusDirectory) Document() (config.NetworkDocument, error) {
+	return d.document(func(authority Directory) (config.NetworkDocument, error) { return authority.Document() })
+}
+
+// DocumentAt returns the network document of the given epoch, which is signed by the threshold of the authorities.
+func (d *ConsensusDirectory) DocumentAt(epoch uint64) (config.NetworkDocument, error) {
+	return d.document(func(authority Directory) (config.NetworkDocument, error) {
+		document, err := authority.DocumentAt(epoch)
+		if err == nil && document.Epoch != epoch {
+			err = ErrUnknownEpoch
+		}
+		return document, err
+	})
+}
+
+func (d *ConsensusDirectory) document(fetch func(Directory) (config.NetworkDocument, error)) (config.NetworkDocument, error) {
+	var latest *config.NetworkDocument
+	for _, authority := range d.authorities {
+		document, err := fetch(authority)
+		if err != nil {
+			logLocal.WithError(err).Warning("Error in fetching the network document from an authority")
+			continue
+		}
+		if err := d.set.Verify(document); err != nil {
+			logLocal.WithError(err).Warning("Network document rejected")
+			continue
+		}
+		if latest == nil || document.Epoch > latest.Epoch {
+			latest = &document
+		}
+	}
+	if latest == nil {
+		return config.NetworkDocument{}, errors.New("no authority served a network document signed by enough authorities")
+	}
+	return *latest, nil
+}
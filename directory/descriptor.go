@@ -0,0 +1,151 @@
+// Copyright 2018 The Loopix-Messaging Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package directory
+
+import (
+	"anonymous-messaging/config"
+	"anonymous-messaging/sphinx"
+
+	"github.com/protobuf/proto"
+
+	"encoding/binary"
+	"errors"
+	"time"
+)
+
+// The purposes of the signatures, which keep the signature of a descriptor from being used
+// as the signature of a revocation, and the other way round.
+const (
+	descriptorPurpose = "descriptor"
+	revocationPurpose = "revocation"
+)
+
+// DescriptorValidity is the time within which the timestamp of an uploaded descriptor or revocation
+// must lie, hence the signed descriptors cannot be uploaded again later.
+const DescriptorValidity = 10 * time.Minute
+
+// ErrStaleDescriptor is returned when the descriptor is signed too long ago, or before the published
+// descriptor with the same id and type, e.g., when an old descriptor or revocation is replayed.
+var ErrStaleDescriptor = errors.New("the descriptor is stale")
+
+// Signer signs the message with the long-term identity key of a node or a client.
+type Signer func(message []byte) ([]byte, error)
+
+// KeySigner returns the signer using the given private key.
+func KeySigner(privKey []byte) Signer {
+	return func(message []byte) ([]byte, error) {
+		return sphinx.Sign(privKey, message)
+	}
+}
+
+// NewDescriptor creates the descriptor of the given configuration, signed by the owner of the configuration.
+func NewDescriptor(typ, id string, configBytes []byte, sign Signer) (config.Descriptor, error) {
+	return newSigned(descriptorPurpose, typ, id, configBytes, sign)
+}
+
+// NewRevocation creates the request to remove the published descriptor, signed by the owner of the configuration.
+func NewRevocation(typ, id string, configBytes []byte, sign Signer) (config.Descriptor, error) {
+	return newSigned(revocationPurpose, typ, id, configBytes, sign)
+}
+
+func newSigned(purpose, typ, id string, configBytes []byte, sign Signer) (config.Descriptor, error) {
+	descriptor := config.Descriptor{Id: id, Typ: typ, Config: configBytes, Timestamp: time.Now().Unix()}
+	signature, err := sign(signedData(purpose, descriptor))
+	if err != nil {
+		return config.Descriptor{}, err
+	}
+	descriptor.Signature = signature
+	return descriptor, nil
+}
+
+// Verify checks that the descriptor is signed with the key published in its configuration.
+func Verify(descriptor config.Descriptor) error {
+	return verify(descriptorPurpose, descriptor)
+}
+
+// VerifyRevocation checks that the revocation is signed with the key published in its configuration.
+func VerifyRevocation(revocation config.Descriptor) error {
+	return verify(revocationPurpose, revocation)
+}
+
+func verify(purpose string, descriptor config.Descriptor) error {
+	pubKey, err := PublicKey(descriptor)
+	if err != nil {
+		return err
+	}
+	if len(descriptor.Signature) == 0 {
+		return errors.New("the descriptor is not signed")
+	}
+	if !sphinx.Verify(pubKey, signedData(purpose, descriptor), descriptor.Signature) {
+		return errors.New("the signature of the descriptor is invalid")
+	}
+	return nil
+}
+
+// checkFresh returns ErrStaleDescriptor if the descriptor is not signed within the validity of the given
+// time, or if it is signed before the published descriptor signed at the given timestamp.
+func checkFresh(descriptor config.Descriptor, published int64, now time.Time) error {
+	signed := time.Unix(descriptor.Timestamp, 0)
+	if signed.Before(now.Add(-DescriptorValidity)) || signed.After(now.Add(DescriptorValidity)) || descriptor.Timestamp < published {
+		return ErrStaleDescriptor
+	}
+	return nil
+}
+
+// PublicKey returns the public key published in the configuration of the descriptor, which must
+// have the same id as the descriptor.
+func PublicKey(descriptor config.Descriptor) ([]byte, error) {
+	var id string
+	var pubKey []byte
+	switch descriptor.Typ {
+	case MixDescriptor, ProviderDescriptor:
+		var mixConfig config.MixConfig
+		if err := proto.Unmarshal(descriptor.Config, &mixConfig); err != nil {
+			return nil, err
+		}
+		id, pubKey = mixConfig.Id, mixConfig.PubKey
+	case ClientDescriptor:
+		var clientConfig config.ClientConfig
+		if err := proto.Unmarshal(descriptor.Config, &clientConfig); err != nil {
+			return nil, err
+		}
+		id, pubKey = clientConfig.Id, clientConfig.PubKey
+	default:
+		return nil, errors.New("unknown type of the descriptor")
+	}
+	if id != descriptor.Id {
+		return nil, errors.New("the id of the descriptor does not match its configuration")
+	}
+	return pubKey, nil
+}
+
+// signedData encodes the purpose and the fields of the descriptor.
+func signedData(purpose string, descriptor config.Descriptor) []byte {
+	var timestamp [8]byte
+	binary.BigEndian.PutUint64(timestamp[:], uint64(descriptor.Timestamp))
+	return lengthPrefixed([]byte(purpose), []byte(descriptor.Typ), []byte(descriptor.Id), descriptor.Config, timestamp[:])
+}
+
+// lengthPrefixed concatenates the fields, each prefixed with its length, hence
+// different sequences of fields never have the same encoding.
+func lengthPrefixed(fields ...[]byte) []byte {
+	var data []byte
+	for _, field := range fields {
+		var length [4]byte
+		binary.BigEndian.PutUint32(length[:], uint32(len(field)))
+		data = append(append(data, length[:]...), field...)
+	}
+	return data
+}
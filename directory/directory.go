@@ -0,0 +1,481 @@
+// Copyright 2018 The Loopix-Messaging Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+/*
+	Package directory implements the directory authority of the mix network. The nodes and the clients
+	upload their descriptors to the authority, and fetch from it the network document, which lists
+	the descriptors of all the mixes, providers and clients. The authority keeps the descriptors in
+	the SQLite PKI database, in memory or in a JSON file, and serves them over HTTP, hence the
+	components of the network do not have to share the database file. Several authorities can
+	agree the network document, which is then trusted only if signed by enough of them, see
+	VotingAuthority.
+*/
+
+package directory
+
+import (
+	"anonymous-messaging/config"
+	"anonymous-messaging/logging"
+
+	"github.com/jmoiron/sqlx"
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/protobuf/proto"
+
+	"bytes"
+	"database/sql"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+)
+
+var logLocal = logging.PackageLogger()
+
+// The types of the descriptors.
+const (
+	MixDescriptor      = "Mix"
+	ProviderDescriptor = "Provider"
+	ClientDescriptor   = "Client"
+)
+
+// The tables of the PKI database keeping the descriptors, and the network documents published in the epochs.
+const (
+	pkiTable      = "Pki"
+	snapshotTable = "Snapshots"
+)
+
+// ErrKeyMismatch is returned when the descriptor is signed with another key than the published
+// descriptor with the same id and type. The first published key is kept, hence no one else can
+// replace or remove the descriptor of a node or a client.
+var ErrKeyMismatch = errors.New("the descriptor is signed with a different key than the published descriptor")
+
+// Directory is the directory authority, either reached over the network or kept locally.
+// The descriptors are signed by their owners, see NewDescriptor and NewRevocation.
+type Directory interface {
+	// Upload publishes the descriptor, replacing the previous descriptor with the same id and type.
+	Upload(descriptor config.Descriptor) error
+	// Remove removes the published descriptor with the id and type of the given revocation.
+	Remove(revocation config.Descriptor) error
+	// Document returns the network document of the latest epoch.
+	Document() (config.NetworkDocument, error)
+	// DocumentAt returns the network document of the given epoch, or ErrUnknownEpoch.
+	DocumentAt(epoch uint64) (config.NetworkDocument, error)
+}
+
+// The prefixes of the locations of the authorities kept in memory and in a JSON file.
+const (
+	memoryPrefix = "memory:"
+	jsonPrefix   = "json:"
+)
+
+// Open returns the directory at the given location, which is either
+//
+//   - the URL of a directory authority service,
+//   - the path of the JSON file of an authority set, ending with .json,
+//   - memory:<name>, the authority kept in memory, shared by the components of the process,
+//   - json:<path>, the path of the JSON file of a single authority,
+//   - or the path of a local SQLite PKI database.
+func Open(location string) (Directory, error) {
+	switch {
+	case strings.HasPrefix(location, "http://") || strings.HasPrefix(location, "https://"):
+		return NewRemoteDirectory(location), nil
+	case strings.HasPrefix(location, memoryPrefix):
+		return sharedMemoryAuthority(strings.TrimPrefix(location, memoryPrefix)), nil
+	case strings.HasPrefix(location, jsonPrefix):
+		return NewJSONFileAuthority(strings.TrimPrefix(location, jsonPrefix)), nil
+	case strings.HasSuffix(location, ".json"):
+		set, err := LoadAuthoritySet(location)
+		if err != nil {
+			return nil, err
+		}
+		return NewConsensusDirectory(set), nil
+	}
+	return NewLocalAuthority(location), nil
+}
+
+// DefaultExpiry is the time after which the mixes and the providers which did not upload their
+// descriptors again are considered dead, and left out of the network document.
+const DefaultExpiry = 15 * time.Minute
+
+// LocalAuthority is the directory authority kept in the local SQLite PKI database.
+// The tables are created when the database is first used. The uploaded descriptors are listed
+// in the network document of the next epoch published with PublishEpoch; until the first epoch
+// is published, the document lists the descriptors as they are uploaded.
+//
+// The nodes upload their descriptors periodically as the heartbeat. The time of the signature of the last
+// upload is kept with the descriptor, and the nodes not seen within the expiry are left out of the document,
+// until they upload the descriptor again. The clients are not expected to stay online, hence their
+// descriptors do not expire.
+type LocalAuthority struct {
+	mutex  sync.Mutex
+	pkiDir string
+	expiry time.Duration
+}
+
+// NewLocalAuthority creates the authority kept in the SQLite database at the given path.
+func NewLocalAuthority(pkiDir string) *LocalAuthority {
+	return &LocalAuthority{pkiDir: pkiDir, expiry: DefaultExpiry}
+}
+
+// SetExpiry sets the time after which the nodes which did not upload their descriptors are left out.
+// The zero expiry keeps all the nodes.
+func (a *LocalAuthority) SetExpiry(expiry time.Duration) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.expiry = expiry
+}
+
+// Entry is the record of a published descriptor with the time of its last upload.
+type Entry struct {
+	Id       string
+	Typ      string
+	LastSeen time.Time
+}
+
+// isStale returns whether the node of the entry was not seen within the expiry.
+func (e Entry) isStale(now time.Time, expiry time.Duration) bool {
+	if e.Typ == ClientDescriptor || expiry == 0 {
+		return false
+	}
+	return now.Sub(e.LastSeen) > expiry
+}
+
+// lastSeen returns the time the owner of the descriptor was last seen, which is the time the descriptor
+// was signed, hence an uploaded descriptor which was replayed does not extend the liveness of its owner.
+func lastSeen(descriptor config.Descriptor, now time.Time) time.Time {
+	signed := time.Unix(descriptor.Timestamp, 0)
+	if signed.After(now) {
+		return now
+	}
+	return signed
+}
+
+func (a *LocalAuthority) open() (*sqlx.DB, error) {
+	db, err := sqlx.Connect("sqlite3", a.pkiDir)
+	if err != nil {
+		return nil, err
+	}
+	for _, query := range []string{
+		"CREATE TABLE IF NOT EXISTS " + pkiTable + " (idx INTEGER PRIMARY KEY, Id TEXT, Typ TEXT, Config BLOB, Signature BLOB, Timestamp INTEGER, LastSeen INTEGER)",
+		"CREATE TABLE IF NOT EXISTS " + snapshotTable + " (idx INTEGER PRIMARY KEY, Epoch INTEGER UNIQUE, Document BLOB)",
+	} {
+		if _, err := db.Exec(query); err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+	if err := migratePkiTable(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+// pkiColumns are the columns of the PKI table added after the first version of the database,
+// which kept only the id, the type and the configuration.
+var pkiColumns = []struct{ name, typ string }{
+	{"Signature", "BLOB"},
+	{"Timestamp", "INTEGER"},
+	{"LastSeen", "INTEGER"},
+}
+
+// migratePkiTable adds the missing columns to the PKI table of an older database. The descriptors
+// of the older database are not signed, hence they are left out of the network documents until
+// their owners upload them again.
+func migratePkiTable(db *sqlx.DB) error {
+	rows, err := db.Query("PRAGMA table_info(" + pkiTable + ")")
+	if err != nil {
+		return err
+	}
+	existing := make(map[string]bool)
+	for rows.Next() {
+		var cid, notNull, primaryKey int
+		var name, typ string
+		var defaultValue sql.NullString
+		if err := rows.Scan(&cid, &name, &typ, &notNull, &defaultValue, &primaryKey); err != nil {
+			rows.Close()
+			return err
+		}
+		existing[name] = true
+	}
+	err = rows.Err()
+	rows.Close()
+	if err != nil {
+		return err
+	}
+
+	for _, column := range pkiColumns {
+		if existing[column.name] {
+			continue
+		}
+		if _, err := db.Exec("ALTER TABLE " + pkiTable + " ADD COLUMN " + column.name + " " + column.typ); err != nil {
+			return err
+		}
+		logLocal.Infof("Added column %s to the table %s of the PKI database", column.name, pkiTable)
+	}
+	return nil
+}
+
+// Upload verifies the signature of the descriptor and publishes it. Uploading the descriptor signed
+// again marks the node as alive.
+func (a *LocalAuthority) Upload(descriptor config.Descriptor) error {
+	if err := Verify(descriptor); err != nil {
+		return err
+	}
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	db, err := a.open()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	published, timestamp, err := a.checkOwner(db, descriptor)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	if err := checkFresh(descriptor, timestamp, now); err != nil {
+		return err
+	}
+	if published {
+		_, err = db.Exec("UPDATE "+pkiTable+" SET Config = ?, Signature = ?, Timestamp = ?, LastSeen = ? WHERE Id = ? AND Typ = ?",
+			descriptor.Config, descriptor.Signature, descriptor.Timestamp, lastSeen(descriptor, now).Unix(), descriptor.Id, descriptor.Typ)
+		return err
+	}
+	_, err = db.Exec("INSERT INTO "+pkiTable+" (Id, Typ, Config, Signature, Timestamp, LastSeen) VALUES (?, ?, ?, ?, ?, ?)",
+		descriptor.Id, descriptor.Typ, descriptor.Config, descriptor.Signature, descriptor.Timestamp, lastSeen(descriptor, now).Unix())
+	return err
+}
+
+// Remove verifies the signature of the revocation and removes the published descriptor.
+func (a *LocalAuthority) Remove(revocation config.Descriptor) error {
+	if err := VerifyRevocation(revocation); err != nil {
+		return err
+	}
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	db, err := a.open()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	published, timestamp, err := a.checkOwner(db, revocation)
+	if err != nil || !published {
+		return err
+	}
+	if err := checkFresh(revocation, timestamp, time.Now()); err != nil {
+		return err
+	}
+	_, err = db.Exec("DELETE FROM "+pkiTable+" WHERE Id = ? AND Typ = ?", revocation.Id, revocation.Typ)
+	return err
+}
+
+// checkOwner returns whether a descriptor with the same id and type is published, with the timestamp of
+// the published descriptor, and an error if the published descriptor has another key than the given one.
+func (a *LocalAuthority) checkOwner(db *sqlx.DB, descriptor config.Descriptor) (bool, int64, error) {
+	published := config.Descriptor{Id: descriptor.Id, Typ: descriptor.Typ}
+	var timestamp sql.NullInt64
+	err := db.QueryRow("SELECT Config, Timestamp FROM "+pkiTable+" WHERE Id = ? AND Typ = ?", descriptor.Id, descriptor.Typ).Scan(&published.Config, &timestamp)
+	if err == sql.ErrNoRows {
+		return false, 0, nil
+	}
+	if err != nil {
+		return false, 0, err
+	}
+	return true, timestamp.Int64, checkKey(published, descriptor)
+}
+
+// checkKey returns ErrKeyMismatch if the descriptor is not signed with the key of the published descriptor.
+func checkKey(published, descriptor config.Descriptor) error {
+	publishedKey, err := PublicKey(published)
+	if err != nil {
+		return err
+	}
+	key, err := PublicKey(descriptor)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(publishedKey, key) {
+		return ErrKeyMismatch
+	}
+	return nil
+}
+
+// Document returns the network document of the latest published epoch, or the uploaded
+// descriptors if no epoch was published.
+func (a *LocalAuthority) Document() (config.NetworkDocument, error) {
+	db, err := a.open()
+	if err != nil {
+		return config.NetworkDocument{}, err
+	}
+	defer db.Close()
+
+	var data []byte
+	err = db.QueryRow("SELECT Document FROM " + snapshotTable + " ORDER BY Epoch DESC LIMIT 1").Scan(&data)
+	if err == sql.ErrNoRows {
+		return a.descriptors(db, a.getExpiry())
+	}
+	if err != nil {
+		return config.NetworkDocument{}, err
+	}
+	var document config.NetworkDocument
+	err = proto.Unmarshal(data, &document)
+	return document, err
+}
+
+// DocumentAt returns the network document published in the given epoch.
+func (a *LocalAuthority) DocumentAt(epoch uint64) (config.NetworkDocument, error) {
+	db, err := a.open()
+	if err != nil {
+		return config.NetworkDocument{}, err
+	}
+	defer db.Close()
+	return a.snapshot(db, epoch)
+}
+
+func (a *LocalAuthority) snapshot(db *sqlx.DB, epoch uint64) (config.NetworkDocument, error) {
+	var data []byte
+	err := db.QueryRow("SELECT Document FROM "+snapshotTable+" WHERE Epoch = ?", int64(epoch)).Scan(&data)
+	if err == sql.ErrNoRows {
+		return config.NetworkDocument{}, ErrUnknownEpoch
+	}
+	if err != nil {
+		return config.NetworkDocument{}, err
+	}
+	var document config.NetworkDocument
+	err = proto.Unmarshal(data, &document)
+	return document, err
+}
+
+// PublishEpoch publishes the network document of the given epoch, listing the uploaded descriptors.
+// The document of an epoch is never changed, hence publishing the same epoch again returns the document
+// published first. The documents of the epochs older than the kept epochs are removed.
+func (a *LocalAuthority) PublishEpoch(epoch uint64) (config.NetworkDocument, error) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	db, err := a.open()
+	if err != nil {
+		return config.NetworkDocument{}, err
+	}
+	defer db.Close()
+
+	published, err := a.snapshot(db, epoch)
+	if err != ErrUnknownEpoch {
+		return published, err
+	}
+	// the mutex is held, hence the expiry is read directly
+	document, err := a.descriptors(db, a.expiry)
+	if err != nil {
+		return config.NetworkDocument{}, err
+	}
+	document.Epoch = epoch
+	data, err := proto.Marshal(&document)
+	if err != nil {
+		return config.NetworkDocument{}, err
+	}
+	_, err = db.Exec("INSERT INTO "+snapshotTable+" (Epoch, Document) VALUES (?, ?)", int64(epoch), data)
+	if err != nil {
+		return config.NetworkDocument{}, err
+	}
+	_, err = db.Exec("DELETE FROM "+snapshotTable+" WHERE Epoch + ? <= (SELECT MAX(Epoch) FROM "+snapshotTable+")", keptEpochs)
+	if err != nil {
+		return config.NetworkDocument{}, err
+	}
+	return document, nil
+}
+
+// Run publishes the network document at the start of each epoch of the given duration, until the stop
+// channel is closed.
+func (a *LocalAuthority) Run(period time.Duration, stop <-chan struct{}) {
+	runEpochs(period, stop, []epochStep{{0, func(epoch uint64) error {
+		_, err := a.PublishEpoch(epoch)
+		return err
+	}}})
+}
+
+// descriptors returns the document of the uploaded descriptors of the live nodes and of the clients,
+// which is not bound to an epoch.
+func (a *LocalAuthority) descriptors(db *sqlx.DB, expiry time.Duration) (config.NetworkDocument, error) {
+	now := time.Now()
+	var document config.NetworkDocument
+	for _, typ := range []string{MixDescriptor, ProviderDescriptor, ClientDescriptor} {
+		rows, err := db.Query("SELECT Id, Config, Signature, Timestamp, LastSeen FROM "+pkiTable+" WHERE Typ = ? ORDER BY idx", typ)
+		if err != nil {
+			return config.NetworkDocument{}, err
+		}
+		for rows.Next() {
+			descriptor := &config.Descriptor{Typ: typ}
+			var timestamp, lastSeen sql.NullInt64
+			if err := rows.Scan(&descriptor.Id, &descriptor.Config, &descriptor.Signature, &timestamp, &lastSeen); err != nil {
+				rows.Close()
+				return config.NetworkDocument{}, err
+			}
+			descriptor.Timestamp = timestamp.Int64
+			if (Entry{Id: descriptor.Id, Typ: typ, LastSeen: time.Unix(lastSeen.Int64, 0)}).isStale(now, expiry) {
+				continue
+			}
+			document.Descriptors = append(document.Descriptors, descriptor)
+		}
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			return config.NetworkDocument{}, err
+		}
+	}
+	return document, nil
+}
+
+func (a *LocalAuthority) getExpiry() time.Duration {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	return a.expiry
+}
+
+// StaleEntries returns the entries of the nodes which were not seen within the expiry,
+// and are left out of the network document.
+func (a *LocalAuthority) StaleEntries() ([]Entry, error) {
+	db, err := a.open()
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	rows, err := db.Query("SELECT Id, Typ, LastSeen FROM " + pkiTable + " ORDER BY LastSeen")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	now, expiry := time.Now(), a.getExpiry()
+	var stale []Entry
+	for rows.Next() {
+		var entry Entry
+		var lastSeen sql.NullInt64
+		if err := rows.Scan(&entry.Id, &entry.Typ, &lastSeen); err != nil {
+			return nil, err
+		}
+		entry.LastSeen = time.Unix(lastSeen.Int64, 0)
+		if entry.isStale(now, expiry) {
+			stale = append(stale, entry)
+		}
+	}
+	return stale, rows.Err()
+}
@@ -0,0 +1,779 @@
+// Copyright 2018 The Loopix-Messaging Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package directory
+
+import (
+	"anonymous-messaging/config"
+	"anonymous-messaging/sphinx"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/protobuf/proto"
+	"github.com/stretchr/testify/assert"
+
+	"fmt"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// setupTestDirectory starts the directory authority service backed by a fresh local PKI database,
+// and returns the client of the service.
+func setupTestDirectory(t *testing.T) (*RemoteDirectory, func()) {
+	dir, err := ioutil.TempDir("", "directory")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(NewServer(NewLocalAuthority(filepath.Join(dir, "database.db"))).server.Handler)
+	return NewRemoteDirectory(server.URL), func() {
+		server.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+// newTestDescriptor creates the configuration of a mix and returns its descriptor signed
+// with a fresh key, and the signer of the mix.
+func newTestDescriptor(t *testing.T, id string) (config.Descriptor, Signer) {
+	pub, priv, err := sphinx.GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	configBytes, err := proto.Marshal(&config.MixConfig{Id: id, Host: "localhost", Port: "9999", PubKey: pub})
+	if err != nil {
+		t.Fatal(err)
+	}
+	descriptor, err := NewDescriptor(MixDescriptor, id, configBytes, KeySigner(priv))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return descriptor, KeySigner(priv)
+}
+
+func TestRemoteDirectory_UploadAndDocument(t *testing.T) {
+	d, cleanup := setupTestDirectory(t)
+	defer cleanup()
+
+	mix, sign := newTestDescriptor(t, "Mix1")
+	other, _ := newTestDescriptor(t, "Mix2")
+	if err := d.Upload(mix); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Upload(other); err != nil {
+		t.Fatal(err)
+	}
+	mix, err := NewDescriptor(MixDescriptor, "Mix1", mix.Config, sign)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Upload(mix); err != nil {
+		t.Fatal(err)
+	}
+
+	document, err := d.Document()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []*config.Descriptor{&mix, &other}, document.Descriptors,
+		"The uploaded descriptor should replace the previous descriptor of the node")
+
+	revocation, err := NewRevocation(MixDescriptor, "Mix1", mix.Config, sign)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Remove(revocation); err != nil {
+		t.Fatal(err)
+	}
+	document, err = d.Document()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []*config.Descriptor{&other}, document.Descriptors)
+}
+
+func TestRemoteDirectory_KeyMismatch(t *testing.T) {
+	d, cleanup := setupTestDirectory(t)
+	defer cleanup()
+
+	mix, _ := newTestDescriptor(t, "Mix1")
+	if err := d.Upload(mix); err != nil {
+		t.Fatal(err)
+	}
+	impostor, sign := newTestDescriptor(t, "Mix1")
+	err := d.Upload(impostor)
+	assert.EqualError(t, err, "the directory returned 403 Forbidden: "+ErrKeyMismatch.Error(),
+		"The descriptor of the node should not be replaced by another key")
+
+	revocation, err := NewRevocation(MixDescriptor, "Mix1", impostor.Config, sign)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = d.Remove(revocation)
+	assert.EqualError(t, err, "the directory returned 403 Forbidden: "+ErrKeyMismatch.Error(),
+		"The descriptor of the node should not be removed by another key")
+}
+
+func TestRemoteDirectory_InvalidDescriptor(t *testing.T) {
+	d, cleanup := setupTestDirectory(t)
+	defer cleanup()
+
+	mix, sign := newTestDescriptor(t, "Mix1")
+
+	unsigned := mix
+	unsigned.Signature = nil
+	err := d.Upload(unsigned)
+	assert.EqualError(t, err, "the directory returned 400 Bad Request: the descriptor is not signed")
+
+	tampered := mix
+	tampered.Id = "Mix2"
+	err = d.Upload(tampered)
+	assert.EqualError(t, err, "the directory returned 400 Bad Request: the id of the descriptor does not match its configuration")
+
+	err = d.Upload(config.Descriptor{Id: "Node", Typ: "Unknown", Config: mix.Config, Signature: mix.Signature})
+	assert.EqualError(t, err, "the directory returned 400 Bad Request: unknown type of the descriptor")
+
+	revocation, err := NewRevocation(MixDescriptor, "Mix1", mix.Config, sign)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = d.Upload(revocation)
+	assert.EqualError(t, err, "the directory returned 400 Bad Request: the signature of the descriptor is invalid",
+		"The revocation should not be accepted as a descriptor")
+}
+
+func TestVerify(t *testing.T) {
+	mix, _ := newTestDescriptor(t, "Mix1")
+	assert.Nil(t, Verify(mix))
+	assert.EqualError(t, VerifyRevocation(mix), "the signature of the descriptor is invalid",
+		"The descriptor should not be accepted as a revocation")
+
+	mix.Config = append(mix.Config, 0)
+	assert.NotNil(t, Verify(mix), "The modified configuration should not verify")
+}
+
+func TestOpen(t *testing.T) {
+	d, err := Open("http://localhost:8080")
+	assert.Nil(t, err)
+	_, remote := d.(*RemoteDirectory)
+	assert.True(t, remote, "The URL should open the directory authority service")
+	d, err = Open("pki/database.db")
+	assert.Nil(t, err)
+	_, local := d.(*LocalAuthority)
+	assert.True(t, local, "The path should open the local PKI database")
+	_, err = Open("pki/missing.json")
+	assert.NotNil(t, err, "The authority set should be read when the directory is opened")
+
+	d, err = Open("memory:test")
+	assert.Nil(t, err)
+	shared, err := Open("memory:test")
+	assert.Nil(t, err)
+	assert.True(t, d == shared, "The authority kept in memory should be shared by name")
+	d, err = Open("json:pki/authority.json")
+	assert.Nil(t, err)
+	_, jsonFile := d.(*JSONFileAuthority)
+	assert.True(t, jsonFile, "The json: prefix should open the authority kept in a JSON file")
+}
+
+// memoryDirectory keeps the uploaded descriptors in memory, as the store of the authorities in the tests.
+type memoryDirectory struct {
+	mutex       sync.Mutex
+	descriptors []*config.Descriptor
+}
+
+func (d *memoryDirectory) Upload(descriptor config.Descriptor) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	for i, published := range d.descriptors {
+		if published.Id == descriptor.Id && published.Typ == descriptor.Typ {
+			d.descriptors[i] = &descriptor
+			return nil
+		}
+	}
+	d.descriptors = append(d.descriptors, &descriptor)
+	return nil
+}
+
+func (d *memoryDirectory) Remove(revocation config.Descriptor) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	for i, published := range d.descriptors {
+		if published.Id == revocation.Id && published.Typ == revocation.Typ {
+			d.descriptors = append(d.descriptors[:i], d.descriptors[i+1:]...)
+			return nil
+		}
+	}
+	return nil
+}
+
+func (d *memoryDirectory) Document() (config.NetworkDocument, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return config.NetworkDocument{Descriptors: append([]*config.Descriptor{}, d.descriptors...)}, nil
+}
+
+func (d *memoryDirectory) DocumentAt(epoch uint64) (config.NetworkDocument, error) {
+	return config.NetworkDocument{}, ErrUnknownEpoch
+}
+
+// setupTestAuthorities creates the given number of in-process voting authorities, each a peer of all the others.
+func setupTestAuthorities(t *testing.T, n, threshold int) ([]*VotingAuthority, AuthoritySet) {
+	set := AuthoritySet{Threshold: threshold}
+	var signers []Signer
+	for i := 0; i < n; i++ {
+		pub, priv, err := sphinx.GenerateKeyPair()
+		if err != nil {
+			t.Fatal(err)
+		}
+		set.Authorities = append(set.Authorities, Authority{Id: fmt.Sprintf("Authority%d", i), PubKey: pub})
+		signers = append(signers, KeySigner(priv))
+	}
+	var authorities []*VotingAuthority
+	for i := range set.Authorities {
+		authority, err := NewVotingAuthority(set.Authorities[i].Id, signers[i], &memoryDirectory{}, set)
+		if err != nil {
+			t.Fatal(err)
+		}
+		authority.period = testPeriod
+		authorities = append(authorities, authority)
+	}
+	for i, authority := range authorities {
+		var peers []Peer
+		for j, peer := range authorities {
+			if i != j {
+				peers = append(peers, peer)
+			}
+		}
+		authority.SetPeers(peers)
+	}
+	return authorities, set
+}
+
+// testPeriod is the duration of the epochs of the test authorities, whose clock is set to the start
+// of each epoch of the consensus.
+const testPeriod = time.Hour
+
+func setEpoch(authorities []*VotingAuthority, epoch uint64) {
+	for _, authority := range authorities {
+		authority.now = func() time.Time { return epochStart(epoch, testPeriod) }
+	}
+}
+
+func runConsensus(t *testing.T, authorities []*VotingAuthority, epoch uint64) {
+	setEpoch(authorities, epoch)
+	for _, authority := range authorities {
+		if err := authority.ComputeConsensus(epoch); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, authority := range authorities {
+		if err := authority.CollectSignatures(epoch); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestVotingAuthority_Consensus(t *testing.T) {
+	authorities, set := setupTestAuthorities(t, 3, 2)
+
+	mix1, _ := newTestDescriptor(t, "Mix1")
+	mix2, _ := newTestDescriptor(t, "Mix2")
+	mix3, _ := newTestDescriptor(t, "Mix3")
+	for _, authority := range authorities {
+		authority.Upload(mix1)
+	}
+	authorities[0].Upload(mix2)
+	authorities[0].Upload(mix3)
+	authorities[1].Upload(mix3)
+
+	_, err := authorities[0].Document()
+	assert.EqualError(t, err, "no consensus on the network document has been reached yet")
+
+	runConsensus(t, authorities, 1)
+
+	expected, err := authorities[0].Document()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, uint64(1), expected.Epoch)
+	assert.Equal(t, []*config.Descriptor{&mix1, &mix3}, expected.Descriptors,
+		"Only the descriptors listed by the majority of the authorities should be in the consensus")
+	assert.Equal(t, 3, len(expected.Signatures))
+	assert.Nil(t, set.Verify(expected))
+	for _, authority := range authorities[1:] {
+		document, err := authority.Document()
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, Digest(expected), Digest(document), "All the authorities should agree on the document")
+	}
+}
+
+func TestVotingAuthority_Threshold(t *testing.T) {
+	authorities, _ := setupTestAuthorities(t, 3, 3)
+	// the last authority does not take part in the epoch
+	authorities[2].SetPeers(nil)
+	authorities[0].SetPeers([]Peer{authorities[1]})
+	authorities[1].SetPeers([]Peer{authorities[0]})
+
+	setEpoch(authorities, 1)
+	for _, authority := range authorities[:2] {
+		if err := authority.ComputeConsensus(1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := authorities[0].CollectSignatures(1)
+	assert.EqualError(t, err, "the network document is signed by 2 of the required 3 authorities")
+	_, err = authorities[0].Document()
+	assert.EqualError(t, err, "no consensus on the network document has been reached yet",
+		"The consensus below the threshold should not be published")
+}
+
+func TestVotingAuthority_VoteEpochs(t *testing.T) {
+	authorities, _ := setupTestAuthorities(t, 3, 2)
+	setEpoch(authorities, 5)
+
+	for _, epoch := range []uint64{5, 6} {
+		_, err := authorities[0].Vote(epoch)
+		assert.NoError(t, err, "The vote of the current and the next epoch should be served")
+	}
+	for _, epoch := range []uint64{4, 7, 1 << 40} {
+		_, err := authorities[0].Vote(epoch)
+		assert.EqualError(t, err, fmt.Sprintf("the vote of epoch %d is not served in epoch 5", epoch))
+	}
+	assert.Len(t, authorities[0].votes, 2, "The refused epochs should not be kept")
+
+	authorities[1].period = 0
+	_, err := authorities[1].Vote(5)
+	assert.EqualError(t, err, "the authority does not take part in the epochs")
+}
+
+func TestAuthoritySet_Validate(t *testing.T) {
+	authority := func(id string) Authority { return Authority{Id: id} }
+	set := AuthoritySet{Threshold: 2, Authorities: []Authority{authority("A"), authority("B"), authority("C")}}
+	assert.NoError(t, set.Validate())
+
+	set.Threshold = 1
+	assert.EqualError(t, set.Validate(), "the threshold must be a majority of the 3 authorities, got 1")
+
+	set.Threshold = 2
+	set.Authorities = append(set.Authorities, authority("D"))
+	assert.EqualError(t, set.Validate(), "the threshold must be a majority of the 4 authorities, got 2",
+		"A half of the authorities should not be a majority")
+
+	set.Threshold = 5
+	assert.EqualError(t, set.Validate(), "the threshold must be between 1 and the number of the authorities, got 5")
+
+	set.Threshold = 3
+	set.Authorities[3] = authority("A")
+	assert.EqualError(t, set.Validate(), "the authority A is listed twice")
+}
+
+func TestAuthoritySet_Verify(t *testing.T) {
+	authorities, set := setupTestAuthorities(t, 3, 2)
+	mix, _ := newTestDescriptor(t, "Mix1")
+	for _, authority := range authorities {
+		authority.Upload(mix)
+	}
+	runConsensus(t, authorities, 1)
+	document, err := authorities[0].Document()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	single := document
+	single.Signatures = []*config.AuthoritySignature{document.Signatures[0], document.Signatures[0]}
+	assert.EqualError(t, set.Verify(single), "the network document is signed by 1 of the required 2 authorities",
+		"The repeated signature of an authority should be counted once")
+
+	tampered := document
+	other, _ := newTestDescriptor(t, "Mix2")
+	tampered.Descriptors = append(append([]*config.Descriptor{}, document.Descriptors...), &other)
+	assert.EqualError(t, set.Verify(tampered), "the network document is signed by 0 of the required 2 authorities",
+		"The signatures should not cover the modified document")
+
+	replayed := document
+	replayed.Epoch = 2
+	assert.NotNil(t, set.Verify(replayed), "The signatures should not cover another epoch")
+
+	unknown, _ := setupTestAuthorities(t, 3, 2)
+	assert.NotNil(t, unknown[0].set.Verify(document), "The signatures of unknown authorities should not be counted")
+}
+
+func TestConsensusDirectory(t *testing.T) {
+	authorities, set := setupTestAuthorities(t, 3, 2)
+	var remotes []*RemoteDirectory
+	for i, authority := range authorities {
+		server := httptest.NewServer(NewServer(authority).server.Handler)
+		defer server.Close()
+		set.Authorities[i].URL = server.URL
+		remotes = append(remotes, NewRemoteDirectory(server.URL))
+	}
+	// the authorities reach each other over HTTP
+	for i, authority := range authorities {
+		var peers []Peer
+		for j, remote := range remotes {
+			if i != j {
+				peers = append(peers, remote)
+			}
+		}
+		authority.SetPeers(peers)
+	}
+
+	d := NewConsensusDirectory(set)
+	_, err := d.Document()
+	assert.EqualError(t, err, "no authority served a network document signed by enough authorities")
+
+	mix, _ := newTestDescriptor(t, "Mix1")
+	if err := d.Upload(mix); err != nil {
+		t.Fatal(err)
+	}
+	runConsensus(t, authorities, 7)
+
+	document, err := d.Document()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, uint64(7), document.Epoch)
+	assert.Equal(t, []*config.Descriptor{&mix}, document.Descriptors)
+
+	runConsensus(t, authorities, 8)
+	document, err = d.DocumentAt(7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, uint64(7), document.Epoch, "The documents of the earlier epochs should be served")
+	_, err = d.DocumentAt(9)
+	assert.NotNil(t, err)
+}
+
+func TestLocalAuthority_PublishEpoch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "directory")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	a := NewLocalAuthority(filepath.Join(dir, "database.db"))
+
+	mix, _ := newTestDescriptor(t, "Mix1")
+	if err := a.Upload(mix); err != nil {
+		t.Fatal(err)
+	}
+	published, err := a.PublishEpoch(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, _ := newTestDescriptor(t, "Mix2")
+	if err := a.Upload(other); err != nil {
+		t.Fatal(err)
+	}
+
+	again, err := a.PublishEpoch(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, Digest(published), Digest(again), "The document of an epoch should not change")
+	document, err := a.Document()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, Digest(published), Digest(document), "The document of the latest epoch should be served")
+
+	next, err := a.PublishEpoch(4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 2, len(next.Descriptors))
+	document, err = a.DocumentAt(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, Digest(published), Digest(document))
+	_, err = a.DocumentAt(5)
+	assert.Equal(t, ErrUnknownEpoch, err)
+}
+
+func TestDigest(t *testing.T) {
+	mix, _ := newTestDescriptor(t, "Mix1")
+	document := config.NetworkDocument{Epoch: 1, Descriptors: []*config.Descriptor{&mix}}
+	digest := Digest(document)
+
+	signed := document
+	signed.Signatures = []*config.AuthoritySignature{{AuthorityId: "Authority", Signature: []byte{1}}}
+	assert.Equal(t, digest, Digest(signed), "The signatures should not change the digest")
+
+	other, _ := newTestDescriptor(t, "Mix2")
+	extended := document
+	extended.Descriptors = []*config.Descriptor{&mix, &other}
+	assert.NotEqual(t, digest, Digest(extended), "The descriptors should be covered by the digest")
+
+	next := document
+	next.Epoch = 2
+	assert.NotEqual(t, digest, Digest(next), "The epoch should be covered by the digest")
+}
+
+func TestEntry_IsStale(t *testing.T) {
+	now := time.Now()
+	mix := Entry{Id: "Mix1", Typ: MixDescriptor, LastSeen: now.Add(-time.Hour)}
+	assert.True(t, mix.isStale(now, time.Minute))
+	assert.False(t, mix.isStale(now, 2*time.Hour))
+	assert.False(t, mix.isStale(now, 0), "The zero expiry should keep all the nodes")
+
+	client := Entry{Id: "Client1", Typ: ClientDescriptor, LastSeen: now.Add(-time.Hour)}
+	assert.False(t, client.isStale(now, time.Minute), "The descriptors of the clients should not expire")
+}
+
+func TestLocalAuthority_Expiry(t *testing.T) {
+	dir, err := ioutil.TempDir("", "directory")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	a := NewLocalAuthority(filepath.Join(dir, "database.db"))
+	a.SetExpiry(time.Minute)
+
+	dead, _ := newTestDescriptor(t, "Mix1")
+	alive, _ := newTestDescriptor(t, "Mix2")
+	for _, descriptor := range []config.Descriptor{dead, alive} {
+		if err := a.Upload(descriptor); err != nil {
+			t.Fatal(err)
+		}
+	}
+	db, err := a.open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Exec("UPDATE "+pkiTable+" SET LastSeen = ? WHERE Id = ?", time.Now().Add(-time.Hour).Unix(), "Mix1")
+	db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stale, err := a.StaleEntries()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 1, len(stale))
+	assert.Equal(t, "Mix1", stale[0].Id)
+	document, err := a.PublishEpoch(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []*config.Descriptor{&alive}, document.Descriptors, "The dead node should be left out of the document")
+
+	// the heartbeat brings the node back in the next epoch
+	if err := a.Upload(dead); err != nil {
+		t.Fatal(err)
+	}
+	document, err = a.PublishEpoch(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 2, len(document.Descriptors))
+}
+
+// testEpochAuthority checks the uploads, the removals, the epochs and the expiry of the authority.
+func testEpochAuthority(t *testing.T, a EpochAuthority) {
+	mix, signMix := newTestDescriptor(t, "Mix1")
+	if err := a.Upload(mix); err != nil {
+		t.Fatal(err)
+	}
+	forged, _ := newTestDescriptor(t, "Mix1")
+	assert.Equal(t, ErrKeyMismatch, a.Upload(forged), "The descriptor of another owner should be rejected")
+
+	document, err := a.Document()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []*config.Descriptor{&mix}, document.Descriptors, "The uploads should be listed before the first epoch")
+
+	published, err := a.PublishEpoch(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, signOther := newTestDescriptor(t, "Mix2")
+	if err := a.Upload(other); err != nil {
+		t.Fatal(err)
+	}
+	document, err = a.Document()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, Digest(published), Digest(document), "The document of the latest epoch should be served")
+	_, err = a.DocumentAt(2)
+	assert.Equal(t, ErrUnknownEpoch, err)
+
+	revocation, err := NewRevocation(MixDescriptor, "Mix1", mix.Config, signMix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Remove(revocation); err != nil {
+		t.Fatal(err)
+	}
+	next, err := a.PublishEpoch(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []*config.Descriptor{&other}, next.Descriptors)
+
+	stale, err := a.StaleEntries()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 0, len(stale))
+	a.SetExpiry(time.Nanosecond)
+	time.Sleep(time.Millisecond)
+	stale, err = a.StaleEntries()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 1, len(stale), "The node without heartbeats should be stale")
+	last, err := a.PublishEpoch(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 0, len(last.Descriptors), "The stale node should be left out of the document")
+
+	old := signedAt(t, descriptorPurpose, other, signOther, time.Now().Add(-time.Hour).Unix())
+	assert.Equal(t, ErrStaleDescriptor, a.Upload(old), "The descriptor signed long ago should be rejected")
+	newer := signedAt(t, descriptorPurpose, other, signOther, other.Timestamp+1)
+	if err := a.Upload(newer); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, ErrStaleDescriptor, a.Upload(other), "The replayed older descriptor should be rejected")
+	replayed := signedAt(t, revocationPurpose, other, signOther, other.Timestamp)
+	assert.Equal(t, ErrStaleDescriptor, a.Remove(replayed), "The revocation older than the published descriptor should be rejected")
+
+	a.SetExpiry(time.Minute)
+	third, signThird := newTestDescriptor(t, "Mix3")
+	late := signedAt(t, descriptorPurpose, third, signThird, time.Now().Add(-2*time.Minute).Unix())
+	if err := a.Upload(late); err != nil {
+		t.Fatal(err)
+	}
+	stale, err = a.StaleEntries()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 1, len(stale), "The node should be seen at the time of the signature, not of the upload")
+}
+
+// testPruneEpochs checks that the authority serves the documents of the kept epochs only.
+func testPruneEpochs(t *testing.T, a EpochAuthority) {
+	for _, epoch := range []uint64{1, 2, keptEpochs} {
+		if _, err := a.PublishEpoch(epoch); err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, err := a.DocumentAt(1)
+	assert.NoError(t, err, "The documents of the kept epochs should be served")
+
+	if _, err := a.PublishEpoch(keptEpochs + 1); err != nil {
+		t.Fatal(err)
+	}
+	_, err = a.DocumentAt(1)
+	assert.Equal(t, ErrUnknownEpoch, err, "The documents older than the kept epochs should be removed")
+	for _, epoch := range []uint64{2, keptEpochs, keptEpochs + 1} {
+		document, err := a.DocumentAt(epoch)
+		if assert.NoError(t, err) {
+			assert.Equal(t, epoch, document.Epoch)
+		}
+	}
+}
+
+// signedAt signs the descriptor again with the given timestamp.
+func signedAt(t *testing.T, purpose string, descriptor config.Descriptor, sign Signer, timestamp int64) config.Descriptor {
+	descriptor.Timestamp = timestamp
+	signature, err := sign(signedData(purpose, descriptor))
+	if err != nil {
+		t.Fatal(err)
+	}
+	descriptor.Signature = signature
+	return descriptor
+}
+
+func TestLocalAuthority_MigrateSchema(t *testing.T) {
+	dir, err := ioutil.TempDir("", "directory")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "database.db")
+
+	db, err := sqlx.Connect("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Exec("CREATE TABLE " + pkiTable + " (idx INTEGER PRIMARY KEY, Id TEXT, Typ TEXT, Config BLOB)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Exec("INSERT INTO "+pkiTable+" (Id, Typ, Config) VALUES (?, ?, ?)", "Old", MixDescriptor, []byte{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	a := NewLocalAuthority(path)
+	mix, _ := newTestDescriptor(t, "Mix1")
+	if err := a.Upload(mix); err != nil {
+		t.Fatal(err)
+	}
+	document, err := a.Document()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 1, len(document.Descriptors), "The unsigned descriptors of the older database should be left out")
+	assert.Equal(t, mix, *document.Descriptors[0], "The uploads should be accepted by the migrated table")
+}
+
+func TestLocalAuthority_PruneEpochs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "directory")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	testPruneEpochs(t, NewLocalAuthority(filepath.Join(dir, "database.db")))
+}
+
+func TestMemoryAuthority(t *testing.T) {
+	testEpochAuthority(t, NewMemoryAuthority())
+	testPruneEpochs(t, NewMemoryAuthority())
+}
+
+func TestJSONFileAuthority(t *testing.T) {
+	dir, err := ioutil.TempDir("", "directory")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "authority.json")
+	testEpochAuthority(t, NewJSONFileAuthority(path))
+
+	reopened := NewJSONFileAuthority(path)
+	document, err := reopened.DocumentAt(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, uint64(3), document.Epoch, "The published epochs should be kept in the file")
+	reopened.SetExpiry(time.Nanosecond)
+	stale, err := reopened.StaleEntries()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 2, len(stale), "The descriptors should be kept in the file")
+
+	testPruneEpochs(t, NewJSONFileAuthority(filepath.Join(dir, "pruned.json")))
+}
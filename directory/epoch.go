@@ -0,0 +1,73 @@
+// Copyright 2018 The Loopix-Messaging Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package directory
+
+import (
+	"errors"
+	"time"
+)
+
+// The network document is published once per epoch, and is not changed during the epoch. The epochs
+// are numbered from the Unix epoch, hence the authorities with the same epoch duration number them
+// in the same way. The nodes and the clients which hold the document of the same epoch can compare
+// its digest to check that they build the paths from the same view of the network.
+
+// keptEpochs is the number of the past epochs whose network documents are served by the authority.
+const keptEpochs = 24
+
+// ErrUnknownEpoch is returned when no network document was published for the requested epoch.
+var ErrUnknownEpoch = errors.New("no network document of the given epoch")
+
+// EpochAt returns the number of the epoch of the given duration at the given time.
+func EpochAt(t time.Time, period time.Duration) uint64 {
+	return uint64(t.UnixNano() / int64(period))
+}
+
+// epochStart returns the start of the epoch of the given duration.
+func epochStart(epoch uint64, period time.Duration) time.Time {
+	return time.Unix(0, int64(epoch)*int64(period))
+}
+
+// runEpochs calls the steps at the given offsets into each epoch of the given duration, until
+// the stop channel is closed. The steps whose time has passed are called at once, hence the
+// authority started during an epoch still takes part in it.
+func runEpochs(period time.Duration, stop <-chan struct{}, steps []epochStep) {
+	for {
+		now := time.Now()
+		epoch := EpochAt(now, period)
+		start := epochStart(epoch, period)
+		for _, step := range steps {
+			select {
+			case <-stop:
+				return
+			case <-time.After(time.Until(start.Add(step.offset))):
+			}
+			if err := step.run(epoch); err != nil {
+				logLocal.WithError(err).Errorf("Error in publishing the network document of epoch %d", epoch)
+			}
+		}
+
+		select {
+		case <-stop:
+			return
+		case <-time.After(time.Until(start.Add(period))):
+		}
+	}
+}
+
+type epochStep struct {
+	offset time.Duration
+	run    func(epoch uint64) error
+}
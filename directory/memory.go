@@ -0,0 +1,421 @@
+// Copyright 2018 The Loopix-Messaging Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package directory
+
+import (
+	"anonymous-messaging/config"
+
+	"github.com/protobuf/proto"
+
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// EpochAuthority is a single directory authority, which publishes the network document of each epoch
+// on its own and leaves out the nodes without heartbeats. It is implemented by the authorities kept
+// in the SQLite database, in memory and in a JSON file.
+type EpochAuthority interface {
+	Directory
+	// PublishEpoch publishes the network document of the given epoch, see LocalAuthority.PublishEpoch.
+	PublishEpoch(epoch uint64) (config.NetworkDocument, error)
+	// StaleEntries returns the entries of the nodes which were not seen within the expiry.
+	StaleEntries() ([]Entry, error)
+	// SetExpiry sets the time after which the nodes without heartbeats are left out.
+	SetExpiry(expiry time.Duration)
+	// Run publishes the network document at the start of each epoch, until the stop channel is closed.
+	Run(period time.Duration, stop <-chan struct{})
+}
+
+// record is a published descriptor with the time of its last upload.
+type record struct {
+	Id        string    `json:"id"`
+	Typ       string    `json:"type"`
+	Config    []byte    `json:"config"`
+	Signature []byte    `json:"signature"`
+	Timestamp int64     `json:"timestamp"`
+	LastSeen  time.Time `json:"lastSeen"`
+}
+
+func (r record) descriptor() config.Descriptor {
+	return config.Descriptor{Id: r.Id, Typ: r.Typ, Config: r.Config, Signature: r.Signature, Timestamp: r.Timestamp}
+}
+
+// snapshot is the encoded network document published in an epoch.
+type snapshot struct {
+	Epoch    uint64 `json:"epoch"`
+	Document []byte `json:"document"`
+}
+
+// authorityState is the content of the authority kept in memory or in a JSON file. The descriptors
+// are kept in the order of their first upload, as in the SQLite database.
+type authorityState struct {
+	Records   []record   `json:"descriptors"`
+	Snapshots []snapshot `json:"snapshots"`
+}
+
+func (s *authorityState) find(typ, id string) int {
+	for i, r := range s.Records {
+		if r.Typ == typ && r.Id == id {
+			return i
+		}
+	}
+	return -1
+}
+
+func (s *authorityState) upload(descriptor config.Descriptor, now time.Time) error {
+	if err := Verify(descriptor); err != nil {
+		return err
+	}
+	r := record{Id: descriptor.Id, Typ: descriptor.Typ, Config: descriptor.Config, Signature: descriptor.Signature,
+		Timestamp: descriptor.Timestamp, LastSeen: lastSeen(descriptor, now)}
+	i := s.find(descriptor.Typ, descriptor.Id)
+	if i < 0 {
+		if err := checkFresh(descriptor, 0, now); err != nil {
+			return err
+		}
+		s.Records = append(s.Records, r)
+		return nil
+	}
+	if err := checkKey(s.Records[i].descriptor(), descriptor); err != nil {
+		return err
+	}
+	if err := checkFresh(descriptor, s.Records[i].Timestamp, now); err != nil {
+		return err
+	}
+	s.Records[i] = r
+	return nil
+}
+
+func (s *authorityState) remove(revocation config.Descriptor, now time.Time) error {
+	if err := VerifyRevocation(revocation); err != nil {
+		return err
+	}
+	i := s.find(revocation.Typ, revocation.Id)
+	if i < 0 {
+		return nil
+	}
+	if err := checkKey(s.Records[i].descriptor(), revocation); err != nil {
+		return err
+	}
+	if err := checkFresh(revocation, s.Records[i].Timestamp, now); err != nil {
+		return err
+	}
+	s.Records = append(s.Records[:i], s.Records[i+1:]...)
+	return nil
+}
+
+// descriptors returns the document of the descriptors of the live nodes and of the clients.
+func (s *authorityState) descriptors(now time.Time, expiry time.Duration) config.NetworkDocument {
+	var document config.NetworkDocument
+	for _, typ := range []string{MixDescriptor, ProviderDescriptor, ClientDescriptor} {
+		for _, r := range s.Records {
+			if r.Typ != typ || (Entry{Id: r.Id, Typ: r.Typ, LastSeen: r.LastSeen}).isStale(now, expiry) {
+				continue
+			}
+			descriptor := r.descriptor()
+			document.Descriptors = append(document.Descriptors, &descriptor)
+		}
+	}
+	return document
+}
+
+func (s *authorityState) document(now time.Time, expiry time.Duration) (config.NetworkDocument, error) {
+	if len(s.Snapshots) == 0 {
+		return s.descriptors(now, expiry), nil
+	}
+	latest := s.Snapshots[0]
+	for _, snapshot := range s.Snapshots {
+		if snapshot.Epoch > latest.Epoch {
+			latest = snapshot
+		}
+	}
+	var document config.NetworkDocument
+	err := proto.Unmarshal(latest.Document, &document)
+	return document, err
+}
+
+func (s *authorityState) documentAt(epoch uint64) (config.NetworkDocument, error) {
+	for _, snapshot := range s.Snapshots {
+		if snapshot.Epoch == epoch {
+			var document config.NetworkDocument
+			err := proto.Unmarshal(snapshot.Document, &document)
+			return document, err
+		}
+	}
+	return config.NetworkDocument{}, ErrUnknownEpoch
+}
+
+func (s *authorityState) publishEpoch(epoch uint64, now time.Time, expiry time.Duration) (config.NetworkDocument, error) {
+	if published, err := s.documentAt(epoch); err != ErrUnknownEpoch {
+		return published, err
+	}
+	document := s.descriptors(now, expiry)
+	document.Epoch = epoch
+	data, err := proto.Marshal(&document)
+	if err != nil {
+		return config.NetworkDocument{}, err
+	}
+	s.Snapshots = append(s.Snapshots, snapshot{Epoch: epoch, Document: data})
+	s.pruneSnapshots()
+	return document, nil
+}
+
+// pruneSnapshots removes the snapshots of the epochs older than the kept epochs before the latest one.
+func (s *authorityState) pruneSnapshots() {
+	var latest uint64
+	for _, snapshot := range s.Snapshots {
+		if snapshot.Epoch > latest {
+			latest = snapshot.Epoch
+		}
+	}
+	kept := s.Snapshots[:0]
+	for _, snapshot := range s.Snapshots {
+		if snapshot.Epoch+keptEpochs > latest {
+			kept = append(kept, snapshot)
+		}
+	}
+	s.Snapshots = kept
+}
+
+func (s *authorityState) staleEntries(now time.Time, expiry time.Duration) []Entry {
+	var stale []Entry
+	for _, r := range s.Records {
+		entry := Entry{Id: r.Id, Typ: r.Typ, LastSeen: r.LastSeen}
+		if entry.isStale(now, expiry) {
+			stale = append(stale, entry)
+		}
+	}
+	return stale
+}
+
+// MemoryAuthority is the directory authority keeping the descriptors in memory, e.g., for the tests
+// or for the network run in a single process. It behaves as the LocalAuthority.
+type MemoryAuthority struct {
+	mutex  sync.Mutex
+	state  authorityState
+	expiry time.Duration
+}
+
+// NewMemoryAuthority creates an empty authority kept in memory.
+func NewMemoryAuthority() *MemoryAuthority {
+	return &MemoryAuthority{expiry: DefaultExpiry}
+}
+
+// memoryAuthorities are the authorities opened by name, which are shared within the process.
+var memoryAuthorities = struct {
+	sync.Mutex
+	byName map[string]*MemoryAuthority
+}{byName: make(map[string]*MemoryAuthority)}
+
+// sharedMemoryAuthority returns the authority kept in memory with the given name, creating it if needed.
+func sharedMemoryAuthority(name string) *MemoryAuthority {
+	memoryAuthorities.Lock()
+	defer memoryAuthorities.Unlock()
+	a, ok := memoryAuthorities.byName[name]
+	if !ok {
+		a = NewMemoryAuthority()
+		memoryAuthorities.byName[name] = a
+	}
+	return a
+}
+
+func (a *MemoryAuthority) SetExpiry(expiry time.Duration) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.expiry = expiry
+}
+
+func (a *MemoryAuthority) Upload(descriptor config.Descriptor) error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	return a.state.upload(descriptor, time.Now())
+}
+
+func (a *MemoryAuthority) Remove(revocation config.Descriptor) error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	return a.state.remove(revocation, time.Now())
+}
+
+func (a *MemoryAuthority) Document() (config.NetworkDocument, error) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	return a.state.document(time.Now(), a.expiry)
+}
+
+func (a *MemoryAuthority) DocumentAt(epoch uint64) (config.NetworkDocument, error) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	return a.state.documentAt(epoch)
+}
+
+func (a *MemoryAuthority) PublishEpoch(epoch uint64) (config.NetworkDocument, error) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	return a.state.publishEpoch(epoch, time.Now(), a.expiry)
+}
+
+func (a *MemoryAuthority) StaleEntries() ([]Entry, error) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	return a.state.staleEntries(time.Now(), a.expiry), nil
+}
+
+func (a *MemoryAuthority) Run(period time.Duration, stop <-chan struct{}) {
+	runEpochs(period, stop, []epochStep{{0, func(epoch uint64) error {
+		_, err := a.PublishEpoch(epoch)
+		return err
+	}}})
+}
+
+// JSONFileAuthority is the directory authority keeping the descriptors in a JSON file, which is read
+// and written at each operation. The file is written by a single process, like the SQLite database
+// of the LocalAuthority, but it can be read and edited by hand.
+type JSONFileAuthority struct {
+	mutex  sync.Mutex
+	path   string
+	expiry time.Duration
+}
+
+// NewJSONFileAuthority creates the authority kept in the JSON file at the given path. The file
+// is created at the first upload.
+func NewJSONFileAuthority(path string) *JSONFileAuthority {
+	return &JSONFileAuthority{path: path, expiry: DefaultExpiry}
+}
+
+func (a *JSONFileAuthority) load() (authorityState, error) {
+	var state authorityState
+	data, err := ioutil.ReadFile(a.path)
+	if os.IsNotExist(err) {
+		return state, nil
+	}
+	if err != nil {
+		return state, err
+	}
+	err = json.Unmarshal(data, &state)
+	return state, err
+}
+
+// save replaces the file with the given state. The state is written to a temporary file first,
+// hence the readers never see a partly written file.
+func (a *JSONFileAuthority) save(state authorityState) error {
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(a.path), filepath.Base(a.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), a.path)
+}
+
+// update applies the change to the state kept in the file, and saves the changed state.
+func (a *JSONFileAuthority) update(change func(state *authorityState) error) error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	state, err := a.load()
+	if err != nil {
+		return err
+	}
+	if err := change(&state); err != nil {
+		return err
+	}
+	return a.save(state)
+}
+
+// read passes the state kept in the file to the given function.
+func (a *JSONFileAuthority) read(use func(state *authorityState, expiry time.Duration) error) error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	state, err := a.load()
+	if err != nil {
+		return err
+	}
+	return use(&state, a.expiry)
+}
+
+func (a *JSONFileAuthority) SetExpiry(expiry time.Duration) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.expiry = expiry
+}
+
+func (a *JSONFileAuthority) Upload(descriptor config.Descriptor) error {
+	return a.update(func(state *authorityState) error {
+		return state.upload(descriptor, time.Now())
+	})
+}
+
+func (a *JSONFileAuthority) Remove(revocation config.Descriptor) error {
+	return a.update(func(state *authorityState) error {
+		return state.remove(revocation, time.Now())
+	})
+}
+
+func (a *JSONFileAuthority) Document() (document config.NetworkDocument, err error) {
+	err = a.read(func(state *authorityState, expiry time.Duration) error {
+		document, err = state.document(time.Now(), expiry)
+		return err
+	})
+	return document, err
+}
+
+func (a *JSONFileAuthority) DocumentAt(epoch uint64) (document config.NetworkDocument, err error) {
+	err = a.read(func(state *authorityState, _ time.Duration) error {
+		document, err = state.documentAt(epoch)
+		return err
+	})
+	return document, err
+}
+
+func (a *JSONFileAuthority) PublishEpoch(epoch uint64) (document config.NetworkDocument, err error) {
+	err = a.update(func(state *authorityState) error {
+		// the mutex is held by update, hence the expiry is read directly
+		document, err = state.publishEpoch(epoch, time.Now(), a.expiry)
+		return err
+	})
+	return document, err
+}
+
+func (a *JSONFileAuthority) StaleEntries() (stale []Entry, err error) {
+	err = a.read(func(state *authorityState, expiry time.Duration) error {
+		stale = state.staleEntries(time.Now(), expiry)
+		return nil
+	})
+	return stale, err
+}
+
+func (a *JSONFileAuthority) Run(period time.Duration, stop <-chan struct{}) {
+	runEpochs(period, stop, []epochStep{{0, func(epoch uint64) error {
+		_, err := a.PublishEpoch(epoch)
+		return err
+	}}})
+}
@@ -0,0 +1,122 @@
+// Copyright 2018 The Loopix-Messaging Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package directory
+
+import (
+	"anonymous-messaging/config"
+
+	"github.com/protobuf/proto"
+
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// requestTimeout is the timeout of the requests to the directory authority service.
+const requestTimeout = 10 * time.Second
+
+// RemoteDirectory is the client of the directory authority service.
+type RemoteDirectory struct {
+	url    string
+	client *http.Client
+}
+
+// NewRemoteDirectory creates the client of the directory authority service at the given URL.
+func NewRemoteDirectory(address string) *RemoteDirectory {
+	return &RemoteDirectory{url: strings.TrimSuffix(address, "/"), client: &http.Client{Timeout: requestTimeout}}
+}
+
+func (d *RemoteDirectory) Upload(descriptor config.Descriptor) error {
+	return d.post("/descriptors", descriptor)
+}
+
+func (d *RemoteDirectory) Remove(revocation config.Descriptor) error {
+	return d.post("/revocations", revocation)
+}
+
+func (d *RemoteDirectory) post(path string, descriptor config.Descriptor) error {
+	data, err := proto.Marshal(&descriptor)
+	if err != nil {
+		return err
+	}
+	request, err := http.NewRequest(http.MethodPost, d.url+path, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", protobufContentType)
+	_, err = d.do(request)
+	return err
+}
+
+func (d *RemoteDirectory) Document() (config.NetworkDocument, error) {
+	var document config.NetworkDocument
+	err := d.get("/document", &document)
+	return document, err
+}
+
+func (d *RemoteDirectory) DocumentAt(epoch uint64) (config.NetworkDocument, error) {
+	var document config.NetworkDocument
+	err := d.get("/document?epoch="+strconv.FormatUint(epoch, 10), &document)
+	return document, err
+}
+
+// Vote returns the vote of the authority for the given epoch.
+func (d *RemoteDirectory) Vote(epoch uint64) (config.NetworkDocument, error) {
+	var vote config.NetworkDocument
+	err := d.get("/vote?epoch="+strconv.FormatUint(epoch, 10), &vote)
+	return vote, err
+}
+
+// ConsensusSignature returns the signature of the authority over its consensus for the given epoch.
+func (d *RemoteDirectory) ConsensusSignature(epoch uint64) (config.AuthoritySignature, error) {
+	var signature config.AuthoritySignature
+	err := d.get("/signature?epoch="+strconv.FormatUint(epoch, 10), &signature)
+	return signature, err
+}
+
+func (d *RemoteDirectory) get(path string, message proto.Message) error {
+	request, err := http.NewRequest(http.MethodGet, d.url+path, nil)
+	if err != nil {
+		return err
+	}
+	data, err := d.do(request)
+	if err != nil {
+		return err
+	}
+	return proto.Unmarshal(data, message)
+}
+
+// do sends the request to the service and returns the body of the response,
+// or the error reported by the service.
+func (d *RemoteDirectory) do(request *http.Request) ([]byte, error) {
+	response, err := d.client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode/100 != 2 {
+		return nil, fmt.Errorf("the directory returned %s: %s", response.Status, strings.TrimSpace(string(body)))
+	}
+	return body, nil
+}
@@ -0,0 +1,196 @@
+// Copyright 2018 The Loopix-Messaging Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package directory
+
+import (
+	"anonymous-messaging/config"
+
+	"github.com/protobuf/proto"
+
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+)
+
+// The directory authority service serves the encoded protobuf messages over HTTP:
+//
+//	GET  /document          -> the NetworkDocument of the latest epoch
+//	GET  /document?epoch=N  -> the NetworkDocument of the epoch N
+//	POST /descriptors  the signed Descriptor to upload
+//	POST /revocations  the signed revocation of the published Descriptor
+//
+// The authorities taking part in the consensus also serve to each other:
+//
+//	GET  /vote?epoch=N       -> the signed vote, a NetworkDocument
+//	GET  /signature?epoch=N  -> the AuthoritySignature over the consensus
+//
+// The errors are returned as plain text.
+
+const (
+	protobufContentType = "application/x-protobuf"
+	// maxDescriptorSize is the limit of the size of the uploaded descriptors
+	maxDescriptorSize = 64 * 1024
+)
+
+// Server serves the directory over HTTP.
+type Server struct {
+	directory Directory
+	server    *http.Server
+}
+
+// NewServer creates the server of the given directory.
+func NewServer(d Directory) *Server {
+	s := &Server{directory: d}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/document", s.handleDocument)
+	mux.HandleFunc("/descriptors", s.handleDescriptor(Verify, s.directory.Upload))
+	mux.HandleFunc("/revocations", s.handleDescriptor(VerifyRevocation, s.directory.Remove))
+	if peer, ok := d.(Peer); ok {
+		mux.HandleFunc("/vote", s.handleEpoch(func(epoch uint64) (proto.Message, error) {
+			vote, err := peer.Vote(epoch)
+			return &vote, err
+		}))
+		mux.HandleFunc("/signature", s.handleEpoch(func(epoch uint64) (proto.Message, error) {
+			signature, err := peer.ConsensusSignature(epoch)
+			return &signature, err
+		}))
+	}
+	s.server = &http.Server{Handler: mux}
+	return s
+}
+
+// Serve serves the requests on the given listener, until the server is closed.
+func (s *Server) Serve(listener net.Listener) error {
+	err := s.server.Serve(listener)
+	if err == http.ErrServerClosed {
+		return nil
+	}
+	return err
+}
+
+// ListenAndServe serves the requests on the given address, until the server is closed.
+func (s *Server) ListenAndServe(address string) error {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+	return s.Serve(listener)
+}
+
+// Handler returns the handler of the requests, which serves the directory on another server.
+func (s *Server) Handler() http.Handler {
+	return s.server.Handler
+}
+
+// Close stops the server.
+func (s *Server) Close() error {
+	return s.server.Close()
+}
+
+func (s *Server) handleDocument(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "the method is not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var document config.NetworkDocument
+	var err error
+	if query := r.URL.Query().Get("epoch"); query != "" {
+		epoch, parseErr := strconv.ParseUint(query, 10, 64)
+		if parseErr != nil {
+			http.Error(w, "the epoch is invalid", http.StatusBadRequest)
+			return
+		}
+		document, err = s.directory.DocumentAt(epoch)
+		if err == ErrUnknownEpoch {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+	} else {
+		document, err = s.directory.Document()
+	}
+	if err != nil {
+		logLocal.WithError(err).Error("Error in serving the network document")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeMessage(w, &document)
+}
+
+// handleEpoch serves the message of the consensus for the epoch given in the query.
+func (s *Server) handleEpoch(message func(epoch uint64) (proto.Message, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "the method is not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		epoch, err := strconv.ParseUint(r.URL.Query().Get("epoch"), 10, 64)
+		if err != nil {
+			http.Error(w, "the epoch is invalid", http.StatusBadRequest)
+			return
+		}
+		m, err := message(epoch)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		writeMessage(w, m)
+	}
+}
+
+func writeMessage(w http.ResponseWriter, message proto.Message) {
+	data, err := proto.Marshal(message)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", protobufContentType)
+	w.Write(data)
+}
+
+// handleDescriptor reads the signed descriptor from the request, verifies it and passes it to the directory.
+func (s *Server) handleDescriptor(verify func(config.Descriptor) error, apply func(config.Descriptor) error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "the method is not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		data, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxDescriptorSize))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var descriptor config.Descriptor
+		if err := proto.Unmarshal(data, &descriptor); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := verify(descriptor); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		err = apply(descriptor)
+		if err == ErrKeyMismatch {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		if err != nil {
+			logLocal.WithError(err).Error("Error in updating the directory")
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
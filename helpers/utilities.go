@@ -20,18 +20,44 @@ package helpers
 
 import (
 	"anonymous-messaging/config"
-	"anonymous-messaging/pki"
-
-	"github.com/protobuf/proto"
 
+	crand "crypto/rand"
 	"crypto/sha256"
+	"encoding/binary"
 	"errors"
+	"io"
+	"io/ioutil"
+	"math"
 	"math/rand"
 	"net"
 	"os"
 	"time"
 )
 
+const (
+	// MaxPacketSize is the maximal size of a packet received over a connection.
+	MaxPacketSize = 512 * 1024
+	// PacketReadTimeout is the time within which the sender must write the whole packet.
+	PacketReadTimeout = 10 * time.Second
+)
+
+// ReadPacket reads the single packet from the connection, which the sender closes after writing
+// the packet. The packet must be written within the read timeout and must not exceed the maximal
+// size, hence a slow or malicious sender cannot hold the receiver or exhaust its memory.
+func ReadPacket(conn net.Conn) ([]byte, error) {
+	if err := conn.SetReadDeadline(time.Now().Add(PacketReadTimeout)); err != nil {
+		return nil, err
+	}
+	packet, err := ioutil.ReadAll(io.LimitReader(conn, MaxPacketSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(packet) > MaxPacketSize {
+		return nil, errors.New("the packet exceeds the maximal size")
+	}
+	return packet, nil
+}
+
 func Permute(slice []config.MixConfig) ([]config.MixConfig, error) {
 	if len(slice) == 0 {
 		return nil, errors.New(" cannot permute an empty list of mixes")
@@ -59,12 +85,20 @@ func RandomSample(slice []config.MixConfig, length int) ([]config.MixConfig, err
 	return permuted[:length], err
 }
 
+// RandomExponential draws a value from the exponential distribution with the given parameter.
+// The value is derived from the cryptographic source of randomness, hence the values drawn
+// by independent streams, e.g., the cover traffic of different identities, are not correlated.
 func RandomExponential(expParam float64) (float64, error) {
-	rand.Seed(time.Now().UTC().UnixNano())
 	if expParam <= 0.0 {
 		return 0.0, errors.New("the parameter of exponential distribution has to be larger than zero")
 	}
-	return rand.ExpFloat64() / expParam, nil
+	var buf [8]byte
+	if _, err := crand.Read(buf[:]); err != nil {
+		return 0.0, err
+	}
+	// a uniform value in (0, 1], built from the 53 bits of the mantissa
+	uniform := float64(binary.BigEndian.Uint64(buf[:])>>11+1) / (1 << 53)
+	return -math.Log(uniform) / expParam, nil
 }
 
 func ResolveTCPAddress(host, port string) (*net.TCPAddr, error) {
@@ -75,22 +109,6 @@ func ResolveTCPAddress(host, port string) (*net.TCPAddr, error) {
 	return addr, nil
 }
 
-// TO DO: This function is useless; remove it and change the code
-
-func AddToDatabase(pkiPath string, tableName, id, typ string, config []byte) error {
-	db, err := pki.OpenDatabase(pkiPath, "sqlite3")
-	if err != nil {
-		return err
-	}
-	defer db.Close()
-
-	err = pki.InsertIntoTable(db, tableName, id, typ, config)
-	if err != nil {
-		return err
-	}
-	return nil
-}
-
 func DirExists(path string) (bool, error) {
 	_, err := os.Stat(path)
 	if os.IsNotExist(err) {
@@ -109,68 +127,6 @@ func SHA256(arg []byte) []byte {
 	return h.Sum(nil)
 }
 
-func GetMixesPKI(pkiDir string) ([]config.MixConfig, error) {
-	var mixes []config.MixConfig
-
-	db, err := pki.OpenDatabase(pkiDir, "sqlite3")
-	if err != nil {
-		return nil, err
-	}
-
-	recordsMixes, err := pki.QueryDatabase(db, "Pki", "Mix")
-	if err != nil {
-		return nil, err
-	}
-
-	for recordsMixes.Next() {
-		result := make(map[string]interface{})
-		err := recordsMixes.MapScan(result)
-		if err != nil {
-			return nil, err
-		}
-
-		var mixConfig config.MixConfig
-		err = proto.Unmarshal(result["Config"].([]byte), &mixConfig)
-		if err != nil {
-			return nil, err
-		}
-		mixes = append(mixes, mixConfig)
-	}
-
-	return mixes, nil
-}
-
-func GetClientPKI(pkiDir string) ([]config.ClientConfig, error) {
-	var clients []config.ClientConfig
-
-	db, err := pki.OpenDatabase(pkiDir, "sqlite3")
-	if err != nil {
-		return nil, err
-	}
-
-	recordsClients, err := pki.QueryDatabase(db, "Pki", "Client")
-	if err != nil {
-		return nil, err
-	}
-	for recordsClients.Next() {
-		result := make(map[string]interface{})
-		err := recordsClients.MapScan(result)
-
-		if err != nil {
-			return nil, err
-		}
-
-		var clientConfig config.ClientConfig
-		err = proto.Unmarshal(result["Config"].([]byte), &clientConfig)
-		if err != nil {
-			return nil, err
-		}
-
-		clients = append(clients, clientConfig)
-	}
-	return clients, nil
-}
-
 func GetLocalIP() (string, error) {
 	ifaces, err := net.Interfaces()
 	if err != nil {
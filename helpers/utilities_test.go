@@ -19,8 +19,10 @@ import (
 
 	"github.com/stretchr/testify/assert"
 
+	"bytes"
 	"errors"
 	"fmt"
+	"net"
 	"os"
 	"reflect"
 	"sort"
@@ -158,3 +160,27 @@ func TestRandomSample_Fail(t *testing.T) {
 func TestResolveTCPAddress(t *testing.T) {
 	// TO DO: How this should be tested ? And should it even be tested it if it uses a build in function?
 }
+
+func TestReadPacket(t *testing.T) {
+	sender, receiver := net.Pipe()
+	go func() {
+		sender.Write([]byte("Packet"))
+		sender.Close()
+	}()
+	packet, err := ReadPacket(receiver)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []byte("Packet"), packet)
+}
+
+func TestReadPacket_TooLarge(t *testing.T) {
+	sender, receiver := net.Pipe()
+	go func() {
+		sender.Write(bytes.Repeat([]byte{1}, MaxPacketSize+1))
+		sender.Close()
+	}()
+	_, err := ReadPacket(receiver)
+	assert.EqualError(t, err, "the packet exceeds the maximal size")
+	receiver.Close()
+}
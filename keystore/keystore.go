@@ -0,0 +1,178 @@
+// Copyright 2018 The Loopix-Messaging Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+/*
+	Package keystore keeps the identity keys of the clients and the nodes on disk, so that they
+	keep their identity across restarts. The private keys are optionally encrypted with a key
+	derived from a passphrase.
+*/
+
+package keystore
+
+import (
+	"anonymous-messaging/sphinx"
+
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+const (
+	// the number of iterations of PBKDF2 deriving the encryption key from the passphrase
+	kdfIterations = 100000
+	saltSize      = 16
+	keySize       = 32
+)
+
+// keyFile is the format of the stored keys. The private key is stored either in plain,
+// or encrypted with AES-GCM under the key derived from the passphrase and the salt.
+type keyFile struct {
+	PublicKey           []byte `json:"publicKey"`
+	PrivateKey          []byte `json:"privateKey,omitempty"`
+	EncryptedPrivateKey []byte `json:"encryptedPrivateKey,omitempty"`
+	Salt                []byte `json:"salt,omitempty"`
+	Nonce               []byte `json:"nonce,omitempty"`
+}
+
+// Generate creates a fresh key pair and stores it at the given path. If the passphrase is not empty,
+// the private key is encrypted. Generate returns an error if the file already exists, so that
+// the existing identity is never overwritten.
+func Generate(path string, passphrase []byte) ([]byte, []byte, error) {
+	if _, err := os.Stat(path); err == nil {
+		return nil, nil, errors.New("the key file already exists")
+	}
+	pubKey, privKey, err := sphinx.GenerateKeyPair()
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := Save(path, pubKey, privKey, passphrase); err != nil {
+		return nil, nil, err
+	}
+	return pubKey, privKey, nil
+}
+
+// Save stores the key pair at the given path, readable only by the owner.
+func Save(path string, pubKey, privKey, passphrase []byte) error {
+	file := keyFile{PublicKey: pubKey}
+	if len(passphrase) == 0 {
+		file.PrivateKey = privKey
+	} else {
+		file.Salt = make([]byte, saltSize)
+		if _, err := rand.Read(file.Salt); err != nil {
+			return err
+		}
+		aead, err := newAEAD(passphrase, file.Salt)
+		if err != nil {
+			return err
+		}
+		file.Nonce = make([]byte, aead.NonceSize())
+		if _, err := rand.Read(file.Nonce); err != nil {
+			return err
+		}
+		file.EncryptedPrivateKey = aead.Seal(nil, file.Nonce, privKey, pubKey)
+	}
+
+	data, err := json.MarshalIndent(file, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, data, 0600)
+}
+
+// Load reads the key pair stored at the given path, decrypting the private key with the passphrase.
+func Load(path string, passphrase []byte) ([]byte, []byte, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	var file keyFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, nil, err
+	}
+
+	if file.EncryptedPrivateKey == nil {
+		if file.PublicKey == nil || file.PrivateKey == nil {
+			return nil, nil, errors.New("the key file is incomplete")
+		}
+		return file.PublicKey, file.PrivateKey, nil
+	}
+	if len(passphrase) == 0 {
+		return nil, nil, errors.New("the private key is encrypted, a passphrase is required")
+	}
+	aead, err := newAEAD(passphrase, file.Salt)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(file.Nonce) != aead.NonceSize() {
+		return nil, nil, errors.New("the key file is incomplete")
+	}
+	privKey, err := aead.Open(nil, file.Nonce, file.EncryptedPrivateKey, file.PublicKey)
+	if err != nil {
+		return nil, nil, errors.New("wrong passphrase or corrupted key file")
+	}
+	return file.PublicKey, privKey, nil
+}
+
+// LoadOrGenerate loads the key pair stored at the given path, or generates and stores
+// a fresh key pair on the first run.
+func LoadOrGenerate(path string, passphrase []byte) ([]byte, []byte, error) {
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return Generate(path, passphrase)
+	}
+	return Load(path, passphrase)
+}
+
+func newAEAD(passphrase, salt []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(pbkdf2(passphrase, salt, kdfIterations, keySize))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// pbkdf2 derives the key from the password following PBKDF2 with HMAC-SHA256, as defined in RFC 8018.
+func pbkdf2(password, salt []byte, iterations, keyLength int) []byte {
+	prf := hmac.New(sha256.New, password)
+	var key []byte
+	for block := uint32(1); len(key) < keyLength; block++ {
+		prf.Reset()
+		prf.Write(salt)
+		var counter [4]byte
+		binary.BigEndian.PutUint32(counter[:], block)
+		prf.Write(counter[:])
+		u := prf.Sum(nil)
+		t := append([]byte{}, u...)
+		for i := 1; i < iterations; i++ {
+			prf.Reset()
+			prf.Write(u)
+			u = prf.Sum(u[:0])
+			for j := range t {
+				t[j] ^= u[j]
+			}
+		}
+		key = append(key, t...)
+	}
+	return key[:keyLength]
+}
@@ -0,0 +1,102 @@
+// Copyright 2018 The Loopix-Messaging Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package keystore
+
+import (
+	"github.com/stretchr/testify/assert"
+
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func tempKeyPath(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "keystore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return filepath.Join(dir, "keys", "node.json"), func() { os.RemoveAll(dir) }
+}
+
+func TestPbkdf2_RFC7914Vector(t *testing.T) {
+	// the PBKDF2-HMAC-SHA256 test vector from RFC 7914, section 11
+	key := pbkdf2([]byte("passwd"), []byte("salt"), 1, 64)
+	expected := "55ac046e56e3089fec1691c22544b605f94185216dde0465e68b9d57c20dacbc" +
+		"49ca9cccf179b645991664b39d77ef317c71b845b1e30bd509112041d3a19783"
+	assert.Equal(t, expected, hex.EncodeToString(key))
+}
+
+func TestLoadOrGenerate_KeepsIdentity(t *testing.T) {
+	path, cleanup := tempKeyPath(t)
+	defer cleanup()
+
+	pub, priv, err := LoadOrGenerate(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	loadedPub, loadedPriv, err := LoadOrGenerate(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, pub, loadedPub, "The restarted node should keep its public key")
+	assert.Equal(t, priv, loadedPriv, "The restarted node should keep its private key")
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm(), "The key file should be readable only by the owner")
+}
+
+func TestLoad_Encrypted(t *testing.T) {
+	path, cleanup := tempKeyPath(t)
+	defer cleanup()
+
+	pub, priv, err := Generate(path, []byte("passphrase"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NotContains(t, string(data), "\"privateKey\"", "The private key should not be stored in plain")
+
+	loadedPub, loadedPriv, err := Load(path, []byte("passphrase"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, pub, loadedPub)
+	assert.Equal(t, priv, loadedPriv)
+
+	_, _, err = Load(path, []byte("wrong"))
+	assert.EqualError(t, err, "wrong passphrase or corrupted key file")
+
+	_, _, err = Load(path, nil)
+	assert.EqualError(t, err, "the private key is encrypted, a passphrase is required")
+}
+
+func TestGenerate_Exists(t *testing.T) {
+	path, cleanup := tempKeyPath(t)
+	defer cleanup()
+
+	if _, _, err := Generate(path, nil); err != nil {
+		t.Fatal(err)
+	}
+	_, _, err := Generate(path, nil)
+	assert.EqualError(t, err, "the key file already exists")
+}
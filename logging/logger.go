@@ -16,6 +16,7 @@ package logging
 
 import (
 	"github.com/sirupsen/logrus"
+	"io"
 	"runtime"
 )
 
@@ -38,6 +39,11 @@ func PackageLogger() *AnonymousMessagingLogger {
 	return &AnonymousMessagingLogger{baseLogger.WithField("prefix", filename)}
 }
 
+// SetOutput sets the destination of the logs of all packages.
+func SetOutput(out io.Writer) {
+	baseLogger.Out = out
+}
+
 func PackageLoggerWithField(key, value string) *AnonymousMessagingLogger {
 	return &AnonymousMessagingLogger{baseLogger.WithField(key, value)}
 }
@@ -17,44 +17,36 @@ package main
 import (
 	"anonymous-messaging/client"
 	"anonymous-messaging/config"
+	"anonymous-messaging/directory"
+	"anonymous-messaging/helpers"
+	"anonymous-messaging/keystore"
 	"anonymous-messaging/logging"
 	"anonymous-messaging/pki"
 	"anonymous-messaging/server"
-	"anonymous-messaging/sphinx"
 
+	"errors"
 	"flag"
 	"fmt"
-
-	"anonymous-messaging/helpers"
-	"github.com/protobuf/proto"
+	"math/rand"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
 )
 
 var logLocal = logging.PackageLogger()
 
 const (
+	// the default location of the PKI, used unless the URL of the directory authority is given
 	PKI_DIR = "pki/database.db"
+	// the environment variable with the passphrase encrypting the private keys
+	KEY_PASSPHRASE_ENV = "LOOPIX_KEY_PASSPHRASE"
+	// the value of the store flag which keeps the messages of the client in memory only
+	MEMORY_STORE = "memory"
 )
 
-func pkiPreSetting(pkiDir string) error {
-	db, err := pki.OpenDatabase(pkiDir, "sqlite3")
-	if err != nil {
-		return err
-	}
-	defer db.Close()
-
-	params := make(map[string]string)
-	params["Id"] = "TEXT"
-	params["Typ"] = "TEXT"
-	params["Config"] = "BLOB"
-
-	err = pki.CreateTable(db, "Pki", params)
-	if err != nil {
-		return err
-	}
-
-	return nil
-}
-
 //func FakeAdding(c *client.Client) {
 //	logLocal.Info("Adding simulated traffic of a client")
 //	for {
@@ -71,59 +63,196 @@ func pkiPreSetting(pkiDir string) error {
 //}
 
 // ReadInClientsPKI reads in the public information about users
-// from the PKI database and stores them locally. In case
-// the connection or fetching data from the PKI went wrong,
-// an error is returned.
+// from the PKI. In case the connection or fetching data from
+// the PKI went wrong, an error is returned.
 func ReadInClientsPKI(pkiName string) error {
 	logLocal.Info(fmt.Sprintf(" Reading network users information from the PKI: %s", pkiName))
-	var users []config.ClientConfig
-
-	db, err := pki.OpenDatabase(pkiName, "sqlite3")
 
+	p, err := pki.Open(pkiName)
 	if err != nil {
 		return err
 	}
-
-	records, err := pki.QueryDatabase(db, "Pki", "Client")
-
+	_, err = p.Clients()
 	if err != nil {
 		logLocal.WithError(err).Error("Error during Querying the Clients PKI")
 		return err
 	}
+	logLocal.Info(" Information about other users uploaded")
+	return nil
+}
 
-	for records.Next() {
-		result := make(map[string]interface{})
-		err := records.MapScan(result)
+// createClient creates the client with the identity keys stored at the given path. The messages and
+// the history of the client are kept in the SQLite database at the store path, hence the pending
+// messages are sent after a restart, or in memory if the store is MEMORY_STORE. The payloads in the
+// database are encrypted with a key derived from the identity key. If the client is not interactive,
+// the received messages are read through the history.
+func createClient(id, host, port, keysPath string, passphrase []byte, storePath, pkiDir string, provider config.MixConfig,
+	params config.ClientParameters, interactive bool) (client.Client, error) {
+	pubC, privC, err := keystore.LoadOrGenerate(keysPath, passphrase)
+	if err != nil {
+		return nil, err
+	}
 
+	store := client.NewMemoryStore()
+	if storePath != MEMORY_STORE {
+		if err := os.MkdirAll(filepath.Dir(storePath), 0700); err != nil {
+			return nil, err
+		}
+		store, err = client.NewSQLiteStore(storePath, client.StoreKeyFromPrivateKey(privC))
 		if err != nil {
-			logLocal.WithError(err).Error("Error in scanning table PKI record")
-			return err
+			return nil, err
 		}
+	}
 
-		var pubs config.ClientConfig
-		err = proto.Unmarshal(result["Config"].([]byte), &pubs)
-		if err != nil {
-			logLocal.WithError(err).Error(" Error during unmarshal function for client config")
-			return err
+	opts := []client.Option{client.WithId(id), client.WithAddress(host, port), client.WithKeys(pubC, privC),
+		client.WithPKI(pkiDir), client.WithProvider(provider), client.WithParameters(params), client.WithStore(store)}
+	if !interactive {
+		// the received messages are kept in the history, which serves as the inbox of the API
+		opts = append(opts, client.WithReceiveCallback(func([]byte) {}))
+	}
+	return client.New(opts...)
+}
+
+// perIdentity splits the comma separated values of a flag into one value per identity. If the flag
+// is empty, the values are empty. If the number of values does not match the number of identities, nil is returned.
+func perIdentity(values string, count int) []string {
+	if values == "" {
+		return make([]string, count)
+	}
+	split := strings.Split(values, ",")
+	if len(split) != count {
+		return nil
+	}
+	return split
+}
+
+// selectProviders returns the providers with the requested ids from the PKI. The identities without
+// a requested provider get distinct providers picked at random, as long as there are enough providers.
+func selectProviders(providers []config.MixConfig, requested []string) ([]config.MixConfig, error) {
+	if requested == nil {
+		return nil, errors.New("the provider should be given for each identity")
+	}
+	byId := make(map[string]config.MixConfig)
+	for _, provider := range providers {
+		byId[provider.Id] = provider
+	}
+
+	selected := make([]config.MixConfig, len(requested))
+	used := make(map[string]bool)
+	for i, providerId := range requested {
+		if providerId == "" {
+			continue
 		}
-		users = append(users, pubs)
+		provider, ok := byId[providerId]
+		if !ok {
+			return nil, fmt.Errorf("the provider %s is not in the PKI", providerId)
+		}
+		selected[i] = provider
+		used[providerId] = true
 	}
-	logLocal.Info(" Information about other users uploaded")
-	return nil
+
+	var unused []config.MixConfig
+	for _, provider := range providers {
+		if !used[provider.Id] {
+			unused = append(unused, provider)
+		}
+	}
+	rand.Shuffle(len(unused), func(i, j int) { unused[i], unused[j] = unused[j], unused[i] })
+	for i := range selected {
+		if selected[i].Id != "" {
+			continue
+		}
+		if len(unused) == 0 {
+			return nil, errors.New("not enough providers in the PKI for distinct providers of the identities")
+		}
+		selected[i], unused = unused[0], unused[1:]
+	}
+	return selected, nil
+}
+
+// createVotingAuthority creates the directory authority which agrees the network document with the other
+// authorities of the set in each epoch. The uploaded descriptors are kept in the given store.
+func createVotingAuthority(id, keysPath string, passphrase []byte, store directory.Directory, setPath string,
+	epoch time.Duration) (*directory.VotingAuthority, error) {
+	_, priv, err := keystore.LoadOrGenerate(keysPath, passphrase)
+	if err != nil {
+		return nil, err
+	}
+	set, err := directory.LoadAuthoritySet(setPath)
+	if err != nil {
+		return nil, err
+	}
+	authority, err := directory.NewVotingAuthority(id, directory.KeySigner(priv), store, set)
+	if err != nil {
+		return nil, err
+	}
+	var peers []directory.Peer
+	for _, a := range set.Authorities {
+		if a.Id != id {
+			peers = append(peers, directory.NewRemoteDirectory(a.URL))
+		}
+	}
+	authority.SetPeers(peers)
+	go authority.Run(epoch, nil)
+	return authority, nil
 }
 
 func main() {
 
 	typ := flag.String("typ", "", "A type of entity we want to run")
-	id := flag.String("id", "", "Id of the entity we want to run")
+	id := flag.String("id", "", "Id of the entity we want to run; several comma separated ids run several client identities")
 	host := flag.String("host", "", "The host on which the entity is running")
 	port := flag.String("port", "", "The port on which the entity is running")
-	providerId := flag.String("provider", "", "The port on which the entity is running")
+	providerId := flag.String("provider", "", "The provider of the client; several identities take comma separated providers, one per identity, or distinct providers picked at random if none is given")
+	paramsPath := flag.String("params", "", "The JSON file with the client traffic parameters, reloaded on SIGHUP")
+	storePath := flag.String("store", "", "The database file keeping the outbox and the history of the client, by default stores/<id>.db, or \"memory\" to keep them in memory")
+	operator := flag.String("operator", "", "The operator running the mix, the mixes of one operator are not put on the same path")
+	capacity := flag.Uint64("capacity", 0, "The capacity of the mix advertised in the PKI, in packets per second")
+	keysPath := flag.String("keys", "", "The file with the identity keys, by default keys/<id>.json; several identities take comma separated files, one per identity")
+	interactive := flag.Bool("interactive", false, "Run the client with an interactive shell")
+	apiAddress := flag.String("api", "", "The local address of the client API, either a loopback host:port or the path of a Unix socket")
+	apiTokenPath := flag.String("apiToken", filepath.Join("keys", "api.token"), "The file with the bearer token of the client API, created if it does not exist")
+	pkiDir := flag.String("pki", PKI_DIR, "The URL of the directory authority, the JSON file of the authority set, or the path of the local PKI database")
+	authorities := flag.String("authorities", "", "The JSON file of the authority set, which the directory authority agrees the network document with")
+	expiry := flag.Duration("expiry", directory.DefaultExpiry, "The time after which the nodes which did not send a heartbeat are left out of the network document")
+	epoch := flag.Duration("epoch", 10*time.Minute, "The duration of the epoch, in which the directory authority publishes one network document")
 	flag.Parse()
 
-	err := pkiPreSetting(PKI_DIR)
-	if err != nil {
-		panic(err)
+	keysFlag := *keysPath
+	if *keysPath == "" {
+		*keysPath = filepath.Join("keys", *id+".json")
+	}
+	passphrase := []byte(os.Getenv(KEY_PASSPHRASE_ENV))
+
+	if *typ == "keygen" {
+		pub, _, err := keystore.Generate(*keysPath, passphrase)
+		if err != nil {
+			panic(err)
+		}
+		fmt.Printf("Generated keys in %s, public key %x\n", *keysPath, pub)
+		return
+	}
+
+	if *typ == "stale" {
+		// lists the nodes of the local PKI which stopped sending the heartbeats
+		d, err := directory.Open(*pkiDir)
+		if err != nil {
+			panic(err)
+		}
+		authority, ok := d.(directory.EpochAuthority)
+		if !ok {
+			panic("the PKI does not keep the heartbeats of the nodes")
+		}
+		authority.SetExpiry(*expiry)
+		entries, err := authority.StaleEntries()
+		if err != nil {
+			panic(err)
+		}
+		for _, entry := range entries {
+			fmt.Printf("%s\t%s\tlast seen %s (%s ago)\n", entry.Typ, entry.Id, entry.LastSeen.Format(time.RFC3339),
+				time.Since(entry.LastSeen).Round(time.Second))
+		}
+		return
 	}
 
 	ip, err := helpers.GetLocalIP()
@@ -135,44 +264,147 @@ func main() {
 
 	switch *typ {
 	case "client":
-		db, err := pki.OpenDatabase(PKI_DIR, "sqlite3")
-
+		p, err := pki.Open(*pkiDir)
+		if err != nil {
+			panic(err)
+		}
+		providers, err := p.Providers()
 		if err != nil {
 			panic(err)
 		}
 
-		row := db.QueryRow("SELECT Config FROM Pki WHERE Id = ? AND Typ = ?", providerId, "Provider")
+		params := config.DefaultClientParameters()
+		if *paramsPath != "" {
+			params, err = config.LoadClientParameters(*paramsPath)
+			if err != nil {
+				panic(err)
+			}
+		}
 
-		var results []byte
-		err = row.Scan(&results)
-		if err != nil {
-			fmt.Println(err)
+		if *interactive {
+			// the logs would interleave with the shell, hence they are written to a file
+			logFile, err := os.OpenFile(fmt.Sprintf("client_%s.log", *id), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+			if err != nil {
+				panic(err)
+			}
+			defer logFile.Close()
+			logging.SetOutput(logFile)
 		}
-		var providerInfo config.MixConfig
-		err = proto.Unmarshal(results, &providerInfo)
 
-		pubC, privC, err := sphinx.GenerateKeyPair()
+		// several comma separated ids run several identities in one process; the identities should not be
+		// linkable, hence each has its own keys and provider, and listens on a port chosen by the system
+		ids := strings.Split(*id, ",")
+		if *interactive && len(ids) > 1 {
+			panic("the interactive shell supports a single identity")
+		}
+		clientPort := *port
+		if len(ids) > 1 {
+			clientPort = "0"
+		}
+		clientProviders, err := selectProviders(providers, perIdentity(*providerId, len(ids)))
 		if err != nil {
 			panic(err)
 		}
+		clientKeys := perIdentity(keysFlag, len(ids))
+		if clientKeys == nil && len(ids) > 1 {
+			panic("the keys should be given for each identity")
+		}
+		identities := client.NewIdentities()
+		for i, clientId := range ids {
+			keys, store := *keysPath, *storePath
+			if len(ids) > 1 {
+				keys = clientKeys[i]
+				if keys == "" {
+					keys = filepath.Join("keys", clientId+".json")
+				}
+				if store != "" && store != MEMORY_STORE {
+					store += "." + clientId
+				}
+			}
+			if store == "" {
+				store = filepath.Join("stores", clientId+".db")
+			}
+			c, err := createClient(clientId, *host, clientPort, keys, passphrase, store, *pkiDir, clientProviders[i], params, *interactive)
+			if err != nil {
+				panic(err)
+			}
+			if err := identities.Add(c); err != nil {
+				panic(err)
+			}
+		}
 
-		client, err := client.NewClient(*id, *host, *port, pubC, privC, PKI_DIR, providerInfo)
+		err = identities.Start()
 		if err != nil {
 			panic(err)
 		}
 
-		err = client.Start()
-		if err != nil {
-			panic(err)
+		if *apiAddress != "" {
+			listener, err := client.ListenAPI(*apiAddress)
+			if err != nil {
+				panic(err)
+			}
+			token, err := client.LoadOrCreateAPIToken(*apiTokenPath)
+			if err != nil {
+				panic(err)
+			}
+			api := client.NewIdentitiesAPIServer(identities, token)
+			if len(ids) == 1 {
+				c, _ := identities.Get(ids[0])
+				api = client.NewAPIServer(c, token)
+			}
+			go func() {
+				err := api.Serve(listener)
+				if err != nil {
+					logLocal.WithError(err).Error("Error in the client API server")
+				}
+			}()
+		}
+
+		if *interactive {
+			c, _ := identities.Get(ids[0])
+			err = client.RunREPL(c, os.Stdin, os.Stdout)
+			if err != nil {
+				logLocal.WithError(err).Error("Error in the interactive shell")
+			}
+			identities.Close()
+			return
+		}
+
+		reload := make(chan os.Signal, 1)
+		signal.Notify(reload, syscall.SIGHUP)
+		for range reload {
+			if *paramsPath == "" {
+				continue
+			}
+			params, err := config.LoadClientParameters(*paramsPath)
+			if err != nil {
+				logLocal.WithError(err).Error("Error during reloading the client parameters")
+				continue
+			}
+			for _, clientId := range identities.Ids() {
+				c, err := identities.Get(clientId)
+				if err != nil {
+					continue
+				}
+				err = c.SetParameters(params)
+				if err != nil {
+					logLocal.WithError(err).Error("Error during reloading the client parameters")
+				}
+			}
+			logLocal.Info("Client parameters reloaded")
 		}
 
 	case "mix":
-		pubM, privM, err := sphinx.GenerateKeyPair()
+		pubM, privM, err := keystore.LoadOrGenerate(*keysPath, passphrase)
+		if err != nil {
+			panic(err)
+		}
+		p, err := pki.Open(*pkiDir)
 		if err != nil {
 			panic(err)
 		}
 
-		mixServer, err := server.NewMixServer(*id, *host, *port, pubM, privM, PKI_DIR)
+		mixServer, err := server.NewMixServer(*id, *host, *port, *operator, *capacity, pubM, privM, p)
 		if err != nil {
 			panic(err)
 		}
@@ -182,12 +414,16 @@ func main() {
 			panic(err)
 		}
 	case "provider":
-		pubP, privP, err := sphinx.GenerateKeyPair()
+		pubP, privP, err := keystore.LoadOrGenerate(*keysPath, passphrase)
+		if err != nil {
+			panic(err)
+		}
+		p, err := pki.Open(*pkiDir)
 		if err != nil {
 			panic(err)
 		}
 
-		providerServer, err := server.NewProviderServer(*id, *host, *port, pubP, privP, PKI_DIR)
+		providerServer, err := server.NewProviderServer(*id, *host, *port, pubP, privP, p)
 		if err != nil {
 			panic(err)
 		}
@@ -196,5 +432,27 @@ func main() {
 		if err != nil {
 			panic(err)
 		}
+	case "directory":
+		// the directory authority serves the PKI to the nodes and the clients running on other machines
+		d, err := directory.Open(*pkiDir)
+		if err != nil {
+			panic(err)
+		}
+		if authority, ok := d.(directory.EpochAuthority); ok {
+			authority.SetExpiry(*expiry)
+		}
+		if *authorities != "" {
+			d, err = createVotingAuthority(*id, *keysPath, passphrase, d, *authorities, *epoch)
+			if err != nil {
+				panic(err)
+			}
+		} else if authority, ok := d.(directory.EpochAuthority); ok {
+			// the single authority publishes the network document of each epoch on its own
+			go authority.Run(*epoch, nil)
+		}
+		err = directory.NewServer(d).ListenAndServe(*host + ":" + *port)
+		if err != nil {
+			panic(err)
+		}
 	}
 }
@@ -28,8 +28,8 @@ type Mix struct {
 }
 
 // ProcessPacket performs the processing operation on the received packet, including cryptographic operations and
-// extraction of the meta information.
-func (m *Mix) ProcessPacket(packet []byte, c chan<- []byte, cAdr chan<- sphinx.Hop, cFlag chan<- string, errCh chan<- error) {
+// extraction of the meta information, i.e., the next hop and the routing commands.
+func (m *Mix) ProcessPacket(packet []byte, c chan<- []byte, cAdr chan<- sphinx.Hop, cCmd chan<- sphinx.Commands, errCh chan<- error) {
 
 	nextHop, commands, newPacket, err := sphinx.ProcessSphinxPacket(packet, m.prvKey)
 	if err != nil {
@@ -45,7 +45,7 @@ func (m *Mix) ProcessPacket(packet []byte, c chan<- []byte, cAdr chan<- sphinx.H
 
 	c <- <-timeoutCh
 	cAdr <- nextHop
-	cFlag <- commands.Flag
+	cCmd <- commands
 	errCh <- nil
 
 }
@@ -40,7 +40,7 @@ func createProviderWorker() (*Mix, error) {
 
 func createTestPacket(curve elliptic.Curve, mixes []config.MixConfig, provider config.MixConfig, recipient config.ClientConfig) (*sphinx.SphinxPacket, error) {
 	path := config.E2EPath{IngressProvider: provider, Mixes: mixes, EgressProvider: provider, Recipient: recipient}
-	testPacket, err := sphinx.PackForwardMessage(curve, path, []float64{1.4, 2.5, 2.3, 3.2, 7.4}, "Test Message")
+	testPacket, err := sphinx.PackForwardMessage(curve, path, []float64{1.4, 2.5, 2.3, 3.2, 7.4}, "Test Message", sphinx.RealMessageType)
 	if err != nil {
 		return nil, err
 	}
@@ -76,7 +76,7 @@ func TestMain(m *testing.M) {
 func TestMixProcessPacket(t *testing.T) {
 	ch := make(chan []byte, 1)
 	chHop := make(chan sphinx.Hop, 1)
-	cAdr := make(chan string, 1)
+	cCmd := make(chan sphinx.Commands, 1)
 	errCh := make(chan error, 1)
 
 	pubD, _, err := sphinx.GenerateKeyPair()
@@ -105,10 +105,10 @@ func TestMixProcessPacket(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	providerWorker.ProcessPacket(testPacketBytes, ch, chHop, cAdr, errCh)
+	providerWorker.ProcessPacket(testPacketBytes, ch, chHop, cCmd, errCh)
 	dePacket := <-ch
 	nextHop := <-chHop
-	flag := <-cAdr
+	commands := <-cCmd
 	err = <-errCh
 	if err != nil {
 		t.Fatal(err)
@@ -116,5 +116,5 @@ func TestMixProcessPacket(t *testing.T) {
 
 	assert.Equal(t, sphinx.Hop{Id: "Mix1", Address: "localhost:3330", PubKey: nodes[0].PubKey}, nextHop, "Next hop does not match")
 	assert.Equal(t, reflect.TypeOf([]byte{}), reflect.TypeOf(dePacket))
-	assert.Equal(t, "\xF1", flag, reflect.TypeOf(dePacket))
+	assert.Equal(t, "\xF1", commands.Flag, reflect.TypeOf(dePacket))
 }
@@ -13,8 +13,10 @@
 // limitations under the License.
 
 /*
-	Package pki implements basic functions for managing the pki
-	represented as a SQL database.
+	Package pki implements the public key infrastructure of the mix network. The PKI interface
+	publishes and reads the typed configurations of the mixes, the providers and the clients,
+	kept by a directory authority in a SQLite database, in memory, in a JSON file or served over
+	HTTP. The package also implements basic functions for managing a SQL database.
 */
 
 package pki
@@ -29,6 +31,9 @@ import (
 	"strings"
 )
 
+// ErrNoRecord is returned by LookupClient when there is no client with the given id.
+var ErrNoRecord = errors.New("no record with the given id and type")
+
 // OpenDatabase opens a connection with a specified database.
 // OpenDatabase returns the database object and an error.
 func OpenDatabase(dataSourceName, dbDriver string) (*sqlx.DB, error) {
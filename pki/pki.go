@@ -0,0 +1,275 @@
+// Copyright 2018 The Loopix-Messaging Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pki
+
+import (
+	"anonymous-messaging/config"
+	"anonymous-messaging/directory"
+	"anonymous-messaging/logging"
+
+	"github.com/protobuf/proto"
+)
+
+var logLocal = logging.PackageLogger()
+
+// PKI is the public key infrastructure of the mix network, through which the mixes, the providers
+// and the clients publish their configurations and learn the configurations of the others.
+// The configurations are signed with the identity keys of their owners, which are published in
+// the configurations themselves. The signatures keep the configurations from being modified in transit,
+// and the directory authority keeps the first key published for an id, trusting it on first use.
+// The signatures do not protect against the authority itself: an authority which is not trusted can
+// publish the configuration of a new key under any id, or leave out the published configurations,
+// hence the documents should be agreed by several authorities, see directory.VotingAuthority.
+type PKI interface {
+	// PublishMix publishes the configuration of the mix, replacing its previous configuration.
+	// Publishing the same configuration again serves as the heartbeat of the mix.
+	PublishMix(mix config.MixConfig, sign directory.Signer) error
+	// PublishProvider publishes the configuration of the provider, as PublishMix.
+	PublishProvider(provider config.MixConfig, sign directory.Signer) error
+	// PublishClient publishes the configuration of the client, replacing its previous configuration.
+	PublishClient(client config.ClientConfig, sign directory.Signer) error
+	// RemoveClient removes the published configuration of the client.
+	RemoveClient(client config.ClientConfig, sign directory.Signer) error
+
+	// Mixes returns the configurations of the mixes in the current network document.
+	Mixes() ([]config.MixConfig, error)
+	// Providers returns the configurations of the providers in the current network document.
+	Providers() ([]config.MixConfig, error)
+	// Clients returns the configurations of the clients in the current network document,
+	// each with the configuration of its provider.
+	Clients() ([]config.ClientConfig, error)
+	// LookupClient returns the configuration of the client with the given id, or ErrNoRecord.
+	LookupClient(id string) (config.ClientConfig, error)
+
+	// Snapshot returns the view of the network in the latest epoch.
+	Snapshot() (Snapshot, error)
+	// SnapshotAt returns the view of the network in the given epoch.
+	SnapshotAt(epoch uint64) (Snapshot, error)
+}
+
+// Snapshot is the view of the network in an epoch, read from a single network document,
+// hence the mixes, the providers and the clients are consistent with each other. The nodes and
+// the clients with the same epoch compare the digest to check that they share the view.
+type Snapshot struct {
+	Epoch     uint64
+	Digest    []byte
+	Mixes     []config.MixConfig
+	Providers []config.MixConfig
+	Clients   []config.ClientConfig
+}
+
+// Open returns the PKI kept by the directory at the given location, see directory.Open.
+func Open(location string) (PKI, error) {
+	d, err := directory.Open(location)
+	if err != nil {
+		return nil, err
+	}
+	return New(d), nil
+}
+
+// NewSQLite returns the PKI kept in the SQLite database at the given path.
+func NewSQLite(path string) PKI {
+	return New(directory.NewLocalAuthority(path))
+}
+
+// NewMemory returns an empty PKI kept in memory.
+func NewMemory() PKI {
+	return New(directory.NewMemoryAuthority())
+}
+
+// NewJSONFile returns the PKI kept in the JSON file at the given path.
+func NewJSONFile(path string) PKI {
+	return New(directory.NewJSONFileAuthority(path))
+}
+
+// New returns the PKI kept by the given directory.
+func New(d directory.Directory) PKI {
+	return &directoryPKI{directory: d}
+}
+
+// directoryPKI publishes the configurations as the signed descriptors of the directory,
+// and reads them from its network document.
+type directoryPKI struct {
+	directory directory.Directory
+}
+
+func (p *directoryPKI) PublishMix(mix config.MixConfig, sign directory.Signer) error {
+	return p.publish(directory.MixDescriptor, mix.Id, &mix, sign)
+}
+
+func (p *directoryPKI) PublishProvider(provider config.MixConfig, sign directory.Signer) error {
+	return p.publish(directory.ProviderDescriptor, provider.Id, &provider, sign)
+}
+
+func (p *directoryPKI) PublishClient(client config.ClientConfig, sign directory.Signer) error {
+	return p.publish(directory.ClientDescriptor, client.Id, &client, sign)
+}
+
+func (p *directoryPKI) publish(typ, id string, message proto.Message, sign directory.Signer) error {
+	configBytes, err := proto.Marshal(message)
+	if err != nil {
+		return err
+	}
+	descriptor, err := directory.NewDescriptor(typ, id, configBytes, sign)
+	if err != nil {
+		return err
+	}
+	return p.directory.Upload(descriptor)
+}
+
+// RemoveClient removes the client from the directory. The removal is signed with the identity key
+// of the client, hence the configuration must be the published one.
+func (p *directoryPKI) RemoveClient(client config.ClientConfig, sign directory.Signer) error {
+	configBytes, err := proto.Marshal(&client)
+	if err != nil {
+		return err
+	}
+	revocation, err := directory.NewRevocation(directory.ClientDescriptor, client.Id, configBytes, sign)
+	if err != nil {
+		return err
+	}
+	return p.directory.Remove(revocation)
+}
+
+func (p *directoryPKI) Mixes() ([]config.MixConfig, error) {
+	document, err := p.directory.Document()
+	if err != nil {
+		return nil, err
+	}
+	return mixConfigsOf(document, directory.MixDescriptor)
+}
+
+func (p *directoryPKI) Providers() ([]config.MixConfig, error) {
+	document, err := p.directory.Document()
+	if err != nil {
+		return nil, err
+	}
+	return mixConfigsOf(document, directory.ProviderDescriptor)
+}
+
+func (p *directoryPKI) Clients() ([]config.ClientConfig, error) {
+	document, err := p.directory.Document()
+	if err != nil {
+		return nil, err
+	}
+	return clientConfigsOf(document)
+}
+
+func (p *directoryPKI) LookupClient(id string) (config.ClientConfig, error) {
+	clients, err := p.Clients()
+	if err != nil {
+		return config.ClientConfig{}, err
+	}
+	for _, client := range clients {
+		if client.Id == id {
+			return client, nil
+		}
+	}
+	return config.ClientConfig{}, ErrNoRecord
+}
+
+func (p *directoryPKI) Snapshot() (Snapshot, error) {
+	document, err := p.directory.Document()
+	if err != nil {
+		return Snapshot{}, err
+	}
+	return snapshotOf(document)
+}
+
+func (p *directoryPKI) SnapshotAt(epoch uint64) (Snapshot, error) {
+	document, err := p.directory.DocumentAt(epoch)
+	if err != nil {
+		return Snapshot{}, err
+	}
+	return snapshotOf(document)
+}
+
+func snapshotOf(document config.NetworkDocument) (Snapshot, error) {
+	snapshot := Snapshot{Epoch: document.Epoch, Digest: directory.Digest(document)}
+	var err error
+	if snapshot.Mixes, err = mixConfigsOf(document, directory.MixDescriptor); err != nil {
+		return Snapshot{}, err
+	}
+	if snapshot.Providers, err = mixConfigsOf(document, directory.ProviderDescriptor); err != nil {
+		return Snapshot{}, err
+	}
+	if snapshot.Clients, err = clientConfigsOf(document); err != nil {
+		return Snapshot{}, err
+	}
+	return snapshot, nil
+}
+
+func mixConfigsOf(document config.NetworkDocument, typ string) ([]config.MixConfig, error) {
+	var mixes []config.MixConfig
+	for _, descriptor := range verifiedDescriptors(document, typ) {
+		var mixConfig config.MixConfig
+		err := proto.Unmarshal(descriptor.Config, &mixConfig)
+		if err != nil {
+			return nil, err
+		}
+		mixes = append(mixes, mixConfig)
+	}
+	return mixes, nil
+}
+
+// clientConfigsOf returns the configurations of the clients in the network document. The published
+// records carry only the id of the provider of the client, hence the providers are looked up in the
+// same document. The clients whose provider is not in the document cannot be reached and are left out.
+func clientConfigsOf(document config.NetworkDocument) ([]config.ClientConfig, error) {
+	providers, err := mixConfigsOf(document, directory.ProviderDescriptor)
+	if err != nil {
+		return nil, err
+	}
+	providersById := make(map[string]config.MixConfig)
+	for _, provider := range providers {
+		providersById[provider.Id] = provider
+	}
+
+	var clients []config.ClientConfig
+	for _, descriptor := range verifiedDescriptors(document, directory.ClientDescriptor) {
+		var clientConfig config.ClientConfig
+		err = proto.Unmarshal(descriptor.Config, &clientConfig)
+		if err != nil {
+			return nil, err
+		}
+
+		provider, ok := providersById[clientConfig.ProviderId]
+		if !ok {
+			continue
+		}
+		clientConfig.Provider = &provider
+		clients = append(clients, clientConfig)
+	}
+	return clients, nil
+}
+
+// verifiedDescriptors returns the descriptors of the given type from the network document, which
+// are signed with the keys in their configurations. The descriptors which are not signed correctly,
+// e.g., modified in transit, are left out. The check does not bind the key to the owner of the id,
+// which is trusted on first use by the directory authority.
+func verifiedDescriptors(document config.NetworkDocument, typ string) []config.Descriptor {
+	var descriptors []config.Descriptor
+	for _, descriptor := range document.Descriptors {
+		if descriptor.Typ != typ {
+			continue
+		}
+		if err := directory.Verify(*descriptor); err != nil {
+			logLocal.WithError(err).Warningf("Descriptor %s rejected", descriptor.Id)
+			continue
+		}
+		descriptors = append(descriptors, *descriptor)
+	}
+	return descriptors
+}
@@ -0,0 +1,107 @@
+// Copyright 2018 The Loopix-Messaging Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pki
+
+import (
+	"anonymous-messaging/config"
+	"anonymous-messaging/directory"
+	"anonymous-messaging/sphinx"
+
+	"github.com/stretchr/testify/assert"
+
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPKI(t *testing.T) {
+	backends := []struct {
+		name string
+		open func(dir string) PKI
+	}{
+		{"SQLite", func(dir string) PKI { return NewSQLite(filepath.Join(dir, "database.db")) }},
+		{"Memory", func(dir string) PKI { return NewMemory() }},
+		{"JSONFile", func(dir string) PKI { return NewJSONFile(filepath.Join(dir, "pki.json")) }},
+	}
+	for _, backend := range backends {
+		t.Run(backend.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "pki")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+			testPKI(t, backend.open(dir))
+		})
+	}
+}
+
+// testPKI checks the publishing, the lookups and the removals of the PKI.
+func testPKI(t *testing.T, p PKI) {
+	pubM, privM, err := sphinx.GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mix := config.MixConfig{Id: "Mix1", Host: "localhost", Port: "9995", PubKey: pubM}
+	assert.Nil(t, p.PublishMix(mix, directory.KeySigner(privM)))
+
+	pubP, privP, err := sphinx.GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	provider := config.MixConfig{Id: "Provider1", Host: "localhost", Port: "9996", PubKey: pubP}
+	assert.Nil(t, p.PublishProvider(provider, directory.KeySigner(privP)))
+
+	pubC, privC, err := sphinx.GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := config.ClientConfig{Id: "Client1", PubKey: pubC, ProviderId: "Provider1"}
+	assert.Nil(t, p.PublishClient(client, directory.KeySigner(privC)))
+
+	_, forger, err := sphinx.GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	forged := config.MixConfig{Id: "Mix1", Host: "localhost", Port: "9997", PubKey: pubM}
+	assert.NotNil(t, p.PublishMix(forged, directory.KeySigner(forger)), "The configuration signed with another key should be rejected")
+
+	mixes, err := p.Mixes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []config.MixConfig{mix}, mixes)
+	providers, err := p.Providers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []config.MixConfig{provider}, providers)
+
+	found, err := p.LookupClient("Client1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, provider, *found.Provider, "The provider of the client should be resolved")
+	snapshot, err := p.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 1, len(snapshot.Clients))
+	assert.Equal(t, []config.MixConfig{mix}, snapshot.Mixes)
+
+	assert.Nil(t, p.RemoveClient(client, directory.KeySigner(privC)))
+	_, err = p.LookupClient("Client1")
+	assert.Equal(t, ErrNoRecord, err)
+}
@@ -0,0 +1,49 @@
+// Copyright 2018 The Loopix-Messaging Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"anonymous-messaging/directory"
+
+	"time"
+)
+
+// heartbeatInterval is the interval of uploading the descriptor of the node again, which tells the
+// directory authority that the node is alive. It is well below the expiry of the authority, hence
+// a single lost heartbeat does not remove the node from the network document.
+const heartbeatInterval = directory.DefaultExpiry / 3
+
+// publisher publishes the signed configuration of a node in the PKI.
+type publisher func() error
+
+// sendHeartbeats uploads the descriptor of the node after each heartbeat interval, until the stop channel
+// is closed. Each heartbeat signs the descriptor again with the current time, see directory.NewDescriptor,
+// and the authority takes the time of the signature as the time the node was last seen, hence a replayed
+// heartbeat does not keep a dead node in the network document. The failed uploads are retried at the next heartbeat.
+func sendHeartbeats(publish publisher, stop <-chan struct{}) {
+	ticker := time.NewTicker(heartbeatInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			if err := publish(); err != nil {
+				logLocal.WithError(err).Error("Error in sending the heartbeat to the PKI")
+			}
+		}
+	}
+}
@@ -0,0 +1,111 @@
+// Copyright 2018 The Loopix-Messaging Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"anonymous-messaging/config"
+	"anonymous-messaging/sphinx"
+
+	"github.com/protobuf/proto"
+
+	"errors"
+	"strings"
+	"time"
+)
+
+// noticeValidity is the time within which the migration notice signed by a client is accepted.
+const noticeValidity = 10 * time.Minute
+
+// validClientId checks that the id of the client can be used as the name of its inbox directory.
+func validClientId(clientId string) error {
+	if clientId == "" || clientId == "." || strings.Contains(clientId, "..") || strings.ContainsAny(clientId, `/\`) {
+		return errors.New("invalid client id")
+	}
+	return nil
+}
+
+// handoverSignedData returns the data of the handover covered by the signature of the previous provider.
+func handoverSignedData(handover config.InboxHandover) ([]byte, error) {
+	handover.Signature = nil
+	data, err := proto.Marshal(&handover)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte("inbox-handover"), data...), nil
+}
+
+// handleMigrationNotice records the migration announced by the client, after the signature of the
+// notice is checked against the key of the client published in the PKI. The handovers of the stored
+// messages of the client are accepted only from the provider named in the notice.
+func (p *ProviderServer) handleMigrationNotice(noticeBytes []byte) error {
+	var notice config.MigrationNotice
+	err := proto.Unmarshal(noticeBytes, &notice)
+	if err != nil {
+		return err
+	}
+	if err := validClientId(notice.ClientId); err != nil {
+		return err
+	}
+	if notice.ToProviderId != p.id {
+		return errors.New("the migration notice is addressed to another provider")
+	}
+	age := time.Since(time.Unix(notice.Timestamp, 0))
+	if age > noticeValidity || age < -noticeValidity {
+		return errors.New("the migration notice is expired")
+	}
+
+	client, err := p.nodes.pki.LookupClient(notice.ClientId)
+	if err != nil {
+		return err
+	}
+	data, err := config.MigrationNoticeSignedData(notice)
+	if err != nil {
+		return err
+	}
+	if !sphinx.Verify(client.PubKey, data, notice.Signature) {
+		return errors.New("the signature of the migration notice is invalid")
+	}
+
+	p.pendingMigrations[notice.ClientId] = notice.FromProviderId
+	logLocal.Infof("Client %s announced the migration from provider %s", notice.ClientId, notice.FromProviderId)
+	return nil
+}
+
+// verifyHandover checks that the handover is sent by the previous provider of a client which
+// announced its migration, and that it is signed with the key of the provider published in the PKI.
+func (p *ProviderServer) verifyHandover(handover config.InboxHandover) error {
+	if err := validClientId(handover.ClientId); err != nil {
+		return err
+	}
+	from, ok := p.pendingMigrations[handover.ClientId]
+	if !ok {
+		return errors.New("no pending migration of the client")
+	}
+	if handover.ProviderId != from {
+		return errors.New("the handover is not sent by the previous provider of the client")
+	}
+	provider, ok := p.nodes.provider(from)
+	if !ok {
+		return errors.New("the previous provider of the client is not in the PKI")
+	}
+	data, err := handoverSignedData(handover)
+	if err != nil {
+		return err
+	}
+	if !sphinx.Verify(provider.PubKey, data, handover.Signature) {
+		return errors.New("the signature of the handover is invalid")
+	}
+	return nil
+}
@@ -13,20 +13,23 @@
 // limitations under the License.
 
 /*
-	Package server implements the mix server.
+Package server implements the mix server.
 */
 package server
 
 import (
 	"anonymous-messaging/config"
+	"anonymous-messaging/directory"
 	"anonymous-messaging/helpers"
 	"anonymous-messaging/logging"
 	"anonymous-messaging/networker"
 	"anonymous-messaging/node"
+	"anonymous-messaging/pki"
 	"anonymous-messaging/sphinx"
 
 	"github.com/protobuf/proto"
 	"net"
+	"sync"
 )
 
 var logLocal = logging.PackageLogger()
@@ -45,7 +48,11 @@ type MixServer struct {
 	listener *net.TCPListener
 	*node.Mix
 
-	config config.MixConfig
+	config  config.MixConfig
+	publish publisher
+
+	stop      chan struct{}
+	closeOnce sync.Once
 }
 
 func (m *MixServer) Start() error {
@@ -53,6 +60,16 @@ func (m *MixServer) Start() error {
 	return nil
 }
 
+// Close stops the heartbeats and the listener of the mix.
+func (m *MixServer) Close() error {
+	var err error
+	m.closeOnce.Do(func() {
+		close(m.stop)
+		err = m.listener.Close()
+	})
+	return err
+}
+
 func (m *MixServer) GetConfig() config.MixConfig {
 	return m.config
 }
@@ -62,20 +79,20 @@ func (m *MixServer) receivedPacket(packet []byte) error {
 
 	c := make(chan []byte)
 	cAdr := make(chan sphinx.Hop)
-	cFlag := make(chan string)
+	cCmd := make(chan sphinx.Commands)
 	errCh := make(chan error)
 
-	go m.ProcessPacket(packet, c, cAdr, cFlag, errCh)
+	go m.ProcessPacket(packet, c, cAdr, cCmd, errCh)
 	dePacket := <-c
 	nextHop := <-cAdr
-	flag := <-cFlag
+	commands := <-cCmd
 	err := <-errCh
 
 	if err != nil {
 		return err
 	}
 
-	if flag == "\xF1" {
+	if commands.Flag == "\xF1" {
 		m.forwardPacket(dePacket, nextHop.Address)
 	} else {
 		logLocal.Info("Packet has non-forward flag. Packet dropped")
@@ -114,14 +131,15 @@ func (m *MixServer) send(packet []byte, address string) error {
 func (m *MixServer) run() {
 
 	defer m.listener.Close()
-	finish := make(chan bool)
+
+	go sendHeartbeats(m.publish, m.stop)
 
 	go func() {
 		logLocal.Infof("Listening on %s", m.host+":"+m.port)
 		m.listenForIncomingConnections()
 	}()
 
-	<-finish
+	<-m.stop
 }
 
 func (m *MixServer) listenForIncomingConnections() {
@@ -129,6 +147,11 @@ func (m *MixServer) listenForIncomingConnections() {
 		conn, err := m.listener.Accept()
 
 		if err != nil {
+			select {
+			case <-m.stop:
+				return
+			default:
+			}
 			logLocal.WithError(err).Error(err)
 		} else {
 			logLocal.Infof("Received connection from %s", conn.RemoteAddr())
@@ -145,14 +168,15 @@ func (m *MixServer) listenForIncomingConnections() {
 func (m *MixServer) handleConnection(conn net.Conn, errs chan<- error) {
 	defer conn.Close()
 
-	buff := make([]byte, 1024)
-	reqLen, err := conn.Read(buff)
+	// the sender closes the connection after writing a single packet
+	buff, err := helpers.ReadPacket(conn)
 	if err != nil {
 		errs <- err
+		return
 	}
 
 	var packet config.GeneralPacket
-	err = proto.Unmarshal(buff[:reqLen], &packet)
+	err = proto.Unmarshal(buff, &packet)
 	if err != nil {
 		errs <- err
 	}
@@ -170,16 +194,18 @@ func (m *MixServer) handleConnection(conn net.Conn, errs chan<- error) {
 	errs <- nil
 }
 
-func NewMixServer(id, host, port string, pubKey []byte, prvKey []byte, pkiPath string) (*MixServer, error) {
+// NewMixServer constructs a new mix object and publishes it in the PKI. The operator and the capacity
+// of the mix are advertised in its descriptor, for the path policies of the clients.
+func NewMixServer(id, host, port, operator string, capacity uint64, pubKey []byte, prvKey []byte, p pki.PKI) (*MixServer, error) {
 	mix := node.NewMix(pubKey, prvKey)
-	mixServer := MixServer{id: id, host: host, port: port, Mix: mix, listener: nil}
-	mixServer.config = config.MixConfig{Id: mixServer.id, Host: mixServer.host, Port: mixServer.port, PubKey: mixServer.GetPublicKey()}
+	mixServer := MixServer{id: id, host: host, port: port, Mix: mix, listener: nil, stop: make(chan struct{})}
+	mixServer.config = config.MixConfig{Id: mixServer.id, Host: mixServer.host, Port: mixServer.port, PubKey: mixServer.GetPublicKey(),
+		Operator: operator, Capacity: capacity}
 
-	configBytes, err := proto.Marshal(&mixServer.config)
-	if err != nil {
-		return nil, err
+	mixServer.publish = func() error {
+		return p.PublishMix(mixServer.config, directory.KeySigner(prvKey))
 	}
-	err = helpers.AddToDatabase(pkiPath, "Pki", mixServer.id, "Mix", configBytes)
+	err := mixServer.publish()
 	if err != nil {
 		return nil, err
 	}
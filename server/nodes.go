@@ -0,0 +1,93 @@
+// Copyright 2018 The Loopix-Messaging Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"anonymous-messaging/config"
+	"anonymous-messaging/pki"
+
+	"sync"
+	"time"
+)
+
+// nodesRefreshInterval is the time after which the view of the nodes is read again from the PKI.
+const nodesRefreshInterval = time.Minute
+
+// knownNodes is the view of the mixes and the providers published in the PKI, which the provider
+// uses to tell the packets relayed by the other nodes from the packets sent by arbitrary hosts.
+// The view is cached, since it is consulted for every received packet.
+type knownNodes struct {
+	mutex sync.Mutex
+	pki   pki.PKI
+	now   func() time.Time
+
+	refreshed time.Time
+	hosts     map[string]bool
+	providers map[string]config.MixConfig
+}
+
+func newKnownNodes(p pki.PKI) *knownNodes {
+	return &knownNodes{pki: p, now: time.Now, hosts: make(map[string]bool), providers: make(map[string]config.MixConfig)}
+}
+
+// refresh reads the nodes from the PKI, if the cached view is older than the refresh interval.
+// If the PKI cannot be read, the previous view is kept.
+func (k *knownNodes) refresh() {
+	now := k.now()
+	if now.Sub(k.refreshed) < nodesRefreshInterval {
+		return
+	}
+	k.refreshed = now
+
+	mixes, err := k.pki.Mixes()
+	if err != nil {
+		logLocal.WithError(err).Warning("Error in reading the mixes from the PKI")
+		return
+	}
+	providers, err := k.pki.Providers()
+	if err != nil {
+		logLocal.WithError(err).Warning("Error in reading the providers from the PKI")
+		return
+	}
+
+	k.hosts = make(map[string]bool)
+	k.providers = make(map[string]config.MixConfig)
+	for _, mix := range mixes {
+		k.hosts[mix.Host] = true
+	}
+	for _, provider := range providers {
+		k.hosts[provider.Host] = true
+		k.providers[provider.Id] = provider
+	}
+}
+
+// isNodeHost returns whether a mix or a provider published in the PKI runs on the given host.
+func (k *knownNodes) isNodeHost(host string) bool {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+
+	k.refresh()
+	return k.hosts[host]
+}
+
+// provider returns the published configuration of the provider with the given id.
+func (k *knownNodes) provider(id string) (config.MixConfig, bool) {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+
+	k.refresh()
+	provider, ok := k.providers[id]
+	return provider, ok
+}
@@ -16,26 +16,45 @@ package server
 
 import (
 	"anonymous-messaging/config"
+	"anonymous-messaging/directory"
 	"anonymous-messaging/helpers"
 	"anonymous-messaging/networker"
 	"anonymous-messaging/node"
+	"anonymous-messaging/pki"
 	"anonymous-messaging/sphinx"
 
 	"github.com/protobuf/proto"
 
-	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io/ioutil"
 	"net"
 	"os"
+	"path/filepath"
+	"sync"
+	"time"
 )
 
 const (
-	assigneFlag = "\xa2"
-	commFlag    = "\xc6"
-	tokenFlag   = "xa9"
-	pullFlag    = "\xff"
+	// the markers of the stored messages, which are either sealed to the public key of the client
+	// or encrypted with the storage key of the provider
+	sealedToClient   = "\x01"
+	sealedForStorage = "\x02"
+
+	assigneFlag    = "\xa2"
+	commFlag       = "\xc6"
+	tokenFlag      = "xa9"
+	pullFlag       = "\xff"
+	deregisterFlag = "\xa4"
+	migrateFlag    = "\xa5"
+	handoverFlag   = "\xa6"
+	noticeFlag     = "\xa7"
+
+	// tokenSize is the length of the random authentication tokens of the clients
+	tokenSize = 32
 )
 
 type ProviderIt interface {
@@ -53,7 +72,31 @@ type ProviderServer struct {
 	listener *net.TCPListener
 
 	assignedClients map[string]ClientRecord
-	config          config.MixConfig
+	migratedClients map[string]migration
+	// the ids of the previous providers of the clients which announced their migration
+	pendingMigrations map[string]string
+	services          map[string]Service
+	config            config.MixConfig
+	storageKey        []byte
+	publish           publisher
+	sign              directory.Signer
+
+	limiter *rateLimiter
+	nodes   *knownNodes
+
+	statsMutex   sync.Mutex
+	messageStats MessageStats
+
+	stop      chan struct{}
+	closeOnce sync.Once
+}
+
+// MessageStats contains the counters of the real, loop and drop messages
+// received by the provider as the last hop.
+type MessageStats struct {
+	Real uint64
+	Loop uint64
+	Drop uint64
 }
 
 type ClientRecord struct {
@@ -64,6 +107,13 @@ type ClientRecord struct {
 	token  []byte
 }
 
+// migration keeps the new provider of a client which migrated, together with the client's
+// public key, which is used to seal the messages forwarded to the new provider.
+type migration struct {
+	provider config.MixConfig
+	pubKey   []byte
+}
+
 // Start function creates the loggers for capturing the info and error logs
 // and starts the listening server. Function returns an error
 // signaling whether any operation was unsuccessful
@@ -77,49 +127,110 @@ func (p *ProviderServer) GetConfig() config.MixConfig {
 	return p.config
 }
 
+// Close stops the heartbeats and the listener of the provider.
+func (p *ProviderServer) Close() error {
+	var err error
+	p.closeOnce.Do(func() {
+		close(p.stop)
+		err = p.listener.Close()
+	})
+	return err
+}
+
+// MessageStats returns the counters of the messages received by the provider as the last hop.
+func (p *ProviderServer) MessageStats() MessageStats {
+	p.statsMutex.Lock()
+	defer p.statsMutex.Unlock()
+
+	return p.messageStats
+}
+
+// countMessage increments the counter of the messages of the given type.
+// The messages without a recognised type are counted as real messages.
+func (p *ProviderServer) countMessage(messageType string) {
+	p.statsMutex.Lock()
+	defer p.statsMutex.Unlock()
+
+	switch messageType {
+	case sphinx.DropMessageType:
+		p.messageStats.Drop++
+	case sphinx.LoopMessageType:
+		p.messageStats.Loop++
+	default:
+		p.messageStats.Real++
+	}
+}
+
+// FloodStats returns the counters of packets dropped because of exceeded rate limits.
+func (p *ProviderServer) FloodStats() FloodStats {
+	return p.limiter.floodStats()
+}
+
 // Function opens the listener to start listening on provider's host and port
 func (p *ProviderServer) run() {
 
 	defer p.listener.Close()
-	finish := make(chan bool)
+
+	go sendHeartbeats(p.publish, p.stop)
 
 	go func() {
 		logLocal.Infof("Listening on %s", p.host+":"+p.port)
 		p.listenForIncomingConnections()
 	}()
 
-	<-finish
+	<-p.stop
 }
 
 // Function processes the received sphinx packet, performs the
 // unwrapping operation and checks whether the packet should be
-// forwarded or stored. If the processing was unsuccessful and error is returned.
+// forwarded, stored or passed to one of the hosted services.
+// The drop cover messages, marked by their senders in the layer
+// of the egress provider, are not stored. The other messages are
+// stored together with their type, which is passed to the recipient.
+// If the processing was unsuccessful and error is returned.
 func (p *ProviderServer) receivedPacket(packet []byte) error {
 	logLocal.Info("Received new sphinx packet")
 
 	c := make(chan []byte)
 	cAdr := make(chan sphinx.Hop)
-	cFlag := make(chan string)
+	cCmd := make(chan sphinx.Commands)
 	errCh := make(chan error)
 
-	go p.ProcessPacket(packet, c, cAdr, cFlag, errCh)
+	go p.ProcessPacket(packet, c, cAdr, cCmd, errCh)
 	dePacket := <-c
 	nextHop := <-cAdr
-	flag := <-cFlag
+	commands := <-cCmd
 	err := <-errCh
 
 	if err != nil {
 		return err
 	}
 
-	switch flag {
+	switch commands.Flag {
 	case "\xF1":
 		err = p.forwardPacket(dePacket, nextHop.Address)
 		if err != nil {
 			return err
 		}
 	case "\xF0":
-		err = p.storeMessage(dePacket, nextHop.Id, "TMP_MESSAGE_ID")
+		p.countMessage(commands.Type)
+		if commands.Type == sphinx.DropMessageType {
+			logLocal.Info("Received drop cover message. Message dropped")
+			return nil
+		}
+		if service, ok := p.services[nextHop.Id]; ok {
+			return p.handleServiceRequest(service, dePacket)
+		}
+		// the recipient learns the type of the message from its provider, not from the payload
+		message := sphinx.TypedMessage(commands.Type, dePacket)
+		if migrated, ok := p.migratedClients[nextHop.Id]; ok {
+			sealed, err := sphinx.SealToPublicKey(migrated.pubKey, message)
+			if err != nil {
+				return err
+			}
+			return p.handOverMessage(nextHop.Id, sealed, migrated.provider)
+		}
+		err = p.storeMessage(message, nextHop.Id, newMessageId())
 		if err != nil {
 			return err
 		}
@@ -169,6 +280,11 @@ func (p *ProviderServer) listenForIncomingConnections() {
 		conn, err := p.listener.Accept()
 
 		if err != nil {
+			select {
+			case <-p.stop:
+				return
+			default:
+			}
 			logLocal.WithError(err).Error(err)
 		} else {
 			logLocal.Infof("Received new connection from %s", conn.RemoteAddr())
@@ -186,20 +302,27 @@ func (p *ProviderServer) listenForIncomingConnections() {
 // packet and schedules a corresponding process function and returns an error.
 func (p *ProviderServer) handleConnection(conn net.Conn, errs chan<- error) {
 
-	buff := make([]byte, 1024)
-	reqLen, err := conn.Read(buff)
+	// the sender closes the connection after writing a single packet
+	buff, err := helpers.ReadPacket(conn)
 	defer conn.Close()
 
 	if err != nil {
 		errs <- err
+		return
 	}
 
 	var packet config.GeneralPacket
-	err = proto.Unmarshal(buff[:reqLen], &packet)
+	err = proto.Unmarshal(buff, &packet)
 	if err != nil {
 		errs <- err
 	}
 
+	if !p.admitPacket(packet, remoteHost(conn)) {
+		logLocal.Warningf("Rate limit exceeded by %s. Packet dropped", conn.RemoteAddr())
+		errs <- nil
+		return
+	}
+
 	switch packet.Flag {
 	case assigneFlag:
 		err = p.handleAssignRequest(packet.Data)
@@ -216,6 +339,26 @@ func (p *ProviderServer) handleConnection(conn net.Conn, errs chan<- error) {
 		if err != nil {
 			errs <- err
 		}
+	case deregisterFlag:
+		err = p.handleDeregisterRequest(packet.ClientId, packet.Token)
+		if err != nil {
+			errs <- err
+		}
+	case migrateFlag:
+		err = p.handleMigrationRequest(packet.ClientId, packet.Token, packet.Data)
+		if err != nil {
+			errs <- err
+		}
+	case handoverFlag:
+		err = p.handleHandover(packet.Data)
+		if err != nil {
+			errs <- err
+		}
+	case noticeFlag:
+		err = p.handleMigrationNotice(packet.Data)
+		if err != nil {
+			errs <- err
+		}
 	default:
 		logLocal.Info(packet.Flag)
 		logLocal.Info("Packet flag not recognised. Packet dropped")
@@ -224,7 +367,51 @@ func (p *ProviderServer) handleConnection(conn net.Conn, errs chan<- error) {
 	errs <- nil
 }
 
-// RegisterNewClient generates a fresh authentication token and saves it together with client's public configuration data
+// admitPacket enforces the rate limits on the received packet. Packets carrying the credentials
+// of a registered client are limited per client and per source address, and the clients which
+// repeatedly exceed their limit lose the registration. The packets relayed by the mixes and the
+// providers published in the PKI are limited per node with a larger budget, and all the other
+// packets are limited per source address. admitPacket returns false if the packet should be dropped.
+func (p *ProviderServer) admitPacket(packet config.GeneralPacket, address string) bool {
+	if packet.ClientId != "" {
+		if !p.authenticateUser(packet.ClientId, packet.Token) {
+			return false
+		}
+		allowed, offender := p.limiter.allowClient(packet.ClientId, address)
+		if offender {
+			logLocal.Warningf("Client %s repeatedly exceeded the rate limit. Registration removed", packet.ClientId)
+			p.deregisterClient(packet.ClientId)
+		}
+		return allowed
+	}
+
+	switch packet.Flag {
+	case commFlag, handoverFlag:
+		if p.nodes.isNodeHost(address) {
+			return p.limiter.allowRelay(address)
+		}
+	}
+	return p.limiter.allowAddress(address)
+}
+
+// remoteHost returns the host part of the address from which the connection was opened.
+func remoteHost(conn net.Conn) string {
+	host, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		return conn.RemoteAddr().String()
+	}
+	return host
+}
+
+// deregisterClient removes the client from the list of registered clients,
+// which invalidates its authentication token.
+func (p *ProviderServer) deregisterClient(clientId string) {
+	delete(p.assignedClients, clientId)
+	delete(p.pendingMigrations, clientId)
+	p.limiter.forget(clientId)
+}
+
+// RegisterNewClient generates a random authentication token and saves it together with client's public configuration data
 // in the list of all registered clients. After the client is registered the function creates an inbox directory
 // for the client's inbox, in which clients messages will be stored.
 func (p *ProviderServer) registerNewClient(clientBytes []byte) ([]byte, string, error) {
@@ -233,24 +420,46 @@ func (p *ProviderServer) registerNewClient(clientBytes []byte) ([]byte, string,
 	if err != nil {
 		return nil, "", err
 	}
+	if err := validClientId(clientConf.Id); err != nil {
+		return nil, "", err
+	}
+	if _, ok := p.services[clientConf.Id]; ok {
+		return nil, "", errors.New("the client id is reserved for a service of the provider")
+	}
 
-	token := helpers.SHA256([]byte("TMP_Token" + clientConf.Id))
+	token := make([]byte, tokenSize)
+	if _, err := rand.Read(token); err != nil {
+		return nil, "", err
+	}
 	record := ClientRecord{id: clientConf.Id, host: clientConf.Host, port: clientConf.Port, pubKey: clientConf.PubKey, token: token}
 	p.assignedClients[clientConf.Id] = record
+	delete(p.migratedClients, clientConf.Id)
 	address := clientConf.Host + ":" + clientConf.Port
 
-	path := fmt.Sprintf("./inboxes/%s", clientConf.Id)
-	exists, err := helpers.DirExists(path)
+	err = p.createInbox(clientConf.Id)
 	if err != nil {
 		return nil, "", err
 	}
+
+	return token, address, nil
+}
+
+// createInbox creates the inbox directory for the given client, if it does not exist yet.
+func (p *ProviderServer) createInbox(clientId string) error {
+	if err := validClientId(clientId); err != nil {
+		return err
+	}
+	path := fmt.Sprintf("./inboxes/%s", clientId)
+	exists, err := helpers.DirExists(path)
+	if err != nil {
+		return err
+	}
 	if exists == false {
 		if err := os.MkdirAll(path, 0775); err != nil {
-			return nil, "", err
+			return err
 		}
 	}
-
-	return token, address, nil
+	return nil
 }
 
 // Function is responsible for handling the registration request from the client.
@@ -286,7 +495,7 @@ func (p *ProviderServer) handlePullRequest(rqsBytes []byte) error {
 		return err
 	}
 
-	logLocal.Infof("Processing pull request: %s %s", request.ClientId, string(request.Token))
+	logLocal.Infof("Processing pull request: %s", request.ClientId)
 
 	if p.authenticateUser(request.ClientId, request.Token) == true {
 		signal, err := p.fetchMessages(request.ClientId)
@@ -308,15 +517,131 @@ func (p *ProviderServer) handlePullRequest(rqsBytes []byte) error {
 	return nil
 }
 
+// handleDeregisterRequest is responsible for handling the deregistration request received from the client.
+// After the client is authenticated, its record and inbox are removed, hence the token is no longer valid.
+func (p *ProviderServer) handleDeregisterRequest(clientId string, token []byte) error {
+	if !p.authenticateUser(clientId, token) {
+		logLocal.Warning("Authentication went wrong")
+		return errors.New("authentication went wrong")
+	}
+
+	p.deregisterClient(clientId)
+	err := os.RemoveAll(fmt.Sprintf("./inboxes/%s", clientId))
+	if err != nil {
+		return err
+	}
+	logLocal.Infof("Client %s deregistered", clientId)
+	return nil
+}
+
+// handleMigrationRequest is responsible for handling the request of a client which moves to another provider.
+// After the client is authenticated, all messages stored in its inbox are handed over to the new provider
+// and the client is deregistered. Messages for the client which arrive after the migration
+// are forwarded to the new provider as well.
+func (p *ProviderServer) handleMigrationRequest(clientId string, token []byte, providerBytes []byte) error {
+	if !p.authenticateUser(clientId, token) {
+		logLocal.Warning("Authentication went wrong")
+		return errors.New("authentication went wrong")
+	}
+
+	var newProvider config.MixConfig
+	err := proto.Unmarshal(providerBytes, &newProvider)
+	if err != nil {
+		return err
+	}
+
+	path := fmt.Sprintf("./inboxes/%s", clientId)
+	exists, err := helpers.DirExists(path)
+	if err != nil {
+		return err
+	}
+	if exists {
+		files, err := ioutil.ReadDir(path)
+		if err != nil {
+			return err
+		}
+		for _, f := range files {
+			dat, err := ioutil.ReadFile(filepath.Join(path, f.Name()))
+			if err != nil {
+				return err
+			}
+			sealed, err := p.messageForClient(clientId, dat)
+			if err != nil {
+				return err
+			}
+			err = p.handOverMessage(clientId, sealed, newProvider)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	pubKey := p.assignedClients[clientId].pubKey
+	err = p.handleDeregisterRequest(clientId, token)
+	if err != nil {
+		return err
+	}
+	p.migratedClients[clientId] = migration{provider: newProvider, pubKey: pubKey}
+	logLocal.Infof("Client %s migrated to provider %s", clientId, newProvider.Id)
+	return nil
+}
+
+// handOverMessage sends the message stored for the given client to the provider to which the client migrated.
+// The handed over message is sealed to the public key of the client, and the handover is signed by the provider.
+func (p *ProviderServer) handOverMessage(clientId string, message []byte, newProvider config.MixConfig) error {
+	handover := config.InboxHandover{ClientId: clientId, Message: message, ProviderId: p.id}
+	data, err := handoverSignedData(handover)
+	if err != nil {
+		return err
+	}
+	handover.Signature, err = p.sign(data)
+	if err != nil {
+		return err
+	}
+	handoverBytes, err := proto.Marshal(&handover)
+	if err != nil {
+		return err
+	}
+
+	packetBytes, err := config.WrapWithFlag(handoverFlag, handoverBytes)
+	if err != nil {
+		return err
+	}
+	return p.send(packetBytes, newProvider.Host+":"+newProvider.Port)
+}
+
+// handleHandover stores the message handed over by the previous provider of a migrating client.
+// The handover is accepted only for the migrations announced by the clients, see handleMigrationNotice.
+// The message is already sealed to the client, hence it is stored as received.
+// The inbox is created if the client did not register yet.
+func (p *ProviderServer) handleHandover(handoverBytes []byte) error {
+	var handover config.InboxHandover
+	err := proto.Unmarshal(handoverBytes, &handover)
+	if err != nil {
+		return err
+	}
+	if err := p.verifyHandover(handover); err != nil {
+		return err
+	}
+
+	err = p.createInbox(handover.ClientId)
+	if err != nil {
+		return err
+	}
+	delete(p.migratedClients, handover.ClientId)
+	return p.writeToInbox(append([]byte(sealedToClient), handover.Message...), handover.ClientId, newMessageId())
+}
+
 // AuthenticateUser compares the authentication token received from the client with
-// the one stored by the provider. If tokens are the same, it returns true
+// the one stored by the provider, in constant time. If tokens are the same, it returns true
 // and false otherwise.
 func (p *ProviderServer) authenticateUser(clientId string, clientToken []byte) bool {
 
-	if bytes.Compare(p.assignedClients[clientId].token, clientToken) == 0 {
+	record, ok := p.assignedClients[clientId]
+	if ok && hmac.Equal(record.token, clientToken) {
 		return true
 	}
-	logLocal.Warningf("Non matching token: %s, %s", p.assignedClients[clientId].token, clientToken)
+	logLocal.Warningf("Non matching token of client %s", clientId)
 	return false
 }
 
@@ -352,7 +677,11 @@ func (p *ProviderServer) fetchMessages(clientId string) (string, error) {
 
 		address := p.assignedClients[clientId].host + ":" + p.assignedClients[clientId].port
 		logLocal.Infof("Found stored message for address %s", address)
-		msgBytes, err := config.WrapWithFlag(commFlag, dat)
+		sealed, err := p.messageForClient(clientId, dat)
+		if err != nil {
+			return "", err
+		}
+		msgBytes, err := config.WrapWithFlag(commFlag, sealed)
 		if err != nil {
 			return "", err
 		}
@@ -364,41 +693,117 @@ func (p *ProviderServer) fetchMessages(clientId string) (string, error) {
 	return "SI", nil
 }
 
+// newMessageId generates a random identifier under which a message is stored in the inbox.
+func newMessageId() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
 // StoreMessage saves the given message in the inbox defined by the given id.
+// The message is sealed to the public key of the inbox owner, hence only the client can read it.
+// If the public key of the client is not known, the message is encrypted with the storage key
+// of the provider and sealed to the client when it is fetched.
 // If the inbox address does not exist or writing into the inbox was unsuccessful
 // the function returns an error
 func (p *ProviderServer) storeMessage(message []byte, inboxId string, messageId string) error {
+	var stored []byte
+	if record, ok := p.assignedClients[inboxId]; ok && len(record.pubKey) != 0 {
+		sealed, err := sphinx.SealToPublicKey(record.pubKey, message)
+		if err != nil {
+			return err
+		}
+		stored = append([]byte(sealedToClient), sealed...)
+	} else {
+		sealed, err := sphinx.SealWithKey(p.storageKey, message)
+		if err != nil {
+			return err
+		}
+		stored = append([]byte(sealedForStorage), sealed...)
+	}
+
+	err := p.writeToInbox(stored, inboxId, messageId)
+	if err != nil {
+		return err
+	}
+
+	logLocal.Infof("Stored message for %s", inboxId)
+	return nil
+}
+
+// writeToInbox writes the encrypted message into the inbox under a random name. The modification
+// times of the file and the inbox are reset, such that they do not reveal when the message arrived.
+func (p *ProviderServer) writeToInbox(stored []byte, inboxId string, messageId string) error {
+	if err := validClientId(inboxId); err != nil {
+		return err
+	}
 	path := fmt.Sprintf("./inboxes/%s", inboxId)
-	fileName := path + "/" + messageId + ".txt"
+	fileName := filepath.Join(path, messageId)
 
-	file, err := os.Create(fileName)
+	err := ioutil.WriteFile(fileName, stored, 0600)
 	if err != nil {
 		return err
 	}
-	defer file.Close()
 
-	_, err = file.Write(message)
+	storageTime := time.Unix(0, 0)
+	err = os.Chtimes(fileName, storageTime, storageTime)
 	if err != nil {
 		return err
 	}
+	return os.Chtimes(path, storageTime, storageTime)
+}
 
-	logLocal.Infof("Stored message for %s", inboxId)
-	return nil
+// messageForClient returns the stored message sealed to the public key of the given client.
+// The messages encrypted with the storage key are decrypted and sealed to the client.
+func (p *ProviderServer) messageForClient(clientId string, stored []byte) ([]byte, error) {
+	if len(stored) == 0 {
+		return nil, errors.New("empty stored message")
+	}
+
+	switch string(stored[:1]) {
+	case sealedToClient:
+		return stored[1:], nil
+	case sealedForStorage:
+		message, err := sphinx.OpenWithKey(p.storageKey, stored[1:])
+		if err != nil {
+			return nil, err
+		}
+		return sphinx.SealToPublicKey(p.assignedClients[clientId].pubKey, message)
+	default:
+		return nil, errors.New("unknown format of the stored message")
+	}
+}
+
+// storageKeyFromPrivateKey derives the key, which the provider uses to encrypt the stored messages
+// of the clients whose public keys are not known.
+func storageKeyFromPrivateKey(prvKey []byte) []byte {
+	return helpers.SHA256(append([]byte("inbox-storage-key"), prvKey...))
 }
 
 // NewProviderServer constructs a new provider object.
 // NewProviderServer returns a new provider object and an error.
-func NewProviderServer(id string, host string, port string, pubKey []byte, prvKey []byte, pkiPath string) (*ProviderServer, error) {
+func NewProviderServer(id string, host string, port string, pubKey []byte, prvKey []byte, p pki.PKI) (*ProviderServer, error) {
 	node := node.NewMix(pubKey, prvKey)
-	providerServer := ProviderServer{id: id, host: host, port: port, Mix: node, listener: nil}
+	providerServer := ProviderServer{id: id, host: host, port: port, Mix: node, listener: nil, stop: make(chan struct{})}
 	providerServer.config = config.MixConfig{Id: providerServer.id, Host: providerServer.host, Port: providerServer.port, PubKey: providerServer.GetPublicKey()}
 	providerServer.assignedClients = make(map[string]ClientRecord)
-
-	configBytes, err := proto.Marshal(&providerServer.config)
-	if err != nil {
+	providerServer.migratedClients = make(map[string]migration)
+	providerServer.pendingMigrations = make(map[string]string)
+	providerServer.services = make(map[string]Service)
+	providerServer.storageKey = storageKeyFromPrivateKey(prvKey)
+	providerServer.sign = directory.KeySigner(prvKey)
+	providerServer.limiter = newRateLimiter()
+	providerServer.nodes = newKnownNodes(p)
+	if err := providerServer.registerDefaultServices(p); err != nil {
 		return nil, err
 	}
-	err = helpers.AddToDatabase(pkiPath, "Pki", providerServer.id, "Provider", configBytes)
+
+	providerServer.publish = func() error {
+		return p.PublishProvider(providerServer.config, directory.KeySigner(prvKey))
+	}
+	err := providerServer.publish()
 	if err != nil {
 		return nil, err
 	}
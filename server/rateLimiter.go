@@ -0,0 +1,254 @@
+// Copyright 2018 The Loopix-Messaging Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"anonymous-messaging/config"
+
+	"sync"
+	"time"
+)
+
+const (
+	// rateTolerance is the multiple of the highest allowed sending rate which a client is allowed to use
+	// before its packets are dropped. The sending times are exponentially distributed, hence a client
+	// following the protocol might temporarily exceed the expected rate.
+	rateTolerance = 2
+	// burstSize is the number of packets a client can send at once, e.g., after a reconnection.
+	burstSize = 50
+	// clientsPerAddress is the number of clients which are expected to share a single source address.
+	clientsPerAddress = 10
+	// maxRateViolations is the number of packets a client can have dropped within the violation window
+	// before it loses its registration.
+	maxRateViolations = 100
+	// violationWindow is the time after which a dropped packet is no longer counted against the client,
+	// hence the occasional bursts of a client following the protocol do not add up to the deregistration.
+	violationWindow = time.Minute
+	// sweepInterval is the interval between the removals of the idle buckets and the expired violations.
+	sweepInterval = time.Minute
+	// clientsPerRelay is the number of clients whose packets are expected to be relayed by a single node.
+	clientsPerRelay = 1000
+)
+
+// clientPacketRate is the highest expected number of packets per second which a client sends to its provider.
+// The clients can publish their own sending rates, up to the maximum rate in each of the real, loop, drop
+// and fetch streams, hence the clients using the highest allowed rates are not throttled.
+const clientPacketRate = 4 * config.MaxTrafficRate
+
+// tokenBucket implements the token bucket algorithm. The bucket is refilled with rate tokens per second
+// up to its capacity, and each accepted packet takes a single token from the bucket.
+type tokenBucket struct {
+	tokens   float64
+	capacity float64
+	rate     float64
+	last     time.Time
+}
+
+// take refills the bucket with the tokens accumulated since the last call and
+// takes a single token. take returns false if the bucket is empty.
+func (b *tokenBucket) take(now time.Time) bool {
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.capacity {
+		b.tokens = b.capacity
+	}
+	b.last = now
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// idle returns whether the bucket has been refilled up to its capacity, in which case it is the same as a new bucket.
+func (b *tokenBucket) idle(now time.Time) bool {
+	return b.tokens+now.Sub(b.last).Seconds()*b.rate >= b.capacity
+}
+
+func newTokenBucket(rate, capacity float64, now time.Time) *tokenBucket {
+	return &tokenBucket{tokens: capacity, capacity: capacity, rate: rate, last: now}
+}
+
+// FloodStats contains the counters of the packets dropped by the provider
+// because the sending client or source address exceeded its rate limit.
+type FloodStats struct {
+	DroppedByClient  uint64
+	DroppedByAddress uint64
+	DroppedByRelay   uint64
+	Deregistered     uint64
+}
+
+// rateLimiter keeps a token bucket for each client and for each source address. The addresses of the
+// mixes and the providers relaying the packets of many clients have separate buckets with a larger budget.
+// The buckets which are refilled are removed, hence a flood from many addresses does not grow the state
+// beyond the addresses seen in the last sweep interval.
+type rateLimiter struct {
+	mutex sync.Mutex
+	now   func() time.Time
+
+	clientRate   float64
+	clientBurst  float64
+	addressRate  float64
+	addressBurst float64
+	relayRate    float64
+	relayBurst   float64
+
+	clients    map[string]*tokenBucket
+	addresses  map[string]*tokenBucket
+	relays     map[string]*tokenBucket
+	violations map[string][]time.Time
+	lastSweep  time.Time
+	stats      FloodStats
+}
+
+// allowClient checks whether the packet of the given client and source address is within the limits.
+// allowClient returns false if the packet should be dropped, and whether the client exceeded the
+// number of allowed rate violations.
+func (r *rateLimiter) allowClient(clientId, address string) (bool, bool) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	now := r.now()
+	r.sweep(now)
+	if !r.takeAddress(address, now) {
+		return false, false
+	}
+
+	bucket, ok := r.clients[clientId]
+	if !ok {
+		bucket = newTokenBucket(r.clientRate, r.clientBurst, now)
+		r.clients[clientId] = bucket
+	}
+	if bucket.take(now) {
+		return true, false
+	}
+
+	r.stats.DroppedByClient++
+	r.violations[clientId] = append(recentViolations(r.violations[clientId], now), now)
+	if len(r.violations[clientId]) >= maxRateViolations {
+		r.stats.Deregistered++
+		return false, true
+	}
+	return false, false
+}
+
+// allowAddress checks whether a packet from the given source address is within the limits.
+func (r *rateLimiter) allowAddress(address string) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	now := r.now()
+	r.sweep(now)
+	return r.takeAddress(address, now)
+}
+
+// allowRelay checks whether a packet relayed by the node at the given address is within the limits.
+func (r *rateLimiter) allowRelay(address string) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	now := r.now()
+	r.sweep(now)
+	bucket, ok := r.relays[address]
+	if !ok {
+		bucket = newTokenBucket(r.relayRate, r.relayBurst, now)
+		r.relays[address] = bucket
+	}
+	if bucket.take(now) {
+		return true
+	}
+	r.stats.DroppedByRelay++
+	return false
+}
+
+func (r *rateLimiter) takeAddress(address string, now time.Time) bool {
+	bucket, ok := r.addresses[address]
+	if !ok {
+		bucket = newTokenBucket(r.addressRate, r.addressBurst, now)
+		r.addresses[address] = bucket
+	}
+	if bucket.take(now) {
+		return true
+	}
+	r.stats.DroppedByAddress++
+	return false
+}
+
+// sweep removes the idle buckets and the violations outside of the window, at most once in the sweep interval.
+func (r *rateLimiter) sweep(now time.Time) {
+	if now.Sub(r.lastSweep) < sweepInterval {
+		return
+	}
+	r.lastSweep = now
+
+	for _, buckets := range []map[string]*tokenBucket{r.clients, r.addresses, r.relays} {
+		for key, bucket := range buckets {
+			if bucket.idle(now) {
+				delete(buckets, key)
+			}
+		}
+	}
+	for clientId, violations := range r.violations {
+		if recent := recentViolations(violations, now); len(recent) > 0 {
+			r.violations[clientId] = recent
+		} else {
+			delete(r.violations, clientId)
+		}
+	}
+}
+
+// recentViolations returns the times of the violations within the window before now.
+func recentViolations(violations []time.Time, now time.Time) []time.Time {
+	recent := violations[:0]
+	for _, t := range violations {
+		if now.Sub(t) < violationWindow {
+			recent = append(recent, t)
+		}
+	}
+	return recent
+}
+
+// forget removes the state kept for the given client, which is called when the client loses its registration.
+func (r *rateLimiter) forget(clientId string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	delete(r.clients, clientId)
+	delete(r.violations, clientId)
+}
+
+func (r *rateLimiter) floodStats() FloodStats {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	return r.stats
+}
+
+// newRateLimiter creates a rate limiter, which limits are derived from the highest allowed sending rates of the clients.
+func newRateLimiter() *rateLimiter {
+	return &rateLimiter{
+		now:          time.Now,
+		clientRate:   clientPacketRate * rateTolerance,
+		clientBurst:  burstSize,
+		addressRate:  clientPacketRate * rateTolerance * clientsPerAddress,
+		addressBurst: burstSize * clientsPerAddress,
+		relayRate:    clientPacketRate * rateTolerance * clientsPerRelay,
+		relayBurst:   burstSize * clientsPerRelay,
+		clients:      make(map[string]*tokenBucket),
+		addresses:    make(map[string]*tokenBucket),
+		relays:       make(map[string]*tokenBucket),
+		violations:   make(map[string][]time.Time),
+	}
+}
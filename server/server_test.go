@@ -16,8 +16,10 @@ package server
 
 import (
 	"anonymous-messaging/config"
+	"anonymous-messaging/directory"
 	"anonymous-messaging/helpers"
 	"anonymous-messaging/node"
+	"anonymous-messaging/pki"
 	"anonymous-messaging/sphinx"
 
 	"github.com/protobuf/proto"
@@ -26,11 +28,13 @@ import (
 	"crypto/elliptic"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net"
 	"os"
 	"path/filepath"
 	"testing"
+	"time"
 )
 
 var mixServer *MixServer
@@ -46,9 +50,20 @@ func createTestProvider() (*ProviderServer, error) {
 		return nil, err
 	}
 	node := node.NewMix(pub, priv)
-	provider := ProviderServer{host: "localhost", port: "9999", Mix: node}
+	provider := ProviderServer{id: "Provider", host: "localhost", port: "9999", Mix: node}
 	provider.config = config.MixConfig{Id: provider.id, Host: provider.host, Port: provider.port, PubKey: provider.GetPublicKey()}
 	provider.assignedClients = make(map[string]ClientRecord)
+	provider.migratedClients = make(map[string]migration)
+	provider.pendingMigrations = make(map[string]string)
+	provider.services = make(map[string]Service)
+	testPKI := pki.NewMemory()
+	if err := provider.registerDefaultServices(testPKI); err != nil {
+		return nil, err
+	}
+	provider.storageKey = storageKeyFromPrivateKey(priv)
+	provider.sign = directory.KeySigner(priv)
+	provider.limiter = newRateLimiter()
+	provider.nodes = newKnownNodes(testPKI)
 	return &provider, nil
 }
 
@@ -136,28 +151,25 @@ func createInbox(id string, t *testing.T) {
 }
 
 func createTestMessage(id string, t *testing.T) {
-
-	file, err := os.Create(filepath.Join("./inboxes", id, "TestMessage.txt"))
+	err := providerServer.storeMessage([]byte("This is a test message"), id, "TestMessage")
 	if err != nil {
 		t.Fatal(err)
 	}
-	defer file.Close()
-	_, err = file.Write([]byte("This is a test message"))
+}
+
+func createTestClientRecord(id string, t *testing.T) ([]byte, ClientRecord) {
+	pub, priv, err := sphinx.GenerateKeyPair()
 	if err != nil {
 		t.Fatal(err)
 	}
-
+	return priv, ClientRecord{id: id, host: "localhost", port: "9999", pubKey: pub, token: []byte("TestToken")}
 }
 
 func TestProviderServer_FetchMessages_FullInbox(t *testing.T) {
 	clientListener, err := createFakeClientListener("localhost", "9999")
 	defer clientListener.Close()
 
-	providerServer.assignedClients["FakeClient"] = ClientRecord{"FakeClient",
-		"localhost",
-		"9999",
-		[]byte("FakePublicKey"),
-		[]byte("TestToken")}
+	_, providerServer.assignedClients["FakeClient"] = createTestClientRecord("FakeClient", t)
 
 	createInbox("FakeClient", t)
 	createTestMessage("FakeClient", t)
@@ -191,30 +203,75 @@ func TestProviderServer_StoreMessage(t *testing.T) {
 	inboxId := "ClientInbox"
 	fileId := "12345"
 	inboxDir := "./inboxes/" + inboxId
-	filePath := inboxDir + "/" + fileId + ".txt"
+	filePath := inboxDir + "/" + fileId
 
 	err := os.MkdirAll(inboxDir, 0755)
 	if err != nil {
 		t.Fatal(err)
 	}
+	priv, record := createTestClientRecord(inboxId, t)
+	providerServer.assignedClients[inboxId] = record
 
 	message := []byte("Hello world message")
-	providerServer.storeMessage(message, inboxId, fileId)
+	err = providerServer.storeMessage(message, inboxId, fileId)
+	if err != nil {
+		t.Fatal(err)
+	}
 
-	_, err = os.Stat(filePath)
+	info, err := os.Stat(filePath)
 	if err != nil {
 		t.Fatal(err)
 	}
 	assert.Nil(t, err, "The file with the message should be created")
+	assert.Equal(t, int64(0), info.ModTime().Unix(), "The modification time should not reveal when the message arrived")
 
 	dat, err := ioutil.ReadFile(filePath)
 	if err != nil {
 		t.Fatal(err)
 	}
-	assert.Equal(t, message, dat, "Messages should be the same")
+	assert.NotContains(t, string(dat), string(message), "The stored message should be encrypted")
+
+	sealed, err := providerServer.messageForClient(inboxId, dat)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opened, err := sphinx.OpenSealed(priv, sealed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, message, opened, "Messages should be the same")
 
 }
 
+func TestProviderServer_StoreMessage_UnknownClient(t *testing.T) {
+	inboxId := "UnknownClientInbox"
+	createInbox(inboxId, t)
+	delete(providerServer.assignedClients, inboxId)
+
+	message := []byte("Hello world message")
+	err := providerServer.storeMessage(message, inboxId, "12345")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dat, err := ioutil.ReadFile(filepath.Join("./inboxes", inboxId, "12345"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, sealedForStorage, string(dat[:1]), "The message should be encrypted with the storage key")
+
+	priv, record := createTestClientRecord(inboxId, t)
+	providerServer.assignedClients[inboxId] = record
+	sealed, err := providerServer.messageForClient(inboxId, dat)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opened, err := sphinx.OpenSealed(priv, sealed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, message, opened, "The message should be sealed to the client when it is fetched")
+}
+
 func TestProviderServer_HandlePullRequest_Pass(t *testing.T) {
 	testPullRequest := config.PullRequest{ClientId: "PassTestId", Token: []byte("TestToken")}
 	providerServer.assignedClients["PassTestId"] = ClientRecord{id: "TestId", host: "localhost", port: "1111", pubKey: nil, token: []byte("TestToken")}
@@ -250,7 +307,7 @@ func TestProviderServer_RegisterNewClient(t *testing.T) {
 		t.Fatal(err)
 	}
 	assert.Equal(t, "localhost:9998", addr, "Returned address should be the same as registered client address")
-	assert.Equal(t, helpers.SHA256([]byte("TMP_Token"+"NewClient")), token, "Returned token should be equal to the hash of clients id")
+	assert.Equal(t, providerServer.assignedClients["NewClient"].token, token, "Returned token should be the stored token of the client")
 
 	path := fmt.Sprintf("./inboxes/%s", "NewClient")
 	exists, err := helpers.DirExists(path)
@@ -277,7 +334,7 @@ func TestProviderServer_HandleAssignRequest(t *testing.T) {
 
 func createTestPacket(t *testing.T) *sphinx.SphinxPacket {
 	path := config.E2EPath{IngressProvider: providerServer.config, Mixes: []config.MixConfig{mixServer.config}, EgressProvider: providerServer.config}
-	sphinxPacket, err := sphinx.PackForwardMessage(elliptic.P224(), path, []float64{0.1, 0.2, 0.3}, "Hello world")
+	sphinxPacket, err := sphinx.PackForwardMessage(elliptic.P224(), path, []float64{0.1, 0.2, 0.3}, "Hello world", sphinx.RealMessageType)
 	if err != nil {
 		t.Fatal(err)
 		return nil
@@ -298,17 +355,593 @@ func TestProviderServer_ReceivedPacket(t *testing.T) {
 }
 
 func TestProviderServer_HandleConnection(t *testing.T) {
+	packetBytes, err := proto.Marshal(createTestPacket(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	wrapped, err := config.WrapWithFlag(commFlag, packetBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serverConn, clientConn := net.Pipe()
+	go func() {
+		clientConn.Write(wrapped)
+		clientConn.Close()
+	}()
+	errs := make(chan error, 1)
+	providerServer.handleConnection(serverConn, errs)
+	assert.Nil(t, <-errs, "The packet read from the connection should be processed without errors")
+}
+
+func TestProviderServer_HandleConnection_Closed(t *testing.T) {
 	serverConn, _ := net.Pipe()
+	serverConn.Close()
+
 	errs := make(chan error, 1)
-	// serverConn.Write([]byte("test"))
+	providerServer.handleConnection(serverConn, errs)
+	assert.Equal(t, io.ErrClosedPipe, <-errs, "The error of reading the packet should be reported")
+}
+
+func TestTokenBucket_Take(t *testing.T) {
+	now := time.Now()
+	bucket := newTokenBucket(1, 2, now)
+
+	assert.True(t, bucket.take(now), "A full bucket should accept a packet")
+	assert.True(t, bucket.take(now), "A full bucket should accept packets up to its capacity")
+	assert.False(t, bucket.take(now), "An empty bucket should not accept a packet")
+	assert.True(t, bucket.take(now.Add(time.Second)), "The bucket should be refilled with the given rate")
+	assert.False(t, bucket.take(now.Add(time.Second)), "The bucket should be refilled only with the accumulated tokens")
+}
+
+func TestRateLimiter_Sweep(t *testing.T) {
+	limiter := newRateLimiter()
+	now := time.Now()
+	limiter.now = func() time.Time { return now }
+
+	for i := 0; i < 100; i++ {
+		assert.True(t, limiter.allowAddress(fmt.Sprintf("10.0.0.%d", i)))
+	}
+	assert.True(t, limiter.allowRelay("10.0.1.1"))
+	assert.Equal(t, 100, len(limiter.addresses))
+
+	now = now.Add(sweepInterval)
+	assert.True(t, limiter.allowAddress("10.0.0.1"))
+	assert.Equal(t, 1, len(limiter.addresses), "The refilled buckets should be removed")
+	assert.Equal(t, 0, len(limiter.relays), "The refilled buckets should be removed")
+}
+
+func TestRateLimiter_ViolationWindow(t *testing.T) {
+	limiter := newRateLimiter()
+	now := time.Now()
+	limiter.now = func() time.Time { return now }
+
+	for round := 0; round < 3; round++ {
+		for i := 0; i < burstSize+maxRateViolations/2; i++ {
+			_, offender := limiter.allowClient("Client", fmt.Sprintf("10.0.0.%d", i))
+			assert.False(t, offender, "The violations outside of the window should not be counted")
+		}
+		now = now.Add(violationWindow)
+	}
+	assert.Equal(t, 1, len(limiter.violations))
+
+	for i := 0; i < burstSize+maxRateViolations-1; i++ {
+		limiter.allowClient("Client", fmt.Sprintf("10.0.0.%d", i))
+	}
+	_, offender := limiter.allowClient("Client", "10.0.0.1")
+	assert.True(t, offender, "The violations within the window should be counted")
+}
+
+func TestProviderServer_AdmitPacket_UnknownClient(t *testing.T) {
+	provider, err := createTestProvider()
+	if err != nil {
+		t.Fatal(err)
+	}
+	packet := config.GeneralPacket{Flag: commFlag, ClientId: "UnknownClient", Token: nil}
+	assert.False(t, provider.admitPacket(packet, "127.0.0.1"), "Packets with invalid credentials should be dropped")
+}
+
+func TestProviderServer_AdmitPacket_ClientFlood(t *testing.T) {
+	provider, err := createTestProvider()
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	provider.limiter.now = func() time.Time { return now }
+	provider.assignedClients["FloodingClient"] = ClientRecord{id: "FloodingClient", host: "localhost", port: "1111", pubKey: nil, token: []byte("TestToken")}
+
+	packet := config.GeneralPacket{Flag: commFlag, ClientId: "FloodingClient", Token: []byte("TestToken")}
+	for i := 0; i < burstSize; i++ {
+		assert.True(t, provider.admitPacket(packet, "127.0.0.1"), "Packets within the burst size should be accepted")
+	}
+	assert.False(t, provider.admitPacket(packet, "127.0.0.1"), "Packets exceeding the rate limit should be dropped")
+
+	for i := 1; i < maxRateViolations; i++ {
+		provider.admitPacket(packet, "127.0.0.1")
+	}
+	_, registered := provider.assignedClients["FloodingClient"]
+	assert.False(t, registered, "A client repeatedly exceeding the rate limit should lose its registration")
+	assert.Equal(t, FloodStats{DroppedByClient: maxRateViolations, DroppedByAddress: 0, Deregistered: 1}, provider.FloodStats())
+}
+
+func TestProviderServer_AdmitPacket_AddressFlood(t *testing.T) {
+	provider, err := createTestProvider()
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	provider.limiter.now = func() time.Time { return now }
+
+	packet := config.GeneralPacket{Flag: assigneFlag}
+	for i := 0; i < burstSize*clientsPerAddress; i++ {
+		assert.True(t, provider.admitPacket(packet, "127.0.0.1"), "Requests within the burst size should be accepted")
+	}
+	assert.False(t, provider.admitPacket(packet, "127.0.0.1"), "Requests exceeding the address limit should be dropped")
+	assert.True(t, provider.admitPacket(packet, "127.0.0.2"), "Requests from other addresses should be accepted")
+
+	anonymous := config.GeneralPacket{Flag: commFlag}
+	assert.False(t, provider.admitPacket(anonymous, "127.0.0.1"), "Packets without credentials from unknown hosts should be limited per address")
+}
+
+func TestProviderServer_AdmitPacket_RelayedByMix(t *testing.T) {
+	provider, err := createTestProvider()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, priv, err := sphinx.GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mix := config.MixConfig{Id: "Mix", Host: "127.0.0.3", Port: "9990", PubKey: pub}
+	if err := provider.nodes.pki.PublishMix(mix, directory.KeySigner(priv)); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	provider.limiter.now = func() time.Time { return now }
+
+	packet := config.GeneralPacket{Flag: commFlag}
+	for i := 0; i < burstSize*clientsPerAddress+1; i++ {
+		assert.True(t, provider.admitPacket(packet, "127.0.0.3"), "The packets relayed by a mix should have a larger budget")
+	}
+	for i := burstSize*clientsPerAddress + 1; i < burstSize*clientsPerRelay; i++ {
+		provider.admitPacket(packet, "127.0.0.3")
+	}
+	assert.False(t, provider.admitPacket(packet, "127.0.0.3"), "The packets exceeding the relay limit should be dropped")
+	assert.Equal(t, uint64(1), provider.FloodStats().DroppedByRelay)
+}
+
+func TestProviderServer_HandleDeregisterRequest_Pass(t *testing.T) {
+	providerServer.assignedClients["LeavingClient"] = ClientRecord{id: "LeavingClient", host: "localhost", port: "1111", pubKey: nil, token: []byte("TestToken")}
+	createInbox("LeavingClient", t)
+
+	err := providerServer.handleDeregisterRequest("LeavingClient", []byte("TestToken"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, registered := providerServer.assignedClients["LeavingClient"]
+	assert.False(t, registered, "A deregistered client should be removed from the registered clients")
+	exists, err := helpers.DirExists("./inboxes/LeavingClient")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.False(t, exists, "The inbox of a deregistered client should be removed")
+}
+
+func TestProviderServer_HandleDeregisterRequest_Fail(t *testing.T) {
+	providerServer.assignedClients["StayingClient"] = ClientRecord{id: "StayingClient", host: "localhost", port: "1111", pubKey: nil, token: []byte("TestToken")}
+	err := providerServer.handleDeregisterRequest("StayingClient", []byte("WrongToken"))
+	assert.EqualError(t, errors.New("authentication went wrong"), err.Error(), "Deregistration should fail if authentication failed")
+
+	_, registered := providerServer.assignedClients["StayingClient"]
+	assert.True(t, registered, "A client should not be deregistered with a wrong token")
+}
+
+func TestProviderServer_HandleMigrationRequest(t *testing.T) {
+	newProviderListener, err := createFakeClientListener("localhost", "9994")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer newProviderListener.Close()
+
+	received := make(chan config.GeneralPacket, 1)
 	go func() {
-		providerServer.handleConnection(serverConn, errs)
-		err := <-errs
+		conn, err := newProviderListener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		buff := make([]byte, 1024)
+		reqLen, err := conn.Read(buff)
+		if err != nil {
+			return
+		}
+		var packet config.GeneralPacket
+		proto.Unmarshal(buff[:reqLen], &packet)
+		received <- packet
+	}()
+
+	priv, record := createTestClientRecord("MigratingClient", t)
+	providerServer.assignedClients["MigratingClient"] = record
+	createInbox("MigratingClient", t)
+	createTestMessage("MigratingClient", t)
+
+	newProvider := config.MixConfig{Id: "NewProvider", Host: "localhost", Port: "9994"}
+	bNewProvider, err := proto.Marshal(&newProvider)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = providerServer.handleMigrationRequest("MigratingClient", []byte("TestToken"), bNewProvider)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	packet := <-received
+	var handover config.InboxHandover
+	err = proto.Unmarshal(packet.Data, &handover)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, handoverFlag, packet.Flag, "Stored messages should be handed over to the new provider")
+	assert.Equal(t, "MigratingClient", handover.ClientId)
+	data, err := handoverSignedData(handover)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, sphinx.Verify(providerServer.GetPublicKey(), data, handover.Signature), "The handover should be signed by the provider")
+	message, err := sphinx.OpenSealed(priv, handover.Message)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []byte("This is a test message"), message)
+
+	_, registered := providerServer.assignedClients["MigratingClient"]
+	assert.False(t, registered, "A migrated client should be removed from the registered clients")
+	assert.Equal(t, newProvider, providerServer.migratedClients["MigratingClient"].provider, "Later messages should be forwarded to the new provider")
+}
+
+// createTestHandover announces the migration of the client from a provider published in the PKI,
+// and returns the handover of the given message signed by that provider.
+func createTestHandover(clientId string, message []byte, t *testing.T) config.InboxHandover {
+	pub, priv, err := sphinx.GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	previous := config.MixConfig{Id: "PreviousProviderOf" + clientId, Host: "localhost", Port: "9993", PubKey: pub}
+	if err := providerServer.nodes.pki.PublishProvider(previous, directory.KeySigner(priv)); err != nil {
+		t.Fatal(err)
+	}
+	providerServer.nodes.refreshed = time.Time{}
+	providerServer.pendingMigrations[clientId] = previous.Id
+
+	handover := config.InboxHandover{ClientId: clientId, Message: message, ProviderId: previous.Id}
+	data, err := handoverSignedData(handover)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handover.Signature, err = sphinx.Sign(priv, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return handover
+}
+
+func TestProviderServer_HandleHandover(t *testing.T) {
+	handover := createTestHandover("ArrivingClient", []byte("Handed over message"), t)
+	bHandover, err := proto.Marshal(&handover)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = providerServer.handleHandover(bHandover)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files, err := ioutil.ReadDir("./inboxes/ArrivingClient")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 1, len(files), "The handed over message should be stored in the inbox")
+	dat, err := ioutil.ReadFile(filepath.Join("./inboxes/ArrivingClient", files[0].Name()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed, err := providerServer.messageForClient("ArrivingClient", dat)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []byte("Handed over message"), sealed, "The handed over message is already sealed to the client")
+}
+
+func TestProviderServer_HandleHandover_Rejected(t *testing.T) {
+	forged := createTestHandover("ForgedClient", []byte("Forged message"), t)
+	forged.Message = []byte("Replaced message")
+	bForged, err := proto.Marshal(&forged)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.EqualError(t, providerServer.handleHandover(bForged), "the signature of the handover is invalid")
+
+	unannounced := createTestHandover("UnannouncedClient", []byte("Handed over message"), t)
+	delete(providerServer.pendingMigrations, "UnannouncedClient")
+	bUnannounced, err := proto.Marshal(&unannounced)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.EqualError(t, providerServer.handleHandover(bUnannounced), "no pending migration of the client")
+
+	traversal := config.InboxHandover{ClientId: "../outside", Message: []byte("Handed over message")}
+	bTraversal, err := proto.Marshal(&traversal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.EqualError(t, providerServer.handleHandover(bTraversal), "invalid client id")
+}
+
+func TestProviderServer_HandleMigrationNotice(t *testing.T) {
+	pub, priv, err := sphinx.GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := providerServer.nodes.pki.PublishProvider(providerServer.config, providerServer.sign); err != nil {
+		t.Fatal(err)
+	}
+	client := config.ClientConfig{Id: "AnnouncingClient", PubKey: pub, ProviderId: providerServer.id}
+	if err := providerServer.nodes.pki.PublishClient(client, directory.KeySigner(priv)); err != nil {
+		t.Fatal(err)
+	}
+
+	notice := config.MigrationNotice{ClientId: "AnnouncingClient", FromProviderId: "PreviousProvider", ToProviderId: providerServer.id, Timestamp: time.Now().Unix()}
+	data, err := config.MigrationNoticeSignedData(notice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	notice.Signature, err = sphinx.Sign(priv, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bNotice, err := proto.Marshal(&notice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Nil(t, providerServer.handleMigrationNotice(bNotice))
+	assert.Equal(t, "PreviousProvider", providerServer.pendingMigrations["AnnouncingClient"])
+
+	stale := notice
+	stale.Timestamp = time.Now().Add(-time.Hour).Unix()
+	bStale, err := proto.Marshal(&stale)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.EqualError(t, providerServer.handleMigrationNotice(bStale), "the migration notice is expired")
+
+	forged := notice
+	forged.FromProviderId = "MaliciousProvider"
+	bForged, err := proto.Marshal(&forged)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.EqualError(t, providerServer.handleMigrationNotice(bForged), "the signature of the migration notice is invalid")
+}
+
+func TestProviderServer_RegisterNewClient_RandomToken(t *testing.T) {
+	first, err := proto.Marshal(&config.ClientConfig{Id: "RegisteringClient", Host: "localhost", Port: "9999"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, _, err := providerServer.registerNewClient(first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, _, err := providerServer.registerNewClient(first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, tokenSize, len(token))
+	assert.NotEqual(t, token, again, "The tokens should be random")
+	assert.True(t, providerServer.authenticateUser("RegisteringClient", again))
+	assert.False(t, providerServer.authenticateUser("RegisteringClient", token), "The token of the previous registration should not be valid")
+}
+
+func TestProviderServer_RegisterNewClient_InvalidId(t *testing.T) {
+	traversal, err := proto.Marshal(&config.ClientConfig{Id: "../RegisteringClient", Host: "localhost", Port: "9999"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = providerServer.registerNewClient(traversal)
+	assert.EqualError(t, err, "invalid client id")
+}
+
+func createTestEgressPacket(recipientId string, message string, messageType string, t *testing.T) []byte {
+	pubI, privI, err := sphinx.GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ingress := config.MixConfig{Id: "Ingress", Host: "localhost", Port: "9990", PubKey: pubI}
+	recipient := config.ClientConfig{Id: recipientId, Host: "localhost", Port: "9998"}
+	path := config.E2EPath{IngressProvider: ingress, Mixes: []config.MixConfig{}, EgressProvider: providerServer.config, Recipient: recipient}
+
+	sphinxPacket, err := sphinx.PackForwardMessage(elliptic.P224(), path, []float64{0.0, 0.0}, message, messageType)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bSphinxPacket, err := proto.Marshal(&sphinxPacket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, egressPacket, err := sphinx.ProcessSphinxPacket(bSphinxPacket, privI)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return egressPacket
+}
+
+func TestProviderServer_ReceivedPacket_DropMessage(t *testing.T) {
+	createInbox("DropRecipient", t)
+	before := providerServer.MessageStats()
+
+	err := providerServer.receivedPacket(createTestEgressPacket("DropRecipient", "Hello world", sphinx.DropMessageType, t))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files, err := ioutil.ReadDir("./inboxes/DropRecipient")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 0, len(files), "Drop cover messages should not be stored")
+	assert.Equal(t, before.Drop+1, providerServer.MessageStats().Drop, "Drop cover messages should be counted")
+}
+
+func TestProviderServer_ReceivedPacket_LoopMessage(t *testing.T) {
+	createInbox("LoopRecipient", t)
+	before := providerServer.MessageStats()
+
+	err := providerServer.receivedPacket(createTestEgressPacket("LoopRecipient", "Hello world", sphinx.LoopMessageType, t))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files, err := ioutil.ReadDir("./inboxes/LoopRecipient")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 1, len(files), "Loop messages should be stored for their senders")
+	assert.Equal(t, before.Loop+1, providerServer.MessageStats().Loop, "Loop messages should be counted")
+
+	dat, err := ioutil.ReadFile(filepath.Join("./inboxes/LoopRecipient", files[0].Name()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored, err := sphinx.OpenWithKey(providerServer.storageKey, dat[1:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	messageType, _, err := sphinx.SplitTypedMessage(stored)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, sphinx.LoopMessageType, messageType, "The type of the message should be stored for the recipient")
+}
+
+func TestProviderServer_ReceivedPacket_ServiceRequest(t *testing.T) {
+	firstHopListener, err := createFakeClientListener("localhost", "9993")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer firstHopListener.Close()
+
+	received := make(chan config.GeneralPacket, 1)
+	go func() {
+		conn, err := firstHopListener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		buff := make([]byte, 1024)
+		reqLen, err := conn.Read(buff)
+		if err != nil {
+			return
+		}
+		var packet config.GeneralPacket
+		proto.Unmarshal(buff[:reqLen], &packet)
+		received <- packet
+	}()
+
+	pubF, privF, err := sphinx.GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubE, privE, err := sphinx.GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	firstHop := config.MixConfig{Id: "FirstHop", Host: "localhost", Port: "9993", PubKey: pubF}
+	egress := config.MixConfig{Id: "Egress", Host: "localhost", Port: "9992", PubKey: pubE}
+	replyPath := config.E2EPath{IngressProvider: firstHop, Mixes: []config.MixConfig{}, EgressProvider: egress,
+		Recipient: config.ClientConfig{Id: "Requester", Host: "localhost", Port: "9998"}}
+	block, keys, err := sphinx.CreateReplyBlock(elliptic.P224(), replyPath, []float64{0.0, 0.0}, sphinx.RealMessageType)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bBlock, err := proto.Marshal(&block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	request, err := proto.Marshal(&config.ServiceRequest{Payload: []byte("Ping"), ReplyBlock: bBlock})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = providerServer.receivedPacket(createTestEgressPacket(EchoServiceId, string(request), sphinx.RealMessageType, t))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	packet := <-received
+	assert.Equal(t, commFlag, packet.Flag, "The reply should be sent to the first hop of the reply block")
+	replyBytes := packet.Data
+	for _, priv := range [][]byte{privF, privE} {
+		_, _, replyBytes, err = sphinx.ProcessSphinxPacket(replyBytes, priv)
 		if err != nil {
 			t.Fatal(err)
 		}
-		serverConn.Close()
+	}
+	var reply sphinx.SphinxPacket
+	err = proto.Unmarshal(replyBytes, &reply)
+	if err != nil {
+		t.Fatal(err)
+	}
+	message, err := sphinx.OpenReply(reply, keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []byte("Ping"), message, "The echo service should reply with the payload of the request")
+}
+
+func TestProviderServer_RegisterService_Taken(t *testing.T) {
+	err := providerServer.RegisterService(EchoService{})
+	assert.EqualError(t, err, "a service with the given id is already registered")
+}
+
+func TestProviderServer_RegisterNewClient_ServiceId(t *testing.T) {
+	bClient, err := proto.Marshal(&config.ClientConfig{Id: EchoServiceId, Host: "localhost", Port: "9998"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = providerServer.registerNewClient(bClient)
+	assert.EqualError(t, err, "the client id is reserved for a service of the provider")
+}
+
+func TestDeliveryReceiptService_Handle(t *testing.T) {
+	service := DeliveryReceiptService{now: func() time.Time { return time.Unix(100, 0) }}
+	bReceipt, err := service.Handle([]byte("Delivered message"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var receipt config.DeliveryReceipt
+	err = proto.Unmarshal(bReceipt, &receipt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, helpers.SHA256([]byte("Delivered message")), receipt.Digest)
+	assert.Equal(t, int64(100), receipt.Timestamp)
+}
+
+func TestSendHeartbeats_Stop(t *testing.T) {
+	stop := make(chan struct{})
+	finished := make(chan struct{})
+	var published int
+	go func() {
+		sendHeartbeats(func() error { published++; return nil }, stop)
+		close(finished)
 	}()
-	serverConn.Close()
 
+	close(stop)
+	select {
+	case <-finished:
+	case <-time.After(time.Second):
+		t.Fatal("The heartbeats should stop when the stop channel is closed")
+	}
+	assert.Equal(t, 0, published, "No heartbeat should be sent before the interval")
 }
@@ -0,0 +1,151 @@
+// Copyright 2018 The Loopix-Messaging Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"anonymous-messaging/config"
+	"anonymous-messaging/helpers"
+	"anonymous-messaging/pki"
+	"anonymous-messaging/sphinx"
+
+	"github.com/protobuf/proto"
+
+	"errors"
+	"time"
+)
+
+const (
+	EchoServiceId            = "echo"
+	PKILookupServiceId       = "pki"
+	DeliveryReceiptServiceId = "receipt"
+)
+
+// Service is a service hosted by the provider, which can be addressed as the recipient of Sphinx packets.
+// A service is addressed by its id at the hosting provider, in the same way as the clients registered
+// with the provider. The provider passes the decrypted payload of each request to Handle and sends
+// the returned reply back to the sender using the reply block attached to the request.
+type Service interface {
+	Id() string
+	Handle(payload []byte) ([]byte, error)
+}
+
+// EchoService replies with the payload of the request.
+type EchoService struct{}
+
+func (s EchoService) Id() string {
+	return EchoServiceId
+}
+
+func (s EchoService) Handle(payload []byte) ([]byte, error) {
+	return payload, nil
+}
+
+// PKILookupService replies with the published configuration of the client,
+// whose id is the payload of the request.
+type PKILookupService struct {
+	pki pki.PKI
+}
+
+func (s PKILookupService) Id() string {
+	return PKILookupServiceId
+}
+
+func (s PKILookupService) Handle(payload []byte) ([]byte, error) {
+	client, err := s.pki.LookupClient(string(payload))
+	if err == pki.ErrNoRecord {
+		return nil, errors.New("no client with the given id in the PKI")
+	}
+	if err != nil {
+		return nil, err
+	}
+	return proto.Marshal(&client)
+}
+
+// DeliveryReceiptService replies with a receipt, which contains the digest
+// of the request payload and the time at which the request was delivered.
+type DeliveryReceiptService struct {
+	now func() time.Time
+}
+
+func (s DeliveryReceiptService) Id() string {
+	return DeliveryReceiptServiceId
+}
+
+func (s DeliveryReceiptService) Handle(payload []byte) ([]byte, error) {
+	receipt := config.DeliveryReceipt{Digest: helpers.SHA256(payload), Timestamp: s.now().Unix()}
+	return proto.Marshal(&receipt)
+}
+
+// RegisterService registers the given service with the provider. RegisterService returns an error
+// if the id of the service is already used by another service or by a registered client.
+func (p *ProviderServer) RegisterService(service Service) error {
+	if _, ok := p.services[service.Id()]; ok {
+		return errors.New("a service with the given id is already registered")
+	}
+	if _, ok := p.assignedClients[service.Id()]; ok {
+		return errors.New("the service id is already used by a registered client")
+	}
+	p.services[service.Id()] = service
+	return nil
+}
+
+// handleServiceRequest passes the payload of the request to the given service and sends the reply
+// to the first hop of the reply block attached to the request. The requests without a reply block
+// are processed, but not replied to.
+func (p *ProviderServer) handleServiceRequest(service Service, packetBytes []byte) error {
+	var packet sphinx.SphinxPacket
+	if err := proto.Unmarshal(packetBytes, &packet); err != nil {
+		return err
+	}
+	var request config.ServiceRequest
+	if err := proto.Unmarshal(packet.Pld, &request); err != nil {
+		return err
+	}
+
+	reply, err := service.Handle(request.Payload)
+	if err != nil {
+		return err
+	}
+	if len(request.ReplyBlock) == 0 {
+		logLocal.Infof("Request to service %s processed without a reply block", service.Id())
+		return nil
+	}
+
+	var block sphinx.ReplyBlock
+	if err := proto.Unmarshal(request.ReplyBlock, &block); err != nil {
+		return err
+	}
+	replyPacket, err := sphinx.PackReplyMessage(block, reply)
+	if err != nil {
+		return err
+	}
+	replyBytes, err := proto.Marshal(&replyPacket)
+	if err != nil {
+		return err
+	}
+	logLocal.Infof("Sending reply of service %s", service.Id())
+	return p.forwardPacket(replyBytes, block.FirstHop.Address)
+}
+
+// registerDefaultServices registers the echo, PKI lookup and delivery receipt services.
+func (p *ProviderServer) registerDefaultServices(pkiStore pki.PKI) error {
+	services := []Service{EchoService{}, PKILookupService{pki: pkiStore}, DeliveryReceiptService{now: time.Now}}
+	for _, service := range services {
+		if err := p.RegisterService(service); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -17,11 +17,14 @@ package sphinx
 import (
 	"crypto/aes"
 	"crypto/cipher"
+	"crypto/ecdsa"
 	"crypto/elliptic"
 	"crypto/hmac"
 	"crypto/rand"
 	"crypto/sha256"
 
+	"errors"
+	"io"
 	"math/big"
 )
 
@@ -114,3 +117,130 @@ func expoGroupBase(curve elliptic.Curve, exp []big.Int) []byte {
 func computeMac(key, data []byte) []byte {
 	return Hmac(key, data)
 }
+
+// SealWithKey encrypts and authenticates the given message with AES-GCM under the given key,
+// using a fresh random nonce. SealWithKey returns the nonce followed by the ciphertext.
+func SealWithKey(key, message []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, message, nil), nil
+}
+
+// OpenWithKey decrypts the message sealed with SealWithKey. OpenWithKey returns an error if the
+// sealed message was modified or encrypted under a different key.
+func OpenWithKey(key, sealed []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(sealed) < aead.NonceSize() {
+		return nil, errors.New("sealed message too short")
+	}
+	nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	return aead.Open(nil, nonce, ciphertext, nil)
+}
+
+// SealToPublicKey encrypts the given message, such that it can be decrypted only by the owner of the
+// private key matching the given public key. SealToPublicKey computes a shared key from a fresh
+// ephemeral key pair and the given public key, and seals the message under the shared key.
+// SealToPublicKey returns the ephemeral public key followed by the sealed message.
+func SealToPublicKey(pubKey, message []byte) ([]byte, error) {
+	x, y := elliptic.Unmarshal(curve, pubKey)
+	if x == nil {
+		return nil, errors.New("invalid public key")
+	}
+
+	ephPriv, ephX, ephY, err := elliptic.GenerateKey(curve, rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	ephPub := elliptic.Marshal(curve, ephX, ephY)
+
+	sharedX, sharedY := curve.ScalarMult(x, y, ephPriv)
+	key := sealingKey(elliptic.Marshal(curve, sharedX, sharedY), ephPub)
+
+	sealed, err := SealWithKey(key, message)
+	if err != nil {
+		return nil, err
+	}
+	return append(ephPub, sealed...), nil
+}
+
+// OpenSealed decrypts the message sealed with SealToPublicKey using the given private key.
+func OpenSealed(privKey, sealed []byte) ([]byte, error) {
+	pubLen := len(elliptic.Marshal(curve, curve.Params().Gx, curve.Params().Gy))
+	if len(sealed) < pubLen {
+		return nil, errors.New("sealed message too short")
+	}
+
+	ephPub := sealed[:pubLen]
+	ephX, ephY := elliptic.Unmarshal(curve, ephPub)
+	if ephX == nil {
+		return nil, errors.New("invalid ephemeral public key")
+	}
+
+	sharedX, sharedY := curve.ScalarMult(ephX, ephY, privKey)
+	key := sealingKey(elliptic.Marshal(curve, sharedX, sharedY), ephPub)
+	return OpenWithKey(key, sealed[pubLen:])
+}
+
+// Sign signs the message with the given private key, following ECDSA with SHA-256. The keys used
+// for the Sphinx packets are the long-term identity keys of the nodes and the clients, hence they
+// also sign their descriptors. Sign returns the values r and s of the signature, each padded to the
+// size of the curve order.
+func Sign(privKey, message []byte) ([]byte, error) {
+	priv := &ecdsa.PrivateKey{D: new(big.Int).SetBytes(privKey)}
+	priv.Curve = curve
+	priv.X, priv.Y = curve.ScalarBaseMult(privKey)
+
+	digest := sha256.Sum256(message)
+	r, s, err := ecdsa.Sign(rand.Reader, priv, digest[:])
+	if err != nil {
+		return nil, err
+	}
+	size := signatureComponentSize()
+	signature := make([]byte, 2*size)
+	rBytes, sBytes := r.Bytes(), s.Bytes()
+	copy(signature[size-len(rBytes):size], rBytes)
+	copy(signature[2*size-len(sBytes):], sBytes)
+	return signature, nil
+}
+
+// Verify checks the signature of the message created by Sign with the private key matching the given public key.
+func Verify(pubKey, message, signature []byte) bool {
+	x, y := elliptic.Unmarshal(curve, pubKey)
+	if x == nil {
+		return false
+	}
+	size := signatureComponentSize()
+	if len(signature) != 2*size {
+		return false
+	}
+	r, s := new(big.Int).SetBytes(signature[:size]), new(big.Int).SetBytes(signature[size:])
+	digest := sha256.Sum256(message)
+	return ecdsa.Verify(&ecdsa.PublicKey{Curve: curve, X: x, Y: y}, digest[:], r, s)
+}
+
+func signatureComponentSize() int {
+	return (curve.Params().N.BitLen() + 7) / 8
+}
+
+func sealingKey(sharedSecret, ephPub []byte) []byte {
+	return hash(append(append([]byte{}, sharedSecret...), ephPub...))
+}
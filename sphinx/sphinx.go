@@ -26,6 +26,7 @@ import (
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/elliptic"
+	"crypto/rand"
 
 	"github.com/protobuf/proto"
 
@@ -44,22 +45,71 @@ const (
 	headerLength = 192
 	lastHopFlag  = "\xf0"
 	relayFlag    = "\xf1"
+	// the prefix of the address of the last hop, which names the inbox of the recipient at the egress
+	// provider; the network address of the recipient is known only to its provider
+	inboxAddressPrefix = "inbox:"
 )
 
+// The types of the messages. The type is carried in the routing commands of the last hop,
+// hence it can be read only by the egress provider and it is protected by the header MAC.
+// The provider stores the type with the message, see TypedMessage, which tells the recipient
+// how to handle the payload without looking into its content.
+const (
+	RealMessageType     = "\xd0"
+	LoopMessageType     = "\xd1"
+	DropMessageType     = "\xd2"
+	ReliableMessageType = "\xd3"
+	AcknowledgementType = "\xd4"
+	GroupInviteType     = "\xd5"
+	GroupMessageType    = "\xd6"
+)
+
+func isMessageType(messageType string) bool {
+	switch messageType {
+	case RealMessageType, LoopMessageType, DropMessageType, ReliableMessageType, AcknowledgementType, GroupInviteType, GroupMessageType:
+		return true
+	}
+	return false
+}
+
+// TypedMessage prepends the type of the message, read by the egress provider from the routing commands,
+// to the processed packet, which is stored for the recipient. The unknown types are stored as real messages.
+func TypedMessage(messageType string, packet []byte) []byte {
+	if !isMessageType(messageType) {
+		messageType = RealMessageType
+	}
+	return append([]byte(messageType), packet...)
+}
+
+// SplitTypedMessage returns the type and the packet of the message stored by the egress provider,
+// or an error if the message does not start with a known type.
+func SplitTypedMessage(message []byte) (string, []byte, error) {
+	if len(message) == 0 || !isMessageType(string(message[:1])) {
+		return "", nil, errors.New("the message does not carry a known type")
+	}
+	return string(message[:1]), message[1:], nil
+}
+
+// InboxAddress returns the address of the inbox of the client with the given id, which is carried
+// in the routing information of the last hop in place of the network address of the client.
+func InboxAddress(clientId string) string {
+	return inboxAddressPrefix + clientId
+}
+
 // PackForwardMessage encapsulates the given message into the cryptographic Sphinx packet format.
 // As arguments the function takes the path, consisting of the sequence of nodes the packet should traverse
 // and the destination of the message, a set of delays and the information about the curve used to perform cryptographic
-// operations.
+// operations. The message type is passed to the egress provider, which uses it to discard the drop cover messages.
 // In order to encapsulate the message PackForwardMessage computes two parts of the packet - the header and
 // the encrypted payload. If creating of any of the packet block failed, an error is returned. Otherwise,
 // a Sphinx packet format is returned.
-func PackForwardMessage(curve elliptic.Curve, path config.E2EPath, delays []float64, message string) (SphinxPacket, error) {
+func PackForwardMessage(curve elliptic.Curve, path config.E2EPath, delays []float64, message string, messageType string) (SphinxPacket, error) {
 	nodes := []config.MixConfig{path.IngressProvider}
 	nodes = append(nodes, path.Mixes...)
 	nodes = append(nodes, path.EgressProvider)
 	dest := path.Recipient
 
-	asb, header, err := createHeader(curve, nodes, delays, dest)
+	asb, header, err := createHeader(curve, nodes, delays, dest, messageType)
 	if err != nil {
 		logLocal.WithError(err).Error("Error in PackForwardMessage - createHeader failed")
 		return SphinxPacket{}, err
@@ -76,11 +126,11 @@ func PackForwardMessage(curve elliptic.Curve, path config.E2EPath, delays []floa
 // createHeader builds the Sphinx packet header, consisting of three parts: the public element, the encapsulated routing information
 // and the message authentication code. createHeader layer encapsulates the routing information for each given node. The routing information
 // contains information where the packet should be forwarded next, how long it should be delayed by the node, and if relevant additional
-// auxiliary information. The message authentication code allows to detect tagging attacks.
+// auxiliary information, e.g., the type of the message passed to the last node. The message authentication code allows to detect tagging attacks.
 // createHeader computes the secret shared key between sender and the nodes and destination, which are used as keys for encryption.
 // createHeader returns the header and a list of the initial elements, used for creating the header. If any operation was unsuccessful
 // createHeader returns an error.
-func createHeader(curve elliptic.Curve, nodes []config.MixConfig, delays []float64, dest config.ClientConfig) ([]HeaderInitials, Header, error) {
+func createHeader(curve elliptic.Curve, nodes []config.MixConfig, delays []float64, dest config.ClientConfig, messageType string) ([]HeaderInitials, Header, error) {
 
 	x, err := randomBigInt(curve.Params())
 
@@ -104,7 +154,7 @@ func createHeader(curve elliptic.Curve, nodes []config.MixConfig, delays []float
 	for i, _ := range nodes {
 		var c Commands
 		if i == len(nodes)-1 {
-			c = Commands{Delay: delays[i], Flag: lastHopFlag}
+			c = Commands{Delay: delays[i], Flag: lastHopFlag, Type: messageType}
 		} else {
 			c = Commands{Delay: delays[i], Flag: relayFlag}
 		}
@@ -125,7 +175,7 @@ func createHeader(curve elliptic.Curve, nodes []config.MixConfig, delays []float
 // given the pre-computed shared keys which are used for encryption.
 // encapsulateHeader returns the Header, or an error if any internal cryptographic of parsing operation failed.
 func encapsulateHeader(asb []HeaderInitials, nodes []config.MixConfig, commands []Commands, destination config.ClientConfig) (Header, error) {
-	finalHop := RoutingInfo{NextHop: &Hop{Id: destination.Id, Address: destination.Host + ":" + destination.Port, PubKey: []byte{}}, RoutingCommands: &commands[len(commands)-1], NextHopMetaData: []byte{}, Mac: []byte{}}
+	finalHop := RoutingInfo{NextHop: &Hop{Id: destination.Id, Address: InboxAddress(destination.Id), PubKey: []byte{}}, RoutingCommands: &commands[len(commands)-1], NextHopMetaData: []byte{}, Mac: []byte{}}
 
 	finalHopBytes, err := proto.Marshal(&finalHop)
 	if err != nil {
@@ -400,3 +450,81 @@ func ProcessSphinxPayload(alpha []byte, payload []byte, privKey []byte) ([]byte,
 
 	return decPayload, nil
 }
+
+// CreateReplyBlock creates a single use reply block, which allows to send a reply message along the given path
+// back to the creator of the block, without revealing the creator's identity to the replying party.
+// The reply block contains the pre-computed header, the first hop of the path and a fresh key which
+// the replying party uses to encrypt the payload. CreateReplyBlock returns the reply block and the keys,
+// which the creator keeps to recognise and decrypt the reply. The type of the reply is chosen by the creator,
+// since the routing commands of the last hop are in the pre-computed header. If any cryptographic operation
+// failed CreateReplyBlock returns an error.
+func CreateReplyBlock(curve elliptic.Curve, path config.E2EPath, delays []float64, messageType string) (ReplyBlock, ReplyKeys, error) {
+	nodes := []config.MixConfig{path.IngressProvider}
+	nodes = append(nodes, path.Mixes...)
+	nodes = append(nodes, path.EgressProvider)
+
+	asb, header, err := createHeader(curve, nodes, delays, path.Recipient, messageType)
+	if err != nil {
+		logLocal.WithError(err).Error("Error in CreateReplyBlock - createHeader failed")
+		return ReplyBlock{}, ReplyKeys{}, err
+	}
+
+	payloadKey := make([]byte, K)
+	if _, err := rand.Read(payloadKey); err != nil {
+		return ReplyBlock{}, ReplyKeys{}, err
+	}
+
+	keys := [][]byte{payloadKey}
+	for _, tuple := range asb {
+		keys = append(keys, KDF(tuple.SecretHash))
+	}
+
+	firstHop := Hop{Id: nodes[0].Id, Address: nodes[0].Host + ":" + nodes[0].Port, PubKey: nodes[0].PubKey}
+	block := ReplyBlock{FirstHop: &firstHop, Hdr: &header, PayloadKey: payloadKey}
+	return block, ReplyKeys{Id: finalAlpha(curve, asb[len(asb)-1]), Keys: keys}, nil
+}
+
+// PackReplyMessage encapsulates the given message into a Sphinx packet using the given reply block.
+// The packet should be sent to the first hop of the reply block.
+func PackReplyMessage(block ReplyBlock, message []byte) (SphinxPacket, error) {
+	payload, err := AES_CTR(block.PayloadKey, message)
+	if err != nil {
+		logLocal.WithError(err).Error("Error in PackReplyMessage - AES_CTR encryption failed")
+		return SphinxPacket{}, err
+	}
+	return SphinxPacket{Hdr: block.Hdr, Pld: payload}, nil
+}
+
+// IsReply checks whether the given packet, processed by all the nodes on its path, is the reply
+// sent using the reply block matching the given keys.
+func IsReply(packet SphinxPacket, keys ReplyKeys) bool {
+	return packet.Hdr != nil && bytes.Equal(packet.Hdr.Alpha, keys.Id)
+}
+
+// OpenReply decrypts the payload of the reply message, which was sent using the reply block matching
+// the given keys. OpenReply removes the layers of encryption added by the replying party and by
+// each node on the path. OpenReply returns an error if the packet does not match the keys.
+func OpenReply(packet SphinxPacket, keys ReplyKeys) ([]byte, error) {
+	if !IsReply(packet, keys) {
+		return nil, errors.New("the packet is not a reply matching the given keys")
+	}
+
+	message := packet.Pld
+	for _, key := range keys.Keys {
+		var err error
+		message, err = AES_CTR(key, message)
+		if err != nil {
+			logLocal.WithError(err).Error("Error in OpenReply - AES_CTR decryption failed")
+			return nil, err
+		}
+	}
+	return message, nil
+}
+
+// finalAlpha computes the public element of the header after it was processed by the last node,
+// which is used to match a received reply with the keys of its reply block.
+func finalAlpha(curve elliptic.Curve, last HeaderInitials) []byte {
+	x, y := elliptic.Unmarshal(curve, last.Alpha)
+	finalX, finalY := curve.Params().ScalarMult(x, y, last.Blinder)
+	return elliptic.Marshal(curve, finalX, finalY)
+}
@@ -275,12 +275,12 @@ func TestEncapsulateHeader(t *testing.T) {
 	}
 
 	actualHeader, err := encapsulateHeader(sharedSecrets, nodes, commands,
-		config.ClientConfig{Id: "DestinationId", Host: "DestinationAddress", Port: "9998", PubKey: pubD})
+		config.ClientConfig{Id: "DestinationId", PubKey: pubD})
 	if err != nil {
 		t.Error(err)
 	}
 
-	routing1 := RoutingInfo{NextHop: &Hop{"DestinationId", "DestinationAddress:9998", []byte{}}, RoutingCommands: &c3,
+	routing1 := RoutingInfo{NextHop: &Hop{"DestinationId", InboxAddress("DestinationId"), []byte{}}, RoutingCommands: &c3,
 		NextHopMetaData: []byte{}, Mac: []byte{}}
 
 	routing1Bytes, err := proto.Marshal(&routing1)
@@ -455,3 +455,213 @@ func TestProcessSphinxPayload(t *testing.T) {
 	}
 	assert.Equal(t, []byte(message), decMsg)
 }
+
+func TestPackForwardMessage_MessageType(t *testing.T) {
+	pub1, priv1, err := GenerateKeyPair()
+	pub2, priv2, err := GenerateKeyPair()
+	pub3, priv3, err := GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m1 := config.NewMixConfig("Node1", "localhost", "3331", pub1)
+	m2 := config.NewMixConfig("Node2", "localhost", "3332", pub2)
+	m3 := config.NewMixConfig("Node3", "localhost", "3333", pub3)
+	path := config.E2EPath{IngressProvider: m1, Mixes: []config.MixConfig{m2}, EgressProvider: m3,
+		Recipient: config.ClientConfig{Id: "DestinationId", Host: "localhost", Port: "9998"}}
+
+	packet, err := PackForwardMessage(curve, path, []float64{0.1, 0.2, 0.3}, "Drop message", DropMessageType)
+	if err != nil {
+		t.Fatal(err)
+	}
+	packetBytes, err := proto.Marshal(&packet)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var commands Commands
+	for i, priv := range [][]byte{priv1, priv2, priv3} {
+		_, commands, packetBytes, err = ProcessSphinxPacket(packetBytes, priv)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i < 2 {
+			assert.Equal(t, "", commands.Type, "The message type should be visible only to the last hop")
+		}
+	}
+	assert.Equal(t, lastHopFlag, commands.Flag)
+	assert.Equal(t, DropMessageType, commands.Type, "The last hop should learn the type of the message")
+}
+
+func TestSealToPublicKey_Pass(t *testing.T) {
+	pub, priv, err := GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sealed, err := SealToPublicKey(pub, []byte("Stored message"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NotContains(t, string(sealed), "Stored message", "The sealed message should not contain the plaintext")
+
+	opened, err := OpenSealed(priv, sealed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []byte("Stored message"), opened)
+}
+
+func TestSealToPublicKey_WrongKey(t *testing.T) {
+	pub, _, err := GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, otherPriv, err := GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sealed, err := SealToPublicKey(pub, []byte("Stored message"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = OpenSealed(otherPriv, sealed)
+	assert.Error(t, err, "A sealed message should not be opened with a different private key")
+}
+
+func TestSealWithKey_Tampered(t *testing.T) {
+	key := hash([]byte("StorageKey"))
+	sealed, err := SealWithKey(key, []byte("Stored message"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sealed[len(sealed)-1] ^= 0x01
+	_, err = OpenWithKey(key, sealed)
+	assert.Error(t, err, "A modified sealed message should be rejected")
+}
+
+func TestCreateReplyBlock_Reply(t *testing.T) {
+	pub1, priv1, err := GenerateKeyPair()
+	pub2, priv2, err := GenerateKeyPair()
+	pub3, priv3, err := GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m1 := config.NewMixConfig("Node1", "localhost", "3331", pub1)
+	m2 := config.NewMixConfig("Node2", "localhost", "3332", pub2)
+	m3 := config.NewMixConfig("Node3", "localhost", "3333", pub3)
+	path := config.E2EPath{IngressProvider: m1, Mixes: []config.MixConfig{m2}, EgressProvider: m3,
+		Recipient: config.ClientConfig{Id: "DestinationId", Host: "localhost", Port: "9998"}}
+
+	block, keys, err := CreateReplyBlock(curve, path, []float64{0.1, 0.2, 0.3}, AcknowledgementType)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "Node1", block.FirstHop.Id)
+	assert.Equal(t, "localhost:3331", block.FirstHop.Address)
+
+	packet, err := PackReplyMessage(block, []byte("Reply message"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	packetBytes, err := proto.Marshal(&packet)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var commands Commands
+	for _, priv := range [][]byte{priv1, priv2, priv3} {
+		_, commands, packetBytes, err = ProcessSphinxPacket(packetBytes, priv)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	assert.Equal(t, lastHopFlag, commands.Flag)
+	assert.Equal(t, AcknowledgementType, commands.Type, "The type chosen by the creator of the block should reach the last hop")
+
+	var received SphinxPacket
+	if err := proto.Unmarshal(packetBytes, &received); err != nil {
+		t.Fatal(err)
+	}
+	assert.NotContains(t, string(received.Pld), "Reply message", "The reply should not be readable by the last hop")
+	assert.True(t, IsReply(received, keys))
+
+	message, err := OpenReply(received, keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []byte("Reply message"), message)
+}
+
+func TestOpenReply_WrongKeys(t *testing.T) {
+	pub1, _, err := GenerateKeyPair()
+	pub2, _, err := GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m1 := config.NewMixConfig("Node1", "localhost", "3331", pub1)
+	m2 := config.NewMixConfig("Node2", "localhost", "3332", pub2)
+	path := config.E2EPath{IngressProvider: m1, Mixes: []config.MixConfig{}, EgressProvider: m2,
+		Recipient: config.ClientConfig{Id: "DestinationId", Host: "localhost", Port: "9998"}}
+
+	block, _, err := CreateReplyBlock(curve, path, []float64{0.1, 0.2}, RealMessageType)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, otherKeys, err := CreateReplyBlock(curve, path, []float64{0.1, 0.2}, RealMessageType)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	packet, err := PackReplyMessage(block, []byte("Reply message"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.False(t, IsReply(packet, otherKeys))
+	_, err = OpenReply(packet, otherKeys)
+	assert.EqualError(t, err, "the packet is not a reply matching the given keys")
+}
+
+func TestSign_Verify(t *testing.T) {
+	pub, priv, err := GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherPub, _, err := GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signature, err := Sign(priv, []byte("descriptor"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, Verify(pub, []byte("descriptor"), signature))
+	assert.False(t, Verify(pub, []byte("tampered"), signature), "The signature of another message should not verify")
+	assert.False(t, Verify(otherPub, []byte("descriptor"), signature), "The signature should not verify with another key")
+	assert.False(t, Verify(pub, []byte("descriptor"), nil), "The missing signature should not verify")
+}
+
+func TestTypedMessage(t *testing.T) {
+	messageType, packet, err := SplitTypedMessage(TypedMessage(GroupInviteType, []byte("Packet")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, GroupInviteType, messageType)
+	assert.Equal(t, []byte("Packet"), packet)
+
+	messageType, _, err = SplitTypedMessage(TypedMessage("Unknown", []byte("Packet")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, RealMessageType, messageType, "The unknown types should be stored as real messages")
+
+	_, _, err = SplitTypedMessage([]byte("Packet"))
+	assert.EqualError(t, err, "the message does not carry a known type")
+	_, _, err = SplitTypedMessage(nil)
+	assert.EqualError(t, err, "the message does not carry a known type")
+}